@@ -0,0 +1,331 @@
+// Package cellarclient is a client of the file-cellar http api
+package cellarclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bytes of error responses kept as the message of an Error
+const errorMessageLimit = 4 << 10
+
+// A client of a file-cellar server
+type Client struct {
+	BaseURL    string       // url of the server, ie http://localhost:8080
+	HTTPClient *http.Client // client making the requests, http.DefaultClient when nil
+	Token      string       // sent as a bearer token when set, for servers behind an authenticating proxy
+}
+
+// A location files are stored in
+type Bin struct {
+	Id       int64  `json:"id"`
+	Name     string `json:"name"`
+	Driver   string `json:"driver"`
+	Redirect bool   `json:"redirect"`
+	Files    int64  `json:"files"` // number of stored files, including trashed files and old versions
+	Bytes    int64  `json:"bytes"`
+}
+
+// A file stored in a bin
+type File struct {
+	Id               int64      `json:"id"`
+	BinId            int64      `json:"binId"`
+	Name             string     `json:"name"`
+	Hash             string     `json:"hash"` // hex md5 of the content
+	Type             string     `json:"type"` // mime type
+	Size             int64      `json:"size"`
+	RelPath          string     `json:"relPath"` // path the file is downloaded and deleted by
+	UploadTimestamp  time.Time  `json:"uploadTimestamp"`
+	LogicalPath      string     `json:"logicalPath,omitempty"`
+	Version          int64      `json:"version,omitempty"`
+	DeletedTimestamp *time.Time `json:"deletedTimestamp,omitempty"`
+	Description      string     `json:"description,omitempty"`
+	Downloads        int64      `json:"downloads"`
+	AccessTimestamp  *time.Time `json:"accessTimestamp,omitempty"`
+}
+
+// Optional fields of an upload
+type UploadOptions struct {
+	Path        string // logical path the file is a new version of
+	Description string
+}
+
+// The outcome of uploading one of the files of an upload
+type UploadResult struct {
+	Name   string `json:"name"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	File   *File  `json:"file,omitempty"`
+}
+
+// The content of a downloaded file
+type Content struct {
+	io.ReadCloser
+	Offset int64  // position of the content in the file
+	Size   int64  // size of the whole file, -1 when unknown
+	ETag   string // entity tag of the whole file
+}
+
+// The headers of a file, got without downloading it
+type FileHeader struct {
+	ETag string
+	Hash string // hex md5 of the content, from the ETag
+	Size int64
+	Type string
+}
+
+// A response of the server with an error status
+type Error struct {
+	StatusCode int
+	Message    string // body of the response
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("file-cellar: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func New(baseURL string) *Client {
+	return &Client{BaseURL: baseURL}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// Sends a request, returning an Error if the response has an error status
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, errorMessageLimit))
+		return nil, &Error{resp.StatusCode, strings.TrimSpace(string(message))}
+	}
+
+	return resp, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, body io.Reader, path ...string) (*http.Request, error) {
+	target, err := url.JoinPath(c.BaseURL, path...)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	return req, nil
+}
+
+// Gets the url a file is downloaded from, which can be shared
+func (c *Client) FileURL(relPath string) (string, error) {
+	return url.JoinPath(c.BaseURL, "f", relPath)
+}
+
+// Uploads content to a bin under a file name, returning the stored file
+//
+// The content is streamed, so it is read once while the request is sent.
+func (c *Client) Upload(ctx context.Context, binId int64, name string, content io.Reader, opts *UploadOptions) (*File, error) {
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+
+	req, err := c.newRequest(ctx, http.MethodPost, body, "upload")
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	go func() {
+		writer.CloseWithError(writeUploadForm(form, binId, name, content, opts))
+	}()
+
+	var results []UploadResult
+	resp, err := c.do(req)
+	// unblock the form writer if the request ended before reading the whole body
+	body.Close()
+	if cellarErr, ok := err.(*Error); ok && json.Unmarshal([]byte(cellarErr.Message), &results) == nil && len(results) == 1 {
+		// report why the file failed rather than the results
+		cellarErr.Message = results[0].Error
+		return nil, cellarErr
+	} else if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err = json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	} else if len(results) != 1 || results[0].File == nil {
+		return nil, fmt.Errorf("file-cellar: unexpected upload results %+v", results)
+	}
+
+	return results[0].File, nil
+}
+
+func writeUploadForm(form *multipart.Writer, binId int64, name string, content io.Reader, opts *UploadOptions) error {
+	if err := form.WriteField("binId", strconv.FormatInt(binId, 10)); err != nil {
+		return err
+	}
+	if opts != nil && opts.Path != "" {
+		if err := form.WriteField("path", opts.Path); err != nil {
+			return err
+		}
+	}
+	if opts != nil && opts.Description != "" {
+		if err := form.WriteField("description", opts.Description); err != nil {
+			return err
+		}
+	}
+
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(part, content); err != nil {
+		return err
+	}
+
+	return form.Close()
+}
+
+// Downloads a file by its relative path, the caller must close the returned content
+func (c *Client) Download(ctx context.Context, relPath string) (io.ReadCloser, error) {
+	content, err := c.DownloadFrom(ctx, relPath, 0, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// Downloads a file by its relative path from an offset, to resume a partial download
+//
+// When ifRange is set the range is only sent if the file still has that ETag.
+// The server may send the whole file instead, in which case the offset of the content is 0.
+// The caller must close the returned content.
+func (c *Client) DownloadFrom(ctx context.Context, relPath string, offset int64, ifRange string) (*Content, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, nil, "f", relPath)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	content := &Content{ReadCloser: resp.Body, Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}
+	if resp.StatusCode == http.StatusPartialContent {
+		var end int64
+		_, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &content.Offset, &end, &content.Size)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("file-cellar: bad Content-Range `%s`", resp.Header.Get("Content-Range"))
+		}
+	}
+
+	return content, nil
+}
+
+// Gets the headers of a file by its relative path without downloading it
+func (c *Client) Stat(ctx context.Context, relPath string) (*FileHeader, error) {
+	req, err := c.newRequest(ctx, http.MethodHead, nil, "f", relPath)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	return &FileHeader{
+		ETag: etag,
+		Hash: strings.Trim(etag, `"`),
+		Size: resp.ContentLength,
+		Type: resp.Header.Get("Content-Type"),
+	}, nil
+}
+
+// Lists the bins
+func (c *Client) ListBins(ctx context.Context) ([]Bin, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, nil, "api/v1/bins")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var bins []Bin
+	if err = json.NewDecoder(resp.Body).Decode(&bins); err != nil {
+		return nil, err
+	}
+
+	return bins, nil
+}
+
+// Lists the files of a bin
+func (c *Client) List(ctx context.Context, binId int64) ([]File, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, nil, "api/v1/bins", strconv.FormatInt(binId, 10), "files")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var files []File
+	if err = json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// Moves a file to the trash by its relative path
+func (c *Client) Delete(ctx context.Context, relPath string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, nil, "f", relPath)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
@@ -0,0 +1,129 @@
+package cellarclient
+
+import (
+	"context"
+	"errors"
+	"file-cellar/db"
+	"file-cellar/server"
+	"file-cellar/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func printMismatch[T any](p func(string, ...any), name string, expected T, recieved T) {
+	p("Incorrect %s, expected %v != %v\n", name, expected, recieved)
+}
+
+// Starts a server backed by an in memory catalog with a single local bin, returning a client of it
+func newTestClient(t *testing.T) *Client {
+	ctx := context.Background()
+	catalog := db.NewMemoryCatalog()
+
+	driver := storage.NewLocalDriver()
+	if !catalog.AddDriver(ctx, driver) {
+		t.Log("Failed to add driver")
+		t.FailNow()
+	}
+
+	bin := &storage.Bin{Name: "testing bin", Driver: driver}
+	bin.Path.External = "testing"
+	bin.Path.Internal = t.TempDir()
+	if _, err := catalog.AddBin(ctx, bin, driver.Id()); err != nil {
+		t.Logf("Failed to add bin: %v\n", err)
+		t.FailNow()
+	}
+
+	ts := httptest.NewServer(server.NewServer(catalog, server.NewEventBus(), 15*time.Minute).GetMux())
+	t.Cleanup(ts.Close)
+
+	return New(ts.URL)
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+
+	uploaded, err := client.Upload(ctx, 1, "notes.txt", strings.NewReader("remember the milk"), &UploadOptions{Description: "groceries"})
+	if err != nil {
+		t.Logf("Failed to upload: %v\n", err)
+		t.FailNow()
+	}
+	relPath := uploaded.RelPath
+
+	content, err := client.Download(ctx, relPath)
+	if err != nil {
+		t.Logf("Failed to download %s: %v\n", relPath, err)
+		t.FailNow()
+	}
+	data, err := io.ReadAll(content)
+	content.Close()
+	if err != nil || string(data) != "remember the milk" {
+		printMismatch(t.Errorf, "downloaded content", "remember the milk", string(data))
+	}
+
+	files, err := client.List(ctx, 1)
+	if err != nil {
+		t.Logf("Failed to list files: %v\n", err)
+		t.FailNow()
+	}
+	if len(files) != 1 {
+		printMismatch(t.Errorf, "number of files", 1, len(files))
+	} else if files[0].RelPath != relPath || files[0].Name != "notes.txt" || files[0].Description != "groceries" || files[0].Size != 17 {
+		t.Errorf("Incorrect listed file %+v\n", files[0])
+	}
+
+	bins, err := client.ListBins(ctx)
+	if err != nil {
+		t.Logf("Failed to list bins: %v\n", err)
+		t.FailNow()
+	}
+	if len(bins) != 1 || bins[0].Name != "testing bin" || bins[0].Files != 1 || bins[0].Bytes != 17 {
+		t.Errorf("Incorrect bins %+v\n", bins)
+	}
+
+	header, err := client.Stat(ctx, relPath)
+	if err != nil || header.Size != 17 || header.Hash != "1c6e76593ebd1c93bc2934c3e57f810c" {
+		t.Errorf("Incorrect file header %+v: %v\n", header, err)
+		t.FailNow()
+	}
+
+	partial, err := client.DownloadFrom(ctx, relPath, 9, header.ETag)
+	if err != nil {
+		t.Logf("Failed to resume download of %s: %v\n", relPath, err)
+		t.FailNow()
+	}
+	data, err = io.ReadAll(partial)
+	partial.Close()
+	if err != nil || string(data) != "the milk" || partial.Offset != 9 || partial.Size != 17 {
+		t.Errorf("Incorrect resumed download %q from %d of %d\n", data, partial.Offset, partial.Size)
+	}
+
+	// a stale ETag gets the whole file rather than a range of a different file
+	whole, err := client.DownloadFrom(ctx, relPath, 9, `"stale"`)
+	if err != nil {
+		t.Logf("Failed to download %s with a stale ETag: %v\n", relPath, err)
+		t.FailNow()
+	}
+	data, _ = io.ReadAll(whole)
+	whole.Close()
+	if string(data) != "remember the milk" || whole.Offset != 0 {
+		t.Errorf("Incorrect download with a stale ETag %q from %d\n", data, whole.Offset)
+	}
+
+	if err = client.Delete(ctx, relPath); err != nil {
+		t.Errorf("Failed to delete %s: %v\n", relPath, err)
+	}
+
+	var cellarErr *Error
+	if err = client.Delete(ctx, relPath); !errors.As(err, &cellarErr) || cellarErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Incorrect error deleting a deleted file: %v\n", err)
+	}
+	_, err = client.Upload(ctx, 7, "lost.txt", strings.NewReader("nowhere"), nil)
+	if !errors.As(err, &cellarErr) || cellarErr.StatusCode != http.StatusBadRequest || cellarErr.Message != "Could not find bin with id `7`" {
+		t.Errorf("Incorrect error uploading to a missing bin: %v\n", err)
+	}
+}
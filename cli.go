@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"file-cellar/config"
+	"file-cellar/db"
+	"file-cellar/server"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Gets an initialized manager for commands which operate on the database directly
+func cliManager() *db.Manager {
+	manager, err := db.GetManager(config.Server["DBURL"], config.DB_PRAGMAS)
+	if err != nil {
+		log.Fatalf("Unable to get manager: %v\n", err)
+	}
+
+	if err = manager.Init(); err != nil {
+		log.Fatalf("Failed to initialize tables: %v\n", err)
+	}
+
+	return manager
+}
+
+// Gets a context attributing audited operations to the user running the command
+func cliContext() context.Context {
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor += ":" + u.Username
+	}
+
+	return db.WithActor(context.Background(), actor)
+}
+
+func trashCommand(args []string) {
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx := cliContext()
+	manager := cliManager()
+	defer manager.Close()
+
+	switch args[0] {
+	case "list":
+		trash, err := manager.GetTrash(ctx, time.Now())
+		if err != nil {
+			log.Fatalf("Failed to list trash: %v\n", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tNAME\tBIN\tSIZE\tDELETED")
+		for _, f := range trash {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", f.RelPath, f.Name, f.Bin.Id, f.Size, f.DeletedTimestamp.Format(time.DateTime))
+		}
+		w.Flush()
+	case "restore":
+		if len(args) != 2 {
+			usage()
+			os.Exit(2)
+		}
+
+		if _, err := server.RestoreFile(ctx, manager, args[1]); errors.Is(err, db.ErrNotFound) {
+			log.Fatalf("No file %s in the trash\n", args[1])
+		} else if err != nil {
+			log.Fatalf("Failed to restore %s: %v\n", args[1], err)
+		}
+		fmt.Printf("Restored %s\n", args[1])
+	case "purge":
+		flags := flag.NewFlagSet("trash purge", flag.ExitOnError)
+		all := flags.Bool("all", false, "purge every file in the trash, ignoring the grace period")
+		flags.Parse(args[1:])
+
+		before := time.Now().Add(-server.TrashGracePeriod())
+		if *all {
+			before = time.Now()
+		}
+
+		// nothing subscribes to events outside of the server, deliveries to webhooks are queued for it
+		purged, err := server.PurgeTrash(ctx, manager, server.NewEventBus(), before)
+		if err != nil {
+			log.Fatalf("Failed to purge trash: %v\n", err)
+		}
+		fmt.Printf("Purged %d files\n", purged)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func migrateCommand(args []string) {
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	manager, err := db.GetManager(config.Server["DBURL"], config.DB_PRAGMAS)
+	if err != nil {
+		log.Fatalf("Unable to get manager: %v\n", err)
+	}
+	defer manager.Close()
+
+	switch args[0] {
+	case "status":
+		status, err := manager.MigrationStatus(ctx)
+		if err != nil {
+			log.Fatalf("Failed to get migration status: %v\n", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range status {
+			applied := "pending"
+			if s.Applied {
+				applied = s.AppliedTimestamp.Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		w.Flush()
+	case "up", "down":
+		if len(args) > 2 || (args[0] == "down" && len(args) != 2) {
+			usage()
+			os.Exit(2)
+		}
+
+		target := db.LatestSchemaVersion()
+		if len(args) == 2 {
+			target, err = strconv.Atoi(args[1])
+			if err != nil {
+				log.Fatalf("Bad version `%s`, it should be an integer\n", args[1])
+			}
+		}
+
+		current, err := manager.SchemaVersion(ctx)
+		if err != nil {
+			log.Fatalf("Failed to get schema version: %v\n", err)
+		}
+		if (args[0] == "up" && target < current) || (args[0] == "down" && target > current) {
+			log.Fatalf("Cannot migrate %s from version %d to %d\n", args[0], current, target)
+		}
+
+		if err = manager.Migrate(ctx, target); err != nil {
+			log.Fatalf("Failed to migrate: %v\n", err)
+		}
+		fmt.Printf("Migrated from version %d to %d\n", current, target)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func auditCommand(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	actor := flags.String("actor", "", "only show actions by this actor, ie system or http:127.0.0.1")
+	action := flags.String("action", "", "only show this action, ie file.delete")
+	target := flags.String("target", "", "only show actions on this target, ie file:PATH")
+	since := flags.Duration("since", 0, "only show actions within this long ago")
+	limit := flags.Int("limit", 50, "maximum number of entries to show, 0 for every entry")
+	asJSON := flags.Bool("json", false, "print entries as json lines, including the before and after states")
+	flags.Parse(args)
+
+	manager := cliManager()
+	defer manager.Close()
+
+	q := db.AuditQuery{Actor: *actor, Action: *action, Target: *target, Limit: *limit}
+	if *since > 0 {
+		q.From = time.Now().Add(-*since)
+	}
+	entries, err := manager.GetAuditLog(context.Background(), q)
+	if err != nil {
+		log.Fatalf("Failed to get audit log: %v\n", err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			encoder.Encode(e)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTOR\tACTION\tTARGET")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Timestamp.Format(time.DateTime), e.Actor, e.Action, e.Target)
+	}
+	w.Flush()
+}
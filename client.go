@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"file-cellar/cellarclient"
+	"file-cellar/config"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+func clientUsage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s client [-config FILE] [-url URL] COMMAND
+
+Commands:
+  bins                                      list the bins of the server
+  ls BIN                                    list the files of a bin, by bin id or name
+  upload [-path DIR] [-description TEXT] BIN FILE|DIR...
+                                            upload files and directories recursively, skipping files
+                                            already uploaded to the same path, and print their urls
+  download [-bin BIN] [-o FILE] [-resume] PATH
+                                            download a file, verifying its md5, and with -resume
+                                            resume a partial download in FILE
+  url [-bin BIN] PATH                       print the url a file is shared by
+
+Files are identified by their relative path, or by their path or name in a bin when -bin is given.
+The url and token of the server are read from the config file, a json object with the keys URL and Token.
+
+Flags:
+`, os.Args[0])
+}
+
+// Reports the progress of a transfer on stderr when it is a terminal
+type progress struct {
+	name    string
+	total   int64 // bytes of the whole transfer, -1 when unknown
+	done    int64
+	shown   time.Time
+	enabled bool
+}
+
+func newProgress(name string, total int64, done int64) *progress {
+	p := &progress{name: name, total: total, done: done}
+	if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		p.enabled = true
+	}
+
+	return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if p.enabled && time.Since(p.shown) > 100*time.Millisecond {
+		p.show()
+	}
+
+	return len(b), nil
+}
+
+func (p *progress) show() {
+	p.shown = time.Now()
+	if p.total > 0 {
+		fmt.Fprintf(os.Stderr, "\r%s %d/%d bytes (%d%%)", p.name, p.done, p.total, p.done*100/p.total)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%s %d bytes", p.name, p.done)
+	}
+}
+
+// Ends the progress line
+func (p *progress) finish() {
+	if p.enabled {
+		p.show()
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// Finds a bin by its id or name
+func resolveBin(ctx context.Context, client *cellarclient.Client, name string) (cellarclient.Bin, error) {
+	bins, err := client.ListBins(ctx)
+	if err != nil {
+		return cellarclient.Bin{}, err
+	}
+
+	id, err := strconv.ParseInt(name, 10, 64)
+	for _, bin := range bins {
+		if (err == nil && bin.Id == id) || bin.Name == name {
+			return bin, nil
+		}
+	}
+
+	return cellarclient.Bin{}, fmt.Errorf("no bin `%s`", name)
+}
+
+// Gets the current version of every logical path of a bin
+func currentVersions(files []cellarclient.File) map[string]cellarclient.File {
+	current := make(map[string]cellarclient.File)
+	for _, f := range files {
+		if f.LogicalPath != "" && f.Version > current[f.LogicalPath].Version {
+			current[f.LogicalPath] = f
+		}
+	}
+
+	return current
+}
+
+// Finds a file of a bin by its logical path, or the newest file with the name
+func resolveFile(ctx context.Context, client *cellarclient.Client, binName string, name string) (cellarclient.File, error) {
+	bin, err := resolveBin(ctx, client, binName)
+	if err != nil {
+		return cellarclient.File{}, err
+	}
+	files, err := client.List(ctx, bin.Id)
+	if err != nil {
+		return cellarclient.File{}, err
+	}
+
+	if f, ok := currentVersions(files)[name]; ok {
+		return f, nil
+	}
+	// files are listed newest first
+	for _, f := range files {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+
+	return cellarclient.File{}, fmt.Errorf("no file `%s` in bin %s", name, bin.Name)
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := md5.New()
+	if _, err = io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// A local file to upload and the logical path it is uploaded to
+type uploadItem struct {
+	local   string
+	logical string
+}
+
+// Gets the files to upload from files and directories, uploading directories under their base name
+func uploadItems(prefix string, names []string) ([]uploadItem, error) {
+	var items []uploadItem
+	for _, name := range names {
+		name = filepath.Clean(name)
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			items = append(items, uploadItem{name, path.Join(prefix, filepath.Base(name))})
+			continue
+		}
+
+		parent := filepath.Dir(name)
+		err = filepath.WalkDir(name, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(parent, p)
+			if err != nil {
+				return err
+			}
+			items = append(items, uploadItem{p, path.Join(prefix, filepath.ToSlash(rel))})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return items, nil
+}
+
+func uploadItemFile(ctx context.Context, client *cellarclient.Client, binId int64, item uploadItem, description string) (string, error) {
+	f, err := os.Open(item.local)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	p := newProgress(item.logical, info.Size(), 0)
+	defer p.finish()
+	uploaded, err := client.Upload(ctx, binId, path.Base(item.logical), io.TeeReader(f, p), &cellarclient.UploadOptions{
+		Path:        item.logical,
+		Description: description,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return uploaded.RelPath, nil
+}
+
+func clientUpload(ctx context.Context, client *cellarclient.Client, args []string) {
+	flags := flag.NewFlagSet("client upload", flag.ExitOnError)
+	prefix := flags.String("path", "", "directory of the bin files are uploaded to")
+	description := flags.String("description", "", "description of the uploaded files")
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		clientUsage()
+		os.Exit(2)
+	}
+
+	bin, err := resolveBin(ctx, client, flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to find bin: %v\n", err)
+	}
+	items, err := uploadItems(*prefix, flags.Args()[1:])
+	if err != nil {
+		log.Fatalf("Failed to find files to upload: %v\n", err)
+	}
+	files, err := client.List(ctx, bin.Id)
+	if err != nil {
+		log.Fatalf("Failed to list files of bin %s: %v\n", bin.Name, err)
+	}
+	current := currentVersions(files)
+
+	failed := 0
+	for _, item := range items {
+		if ctx.Err() != nil {
+			break
+		}
+
+		// skip files uploaded before, so an interrupted upload resumes where it stopped
+		relPath := current[item.logical].RelPath
+		if hash, err := hashFile(item.local); err == nil && hash == current[item.logical].Hash {
+			log.Printf("Skipping %s, it is already uploaded\n", item.local)
+		} else if relPath, err = uploadItemFile(ctx, client, bin.Id, item, *description); err != nil {
+			log.Printf("Failed to upload %s: %v\n", item.local, err)
+			failed++
+			continue
+		}
+
+		fileURL, err := client.FileURL(relPath)
+		if err != nil {
+			log.Fatalf("Bad server url: %v\n", err)
+		}
+		fmt.Printf("%s\t%s\n", item.logical, fileURL)
+	}
+
+	if failed > 0 {
+		log.Fatalf("Failed to upload %d of %d files\n", failed, len(items))
+	} else if ctx.Err() != nil {
+		log.Fatalf("Upload interrupted\n")
+	}
+}
+
+func clientDownload(ctx context.Context, client *cellarclient.Client, args []string) {
+	flags := flag.NewFlagSet("client download", flag.ExitOnError)
+	binName := flags.String("bin", "", "bin the file is found in by its path or name")
+	output := flags.String("o", "", "file to download to, - for stdout, the name of the file by default")
+	resume := flags.Bool("resume", false, "resume a partial download in the output file rather than replacing it")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		clientUsage()
+		os.Exit(2)
+	}
+
+	relPath, name := flags.Arg(0), path.Base(flags.Arg(0))
+	if *binName != "" {
+		f, err := resolveFile(ctx, client, *binName, flags.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to find file: %v\n", err)
+		}
+		relPath, name = f.RelPath, f.Name
+	}
+	if *output == "" {
+		*output = name
+	}
+
+	header, err := client.Stat(ctx, relPath)
+	if err != nil {
+		log.Fatalf("Failed to find %s: %v\n", relPath, err)
+	}
+
+	if *output == "-" {
+		content, err := client.Download(ctx, relPath)
+		if err != nil {
+			log.Fatalf("Failed to download %s: %v\n", relPath, err)
+		}
+		defer content.Close()
+		hasher := md5.New()
+		if _, err = io.Copy(io.MultiWriter(os.Stdout, hasher), content); err != nil {
+			log.Fatalf("Failed to download %s: %v\n", relPath, err)
+		}
+		if hash := hex.EncodeToString(hasher.Sum(nil)); hash != header.Hash {
+			log.Fatalf("Downloaded %s is corrupt, its md5 %s is not %s\n", relPath, hash, header.Hash)
+		}
+		return
+	}
+
+	mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if *resume {
+		mode = os.O_WRONLY | os.O_CREATE
+	}
+	out, err := os.OpenFile(*output, mode, 0o644)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v\n", *output, err)
+	}
+	defer out.Close()
+	info, err := out.Stat()
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v\n", *output, err)
+	}
+
+	// resume from the end of what was downloaded before, if the file on the server is still the same
+	content, err := client.DownloadFrom(ctx, relPath, info.Size(), header.ETag)
+	var cellarErr *cellarclient.Error
+	if errors.As(err, &cellarErr) && cellarErr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// the output is already as large as the file, so it is either complete or a different file
+		verifyDownload(*output, relPath, header.Hash)
+		fmt.Printf("Already downloaded %s to %s\n", relPath, *output)
+		return
+	} else if err != nil {
+		log.Fatalf("Failed to download %s: %v\n", relPath, err)
+	}
+	defer content.Close()
+
+	if content.Offset == 0 {
+		err = out.Truncate(0)
+	}
+	if err == nil {
+		_, err = out.Seek(content.Offset, io.SeekStart)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write %s: %v\n", *output, err)
+	}
+
+	p := newProgress(*output, content.Size, content.Offset)
+	_, err = io.Copy(io.MultiWriter(out, p), content)
+	p.finish()
+	if err != nil {
+		log.Fatalf("Failed to download %s, run the command again with -resume to resume: %v\n", relPath, err)
+	}
+
+	verifyDownload(*output, relPath, header.Hash)
+	fmt.Printf("Downloaded %s to %s\n", relPath, *output)
+}
+
+// Exits if a downloaded file doesn't have the hash of the file on the server
+func verifyDownload(output string, relPath string, expected string) {
+	hash, err := hashFile(output)
+	if err != nil {
+		log.Fatalf("Failed to verify %s: %v\n", output, err)
+	}
+	if hash != expected {
+		log.Fatalf("%s does not match %s, its md5 %s is not %s, remove it and download again\n", output, relPath, hash, expected)
+	}
+}
+
+func clientURL(ctx context.Context, client *cellarclient.Client, args []string) {
+	flags := flag.NewFlagSet("client url", flag.ExitOnError)
+	binName := flags.String("bin", "", "bin the file is found in by its path or name")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		clientUsage()
+		os.Exit(2)
+	}
+
+	relPath := flags.Arg(0)
+	if *binName != "" {
+		f, err := resolveFile(ctx, client, *binName, flags.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to find file: %v\n", err)
+		}
+		relPath = f.RelPath
+	}
+
+	fileURL, err := client.FileURL(relPath)
+	if err != nil {
+		log.Fatalf("Bad server url: %v\n", err)
+	}
+	fmt.Println(fileURL)
+}
+
+func clientCommand(args []string) {
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	flags.Usage = func() {
+		clientUsage()
+		flags.PrintDefaults()
+	}
+	configPath := flags.String("config", config.ClientConfigPath(), "client config file")
+	serverURL := flags.String("url", "", "url of the server, overriding the config file")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// the default config file is optional, one given explicitly isn't
+	err := config.LoadClient(*configPath)
+	if err != nil && !(errors.Is(err, fs.ErrNotExist) && *configPath == config.ClientConfigPath()) {
+		log.Fatalf("Failed to load client config: %v\n", err)
+	}
+	if *serverURL != "" {
+		config.Client["URL"] = *serverURL
+	}
+
+	client := cellarclient.New(config.Client["URL"])
+	client.Token = config.Client["Token"]
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	args = flags.Args()
+	switch args[0] {
+	case "bins":
+		bins, err := client.ListBins(ctx)
+		if err != nil {
+			log.Fatalf("Failed to list bins: %v\n", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tDRIVER\tFILES\tSIZE")
+		for _, bin := range bins {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\n", bin.Id, bin.Name, bin.Driver, bin.Files, bin.Bytes)
+		}
+		w.Flush()
+	case "ls":
+		if len(args) != 2 {
+			clientUsage()
+			os.Exit(2)
+		}
+
+		bin, err := resolveBin(ctx, client, args[1])
+		if err != nil {
+			log.Fatalf("Failed to find bin: %v\n", err)
+		}
+		files, err := client.List(ctx, bin.Id)
+		if err != nil {
+			log.Fatalf("Failed to list files of bin %s: %v\n", bin.Name, err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tNAME\tLOGICAL PATH\tVERSION\tSIZE\tUPLOADED")
+		for _, f := range files {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", f.RelPath, f.Name, f.LogicalPath, f.Version, f.Size, f.UploadTimestamp.Local().Format(time.DateTime))
+		}
+		w.Flush()
+	case "upload":
+		clientUpload(ctx, client, args[1:])
+	case "download":
+		clientDownload(ctx, client, args[1:])
+	case "url":
+		clientURL(ctx, client, args[1:])
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
@@ -1,12 +1,79 @@
 package config
 
-import "file-cellar/db"
+import (
+	"encoding/json"
+	"file-cellar/db"
+	"os"
+	"path/filepath"
+)
 
 var Server map[string]string
+var Client map[string]string
 var DB_PRAGMAS map[string]string
 
 func init() {
 	DB_PRAGMAS = db.SQLITE_DEFAULT_PRAGMAS
 	Server = make(map[string]string)
 	Server["DBURL"] = "testing.db"
+	Server["DerivativeBin"] = ""         // id of the bin to store derivatives in, empty to use the bin of the source file
+	Server["ThumbnailSizes"] = "128,256" // comma separated sizes thumbnails can be requested at
+	Server["ThumbnailsOnUpload"] = "true"
+	Server["ThumbnailMaxPixels"] = "40000000" // pixels an image may have to be thumbnailed, larger images are refused before decoding
+	Server["TrashGracePeriod"] = "720h"       // time files stay in the trash before they are purged
+	Server["TrashPurgeInterval"] = "1h"
+	Server["IndexTextContent"] = "true"      // index the content of text files for searches
+	Server["IndexTextLimit"] = "65536"       // bytes of text content indexed per file
+	Server["VersionRetention"] = "10"        // versions kept for each logical path, 0 to keep every version
+	Server["StatsInterval"] = "1m"           // time between recordings of bin and driver stats
+	Server["StatsRawRetention"] = "168h"     // time raw stats are kept for, once summed into hourly and daily rollups
+	Server["StatsHourlyRetention"] = "2160h" // time hourly stats rollups are kept for, daily rollups are kept indefinitely
+	Server["UnusedFileAge"] = ""             // time files can go without downloads before they are trashed, empty to keep them
+	Server["UnusedCleanupInterval"] = "24h"  // time between trashings of files unused for longer than UnusedFileAge
+	Server["WebhookRetryDelay"] = "30s"      // delay before retrying a failed webhook delivery, doubled after every failure
+	Server["WebhookMaxAttempts"] = "8"
+	Server["WebhookTimeout"] = "10s"
+	Server["WebhookAllowedHosts"] = ""          // comma separated hosts webhooks may target even at loopback, private or link-local addresses
+	Server["WebhookWorkers"] = "4"              // webhooks delivered to at once, each getting its deliveries in order
+	Server["WebhookPollInterval"] = "10s"       // time between checks for webhook deliveries due a retry
+	Server["WebhookDeliveryRetention"] = "168h" // time finished webhook deliveries are kept for
+	Server["EventLogSize"] = "10000"            // events kept for clients resuming event streams
+	Server["ExtractArchiveBins"] = ""           // comma separated ids of the bins zip and tar archives are extracted in on upload
+	Server["ExtractMaxBytes"] = "1073741824"    // total size of the files extracted from an archive
+	Server["ExtractMaxFiles"] = "10000"         // number of files extracted from an archive
+	Server["ExtractMaxRatio"] = "100"           // total size of the files extracted from an archive over its size
+	Server["RedirectLifetime"] = "15m"          // time redirects of redirecting bins are cached for, drivers with expiring urls keep them valid at least as long
+
+	Client = make(map[string]string)
+	Client["URL"] = "http://localhost:8080" // url of the server the client command talks to
+	Client["Token"] = ""                    // bearer token sent with every request, empty to send none
+}
+
+// Gets the default path of the client config file
+func ClientConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "file-cellar", "client.json")
+}
+
+// Loads the client config from a json file of the same keys as Client, ie {"URL": "http://cellar:8080"}
+//
+// Keys missing from the file keep their defaults.
+func LoadClient(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]string)
+	if err = json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	for key, value := range values {
+		Client[key] = value
+	}
+
+	return nil
 }
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"file-cellar/storage"
+	"time"
+)
+
+// A download of a file or redirect to it
+type FileAccess struct {
+	Id         int64
+	FileId     int64
+	Timestamp  time.Time
+	ClientIP   string
+	UserAgent  string
+	BytesSent  int64
+	Range      string // requested byte range, empty for the whole file
+	Redirected bool   // the client was redirected to the storage backend
+}
+
+// Records an access of a file, counting it as a download of the file
+func (m *Manager) RecordAccess(ctx context.Context, a *FileAccess) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Print(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	redirected := 0
+	if a.Redirected {
+		redirected = 1
+	}
+	row := tx.QueryRowContext(ctx, `
+    INSERT INTO accessLog (fileID, accessTimestamp, clientIP, userAgent, bytesSent, byteRange, redirected)
+    VALUES (?,?,?,?,?,?,?)
+    RETURNING id`, a.FileId, a.Timestamp.Unix(), a.ClientIP, a.UserAgent, a.BytesSent, a.Range, redirected)
+	if err = row.Scan(&a.Id); err != nil {
+		logger.Printf("Failed to record access of file %d\n%v", a.FileId, err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    UPDATE files
+    SET downloadCount=downloadCount+1,
+    lastAccessTimestamp=CASE WHEN lastAccessTimestamp>? THEN lastAccessTimestamp ELSE ? END
+    WHERE id=?`, a.Timestamp.Unix(), a.Timestamp.Unix(), a.FileId)
+	if err != nil {
+		logger.Printf("Failed to count access of file %d\n%v", a.FileId, err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Gets the most recent accesses of a file, newest first
+func (m *Manager) GetAccessLog(ctx context.Context, uri string, limit int) ([]*FileAccess, error) {
+	rows, err := m.db.QueryContext(ctx, `
+    SELECT accessLog.id, accessLog.fileID, accessLog.accessTimestamp, accessLog.clientIP, accessLog.userAgent,
+    accessLog.bytesSent, accessLog.byteRange, accessLog.redirected
+    FROM accessLog
+    INNER JOIN files ON accessLog.fileID = files.id
+    WHERE files.relPath=?
+    ORDER BY accessLog.accessTimestamp DESC, accessLog.id DESC
+    LIMIT ?`, uri, limit)
+	if err != nil {
+		logger.Printf("failure when querying for accesses of %s\n%v", uri, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	accesses := make([]*FileAccess, 0)
+	for rows.Next() {
+		a := new(FileAccess)
+		var epochTime int64
+		var redirected int64
+		err = rows.Scan(&a.Id, &a.FileId, &epochTime, &a.ClientIP, &a.UserAgent, &a.BytesSent, &a.Range, &redirected)
+		if err != nil {
+			return nil, err
+		}
+		a.Timestamp = time.Unix(epochTime, 0)
+		a.Redirected = redirected != 0
+		accesses = append(accesses, a)
+	}
+
+	return accesses, rows.Err()
+}
+
+// Gets files not in the trash which were last accessed before a time, least recently used first
+//
+// Files which were never downloaded are treated as last accessed when they were uploaded.
+// Results are limited to a bin unless binId is negative.
+func (m *Manager) GetLeastRecentlyUsed(ctx context.Context, binId int64, before time.Time, limit int) ([]*storage.FileInfo, error) {
+	return m.queryFiles(ctx, `
+    SELECT `+fileColumns+`
+    FROM files
+    LEFT JOIN paths ON files.pathID = paths.id
+    WHERE files.deletedTimestamp IS NULL AND (? < 0 OR files.binID=?)
+    AND COALESCE(files.lastAccessTimestamp, files.uploadTimestamp) < ?
+    ORDER BY COALESCE(files.lastAccessTimestamp, files.uploadTimestamp), files.id
+    LIMIT ?`, binId, binId, before.Unix(), limit)
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditDriverRegister   = "driver.register"
+	AuditBinCreate        = "bin.create"
+	AuditFileTrash        = "file.trash"
+	AuditFileRename       = "file.rename"
+	AuditFileDescribe     = "file.describe"
+	AuditFileRestore      = "file.restore"
+	AuditFileDelete       = "file.delete"
+	AuditVersionRollback  = "version.rollback"
+	AuditCollectionCreate = "collection.create" // creates a share token
+	AuditCollectionDelete = "collection.delete"
+	AuditWebhookCreate    = "webhook.create"
+	AuditWebhookDelete    = "webhook.delete"
+)
+
+// The actor of operations which weren't requested by anyone, ie scheduled cleanups
+const SystemActor = "system"
+
+// An administrative or destructive operation
+type AuditEntry struct {
+	Id        int64           `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Actor     string          `json:"actor"`            // who performed the action
+	Action    string          `json:"action"`           // one of the Audit actions
+	Target    string          `json:"target"`           // kind and id of the target, ie file:<relPath>
+	Before    json.RawMessage `json:"before,omitempty"` // state of the target before the action, nil if it didn't exist
+	After     json.RawMessage `json:"after,omitempty"`  // state of the target after the action, nil if it no longer exists
+}
+
+// Filters of audit log entries, zero values match every entry
+type AuditQuery struct {
+	Actor  string
+	Action string
+	Target string
+	From   time.Time // inclusive
+	To     time.Time // inclusive
+	Limit  int       // maximum number of entries, 0 for every entry
+}
+
+type actorKey struct{}
+
+// Attributes operations performed with a context to an actor
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Gets the actor of a context, SystemActor if none was set
+func ActorOf(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+
+	return SystemActor
+}
+
+// Checks if an entry matches a query
+func (q AuditQuery) matches(e *AuditEntry) bool {
+	return (q.Actor == "" || e.Actor == q.Actor) &&
+		(q.Action == "" || e.Action == q.Action) &&
+		(q.Target == "" || e.Target == q.Target) &&
+		(q.From.IsZero() || e.Timestamp.Unix() >= q.From.Unix()) &&
+		(q.To.IsZero() || e.Timestamp.Unix() <= q.To.Unix())
+}
+
+func nullableJSON(state json.RawMessage) any {
+	if state == nil {
+		return nil
+	}
+	return string(state)
+}
+
+// Appends an entry to the audit log
+func (m *Manager) AddAuditEntry(ctx context.Context, e *AuditEntry) error {
+	row := m.db.QueryRowContext(ctx, `
+    INSERT INTO auditLog (auditTimestamp, actor, action, target, beforeState, afterState)
+    VALUES (?,?,?,?,?,?)
+    RETURNING id`,
+		e.Timestamp.Unix(), e.Actor, e.Action, e.Target, nullableJSON(e.Before), nullableJSON(e.After))
+
+	err := row.Scan(&e.Id)
+	if err != nil {
+		logger.Printf("Failed to audit %s of %s\n%v", e.Action, e.Target, err)
+	}
+
+	return err
+}
+
+// Gets the audit log entries matching a query, newest first
+func (m *Manager) GetAuditLog(ctx context.Context, q AuditQuery) ([]*AuditEntry, error) {
+	conditions := "1=1"
+	args := make([]any, 0)
+	for _, filter := range [][2]string{{"actor", q.Actor}, {"action", q.Action}, {"target", q.Target}} {
+		if filter[1] != "" {
+			conditions += " AND " + filter[0] + "=?"
+			args = append(args, filter[1])
+		}
+	}
+	if !q.From.IsZero() {
+		conditions += " AND auditTimestamp>=?"
+		args = append(args, q.From.Unix())
+	}
+	if !q.To.IsZero() {
+		conditions += " AND auditTimestamp<=?"
+		args = append(args, q.To.Unix())
+	}
+	limit := ""
+	if q.Limit > 0 {
+		limit = " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := m.db.QueryContext(ctx, `
+    SELECT id, auditTimestamp, actor, action, target, beforeState, afterState
+    FROM auditLog
+    WHERE `+conditions+`
+    ORDER BY auditTimestamp DESC, id DESC`+limit, args...)
+	if err != nil {
+		logger.Printf("failure when querying the audit log\n%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*AuditEntry, 0)
+	for rows.Next() {
+		e := new(AuditEntry)
+		var epochTime int64
+		var before, after sql.NullString
+		if err = rows.Scan(&e.Id, &epochTime, &e.Actor, &e.Action, &e.Target, &before, &after); err != nil {
+			return nil, err
+		}
+		e.Timestamp = time.Unix(epochTime, 0)
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"file-cellar/storage"
+	"fmt"
+	"time"
+)
+
+// Errors of catalog lookups for callers to match with errors.Is
+var (
+	ErrNotFound = errors.New("not found") // the record doesn't exist
+	ErrTrashed  = errors.New("file is in the trash")
+)
+
+// Wraps the error of a query which returned no rows in ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+
+	return err
+}
+
+// A catalog of files, the bins storing them and the drivers accessing those bins
+//
+// Lookups of missing records return ErrNotFound.
+type Catalog interface {
+	// drivers and bins
+	AddDriver(ctx context.Context, d storage.Driver) bool
+	AddBin(ctx context.Context, bin *storage.Bin, driverID int64) (int64, error)
+	GetBin(ctx context.Context, id int64) (*storage.Bin, error)
+	ListBins(ctx context.Context) ([]*storage.Bin, error)
+
+	// files
+	AddFile(ctx context.Context, f *storage.FileInfo) error
+	GetFile(ctx context.Context, uri string) (*storage.FileInfo, error)
+	ListFiles(ctx context.Context, binId int64) ([]*storage.FileInfo, error)
+	SetDescription(ctx context.Context, uri string, description string) (bool, error)
+	SetName(ctx context.Context, uri string, name string) (bool, error)
+	RemoveFile(ctx context.Context, uri string) (bool, error)
+
+	// versions
+	AddVersion(ctx context.Context, f *storage.FileInfo) error
+	GetVersion(ctx context.Context, binId int64, path string, version int64) (*storage.FileInfo, error)
+	GetVersions(ctx context.Context, binId int64, path string) ([]*storage.FileInfo, error)
+	SetCurrentVersion(ctx context.Context, binId int64, path string, version int64) error
+
+	// trash
+	TrashFile(ctx context.Context, uri string, deleteTime time.Time) (bool, error)
+	RestoreFile(ctx context.Context, uri string) (bool, error)
+	GetTrashedFile(ctx context.Context, uri string) (*storage.FileInfo, error)
+	GetTrashedVersion(ctx context.Context, binId int64, path string, version int64) (*storage.FileInfo, error)
+	GetTrash(ctx context.Context, before time.Time) ([]*storage.FileInfo, error)
+
+	// derivatives
+	AddDerivative(ctx context.Context, d *storage.Derivative) error
+	GetDerivative(ctx context.Context, fileId int64, kind string, param int64) (*storage.Derivative, error)
+	GetDerivatives(ctx context.Context, fileId int64) ([]*storage.Derivative, error)
+
+	// tags
+	TagFile(ctx context.Context, uri string, tag string) error
+	UntagFile(ctx context.Context, uri string, tag string) (bool, error)
+	GetTags(ctx context.Context, uri string) ([]string, error)
+	ListTags(ctx context.Context) (map[string]int64, error)
+	GetTaggedFiles(ctx context.Context, tag string) ([]*storage.FileInfo, error)
+
+	// collections
+	AddCollection(ctx context.Context, c *storage.Collection) error
+	RemoveCollection(ctx context.Context, id int64) (bool, error)
+	AddToCollection(ctx context.Context, collectionId int64, uri string) error
+	RemoveFromCollection(ctx context.Context, collectionId int64, uri string) (bool, error)
+	GetCollection(ctx context.Context, id int64) (*storage.Collection, error)
+	GetSharedCollection(ctx context.Context, token string) (*storage.Collection, error)
+	ListCollections(ctx context.Context) ([]*storage.Collection, error)
+	GetCollectionFiles(ctx context.Context, collectionId int64) ([]*storage.FileInfo, error)
+
+	// search
+	IndexContent(ctx context.Context, fileId int64, content string) error
+	Search(ctx context.Context, query string, binId int64, limit int) ([]SearchResult, error)
+
+	// accesses
+	RecordAccess(ctx context.Context, a *FileAccess) error
+	GetAccessLog(ctx context.Context, uri string, limit int) ([]*FileAccess, error)
+	GetLeastRecentlyUsed(ctx context.Context, binId int64, before time.Time, limit int) ([]*storage.FileInfo, error)
+
+	// audit log
+	AddAuditEntry(ctx context.Context, e *AuditEntry) error
+	GetAuditLog(ctx context.Context, q AuditQuery) ([]*AuditEntry, error)
+
+	// webhooks
+	AddWebhook(ctx context.Context, h *Webhook) error
+	RemoveWebhook(ctx context.Context, id int64) (bool, error)
+	GetWebhook(ctx context.Context, id int64) (*Webhook, error)
+	ListWebhooks(ctx context.Context) ([]*Webhook, error)
+	QueueEvent(ctx context.Context, eventType string, payload []byte, at time.Time) (int, error)
+	GetDueDeliveries(ctx context.Context, now time.Time, limit int) ([]*WebhookDelivery, error)
+	GetDeliveries(ctx context.Context, webhookId int64, limit int) ([]*WebhookDelivery, error)
+	UpdateDelivery(ctx context.Context, d *WebhookDelivery) error
+	RemoveFinishedDeliveries(ctx context.Context, before time.Time) (int64, error)
+
+	// event log
+	AddEvent(ctx context.Context, e *EventRecord, retain int) error
+	GetEvents(ctx context.Context, afterId int64, binId int64, limit int) ([]*EventRecord, error)
+	LastEventId(ctx context.Context) (int64, error)
+
+	// usage statistics
+	AddStats(ctx context.Context, records []StatsRecord) error
+	GetStats(ctx context.Context, source StatsSource, sourceId int64, from time.Time, to time.Time, resolution time.Duration) ([]StatsRecord, error)
+	PruneStats(ctx context.Context, resolution time.Duration, before time.Time) (int64, error)
+	GetBinUsage(ctx context.Context) ([]BinUsage, error)
+
+	Close() error
+}
+
+var _ Catalog = (*Manager)(nil)
+
+// Gets a file by its uri, failing with ErrTrashed if it has been moved to the trash, including by expiring,
+// and ErrNotFound if it doesn't exist or has been purged
+func FindFile(ctx context.Context, catalog Catalog, uri string) (*storage.FileInfo, error) {
+	f, err := catalog.GetFile(ctx, uri)
+	if !errors.Is(err, ErrNotFound) {
+		return f, err
+	}
+
+	if _, err = catalog.GetTrashedFile(ctx, uri); err == nil {
+		return nil, ErrTrashed
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	return nil, ErrNotFound
+}
+
+// Gets a version of the file at a logical path like GetVersion, failing with ErrTrashed if the version,
+// or every version when version is 0, has been moved to the trash and ErrNotFound if it doesn't exist
+func FindVersion(ctx context.Context, catalog Catalog, binId int64, path string, version int64) (*storage.FileInfo, error) {
+	f, err := catalog.GetVersion(ctx, binId, path, version)
+	if !errors.Is(err, ErrNotFound) {
+		return f, err
+	}
+
+	if _, err = catalog.GetTrashedVersion(ctx, binId, path, version); err == nil {
+		return nil, ErrTrashed
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	return nil, ErrNotFound
+}
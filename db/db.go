@@ -1,15 +1,19 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"log"
 	"os"
 
-	_ "github.com/mattn/go-sqlite3"
+	_ "github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 )
 
 var SQLITE_DEFAULT_PRAGMAS = map[string]string{
+	"busy_timeout": "5000",
 	"foreign_keys": "ON",
 	"journal_mode": "wal",
 	"synchronous":  "normal",
@@ -22,12 +26,12 @@ type dbPoolCounts struct {
 	db    *sql.DB
 }
 
-// Sets pragmas for a database connection pool
+// Sets pragmas for a database connection
 //
 // Returns a non nil value when an error occurs during SQL statement execution
-func setPragmas(db *sql.DB, pragmas map[string]string) error {
+func setPragmas(conn *sqlite3.SQLiteConn, pragmas map[string]string) error {
 	for k, v := range pragmas {
-		_, err := db.Exec(fmt.Sprintf("PRAGMA %s = %s", k, v))
+		_, err := conn.Exec(fmt.Sprintf("PRAGMA %s = %s", k, v), nil)
 		if err != nil {
 			logger.Printf("Error setting pragma %s to %s\n", k, v)
 			return err
@@ -37,83 +41,70 @@ func setPragmas(db *sql.DB, pragmas map[string]string) error {
 	return nil
 }
 
-// Gets a database connection pool
-// Only sets pragmas for the connection pool on creation.
-func getPool(connStr string, pragmas map[string]string) (*sql.DB, error) {
-	pool, err := sql.Open("sqlite3", connStr)
+// Opens sqlite connections with pragmas set, pragmas like foreign_keys only apply to the connection they are set on
+type sqliteConnector struct {
+	dsn     string
+	pragmas map[string]string
+}
+
+func (c sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
 	if err != nil {
-		logger.Printf("Failed to open sqlite3 connection to %s", connStr)
 		return nil, err
 	}
-	logger.Printf("Created sqlite3 connnection pool: %s", connStr)
 
-	if err = setPragmas(pool, pragmas); err != nil {
-		logger.Printf("Failed to set pragmas for %s", connStr)
+	if err = setPragmas(conn.(*sqlite3.SQLiteConn), c.pragmas); err != nil {
+		logger.Printf("Failed to set pragmas for %s", c.dsn)
+		conn.Close()
 		return nil, err
 	}
-	logger.Printf("Succesfully set pragmas for %s\n", connStr)
 
-	return pool, nil
+	return conn, nil
 }
 
-// Initializes tables in a database and sets indexes
-//
-// error is non nil if an error occurs while executing any SQL statement
-func InitTables(db *sql.DB) error {
-	_, err := db.Exec(`
-        CREATE TABLE IF NOT EXISTS serverConfig (
-        key TEXT UNIQUE NOT NULL,
-        value TEXT
-	)`)
-	if err != nil {
-		return err
-	}
+func (c sqliteConnector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{}
+}
 
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS drivers(
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT UNIQUE NOT NULL
-	)`)
-	if err != nil {
-		return err
-	}
+// Gets a database connection pool, postgres:// and postgresql:// urls connect to PostgreSQL and anything else to SQLite
+// Pragmas are set on every sqlite connection in the pool.
+func getPool(connStr string, pragmas map[string]string) (*database, error) {
+	d := dialectOf(connStr)
+	if d != sqliteDialect {
+		pool, err := sql.Open(d.driverName(), connStr)
+		if err != nil {
+			logger.Printf("Failed to open %s connection to %s", d, connStr)
+			return nil, err
+		}
+		logger.Printf("Created %s connnection pool: %s", d, connStr)
 
-	_, err = db.Exec(`
-    CREATE TABLE IF NOT EXISTS bins (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    driverID INTEGER,
-    name TEXT UNIQUE NOT NULL,
-    externalURL TEXT UNIQUE NOT NULL,
-    internalURL TEXT NOT NULL,
-    redirect INTEGER NOT NULL CHECK(redirect IN (0, 1)),
-    FOREIGN KEY(driverID) REFERENCES drivers(id)
-    )`)
-	if err != nil {
-		return err
+		return &database{pool, d}, nil
 	}
 
-	_, err = db.Exec(`
-    CREATE TABLE IF NOT EXISTS files (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    binID INTEGER,
-    name TEXT NOT NULL,
-    hash TEXT NOT NULL,
-    size INTEGER NOT NULL,
-    relPath TEXT UNIQUE NOT NULL,
-    uploadTimestamp INTEGER,
-    FOREIGN KEY(binID) REFERENCES bins(id)
-    )`)
-	if err != nil {
-		return err
+	pool := sql.OpenDB(sqliteConnector{connStr, pragmas})
+	// every connection to an in memory database has its own database
+	if connStr == ":memory:" {
+		pool.SetMaxOpenConns(1)
+	}
+	if err := pool.Ping(); err != nil {
+		logger.Printf("Failed to open %s connection to %s", d, connStr)
+		pool.Close()
+		return nil, err
 	}
+	logger.Printf("Created %s connnection pool: %s", d, connStr)
 
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_files_date ON files(uploadTimestamp)")
-	if err != nil {
+	return &database{pool, d}, nil
+}
+
+// Initializes tables in a database by applying every migration, then creates the search index
+//
+// error is non nil if an error occurs while executing any SQL statement
+func InitTables(db *database) error {
+	if err := migrate(context.Background(), db, LatestSchemaVersion()); err != nil {
 		return err
 	}
 
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_files_name on files(name)")
-	if err != nil {
+	if err := initSearch(db); err != nil {
 		return err
 	}
 
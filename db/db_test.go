@@ -2,8 +2,14 @@ package db
 
 import (
 	"context"
-	"database/sql"
+	"encoding/json"
+	"errors"
 	"file-cellar/storage"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -12,12 +18,53 @@ func printMismatch[T any](p func(string, ...any), name string, expected T, recie
 	p("Incorrect %s, expected %v != %v\n", name, expected, recieved)
 }
 
-func newTestManager() (*Manager, error) {
-	m, err := GetManager(":memory:", SQLITE_DEFAULT_PRAGMAS)
+// Connection strings of the databases tests are run against
+//
+// Set FILE_CELLAR_TEST_POSTGRES to the url of a disposable PostgreSQL database to also test against it,
+// its public schema is dropped before every test.
+func testBackends() []string {
+	backends := []string{":memory:"}
+	if connStr := os.Getenv("FILE_CELLAR_TEST_POSTGRES"); connStr != "" {
+		backends = append(backends, connStr)
+	}
+
+	return backends
+}
+
+// Set by the postgres build tag so tests fail instead of quietly skipping PostgreSQL
+var requirePostgres = false
+
+// Runs a test against every backend
+func forEachBackend(t *testing.T, test func(*testing.T, string)) {
+	if requirePostgres && os.Getenv("FILE_CELLAR_TEST_POSTGRES") == "" {
+		t.Log("The postgres build tag needs FILE_CELLAR_TEST_POSTGRES set to a disposable database")
+		t.FailNow()
+	}
+
+	for _, connStr := range testBackends() {
+		t.Run(dialectOf(connStr).String(), func(t *testing.T) {
+			test(t, connStr)
+		})
+	}
+}
+
+func newTestManager(connStr string) (*Manager, error) {
+	m, err := GetManager(connStr, SQLITE_DEFAULT_PRAGMAS)
 	if err != nil {
 		return nil, err
 	}
 
+	if m.db.dialect == postgresDialect {
+		if _, err = m.db.Exec("DROP SCHEMA public CASCADE"); err != nil {
+			return nil, err
+		}
+		if _, err = m.db.Exec("CREATE SCHEMA public"); err != nil {
+			return nil, err
+		}
+		m.bins = make(map[int64]*storage.Bin)
+		m.drivers = make(map[string]storage.Driver)
+	}
+
 	if err = InitTables(m.db); err != nil {
 		return nil, err
 	}
@@ -61,13 +108,13 @@ func sampleData(m *Manager) error {
 	localDriver := new(storage.LocalDriver)
 	localDriver.SetId(1)
 	localDriver.SetName("local")
-	m.Drivers["local"] = localDriver
+	m.drivers["local"] = localDriver
 
 	// TODO: change to correct driver type
 	networkDriver := new(storage.LocalDriver)
 	networkDriver.SetId(2)
 	networkDriver.SetName("network")
-	m.Drivers["network"] = networkDriver
+	m.drivers["network"] = networkDriver
 
 	bin := new(storage.Bin)
 	bin.Id = 1
@@ -76,7 +123,7 @@ func sampleData(m *Manager) error {
 	bin.Path.Internal = "/mount/slow"
 	bin.Redirect = false
 	bin.Driver = localDriver
-	m.Bins[1] = bin
+	m.bins[1] = bin
 
 	bin = new(storage.Bin)
 	bin.Id = 2
@@ -85,7 +132,7 @@ func sampleData(m *Manager) error {
 	bin.Path.Internal = "/mount/zyoom"
 	bin.Redirect = false
 	bin.Driver = localDriver
-	m.Bins[2] = bin
+	m.bins[2] = bin
 
 	bin = new(storage.Bin)
 	bin.Id = 3
@@ -94,13 +141,17 @@ func sampleData(m *Manager) error {
 	bin.Path.Internal = "https://myhomenas.local"
 	bin.Redirect = true
 	bin.Driver = networkDriver
-	m.Bins[3] = bin
+	m.bins[3] = bin
 
 	return err
 }
 
 func TestResolve(t *testing.T) {
-	m, err := newTestManager()
+	forEachBackend(t, testResolve)
+}
+
+func testResolve(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
 	if err != nil {
 		t.Logf("Error creating manager for testing: %v\n", err)
 		t.FailNow()
@@ -128,8 +179,8 @@ func TestResolve(t *testing.T) {
 
 	testNoMatchCase := func(uri string) {
 		url, err := m.Resolve(context.Background(), uri)
-		if err != sql.ErrNoRows {
-			t.Logf("Incorrect error type, expected %v but got %s\n", sql.ErrNoRows, err)
+		if !errors.Is(err, ErrNotFound) {
+			t.Logf("Incorrect error type, expected %v but got %s\n", ErrNotFound, err)
 			t.Logf("Resolved Url to %s", url)
 			t.Fail()
 		}
@@ -149,7 +200,11 @@ func TestResolve(t *testing.T) {
 }
 
 func TestGetFile(t *testing.T) {
-	m, err := newTestManager()
+	forEachBackend(t, testGetFile)
+}
+
+func testGetFile(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
 	if err != nil {
 		t.Logf("Error creating manager for testing: %v\n", err)
 		t.FailNow()
@@ -198,7 +253,7 @@ func TestGetFile(t *testing.T) {
 
 	testBadCase := func(expected error, uri string) {
 		f, err := m.GetFile(ctx, uri)
-		if err != expected {
+		if !errors.Is(err, expected) {
 			printMismatch(t.Logf, "error type", expected, err)
 			t.Logf("Got file %s\n", f)
 			t.Fail()
@@ -212,7 +267,7 @@ func TestGetFile(t *testing.T) {
 		Hash:            "af8182a217f6c4ae4abb6d52951f6e7a2cac3a4d59889e4a7a3cce87ac0ae508",
 		Size:            6e8,
 		RelPath:         "oldvid.mp4",
-		Bin:             m.Bins[1],
+		Bin:             m.bins[1],
 		UploadTimestamp: time.Unix(1000209017, 0),
 	}
 	testGoodCase(expected, "oldvid.mp4")
@@ -223,7 +278,7 @@ func TestGetFile(t *testing.T) {
 		Size:            3.072e4,
 		RelPath:         "WeddingAltar5.jpg",
 		UploadTimestamp: time.Unix(451309817, 0),
-		Bin:             m.Bins[1],
+		Bin:             m.bins[1],
 	}
 	testGoodCase(expected, "WeddingAltar5.jpg")
 
@@ -233,7 +288,7 @@ func TestGetFile(t *testing.T) {
 		Size:            55e9,
 		RelPath:         "Dota2Beta",
 		UploadTimestamp: time.Unix(1373370617, 0),
-		Bin:             m.Bins[2],
+		Bin:             m.bins[2],
 	}
 	testGoodCase(expected, "Dota2Beta")
 
@@ -243,10 +298,890 @@ func TestGetFile(t *testing.T) {
 		Size:            1.9e9,
 		RelPath:         "I_Saw_The_TV_Glow_2024.mp4",
 		UploadTimestamp: time.Unix(1718538617, 0),
-		Bin:             m.Bins[3],
+		Bin:             m.bins[3],
 	}
 	testGoodCase(expected, "I_Saw_The_TV_Glow_2024.mp4")
 
 	t.Log("Testing Non-Existing Files")
-	testBadCase(sql.ErrNoRows, "bingbong")
+	testBadCase(ErrNotFound, "bingbong")
+}
+
+func TestVersions(t *testing.T) {
+	forEachBackend(t, testVersions)
+}
+
+func testVersions(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
+	if err != nil {
+		t.Logf("Error creating manager for testing: %v\n", err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	err = sampleData(m)
+	if err != nil {
+		t.Logf("Error adding sample data to manager for testing: %v\n", err)
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+	const path = "docs/report.pdf"
+
+	for i, hash := range []string{"aaaa", "bbbb", "cccc"} {
+		f := &storage.FileInfo{
+			Name:            "report.pdf",
+			Hash:            hash,
+			Size:            int64(100 * (i + 1)),
+			RelPath:         "report" + hash,
+			UploadTimestamp: time.Unix(int64(1718538617+i), 0),
+			Bin:             m.bins[1],
+			LogicalPath:     path,
+		}
+		if err = m.AddVersion(ctx, f); err != nil {
+			t.Logf("Error adding version %d: %v\n", i+1, err)
+			t.FailNow()
+		}
+		if f.Version != int64(i+1) {
+			printMismatch(t.Errorf, "version", int64(i+1), f.Version)
+		}
+	}
+
+	versions, err := m.GetVersions(ctx, 1, path)
+	if err != nil {
+		t.Logf("Error getting versions: %v\n", err)
+		t.FailNow()
+	}
+	if len(versions) != 3 || versions[0].Version != 3 || versions[2].Hash != "aaaa" {
+		t.Errorf("Incorrect versions: %v\n", versions)
+	}
+
+	current, err := m.GetVersion(ctx, 1, path, 0)
+	if err != nil || current.Hash != "cccc" {
+		t.Errorf("Incorrect current version %v: %v\n", current, err)
+	}
+
+	if err = m.SetCurrentVersion(ctx, 1, path, 1); err != nil {
+		t.Errorf("Error rolling back: %v\n", err)
+	}
+	current, err = m.GetVersion(ctx, 1, path, 0)
+	if err != nil || current.Hash != "aaaa" {
+		t.Errorf("Incorrect current version after rollback %v: %v\n", current, err)
+	}
+
+	if err = m.SetCurrentVersion(ctx, 1, path, 7); !errors.Is(err, ErrNotFound) {
+		printMismatch(t.Errorf, "error for missing version", ErrNotFound, err)
+	}
+	if _, err = m.GetVersion(ctx, 2, path, 0); !errors.Is(err, ErrNotFound) {
+		printMismatch(t.Errorf, "error for path in other bin", ErrNotFound, err)
+	}
+
+	if _, err = m.RemoveFile(ctx, "reportaaaa"); err != nil {
+		t.Errorf("Error removing current version: %v\n", err)
+	}
+	current, err = m.GetVersion(ctx, 1, path, 0)
+	if err != nil || current.Hash != "cccc" {
+		t.Errorf("Incorrect current version after removal %v: %v\n", current, err)
+	}
+	if _, err = m.TrashFile(ctx, "reportbbbb", time.Now()); err != nil {
+		t.Errorf("Error trashing a version: %v\n", err)
+	}
+	if _, err = FindVersion(ctx, m, 1, path, 2); err != ErrTrashed {
+		printMismatch(t.Errorf, "error finding a trashed version", ErrTrashed, err)
+	}
+	if _, err = FindVersion(ctx, m, 1, path, 9); !errors.Is(err, ErrNotFound) {
+		printMismatch(t.Errorf, "error finding a missing version", ErrNotFound, err)
+	}
+	if current, err = FindVersion(ctx, m, 1, path, 0); err != nil || current.Hash != "cccc" {
+		t.Errorf("Incorrect current version found %v: %v\n", current, err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	forEachBackend(t, testTrash)
+}
+
+func testTrash(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
+	if err != nil {
+		t.Logf("Error creating manager for testing: %v\n", err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	err = sampleData(m)
+	if err != nil {
+		t.Logf("Error adding sample data to manager for testing: %v\n", err)
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+	deleteTime := time.Unix(1718538617, 0)
+
+	ok, err := m.TrashFile(ctx, "oldvid.mp4", deleteTime)
+	if !ok || err != nil {
+		t.Logf("Failed to trash file: %v\n", err)
+		t.FailNow()
+	}
+	if ok, _ = m.TrashFile(ctx, "oldvid.mp4", deleteTime); ok {
+		t.Error("Trashed a file already in the trash")
+	}
+
+	if _, err = m.GetFile(ctx, "oldvid.mp4"); !errors.Is(err, ErrNotFound) {
+		printMismatch(t.Errorf, "error getting trashed file", ErrNotFound, err)
+	}
+	if _, err = FindFile(ctx, m, "oldvid.mp4"); err != ErrTrashed {
+		printMismatch(t.Errorf, "error finding trashed file", ErrTrashed, err)
+	}
+	if _, err = FindFile(ctx, m, "missing.mp4"); !errors.Is(err, ErrNotFound) {
+		printMismatch(t.Errorf, "error finding missing file", ErrNotFound, err)
+	}
+
+	files, err := m.ListFiles(ctx, 1)
+	if err != nil || len(files) != 1 || files[0].RelPath != "WeddingAltar5.jpg" {
+		t.Errorf("Incorrect listing with a trashed file %v: %v\n", files, err)
+	}
+
+	trash, err := m.GetTrash(ctx, deleteTime.Add(-time.Second))
+	if err != nil || len(trash) != 0 {
+		t.Errorf("Incorrect trash before delete time %v: %v\n", trash, err)
+	}
+	trash, err = m.GetTrash(ctx, deleteTime)
+	if err != nil || len(trash) != 1 || !trash[0].DeletedTimestamp.Equal(deleteTime) {
+		t.Errorf("Incorrect trash at delete time %v: %v\n", trash, err)
+	}
+
+	ok, err = m.RestoreFile(ctx, "oldvid.mp4")
+	if !ok || err != nil {
+		t.Errorf("Failed to restore file: %v\n", err)
+	}
+	if _, err = m.GetFile(ctx, "oldvid.mp4"); err != nil {
+		t.Errorf("Failed to get restored file: %v\n", err)
+	}
+}
+
+func TestTagsAndCollections(t *testing.T) {
+	forEachBackend(t, testTagsAndCollections)
+}
+
+func testTagsAndCollections(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
+	if err != nil {
+		t.Logf("Error creating manager for testing: %v\n", err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	err = sampleData(m)
+	if err != nil {
+		t.Logf("Error adding sample data to manager for testing: %v\n", err)
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+
+	for _, uri := range []string{"oldvid.mp4", "WeddingAltar5.jpg"} {
+		if err = m.TagFile(ctx, uri, "family"); err != nil {
+			t.Errorf("Failed to tag %s: %v\n", uri, err)
+		}
+	}
+	if err = m.TagFile(ctx, "oldvid.mp4", "family"); err != nil {
+		t.Errorf("Failed to retag file: %v\n", err)
+	}
+	if err = m.TagFile(ctx, "bingbong", "family"); !errors.Is(err, ErrNotFound) {
+		printMismatch(t.Errorf, "error tagging missing file", ErrNotFound, err)
+	}
+
+	files, err := m.GetTaggedFiles(ctx, "family")
+	if err != nil || len(files) != 2 {
+		t.Errorf("Incorrect tagged files %v: %v\n", files, err)
+	}
+
+	ok, err := m.UntagFile(ctx, "oldvid.mp4", "family")
+	if !ok || err != nil {
+		t.Errorf("Failed to untag file: %v\n", err)
+	}
+	tags, err := m.ListTags(ctx)
+	if err != nil || tags["family"] != 1 {
+		t.Errorf("Incorrect tag counts %v: %v\n", tags, err)
+	}
+
+	c := &storage.Collection{Name: "games", ShareToken: "sharetoken", CreatedTimestamp: time.Unix(1718538617, 0)}
+	if err = m.AddCollection(ctx, c); err != nil {
+		t.Logf("Failed to add collection: %v\n", err)
+		t.FailNow()
+	}
+
+	if err = m.AddToCollection(ctx, c.Id, "Dota2Beta"); err != nil {
+		t.Errorf("Failed to add file to collection: %v\n", err)
+	}
+	if err = m.AddToCollection(ctx, c.Id+1, "Dota2Beta"); !errors.Is(err, ErrNotFound) {
+		printMismatch(t.Errorf, "error adding to missing collection", ErrNotFound, err)
+	}
+
+	shared, err := m.GetSharedCollection(ctx, "sharetoken")
+	if err != nil || shared.Id != c.Id {
+		t.Errorf("Incorrect shared collection %v: %v\n", shared, err)
+	}
+
+	files, err = m.GetCollectionFiles(ctx, c.Id)
+	if err != nil || len(files) != 1 || files[0].Name != "dota2" {
+		t.Errorf("Incorrect collection files %v: %v\n", files, err)
+	}
+
+	if _, err = m.RemoveFile(ctx, "Dota2Beta"); err != nil {
+		t.Errorf("Failed to remove collected file: %v\n", err)
+	}
+	files, err = m.GetCollectionFiles(ctx, c.Id)
+	if err != nil || len(files) != 0 {
+		t.Errorf("Incorrect collection files after removal %v: %v\n", files, err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	forEachBackend(t, testSearch)
+}
+
+func testSearch(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
+	if err != nil {
+		t.Logf("Error creating manager for testing: %v\n", err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	err = sampleData(m)
+	if err != nil {
+		t.Logf("Error adding sample data to manager for testing: %v\n", err)
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+
+	testCase := func(query string, binId int64, expected ...string) {
+		results, err := m.Search(ctx, query, binId, 10)
+		if err != nil {
+			t.Errorf("Failed to search for %s: %v\n", query, err)
+			return
+		}
+		if len(results) != len(expected) {
+			t.Errorf("Incorrect number of results for %s, expected %d != %d\n", query, len(expected), len(results))
+			return
+		}
+		for i, result := range results {
+			if result.File.RelPath != expected[i] {
+				printMismatch(t.Errorf, "result for "+query, expected[i], result.File.RelPath)
+			}
+		}
+	}
+
+	testCase("sentimental", -1, "oldvid.mp4")
+	testCase("SENTIMENTAL video", -1, "oldvid.mp4")
+	testCase("marriage", 2)
+	testCase("tv glow", 3, "I_Saw_The_TV_Glow_2024.mp4")
+	testCase("", -1)
+	testCase(`"unbalanced`, -1)
+
+	if _, err = m.SetDescription(ctx, "Dota2Beta", "a <i>multiplayer</i> game from valve"); err != nil {
+		t.Errorf("Failed to set description: %v\n", err)
+	}
+	testCase("valve", -1, "Dota2Beta")
+	results, err := m.Search(ctx, "valve", -1, 10)
+	if err != nil || len(results) != 1 {
+		t.Errorf("Incorrect search results %v: %v\n", results, err)
+	} else if !strings.HasPrefix(results[0].DescriptionHighlight, "a &lt;i&gt;multiplayer&lt;/i&gt; game from ") {
+		t.Errorf("Description highlight not escaped %s\n", results[0].DescriptionHighlight)
+	}
+
+	m.TrashFile(ctx, "Dota2Beta", time.Now())
+	testCase("valve", -1)
+
+	if err = m.TagFile(ctx, "WeddingAltar5.jpg", "anniversary"); err != nil {
+		t.Errorf("Failed to tag file: %v\n", err)
+	}
+	testCase("anniversary", -1, "WeddingAltar5.jpg")
+	testCase("anniv", -1, "WeddingAltar5.jpg")
+
+	indexed, err := m.hasSearchIndex(ctx)
+	if err != nil {
+		t.Logf("Failed to check for search index: %v\n", err)
+		t.FailNow()
+	} else if !indexed {
+		t.Log("Skipping full text search cases, they need sqlite built with -tags sqlite_fts5")
+		return
+	}
+
+	if err = m.IndexContent(ctx, 1, "the first birthday party"); err != nil {
+		t.Errorf("Failed to index content: %v\n", err)
+	}
+	results, err = m.Search(ctx, "birthday", -1, 10)
+	if err != nil || len(results) != 1 {
+		t.Errorf("Incorrect content search results %v: %v\n", results, err)
+	} else if results[0].Snippet != "the first "+HighlightStart+"birthday"+HighlightEnd+" party" {
+		t.Errorf("Incorrect snippet %s\n", results[0].Snippet)
+	}
+
+	results, err = m.Search(ctx, "marriage", -1, 10)
+	if err != nil || len(results) != 1 {
+		t.Errorf("Incorrect search results %v: %v\n", results, err)
+	} else if results[0].NameHighlight != HighlightStart+"marriage"+HighlightEnd+" photo" {
+		t.Errorf("Incorrect highlight %s\n", results[0].NameHighlight)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	forEachBackend(t, testAccessLog)
+}
+
+func testAccessLog(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
+	if err != nil {
+		t.Logf("Error creating manager for testing: %v\n", err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	err = sampleData(m)
+	if err != nil {
+		t.Logf("Error adding sample data to manager for testing: %v\n", err)
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+	f, err := m.GetFile(ctx, "WeddingAltar5.jpg")
+	if err != nil {
+		t.Logf("Failed to get file: %v\n", err)
+		t.FailNow()
+	}
+
+	accessTime := time.Unix(1718538617, 0)
+	accesses := []*FileAccess{
+		{FileId: f.Id, Timestamp: accessTime, ClientIP: "10.0.0.2", UserAgent: "curl/8.0", BytesSent: 30720},
+		{FileId: f.Id, Timestamp: accessTime.Add(time.Hour), ClientIP: "10.0.0.3", BytesSent: 1024, Range: "bytes=0-1023"},
+		// recorded late, so it doesn't move the last access back
+		{FileId: f.Id, Timestamp: accessTime.Add(-time.Hour), ClientIP: "10.0.0.4", Redirected: true},
+	}
+	for _, a := range accesses {
+		if err = m.RecordAccess(ctx, a); err != nil {
+			t.Logf("Failed to record access: %v\n", err)
+			t.FailNow()
+		}
+	}
+
+	f, err = m.GetFile(ctx, "WeddingAltar5.jpg")
+	if err != nil {
+		t.Logf("Failed to get accessed file: %v\n", err)
+		t.FailNow()
+	}
+	if f.Downloads != 3 {
+		printMismatch(t.Errorf, "downloads", 3, f.Downloads)
+	}
+	if expected := accessTime.Add(time.Hour); !f.AccessTimestamp.Equal(expected) {
+		printMismatch(t.Errorf, "access time", expected, f.AccessTimestamp)
+	}
+
+	log, err := m.GetAccessLog(ctx, "WeddingAltar5.jpg", 2)
+	if err != nil || len(log) != 2 {
+		t.Logf("Incorrect access log %v: %v\n", log, err)
+		t.FailNow()
+	}
+	if *log[0] != *accesses[1] || *log[1] != *accesses[0] {
+		t.Errorf("Incorrect access log order %v %v\n", *log[0], *log[1])
+	}
+
+	// the photo is used more recently than its upload, the video was never downloaded
+	unused, err := m.GetLeastRecentlyUsed(ctx, 1, accessTime, 10)
+	if err != nil || len(unused) != 1 || unused[0].RelPath != "oldvid.mp4" {
+		t.Errorf("Incorrect least recently used files %v: %v\n", unused, err)
+	}
+	unused, err = m.GetLeastRecentlyUsed(ctx, -1, accessTime.Add(2*time.Hour), 10)
+	if err != nil || len(unused) != 4 || unused[0].RelPath != "oldvid.mp4" || unused[3].RelPath != "WeddingAltar5.jpg" {
+		t.Errorf("Incorrect least recently used files in every bin %v: %v\n", unused, err)
+	}
+
+	if ok, err := m.RemoveFile(ctx, "WeddingAltar5.jpg"); !ok || err != nil {
+		t.Errorf("Failed to remove accessed file: %v\n", err)
+	}
+	if log, err = m.GetAccessLog(ctx, "WeddingAltar5.jpg", 10); err != nil || len(log) != 0 {
+		t.Errorf("Accesses of removed file remain %v: %v\n", log, err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	forEachBackend(t, testAuditLog)
+}
+
+func testAuditLog(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
+	if err != nil {
+		t.Logf("Error creating manager for testing: %v\n", err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	ctx := context.Background()
+	start := time.Unix(1718538617, 0)
+	entries := []*AuditEntry{
+		{Timestamp: start, Actor: SystemActor, Action: AuditBinCreate, Target: "bin:1", After: json.RawMessage(`{"id":1}`)},
+		{Timestamp: start.Add(time.Minute), Actor: "http:10.0.0.2", Action: AuditFileTrash, Target: "file:a.txt",
+			Before: json.RawMessage(`{"name":"a.txt"}`), After: json.RawMessage(`{"name":"a.txt","deleted":true}`)},
+		{Timestamp: start.Add(2 * time.Minute), Actor: "http:10.0.0.2", Action: AuditFileDelete, Target: "file:a.txt",
+			Before: json.RawMessage(`{"name":"a.txt","deleted":true}`)},
+	}
+	for _, e := range entries {
+		if err = m.AddAuditEntry(ctx, e); err != nil {
+			t.Logf("Failed to add audit entry: %v\n", err)
+			t.FailNow()
+		}
+	}
+
+	log, err := m.GetAuditLog(ctx, AuditQuery{})
+	if err != nil || len(log) != 3 {
+		t.Logf("Incorrect audit log %v: %v\n", log, err)
+		t.FailNow()
+	}
+	if log[0].Id != entries[2].Id || log[0].After != nil || string(log[0].Before) != string(entries[2].Before) {
+		t.Errorf("Incorrect newest audit entry %v\n", log[0])
+	}
+	if log[2].Before != nil || !log[2].Timestamp.Equal(start) {
+		t.Errorf("Incorrect oldest audit entry %v\n", log[2])
+	}
+
+	log, err = m.GetAuditLog(ctx, AuditQuery{Actor: "http:10.0.0.2", Target: "file:a.txt", Limit: 1})
+	if err != nil || len(log) != 1 || log[0].Action != AuditFileDelete {
+		t.Errorf("Incorrect filtered audit log %v: %v\n", log, err)
+	}
+	log, err = m.GetAuditLog(ctx, AuditQuery{From: start.Add(30 * time.Second), To: start.Add(time.Minute)})
+	if err != nil || len(log) != 1 || log[0].Action != AuditFileTrash {
+		t.Errorf("Incorrect audit log between times %v: %v\n", log, err)
+	}
+
+	if _, err = m.db.Exec("UPDATE auditLog SET actor='someone else'"); err == nil {
+		t.Error("Updated the append only audit log")
+	}
+	if _, err = m.db.Exec("DELETE FROM auditLog"); err == nil {
+		t.Error("Deleted from the append only audit log")
+	}
+}
+
+func TestStats(t *testing.T) {
+	forEachBackend(t, testStats)
+}
+
+func testStats(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
+	if err != nil {
+		t.Logf("Error creating manager for testing: %v\n", err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	ctx := context.Background()
+	day := time.Unix(1718496000, 0) // midnight UTC
+	records := []StatsRecord{
+		{BinStats, 1, day.Add(10 * time.Minute), storage.Stats{Uploaded: 1, UploadedBytes: 100}},
+		{BinStats, 1, day.Add(50 * time.Minute), storage.Stats{Uploaded: 2, UploadedBytes: 300, Downloaded: 1}},
+		{BinStats, 1, day.Add(2 * time.Hour), storage.Stats{Deleted: 1, DeletedBytes: 100}},
+		{BinStats, 2, day.Add(20 * time.Minute), storage.Stats{Failed: 4}},
+		{DriverStats, 1, day.Add(10 * time.Minute), storage.Stats{Uploaded: 1, UploadedBytes: 100}},
+		{BinStats, 1, day.Add(25 * time.Hour), storage.Stats{Redirected: 7}},
+	}
+	if err = m.AddStats(ctx, records); err != nil {
+		t.Logf("Failed to add stats: %v\n", err)
+		t.FailNow()
+	}
+
+	testRange := func(name string, sourceId int64, to time.Time, resolution time.Duration, expected []StatsRecord) {
+		stats, err := m.GetStats(ctx, BinStats, sourceId, day, to, resolution)
+		if err != nil {
+			t.Errorf("Failed to get %s stats: %v\n", name, err)
+			return
+		}
+		if len(stats) != len(expected) {
+			t.Errorf("Incorrect %s stats %v\n", name, stats)
+			return
+		}
+		for i, r := range stats {
+			if !r.Timestamp.Equal(expected[i].Timestamp) || r.Stats != expected[i].Stats || r.SourceId != sourceId {
+				printMismatch(t.Errorf, name+" stats", expected[i], r)
+			}
+		}
+	}
+
+	testRange("raw", 1, day.Add(time.Hour), RawResolution, []StatsRecord{
+		{Timestamp: day.Add(10 * time.Minute), Stats: storage.Stats{Uploaded: 1, UploadedBytes: 100}},
+		{Timestamp: day.Add(50 * time.Minute), Stats: storage.Stats{Uploaded: 2, UploadedBytes: 300, Downloaded: 1}},
+	})
+	testRange("hourly", 1, day.Add(24*time.Hour), HourResolution, []StatsRecord{
+		{Timestamp: day, Stats: storage.Stats{Uploaded: 3, UploadedBytes: 400, Downloaded: 1}},
+		{Timestamp: day.Add(2 * time.Hour), Stats: storage.Stats{Deleted: 1, DeletedBytes: 100}},
+	})
+	testRange("daily", 1, day.Add(48*time.Hour), DayResolution, []StatsRecord{
+		{Timestamp: day, Stats: storage.Stats{Uploaded: 3, UploadedBytes: 400, Downloaded: 1, Deleted: 1, DeletedBytes: 100}},
+		{Timestamp: day.Add(24 * time.Hour), Stats: storage.Stats{Redirected: 7}},
+	})
+	testRange("every bin hourly", -1, day.Add(time.Hour), HourResolution, []StatsRecord{
+		{Timestamp: day, Stats: storage.Stats{Uploaded: 3, UploadedBytes: 400, Downloaded: 1, Failed: 4}},
+	})
+
+	// rollups outlive the raw records they sum
+	pruned, err := m.PruneStats(ctx, RawResolution, day.Add(24*time.Hour))
+	if err != nil || pruned != 5 {
+		t.Errorf("Incorrect pruning of raw stats %d: %v\n", pruned, err)
+	}
+	testRange("pruned raw", 1, day.Add(time.Hour), RawResolution, []StatsRecord{})
+	testRange("hourly after pruning raw", 1, day.Add(24*time.Hour), HourResolution, []StatsRecord{
+		{Timestamp: day, Stats: storage.Stats{Uploaded: 3, UploadedBytes: 400, Downloaded: 1}},
+		{Timestamp: day.Add(2 * time.Hour), Stats: storage.Stats{Deleted: 1, DeletedBytes: 100}},
+	})
+	testRange("hourly from within a bucket", 1, day.Add(30*time.Minute), HourResolution, []StatsRecord{
+		{Timestamp: day, Stats: storage.Stats{Uploaded: 3, UploadedBytes: 400, Downloaded: 1}},
+	})
+
+	if pruned, err = m.PruneStats(ctx, HourResolution, day.Add(time.Hour)); err != nil || pruned != 3 {
+		t.Errorf("Incorrect pruning of hourly stats %d: %v\n", pruned, err)
+	}
+	testRange("pruned hourly", 1, day.Add(24*time.Hour), HourResolution, []StatsRecord{
+		{Timestamp: day.Add(2 * time.Hour), Stats: storage.Stats{Deleted: 1, DeletedBytes: 100}},
+	})
+	testRange("daily after pruning hourly", 1, day.Add(48*time.Hour), DayResolution, []StatsRecord{
+		{Timestamp: day, Stats: storage.Stats{Uploaded: 3, UploadedBytes: 400, Downloaded: 1, Deleted: 1, DeletedBytes: 100}},
+		{Timestamp: day.Add(24 * time.Hour), Stats: storage.Stats{Redirected: 7}},
+	})
+}
+
+func TestMigrations(t *testing.T) {
+	forEachBackend(t, testMigrations)
+}
+
+func testMigrations(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
+	if err != nil {
+		t.Logf("Error creating manager for testing: %v\n", err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	err = sampleData(m)
+	if err != nil {
+		t.Logf("Error adding sample data to manager for testing: %v\n", err)
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+
+	testVersion := func(expected int) {
+		version, err := m.SchemaVersion(ctx)
+		if err != nil {
+			t.Logf("Failed to get schema version: %v\n", err)
+			t.FailNow()
+		} else if version != expected {
+			printMismatch(t.Errorf, "schema version", expected, version)
+		}
+	}
+
+	testVersion(LatestSchemaVersion())
+	if err = m.TagFile(ctx, "oldvid.mp4", "family"); err != nil {
+		t.Errorf("Failed to tag file: %v\n", err)
+	}
+
+	for target := LatestSchemaVersion() - 1; target > 0; target-- {
+		if err = m.Migrate(ctx, target); err != nil {
+			t.Logf("Failed to migrate down to %d: %v\n", target, err)
+			t.FailNow()
+		}
+		testVersion(target)
+
+		var count int
+		if err = m.db.QueryRow("SELECT count(*) FROM files").Scan(&count); err != nil || count != 4 {
+			t.Errorf("Incorrect number of files at version %d, expected 4 != %d: %v\n", target, count, err)
+		}
+	}
+
+	status, err := m.MigrationStatus(ctx)
+	if err != nil || len(status) != LatestSchemaVersion() || !status[0].Applied || status[1].Applied {
+		t.Errorf("Incorrect migration status %v: %v\n", status, err)
+	}
+
+	if err = m.Init(); err != nil {
+		t.Logf("Failed to migrate up: %v\n", err)
+		t.FailNow()
+	}
+	testVersion(LatestSchemaVersion())
+
+	if _, err = m.GetFile(ctx, "WeddingAltar5.jpg"); err != nil {
+		t.Errorf("Failed to get file after migrating: %v\n", err)
+	}
+	results, err := m.Search(ctx, "sentimental", -1, 10)
+	if err != nil || len(results) != 1 {
+		t.Errorf("Incorrect search results after migrating %v: %v\n", results, err)
+	}
+
+	// the rollups of stats recorded before they existed are created from the raw stats
+	recorded := time.Unix(1718496000, 0)
+	if err = m.AddStats(ctx, []StatsRecord{{BinStats, 1, recorded, storage.Stats{Uploaded: 2}}}); err != nil {
+		t.Errorf("Failed to add stats: %v\n", err)
+	}
+	if err = m.Migrate(ctx, 11); err != nil {
+		t.Errorf("Failed to migrate down to 11: %v\n", err)
+	}
+	if err = m.Init(); err != nil {
+		t.Errorf("Failed to migrate up: %v\n", err)
+	}
+	stats, err := m.GetStats(ctx, BinStats, 1, recorded, recorded, DayResolution)
+	if err != nil || len(stats) != 1 || stats[0].Uploaded != 2 {
+		t.Errorf("Incorrect stats rolled up after migrating %v: %v\n", stats, err)
+	}
+
+	if err = m.Migrate(ctx, LatestSchemaVersion()+1); err == nil {
+		t.Error("Migrated to an unknown version")
+	}
+}
+
+// Shares a manager between goroutines, run with -race to check its caches are synchronized
+func TestConcurrentManager(t *testing.T) {
+	connStr := filepath.Join(t.TempDir(), "concurrent.db")
+	ctx := context.Background()
+	const workers = 16
+
+	var wg sync.WaitGroup
+	shared := make([]*Manager, workers)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shared[i], _ = GetManager(connStr, SQLITE_DEFAULT_PRAGMAS)
+		}()
+	}
+	wg.Wait()
+
+	m := shared[0]
+	for _, other := range shared {
+		if other == nil || other != m {
+			t.Log("Concurrent calls to GetManager returned different managers")
+			t.FailNow()
+		}
+	}
+
+	if err := m.Init(); err != nil {
+		t.Logf("Error initializing database: %v\n", err)
+		t.FailNow()
+	}
+
+	driver := storage.NewLocalDriver()
+	if !m.AddDriver(ctx, driver) {
+		t.Log("Failed to add driver")
+		t.FailNow()
+	}
+	bin := &storage.Bin{Name: "shared bin", Driver: driver}
+	bin.Path.External = "shared"
+	bin.Path.Internal = t.TempDir()
+	binId, err := m.AddBin(ctx, bin, driver.Id())
+	if err != nil {
+		t.Logf("Error adding bin: %v\n", err)
+		t.FailNow()
+	}
+	m.InvalidateBins()
+
+	bins := make([]*storage.Bin, workers)
+	errs := make(chan error, 3*workers)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var err error
+			if bins[i], err = m.GetBin(ctx, binId); err != nil {
+				errs <- err
+				return
+			}
+
+			f := &storage.FileInfo{
+				Name:            fmt.Sprintf("file %d", i),
+				Hash:            "hash",
+				RelPath:         fmt.Sprintf("file%d.txt", i),
+				UploadTimestamp: time.Now(),
+				Bin:             bins[i],
+			}
+			if err = m.AddFile(ctx, f); err != nil {
+				errs <- err
+			} else if _, err = m.GetFile(ctx, f.RelPath); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Error using shared manager: %v\n", err)
+	}
+	for _, other := range bins {
+		if other != bins[0] {
+			t.Error("Concurrent calls to GetBin cached different bins")
+			break
+		}
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		m.InvalidateBins()
+		if err := m.GetBins(ctx); err != nil {
+			t.Errorf("Error reloading bins: %v\n", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if files, err := m.ListFiles(ctx, binId); err != nil || len(files) != workers {
+			t.Errorf("Incorrect files listed while reloading bins, expected %d != %d: %v\n", workers, len(files), err)
+		}
+	}()
+	wg.Wait()
+
+	if err = m.Close(); err != nil {
+		t.Errorf("Error closing manager: %v\n", err)
+	}
+	reopened, err := GetManager(connStr, SQLITE_DEFAULT_PRAGMAS)
+	if err != nil || reopened == m {
+		t.Errorf("Closed manager was not replaced: %v\n", err)
+	} else {
+		reopened.Close()
+	}
+}
+
+func TestRebind(t *testing.T) {
+	testCase := func(d dialect, query string, expected string) {
+		if rebound := d.rebind(query); rebound != expected {
+			printMismatch(t.Errorf, "rebound query", expected, rebound)
+		}
+	}
+
+	testCase(sqliteDialect, "SELECT id FROM files WHERE name=? AND size>?", "SELECT id FROM files WHERE name=? AND size>?")
+	testCase(postgresDialect, "SELECT id FROM files WHERE name=? AND size>?", "SELECT id FROM files WHERE name=$1 AND size>$2")
+	testCase(postgresDialect, "SELECT '?' WHERE name LIKE ? ESCAPE '\\' AND hash=?", "SELECT '?' WHERE name LIKE $1 ESCAPE '\\' AND hash=$2")
+
+	ddl := postgresDialect.ddl("id INTEGER PRIMARY KEY AUTOINCREMENT, size INTEGER NOT NULL, redirect INTEGER NOT NULL CHECK(redirect IN (0, 1))")
+	if expected := "id BIGSERIAL PRIMARY KEY, size BIGINT NOT NULL, redirect BOOLEAN NOT NULL"; ddl != expected {
+		printMismatch(t.Errorf, "translated ddl", expected, ddl)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	forEachBackend(t, testWebhooks)
+}
+
+func testWebhooks(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
+	if err != nil {
+		t.Logf("Error creating manager for testing: %v\n", err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	ctx := context.Background()
+	start := time.Unix(1718538617, 0)
+	every := &Webhook{URL: "http://localhost/every", Secret: "a", CreatedTimestamp: start}
+	uploads := &Webhook{URL: "http://localhost/uploads", Secret: "b", Events: []string{"file.uploaded"}, CreatedTimestamp: start}
+	for _, h := range []*Webhook{every, uploads} {
+		if err = m.AddWebhook(ctx, h); err != nil {
+			t.Logf("Failed to add webhook: %v\n", err)
+			t.FailNow()
+		}
+	}
+
+	webhooks, err := m.ListWebhooks(ctx)
+	if err != nil || len(webhooks) != 2 || webhooks[1].URL != uploads.URL || len(webhooks[1].Events) != 1 || webhooks[0].Events != nil {
+		t.Errorf("Incorrect webhooks %v: %v\n", webhooks, err)
+	}
+
+	queued, err := m.QueueEvent(ctx, "file.uploaded", []byte(`{"type":"file.uploaded"}`), start)
+	if err != nil || queued != 2 {
+		printMismatch(t.Errorf, "deliveries of upload", 2, queued)
+	}
+	queued, err = m.QueueEvent(ctx, "file.deleted", []byte(`{"type":"file.deleted"}`), start.Add(time.Second))
+	if err != nil || queued != 1 {
+		printMismatch(t.Errorf, "deliveries of deletion", 1, queued)
+	}
+
+	due, err := m.GetDueDeliveries(ctx, start, 10)
+	if err != nil || len(due) != 2 || due[0].Secret != "a" || string(due[0].Payload) != `{"type":"file.uploaded"}` {
+		t.Logf("Incorrect due deliveries %v: %v\n", due, err)
+		t.FailNow()
+	}
+
+	due[0].Status = DeliveryDelivered
+	due[0].Attempts = 1
+	due[1].Attempts = 1
+	due[1].LastError = "webhook responded with 500 Internal Server Error"
+	due[1].NextAttemptTimestamp = start.Add(time.Minute)
+	for _, d := range due {
+		if err = m.UpdateDelivery(ctx, d); err != nil {
+			t.Errorf("Failed to update delivery: %v\n", err)
+		}
+	}
+
+	due, err = m.GetDueDeliveries(ctx, start.Add(time.Second), 10)
+	if err != nil || len(due) != 1 || due[0].Event != "file.deleted" {
+		t.Errorf("Incorrect due deliveries after attempts %v: %v\n", due, err)
+	}
+	deliveries, err := m.GetDeliveries(ctx, uploads.Id, 10)
+	if err != nil || len(deliveries) != 1 || deliveries[0].Attempts != 1 || deliveries[0].LastError == "" {
+		t.Errorf("Incorrect deliveries of webhook %v: %v\n", deliveries, err)
+	}
+
+	removed, err := m.RemoveFinishedDeliveries(ctx, start.Add(time.Hour))
+	if err != nil || removed != 1 {
+		printMismatch(t.Errorf, "removed deliveries", 1, removed)
+	}
+
+	if ok, err := m.RemoveWebhook(ctx, every.Id); !ok || err != nil {
+		t.Errorf("Failed to remove webhook: %v\n", err)
+	}
+	if _, err = m.GetWebhook(ctx, every.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Removed webhook still found: %v\n", err)
+	}
+	due, err = m.GetDueDeliveries(ctx, start.Add(time.Hour), 10)
+	if err != nil || len(due) != 1 || due[0].WebhookId != uploads.Id {
+		t.Errorf("Incorrect due deliveries after removing webhook %v: %v\n", due, err)
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	forEachBackend(t, testEventLog)
+}
+
+func testEventLog(t *testing.T, connStr string) {
+	m, err := newTestManager(connStr)
+	if err != nil {
+		t.Logf("Error creating manager for testing: %v\n", err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	ctx := context.Background()
+	if id, err := m.LastEventId(ctx); id != 0 || err != nil {
+		t.Errorf("Incorrect last id of empty event log %d: %v\n", id, err)
+	}
+
+	start := time.Unix(1718538617, 0)
+	for i := range 5 {
+		e := &EventRecord{Type: "file.uploaded", BinId: int64(i%2 + 1), Timestamp: start.Add(time.Duration(i) * time.Second),
+			Actor: SystemActor, Data: []byte(fmt.Sprintf(`{"n":%d}`, i))}
+		if err = m.AddEvent(ctx, e, 3); err != nil || e.Id != int64(i+1) {
+			t.Logf("Failed to add event %d: %v\n", e.Id, err)
+			t.FailNow()
+		}
+	}
+
+	events, err := m.GetEvents(ctx, 0, -1, 10)
+	if err != nil || len(events) != 3 || events[0].Id != 3 || string(events[2].Data) != `{"n":4}` {
+		t.Errorf("Incorrect bounded event log %v: %v\n", events, err)
+	}
+	events, err = m.GetEvents(ctx, 3, 1, 10)
+	if err != nil || len(events) != 1 || events[0].Id != 5 || !events[0].Timestamp.Equal(start.Add(4*time.Second)) {
+		t.Errorf("Incorrect events of bin after id %v: %v\n", events, err)
+	}
+	if id, err := m.LastEventId(ctx); id != 5 || err != nil {
+		printMismatch(t.Errorf, "last event id", 5, id)
+	}
 }
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"file-cellar/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time taken by database statements by their operation
+var QueryDurations = metrics.NewHistogramVec("file_cellar_db_query_duration_seconds",
+	"Time taken to execute database statements, excluding reading their rows.", metrics.DefaultBuckets, "operation")
+
+// Operations statements are timed by, anything else is timed as other
+var queryOperations = map[string]bool{
+	"select": true, "insert": true, "update": true, "delete": true,
+	"create": true, "drop": true, "alter": true, "pragma": true,
+}
+
+// Records the time taken by a statement, call the returned function once it has executed
+func observeQuery(query string) func() {
+	start := time.Now()
+	return func() {
+		operation := "other"
+		if words := strings.Fields(query); len(words) > 0 && queryOperations[strings.ToLower(words[0])] {
+			operation = strings.ToLower(words[0])
+		}
+		QueryDurations.With(operation).Observe(time.Since(start).Seconds())
+	}
+}
+
+// The SQL variant spoken by a database backend
+type dialect uint8
+
+const (
+	sqliteDialect dialect = iota
+	postgresDialect
+)
+
+// Converts column types in sqlite DDL to their postgres equivalents
+var postgresTypes = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+	"INTEGER NOT NULL CHECK(redirect IN (0, 1))", "BOOLEAN NOT NULL",
+	"INTEGER", "BIGINT",
+)
+
+// Gets the dialect of a connection string, postgres urls use postgres and everything else sqlite
+func dialectOf(connStr string) dialect {
+	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
+		return postgresDialect
+	}
+
+	return sqliteDialect
+}
+
+// The name of the database/sql driver for a dialect
+func (d dialect) driverName() string {
+	return [...]string{"sqlite3", "postgres"}[d]
+}
+
+func (d dialect) String() string {
+	return [...]string{"sqlite", "postgres"}[d]
+}
+
+// Rewrites ? placeholders outside of string literals to the dialect's placeholder style
+func (d dialect) rebind(query string) string {
+	if d != postgresDialect || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+			b.WriteRune(c)
+		case c == '?' && !quoted:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+		default:
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
+
+// Translates DDL written for sqlite into the dialect
+func (d dialect) ddl(statement string) string {
+	if d == postgresDialect {
+		return postgresTypes.Replace(statement)
+	}
+
+	return statement
+}
+
+// Case insensitive LIKE operator
+func (d dialect) ilike() string {
+	if d == postgresDialect {
+		return "ILIKE"
+	}
+
+	return "LIKE"
+}
+
+// A connection pool which rewrites queries for its dialect
+type database struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (db *database) Exec(query string, args ...any) (sql.Result, error) {
+	defer observeQuery(query)()
+	return db.DB.Exec(db.dialect.rebind(query), args...)
+}
+
+func (db *database) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	defer observeQuery(query)()
+	return db.DB.ExecContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *database) Query(query string, args ...any) (*sql.Rows, error) {
+	defer observeQuery(query)()
+	return db.DB.Query(db.dialect.rebind(query), args...)
+}
+
+func (db *database) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	defer observeQuery(query)()
+	return db.DB.QueryContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *database) QueryRow(query string, args ...any) *sql.Row {
+	defer observeQuery(query)()
+	return db.DB.QueryRow(db.dialect.rebind(query), args...)
+}
+
+func (db *database) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	defer observeQuery(query)()
+	return db.DB.QueryRowContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *database) BeginTx(ctx context.Context, opts *sql.TxOptions) (*transaction, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transaction{tx, db.dialect}, nil
+}
+
+// A transaction which rewrites queries for its dialect
+type transaction struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (tx *transaction) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	defer observeQuery(query)()
+	return tx.Tx.ExecContext(ctx, tx.dialect.rebind(query), args...)
+}
+
+func (tx *transaction) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	defer observeQuery(query)()
+	return tx.Tx.QueryContext(ctx, tx.dialect.rebind(query), args...)
+}
+
+func (tx *transaction) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	defer observeQuery(query)()
+	return tx.Tx.QueryRowContext(ctx, tx.dialect.rebind(query), args...)
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// An event in the event log
+type EventRecord struct {
+	Id        int64
+	Type      string
+	BinId     int64 // bin the event happened in
+	Timestamp time.Time
+	Actor     string
+	Data      []byte // json data of the event
+}
+
+// Appends an event to the event log, setting its id
+//
+// Only the newest retain events are kept, older events are removed.
+func (m *Manager) AddEvent(ctx context.Context, e *EventRecord, retain int) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Print(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+    INSERT INTO events (eventType, binID, eventTimestamp, actor, data)
+    VALUES (?,?,?,?,?)
+    RETURNING id`, e.Type, e.BinId, e.Timestamp.Unix(), e.Actor, string(e.Data))
+	if err = row.Scan(&e.Id); err != nil {
+		logger.Printf("Failed to log %s event\n%v", e.Type, err)
+		return err
+	}
+
+	// ids are never reused, so the newest events are the last retain ids
+	_, err = tx.ExecContext(ctx, `
+    DELETE FROM events
+    WHERE id<=?`, e.Id-int64(retain))
+	if err != nil {
+		logger.Printf("Failed to trim the event log\n%v", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Gets the events logged after an id, oldest first
+//
+// Results are limited to the events of a bin unless binId is negative.
+func (m *Manager) GetEvents(ctx context.Context, afterId int64, binId int64, limit int) ([]*EventRecord, error) {
+	rows, err := m.db.QueryContext(ctx, `
+    SELECT id, eventType, binID, eventTimestamp, actor, data
+    FROM events
+    WHERE id>? AND (? < 0 OR binID=?)
+    ORDER BY id
+    LIMIT ?`, afterId, binId, binId, limit)
+	if err != nil {
+		logger.Printf("failure when querying the event log\n%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*EventRecord, 0)
+	for rows.Next() {
+		e := new(EventRecord)
+		var epochTime int64
+		var data string
+		if err = rows.Scan(&e.Id, &e.Type, &e.BinId, &epochTime, &e.Actor, &data); err != nil {
+			return nil, err
+		}
+		e.Timestamp = time.Unix(epochTime, 0)
+		e.Data = []byte(data)
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// Gets the id of the newest event in the event log, 0 if it is empty
+func (m *Manager) LastEventId(ctx context.Context) (int64, error) {
+	var id int64
+	row := m.db.QueryRowContext(ctx, "SELECT coalesce(max(id), 0) FROM events")
+	err := row.Scan(&id)
+
+	return id, err
+}
@@ -1,62 +1,145 @@
 package db
 
 import (
-	"database/sql"
+	"context"
 	"file-cellar/storage"
+	"fmt"
+	"sync"
 )
 
-var Managers map[string]*Manager
+// Open managers by connection string, shared by every caller of GetManager
+var (
+	managers   = make(map[string]*Manager)
+	managersMu sync.Mutex
+)
 
+// A catalog backed by a database
+//
+// Managers are safe for concurrent use, a process should share one manager per database and close it at shutdown.
 type Manager struct {
-	db      *sql.DB
+	db      *database
 	connStr string
-	Bins    map[int64]*storage.Bin
-	Drivers map[string]storage.Driver
+
+	mu      sync.RWMutex // guards bins and drivers
+	bins    map[int64]*storage.Bin
+	drivers map[string]storage.Driver
 }
 
 // Gets a database manager, reusing a connection pool if one exists
 //
 // Don't worry, using this function doesn't make you a Karen ;)
 func GetManager(connStr string, pragmas map[string]string) (*Manager, error) {
+	managersMu.Lock()
+	defer managersMu.Unlock()
+
 	if connStr != ":memory:" {
-		if m, ok := Managers[connStr]; ok {
+		if m, ok := managers[connStr]; ok {
 			return m, nil
 		}
 	}
 
-	m := &Manager{
-		connStr: connStr,
-		Bins:    make(map[int64]*storage.Bin),
-		Drivers: make(map[string]storage.Driver),
-	}
-
 	db, err := getPool(connStr, pragmas)
 	if err != nil {
 		return nil, err
 	}
 
-	m.db = db
-	Managers[connStr] = m
+	m := &Manager{
+		db:      db,
+		connStr: connStr,
+		bins:    make(map[int64]*storage.Bin),
+		drivers: make(map[string]storage.Driver),
+	}
+	if connStr != ":memory:" {
+		managers[connStr] = m
+	}
 
 	return m, nil
 }
 
+// Initializes the database, migrating it to the latest schema if it is out of date
 func (m *Manager) Init() error {
-	// TODO: add field to avoid reinitialzing tables
+	version, err := schemaVersion(context.Background(), m.db)
+	if err != nil {
+		return err
+	}
+
+	if version == LatestSchemaVersion() {
+		return initSearch(m.db)
+	} else if version > LatestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, LatestSchemaVersion())
+	}
+
+	logger.Printf("Migrating database from schema version %d to %d\n", version, LatestSchemaVersion())
 	return InitTables(m.db)
 }
 
-// Closes a manager's database connection
+// Closes a manager's database connection, later calls to GetManager open a new connection pool
+//
+// Only close a manager once nothing else is using it, usually at shutdown.
 func (m *Manager) Close() error {
+	managersMu.Lock()
+	if managers[m.connStr] == m {
+		delete(managers, m.connStr)
+	}
+	managersMu.Unlock()
+
 	if err := m.db.Close(); err != nil {
 		logger.Printf("Failed to close connection: %s\n%v", m.connStr, err)
 		return err
 	}
-	m.db = nil
 
 	return nil
 }
 
-func init() {
-	Managers = make(map[string]*Manager)
+// Gets a cached bin
+func (m *Manager) cachedBin(id int64) (*storage.Bin, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	bin, ok := m.bins[id]
+	return bin, ok
+}
+
+// Caches a bin unless it was cached concurrently, returning the cached bin
+func (m *Manager) cacheBin(bin *storage.Bin) *storage.Bin {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cached, ok := m.bins[bin.Id]; ok {
+		return cached
+	}
+	bin.RegisterRoot()
+	m.bins[bin.Id] = bin
+
+	return bin
+}
+
+// Drops every cached bin, they are reloaded from the database when next requested
+func (m *Manager) InvalidateBins() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bins = make(map[int64]*storage.Bin)
+}
+
+// Gets a cached driver
+func (m *Manager) cachedDriver(name string) (storage.Driver, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	d, ok := m.drivers[name]
+	return d, ok
+}
+
+// Caches a driver unless it was cached concurrently, returning the cached driver
+func (m *Manager) cacheDriver(d storage.Driver) storage.Driver {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cached, ok := m.drivers[d.Name()]; ok {
+		return cached
+	}
+	m.drivers[d.Name()] = d
+
+	return d
 }
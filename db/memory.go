@@ -0,0 +1,1241 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"file-cellar/storage"
+	"fmt"
+	"html"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryFile struct {
+	info    storage.FileInfo
+	pathId  int64 // 0 for unversioned files
+	tags    map[string]bool
+	content string
+}
+
+type memoryPath struct {
+	binId   int64
+	name    string
+	current int64 // id of the current version, 0 if every version is in the trash
+}
+
+// A catalog held in memory, for tests and throwaway servers
+//
+// Records are copied in and out so callers see the same behaviour as a database backed catalog,
+// timestamps are truncated to seconds like they are when stored in a database.
+type MemoryCatalog struct {
+	mu sync.Mutex
+
+	drivers         map[string]storage.Driver
+	bins            map[int64]*storage.Bin
+	files           map[int64]*memoryFile
+	paths           map[int64]*memoryPath
+	derivatives     map[int64]*storage.Derivative
+	tags            map[string]bool
+	collections     map[int64]*storage.Collection
+	collectionFiles map[int64]map[int64]bool
+	accessLog       []*FileAccess
+	auditLog        []*AuditEntry
+	stats           []StatsRecord
+	statsRollups    map[statsRollupKey]*StatsRecord
+	webhooks        map[int64]*Webhook
+	deliveries      map[int64]*WebhookDelivery
+	events          []*EventRecord
+
+	lastDriverId     int64
+	lastBinId        int64
+	lastFileId       int64
+	lastPathId       int64
+	lastDerivativeId int64
+	lastCollectionId int64
+	lastAccessId     int64
+	lastAuditId      int64
+	lastWebhookId    int64
+	lastDeliveryId   int64
+	lastEventId      int64
+}
+
+var _ Catalog = (*MemoryCatalog)(nil)
+
+// Identifies the rollup of the stats of a source over a bucket
+type statsRollupKey struct {
+	resolution time.Duration
+	source     StatsSource
+	sourceId   int64
+	start      int64 // unix time of the start of the bucket
+}
+
+func NewMemoryCatalog() *MemoryCatalog {
+	return &MemoryCatalog{
+		drivers:         make(map[string]storage.Driver),
+		bins:            make(map[int64]*storage.Bin),
+		files:           make(map[int64]*memoryFile),
+		paths:           make(map[int64]*memoryPath),
+		derivatives:     make(map[int64]*storage.Derivative),
+		tags:            make(map[string]bool),
+		collections:     make(map[int64]*storage.Collection),
+		collectionFiles: make(map[int64]map[int64]bool),
+		webhooks:        make(map[int64]*Webhook),
+		deliveries:      make(map[int64]*WebhookDelivery),
+		statsRollups:    make(map[statsRollupKey]*StatsRecord),
+	}
+}
+
+func seconds(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return time.Unix(t.Unix(), 0)
+}
+
+func trashed(f *memoryFile) bool {
+	return !f.info.DeletedTimestamp.IsZero()
+}
+
+// Gets a file by its relative path, including files in the trash
+func (c *MemoryCatalog) file(uri string) *memoryFile {
+	for _, f := range c.files {
+		if f.info.RelPath == uri {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// Gets copies of the files matching a filter, sorted by order then by id
+func (c *MemoryCatalog) query(match func(*memoryFile) bool, order func(a, b *storage.FileInfo) int) []*storage.FileInfo {
+	files := make([]*storage.FileInfo, 0)
+	for _, f := range c.files {
+		if match(f) {
+			info := f.info
+			files = append(files, &info)
+		}
+	}
+
+	slices.SortFunc(files, func(a, b *storage.FileInfo) int {
+		if n := order(a, b); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.Id, b.Id)
+	})
+
+	return files
+}
+
+func newestFirst(a, b *storage.FileInfo) int {
+	return b.UploadTimestamp.Compare(a.UploadTimestamp)
+}
+
+// Gets the id of the newest version of a path not in the trash, ignoring a file
+func (c *MemoryCatalog) newestVersion(pathId int64, ignore int64) int64 {
+	var newest *memoryFile
+	for _, f := range c.files {
+		if f.pathId != pathId || f.info.Id == ignore || trashed(f) {
+			continue
+		}
+		if newest == nil || f.info.Version > newest.info.Version {
+			newest = f
+		}
+	}
+
+	if newest == nil {
+		return 0
+	}
+	return newest.info.Id
+}
+
+func (c *MemoryCatalog) AddDriver(ctx context.Context, d storage.Driver) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.drivers[d.Name()]; ok {
+		return false
+	}
+
+	c.lastDriverId++
+	d.SetId(c.lastDriverId)
+	c.drivers[d.Name()] = d
+
+	return true
+}
+
+func (c *MemoryCatalog) AddBin(ctx context.Context, bin *storage.Bin, driverID int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	known := false
+	for _, d := range c.drivers {
+		known = known || d.Id() == driverID
+	}
+	if !known {
+		return 0, fmt.Errorf("no driver with id %d", driverID)
+	}
+
+	for _, b := range c.bins {
+		if b.Name == bin.Name || b.Path.External == bin.Path.External {
+			return 0, fmt.Errorf("bin %s already exists", bin.Name)
+		}
+	}
+
+	c.lastBinId++
+	bin.Id = c.lastBinId
+	bin.RegisterRoot()
+	c.bins[bin.Id] = bin
+
+	return bin.Id, nil
+}
+
+func (c *MemoryCatalog) GetBin(ctx context.Context, id int64) (*storage.Bin, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bin, ok := c.bins[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return bin, nil
+}
+
+func (c *MemoryCatalog) ListBins(ctx context.Context) ([]*storage.Bin, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bins := make([]*storage.Bin, 0, len(c.bins))
+	for _, bin := range c.bins {
+		bins = append(bins, bin)
+	}
+	slices.SortFunc(bins, func(a, b *storage.Bin) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+
+	return bins, nil
+}
+
+// Stores a new file, the caller must hold the lock
+func (c *MemoryCatalog) insertFile(f *storage.FileInfo, pathId int64) error {
+	if f.Bin == nil {
+		return fmt.Errorf("file %s has no bin", f.RelPath)
+	} else if c.file(f.RelPath) != nil {
+		return fmt.Errorf("file %s already exists", f.RelPath)
+	}
+
+	c.lastFileId++
+	f.Id = c.lastFileId
+
+	record := &memoryFile{info: *f, pathId: pathId, tags: make(map[string]bool)}
+	record.info.UploadTimestamp = seconds(f.UploadTimestamp)
+	record.info.DeletedTimestamp = time.Time{}
+	record.info.Downloads = 0
+	record.info.AccessTimestamp = time.Time{}
+	if pathId == 0 {
+		record.info.LogicalPath = ""
+		record.info.Version = 0
+	}
+	c.files[f.Id] = record
+
+	return nil
+}
+
+func (c *MemoryCatalog) AddFile(ctx context.Context, f *storage.FileInfo) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.insertFile(f, 0)
+}
+
+func (c *MemoryCatalog) GetFile(ctx context.Context, uri string) (*storage.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.file(uri)
+	if f == nil || trashed(f) {
+		return nil, ErrNotFound
+	}
+	info := f.info
+
+	return &info, nil
+}
+
+func (c *MemoryCatalog) ListFiles(ctx context.Context, binId int64) ([]*storage.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.query(func(f *memoryFile) bool {
+		return f.info.Bin.Id == binId && !trashed(f)
+	}, newestFirst), nil
+}
+
+func (c *MemoryCatalog) SetDescription(ctx context.Context, uri string, description string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.file(uri)
+	if f == nil || trashed(f) {
+		return false, nil
+	}
+	f.info.Description = description
+
+	return true, nil
+}
+
+func (c *MemoryCatalog) SetName(ctx context.Context, uri string, name string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.file(uri)
+	if f == nil || trashed(f) {
+		return false, nil
+	}
+	f.info.Name = name
+
+	return true, nil
+}
+
+func (c *MemoryCatalog) RemoveFile(ctx context.Context, uri string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.file(uri)
+	if f == nil {
+		return false, nil
+	}
+
+	for id, d := range c.derivatives {
+		if d.ParentId == f.info.Id {
+			delete(c.derivatives, id)
+		}
+	}
+	for _, members := range c.collectionFiles {
+		delete(members, f.info.Id)
+	}
+	c.accessLog = slices.DeleteFunc(c.accessLog, func(a *FileAccess) bool {
+		return a.FileId == f.info.Id
+	})
+	if p, ok := c.paths[f.pathId]; ok && p.current == f.info.Id {
+		p.current = c.newestVersion(f.pathId, f.info.Id)
+	}
+	delete(c.files, f.info.Id)
+
+	return true, nil
+}
+
+func (c *MemoryCatalog) AddVersion(ctx context.Context, f *storage.FileInfo) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f.Bin == nil {
+		return fmt.Errorf("file %s has no bin", f.RelPath)
+	} else if c.file(f.RelPath) != nil {
+		return fmt.Errorf("file %s already exists", f.RelPath)
+	}
+
+	pathId := c.pathId(f.Bin.Id, f.LogicalPath)
+	if pathId == 0 {
+		c.lastPathId++
+		pathId = c.lastPathId
+		c.paths[pathId] = &memoryPath{binId: f.Bin.Id, name: f.LogicalPath}
+	}
+
+	var version int64
+	for _, other := range c.files {
+		if other.pathId == pathId {
+			version = max(version, other.info.Version)
+		}
+	}
+	f.Version = version + 1
+
+	if err := c.insertFile(f, pathId); err != nil {
+		return err
+	}
+	c.paths[pathId].current = f.Id
+
+	return nil
+}
+
+// Gets the id of a logical path, 0 if it does not exist
+func (c *MemoryCatalog) pathId(binId int64, path string) int64 {
+	for id, p := range c.paths {
+		if p.binId == binId && p.name == path {
+			return id
+		}
+	}
+
+	return 0
+}
+
+func (c *MemoryCatalog) GetVersion(ctx context.Context, binId int64, path string, version int64) (*storage.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pathId := c.pathId(binId, path)
+	if pathId == 0 {
+		return nil, ErrNotFound
+	}
+
+	for _, f := range c.files {
+		if f.pathId != pathId || trashed(f) {
+			continue
+		}
+		if (version == 0 && c.paths[pathId].current == f.info.Id) || (version != 0 && f.info.Version == version) {
+			info := f.info
+			return &info, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (c *MemoryCatalog) GetVersions(ctx context.Context, binId int64, path string) ([]*storage.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pathId := c.pathId(binId, path)
+	return c.query(func(f *memoryFile) bool {
+		return pathId != 0 && f.pathId == pathId && !trashed(f)
+	}, func(a, b *storage.FileInfo) int {
+		return cmp.Compare(b.Version, a.Version)
+	}), nil
+}
+
+func (c *MemoryCatalog) SetCurrentVersion(ctx context.Context, binId int64, path string, version int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pathId := c.pathId(binId, path)
+	for _, f := range c.files {
+		if pathId != 0 && f.pathId == pathId && f.info.Version == version && !trashed(f) {
+			c.paths[pathId].current = f.info.Id
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (c *MemoryCatalog) TrashFile(ctx context.Context, uri string, deleteTime time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.file(uri)
+	if f == nil || trashed(f) {
+		return false, nil
+	}
+	f.info.DeletedTimestamp = seconds(deleteTime)
+
+	if p, ok := c.paths[f.pathId]; ok && p.current == f.info.Id {
+		p.current = c.newestVersion(f.pathId, 0)
+	}
+
+	return true, nil
+}
+
+func (c *MemoryCatalog) RestoreFile(ctx context.Context, uri string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.file(uri)
+	if f == nil || !trashed(f) {
+		return false, nil
+	}
+	f.info.DeletedTimestamp = time.Time{}
+
+	if p, ok := c.paths[f.pathId]; ok && p.current == 0 {
+		p.current = f.info.Id
+	}
+
+	return true, nil
+}
+
+func (c *MemoryCatalog) GetTrashedFile(ctx context.Context, uri string) (*storage.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.file(uri)
+	if f == nil || !trashed(f) {
+		return nil, ErrNotFound
+	}
+	info := f.info
+
+	return &info, nil
+}
+
+func (c *MemoryCatalog) GetTrashedVersion(ctx context.Context, binId int64, path string, version int64) (*storage.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pathId := c.pathId(binId, path)
+	var newest *memoryFile
+	for _, f := range c.files {
+		if pathId == 0 || f.pathId != pathId || !trashed(f) || (version != 0 && f.info.Version != version) {
+			continue
+		}
+		if newest == nil || f.info.Version > newest.info.Version {
+			newest = f
+		}
+	}
+	if newest == nil {
+		return nil, ErrNotFound
+	}
+	info := newest.info
+
+	return &info, nil
+}
+
+func (c *MemoryCatalog) GetTrash(ctx context.Context, before time.Time) ([]*storage.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.query(func(f *memoryFile) bool {
+		return trashed(f) && f.info.DeletedTimestamp.Unix() <= before.Unix()
+	}, func(a, b *storage.FileInfo) int {
+		return a.DeletedTimestamp.Compare(b.DeletedTimestamp)
+	}), nil
+}
+
+func (c *MemoryCatalog) AddDerivative(ctx context.Context, d *storage.Derivative) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.files[d.ParentId]; !ok {
+		return fmt.Errorf("no file with id %d", d.ParentId)
+	} else if c.file(d.RelPath) != nil {
+		return fmt.Errorf("file %s already exists", d.RelPath)
+	}
+	for _, other := range c.derivatives {
+		if other.ParentId == d.ParentId && other.Kind == d.Kind && other.Param == d.Param {
+			return fmt.Errorf("%s %d of file %d already exists", d.Kind, d.Param, d.ParentId)
+		} else if other.RelPath == d.RelPath {
+			return fmt.Errorf("derivative %s already exists", d.RelPath)
+		}
+	}
+
+	c.lastDerivativeId++
+	d.Id = c.lastDerivativeId
+	record := *d
+	record.UploadTimestamp = seconds(d.UploadTimestamp)
+	c.derivatives[d.Id] = &record
+
+	return nil
+}
+
+func (c *MemoryCatalog) GetDerivative(ctx context.Context, fileId int64, kind string, param int64) (*storage.Derivative, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, d := range c.derivatives {
+		if d.ParentId == fileId && d.Kind == kind && d.Param == param {
+			derivative := *d
+			return &derivative, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (c *MemoryCatalog) GetDerivatives(ctx context.Context, fileId int64) ([]*storage.Derivative, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	derivatives := make([]*storage.Derivative, 0)
+	for _, d := range c.derivatives {
+		if d.ParentId == fileId {
+			derivative := *d
+			derivatives = append(derivatives, &derivative)
+		}
+	}
+	slices.SortFunc(derivatives, func(a, b *storage.Derivative) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+
+	return derivatives, nil
+}
+
+func (c *MemoryCatalog) TagFile(ctx context.Context, uri string, tag string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.file(uri)
+	if f == nil || trashed(f) {
+		return ErrNotFound
+	}
+	c.tags[tag] = true
+	f.tags[tag] = true
+
+	return nil
+}
+
+func (c *MemoryCatalog) UntagFile(ctx context.Context, uri string, tag string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.file(uri)
+	if f == nil || !f.tags[tag] {
+		return false, nil
+	}
+	delete(f.tags, tag)
+
+	return true, nil
+}
+
+func (c *MemoryCatalog) GetTags(ctx context.Context, uri string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tags := make([]string, 0)
+	if f := c.file(uri); f != nil {
+		for tag := range f.tags {
+			tags = append(tags, tag)
+		}
+	}
+	slices.Sort(tags)
+
+	return tags, nil
+}
+
+func (c *MemoryCatalog) ListTags(ctx context.Context) (map[string]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tags := make(map[string]int64)
+	for tag := range c.tags {
+		tags[tag] = 0
+	}
+	for _, f := range c.files {
+		if trashed(f) {
+			continue
+		}
+		for tag := range f.tags {
+			tags[tag]++
+		}
+	}
+
+	return tags, nil
+}
+
+func (c *MemoryCatalog) GetTaggedFiles(ctx context.Context, tag string) ([]*storage.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.query(func(f *memoryFile) bool {
+		return f.tags[tag] && !trashed(f)
+	}, newestFirst), nil
+}
+
+func (c *MemoryCatalog) AddCollection(ctx context.Context, collection *storage.Collection) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, other := range c.collections {
+		if other.ShareToken == collection.ShareToken {
+			return fmt.Errorf("collection share token already in use")
+		}
+	}
+
+	c.lastCollectionId++
+	collection.Id = c.lastCollectionId
+	record := *collection
+	record.CreatedTimestamp = seconds(collection.CreatedTimestamp)
+	c.collections[collection.Id] = &record
+	c.collectionFiles[collection.Id] = make(map[int64]bool)
+
+	return nil
+}
+
+func (c *MemoryCatalog) RemoveCollection(ctx context.Context, id int64) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.collections[id]; !ok {
+		return false, nil
+	}
+	delete(c.collections, id)
+	delete(c.collectionFiles, id)
+
+	return true, nil
+}
+
+func (c *MemoryCatalog) AddToCollection(ctx context.Context, collectionId int64, uri string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members, ok := c.collectionFiles[collectionId]
+	f := c.file(uri)
+	if !ok || f == nil {
+		return ErrNotFound
+	} else if trashed(f) && !members[f.info.Id] {
+		return ErrNotFound
+	}
+	members[f.info.Id] = true
+
+	return nil
+}
+
+func (c *MemoryCatalog) RemoveFromCollection(ctx context.Context, collectionId int64, uri string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members := c.collectionFiles[collectionId]
+	f := c.file(uri)
+	if f == nil || !members[f.info.Id] {
+		return false, nil
+	}
+	delete(members, f.info.Id)
+
+	return true, nil
+}
+
+func (c *MemoryCatalog) GetCollection(ctx context.Context, id int64) (*storage.Collection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	collection, ok := c.collections[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	record := *collection
+
+	return &record, nil
+}
+
+func (c *MemoryCatalog) GetSharedCollection(ctx context.Context, token string) (*storage.Collection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, collection := range c.collections {
+		if collection.ShareToken == token {
+			record := *collection
+			return &record, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (c *MemoryCatalog) ListCollections(ctx context.Context) ([]*storage.Collection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	collections := make([]*storage.Collection, 0, len(c.collections))
+	for _, collection := range c.collections {
+		record := *collection
+		collections = append(collections, &record)
+	}
+	slices.SortFunc(collections, func(a, b *storage.Collection) int {
+		if n := strings.Compare(a.Name, b.Name); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.Id, b.Id)
+	})
+
+	return collections, nil
+}
+
+func (c *MemoryCatalog) GetCollectionFiles(ctx context.Context, collectionId int64) ([]*storage.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members := c.collectionFiles[collectionId]
+	return c.query(func(f *memoryFile) bool {
+		return members[f.info.Id] && !trashed(f)
+	}, func(a, b *storage.FileInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	}), nil
+}
+
+func (c *MemoryCatalog) IndexContent(ctx context.Context, fileId int64, content string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.files[fileId]; ok {
+		f.content = content
+	}
+
+	return nil
+}
+
+// Searches for files whose name, description, tags or content contain every term of a query, newest first
+func (c *MemoryCatalog) Search(ctx context.Context, query string, binId int64, limit int) ([]SearchResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	files := c.query(func(f *memoryFile) bool {
+		if trashed(f) || (binId >= 0 && f.info.Bin.Id != binId) {
+			return false
+		}
+
+		text := []string{f.info.Name, f.info.Description, f.content}
+		for tag := range f.tags {
+			text = append(text, tag)
+		}
+		searchable := strings.ToLower(strings.Join(text, "\n"))
+		for _, term := range terms {
+			if !strings.Contains(searchable, term) {
+				return false
+			}
+		}
+		return true
+	}, newestFirst)
+
+	results := make([]SearchResult, 0, min(len(files), max(limit, 0)))
+	for _, f := range files {
+		if len(results) >= limit {
+			break
+		}
+		results = append(results, SearchResult{File: f, NameHighlight: html.EscapeString(f.Name), DescriptionHighlight: html.EscapeString(f.Description)})
+	}
+
+	return results, nil
+}
+
+func (c *MemoryCatalog) RecordAccess(ctx context.Context, a *FileAccess) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.files[a.FileId]
+	if !ok {
+		return fmt.Errorf("no file with id %d", a.FileId)
+	}
+
+	c.lastAccessId++
+	a.Id = c.lastAccessId
+	record := *a
+	record.Timestamp = seconds(a.Timestamp)
+	c.accessLog = append(c.accessLog, &record)
+
+	f.info.Downloads++
+	if record.Timestamp.After(f.info.AccessTimestamp) {
+		f.info.AccessTimestamp = record.Timestamp
+	}
+
+	return nil
+}
+
+func (c *MemoryCatalog) GetAccessLog(ctx context.Context, uri string, limit int) ([]*FileAccess, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	accesses := make([]*FileAccess, 0)
+	f := c.file(uri)
+	if f == nil {
+		return accesses, nil
+	}
+
+	for _, a := range c.accessLog {
+		if a.FileId == f.info.Id {
+			record := *a
+			accesses = append(accesses, &record)
+		}
+	}
+	slices.SortFunc(accesses, func(a, b *FileAccess) int {
+		if n := b.Timestamp.Compare(a.Timestamp); n != 0 {
+			return n
+		}
+		return cmp.Compare(b.Id, a.Id)
+	})
+
+	return accesses[:min(len(accesses), max(limit, 0))], nil
+}
+
+// Gets the time a file was last accessed, or uploaded if it was never accessed
+func lastUsed(f *storage.FileInfo) time.Time {
+	if f.AccessTimestamp.IsZero() {
+		return f.UploadTimestamp
+	}
+	return f.AccessTimestamp
+}
+
+func (c *MemoryCatalog) GetLeastRecentlyUsed(ctx context.Context, binId int64, before time.Time, limit int) ([]*storage.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files := c.query(func(f *memoryFile) bool {
+		return !trashed(f) && (binId < 0 || f.info.Bin.Id == binId) && lastUsed(&f.info).Unix() < before.Unix()
+	}, func(a, b *storage.FileInfo) int {
+		return lastUsed(a).Compare(lastUsed(b))
+	})
+
+	return files[:min(len(files), max(limit, 0))], nil
+}
+
+func (c *MemoryCatalog) AddAuditEntry(ctx context.Context, e *AuditEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastAuditId++
+	e.Id = c.lastAuditId
+	record := *e
+	record.Timestamp = seconds(e.Timestamp)
+	record.Before = slices.Clone(e.Before)
+	record.After = slices.Clone(e.After)
+	c.auditLog = append(c.auditLog, &record)
+
+	return nil
+}
+
+func (c *MemoryCatalog) GetAuditLog(ctx context.Context, q AuditQuery) ([]*AuditEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]*AuditEntry, 0)
+	for _, e := range c.auditLog {
+		if q.matches(e) {
+			record := *e
+			record.Before = slices.Clone(e.Before)
+			record.After = slices.Clone(e.After)
+			entries = append(entries, &record)
+		}
+	}
+	slices.SortFunc(entries, func(a, b *AuditEntry) int {
+		if n := b.Timestamp.Compare(a.Timestamp); n != 0 {
+			return n
+		}
+		return cmp.Compare(b.Id, a.Id)
+	})
+	if q.Limit > 0 {
+		entries = entries[:min(len(entries), q.Limit)]
+	}
+
+	return entries, nil
+}
+
+func (c *MemoryCatalog) AddWebhook(ctx context.Context, h *Webhook) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastWebhookId++
+	h.Id = c.lastWebhookId
+	record := *h
+	record.Events = slices.Clone(h.Events)
+	record.CreatedTimestamp = seconds(h.CreatedTimestamp)
+	c.webhooks[h.Id] = &record
+
+	return nil
+}
+
+func (c *MemoryCatalog) RemoveWebhook(ctx context.Context, id int64) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.webhooks[id]; !ok {
+		return false, nil
+	}
+	delete(c.webhooks, id)
+	for deliveryId, d := range c.deliveries {
+		if d.WebhookId == id {
+			delete(c.deliveries, deliveryId)
+		}
+	}
+
+	return true, nil
+}
+
+func (c *MemoryCatalog) GetWebhook(ctx context.Context, id int64) (*Webhook, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.webhooks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	record := *h
+	record.Events = slices.Clone(h.Events)
+
+	return &record, nil
+}
+
+func (c *MemoryCatalog) ListWebhooks(ctx context.Context) ([]*Webhook, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	webhooks := make([]*Webhook, 0, len(c.webhooks))
+	for _, h := range c.webhooks {
+		record := *h
+		record.Events = slices.Clone(h.Events)
+		webhooks = append(webhooks, &record)
+	}
+	slices.SortFunc(webhooks, func(a, b *Webhook) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+
+	return webhooks, nil
+}
+
+func (c *MemoryCatalog) QueueEvent(ctx context.Context, eventType string, payload []byte, at time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	queued := 0
+	for _, h := range c.webhooks {
+		if !h.Accepts(eventType) {
+			continue
+		}
+
+		c.lastDeliveryId++
+		c.deliveries[c.lastDeliveryId] = &WebhookDelivery{
+			Id:                   c.lastDeliveryId,
+			WebhookId:            h.Id,
+			Event:                eventType,
+			Payload:              slices.Clone(payload),
+			CreatedTimestamp:     seconds(at),
+			Status:               DeliveryPending,
+			NextAttemptTimestamp: seconds(at),
+		}
+		queued++
+	}
+
+	return queued, nil
+}
+
+// Gets copies of the deliveries matching a filter, filled in with the url and secret of their webhook
+func (c *MemoryCatalog) queryDeliveries(match func(*WebhookDelivery) bool, order func(a, b *WebhookDelivery) int, limit int) []*WebhookDelivery {
+	deliveries := make([]*WebhookDelivery, 0)
+	for _, d := range c.deliveries {
+		if !match(d) {
+			continue
+		}
+		record := *d
+		record.Payload = slices.Clone(d.Payload)
+		record.URL = c.webhooks[d.WebhookId].URL
+		record.Secret = c.webhooks[d.WebhookId].Secret
+		deliveries = append(deliveries, &record)
+	}
+	slices.SortFunc(deliveries, order)
+
+	return deliveries[:min(len(deliveries), max(limit, 0))]
+}
+
+func (c *MemoryCatalog) GetDueDeliveries(ctx context.Context, now time.Time, limit int) ([]*WebhookDelivery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.queryDeliveries(func(d *WebhookDelivery) bool {
+		return d.Status == DeliveryPending && d.NextAttemptTimestamp.Unix() <= now.Unix()
+	}, func(a, b *WebhookDelivery) int {
+		if n := a.NextAttemptTimestamp.Compare(b.NextAttemptTimestamp); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.Id, b.Id)
+	}, limit), nil
+}
+
+func (c *MemoryCatalog) GetDeliveries(ctx context.Context, webhookId int64, limit int) ([]*WebhookDelivery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.queryDeliveries(func(d *WebhookDelivery) bool {
+		return d.WebhookId == webhookId
+	}, func(a, b *WebhookDelivery) int {
+		if n := b.CreatedTimestamp.Compare(a.CreatedTimestamp); n != 0 {
+			return n
+		}
+		return cmp.Compare(b.Id, a.Id)
+	}, limit), nil
+}
+
+func (c *MemoryCatalog) UpdateDelivery(ctx context.Context, d *WebhookDelivery) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	record, ok := c.deliveries[d.Id]
+	if !ok {
+		return nil
+	}
+	record.Status = d.Status
+	record.Attempts = d.Attempts
+	record.NextAttemptTimestamp = seconds(d.NextAttemptTimestamp)
+	record.LastError = d.LastError
+
+	return nil
+}
+
+func (c *MemoryCatalog) RemoveFinishedDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var removed int64
+	for id, d := range c.deliveries {
+		if d.Status != DeliveryPending && d.CreatedTimestamp.Unix() < before.Unix() {
+			delete(c.deliveries, id)
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+func (c *MemoryCatalog) AddEvent(ctx context.Context, e *EventRecord, retain int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastEventId++
+	e.Id = c.lastEventId
+	record := *e
+	record.Timestamp = seconds(e.Timestamp)
+	record.Data = slices.Clone(e.Data)
+	c.events = append(c.events, &record)
+	if len(c.events) > max(retain, 0) {
+		c.events = slices.Clone(c.events[len(c.events)-max(retain, 0):])
+	}
+
+	return nil
+}
+
+func (c *MemoryCatalog) GetEvents(ctx context.Context, afterId int64, binId int64, limit int) ([]*EventRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	events := make([]*EventRecord, 0)
+	for _, e := range c.events {
+		if len(events) == max(limit, 0) {
+			break
+		}
+		if e.Id > afterId && (binId < 0 || e.BinId == binId) {
+			record := *e
+			record.Data = slices.Clone(e.Data)
+			events = append(events, &record)
+		}
+	}
+
+	return events, nil
+}
+
+func (c *MemoryCatalog) LastEventId(ctx context.Context) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.events) == 0 {
+		return 0, nil
+	}
+	return c.events[len(c.events)-1].Id, nil
+}
+
+func (c *MemoryCatalog) AddStats(ctx context.Context, records []StatsRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, r := range records {
+		r.Timestamp = seconds(r.Timestamp)
+		c.stats = append(c.stats, r)
+
+		for _, resolution := range rollupResolutions {
+			bucket := bucketSeconds(resolution)
+			key := statsRollupKey{resolution, r.Source, r.SourceId, r.Timestamp.Unix() / bucket * bucket}
+			rollup, ok := c.statsRollups[key]
+			if !ok {
+				rollup = &StatsRecord{Source: r.Source, SourceId: r.SourceId, Timestamp: time.Unix(key.start, 0)}
+				c.statsRollups[key] = rollup
+			}
+			rollup.Add(r.Stats)
+		}
+	}
+
+	return nil
+}
+
+func (c *MemoryCatalog) GetStats(ctx context.Context, source StatsSource, sourceId int64, from time.Time, to time.Time, resolution time.Duration) ([]StatsRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bucket := bucketSeconds(resolution)
+	start := from.Unix()
+	stats := c.stats
+	if slices.Contains(rollupResolutions, resolution) {
+		start = start / bucket * bucket
+		stats = make([]StatsRecord, 0)
+		for key, rollup := range c.statsRollups {
+			if key.resolution == resolution {
+				stats = append(stats, *rollup)
+			}
+		}
+	}
+
+	buckets := make(map[int64]*StatsRecord)
+	for _, r := range stats {
+		if r.Source != source || (sourceId >= 0 && r.SourceId != sourceId) {
+			continue
+		}
+		if r.Timestamp.Unix() < start || r.Timestamp.Unix() > to.Unix() {
+			continue
+		}
+
+		start := r.Timestamp.Unix() / bucket * bucket
+		b, ok := buckets[start]
+		if !ok {
+			b = &StatsRecord{Source: source, SourceId: sourceId, Timestamp: time.Unix(start, 0)}
+			buckets[start] = b
+		}
+		b.Add(r.Stats)
+	}
+
+	records := make([]StatsRecord, 0, len(buckets))
+	for _, b := range buckets {
+		records = append(records, *b)
+	}
+	slices.SortFunc(records, func(a, b StatsRecord) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	return records, nil
+}
+
+func (c *MemoryCatalog) PruneStats(ctx context.Context, resolution time.Duration, before time.Time) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pruned := int64(0)
+	if resolution == RawResolution {
+		kept := len(c.stats)
+		c.stats = slices.DeleteFunc(c.stats, func(r StatsRecord) bool {
+			return r.Timestamp.Unix() < before.Unix()
+		})
+		return int64(kept - len(c.stats)), nil
+	}
+
+	for key := range c.statsRollups {
+		if key.resolution == resolution && key.start < before.Unix() {
+			delete(c.statsRollups, key)
+			pruned++
+		}
+	}
+
+	return pruned, nil
+}
+
+func (c *MemoryCatalog) GetBinUsage(ctx context.Context) ([]BinUsage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	usage := make([]BinUsage, 0, len(c.bins))
+	for id := range c.bins {
+		u := BinUsage{BinId: id}
+		for _, f := range c.files {
+			if f.info.Bin.Id == id {
+				u.Files++
+				u.Bytes += f.info.Size
+			}
+		}
+		usage = append(usage, u)
+	}
+	slices.SortFunc(usage, func(a, b BinUsage) int {
+		return cmp.Compare(a.BinId, b.BinId)
+	})
+
+	return usage, nil
+}
+
+func (c *MemoryCatalog) Close() error {
+	return nil
+}
@@ -0,0 +1,600 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// A versioned change to the database schema
+//
+// Each migration is applied in a single transaction alongside its record in schema_migrations.
+type migration struct {
+	version int
+	name    string
+	up      []string // statements applying the migration
+	down    []string // statements reverting the migration
+
+	extraUp     map[dialect][]string // run after up in dialects needing statements the others can't run
+	dialectDown map[dialect][]string // replaces down for dialects needing different statements
+}
+
+// The state of a migration in a database
+type MigrationStatus struct {
+	Version          int
+	Name             string
+	Applied          bool
+	AppliedTimestamp time.Time // zero unless applied
+}
+
+// files as created by the initial schema and versioned file types, used when dropping later columns
+const filesV2 = `
+    CREATE TABLE files (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    binID INTEGER,
+    name TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    type TEXT,
+    size INTEGER NOT NULL,
+    relPath TEXT UNIQUE NOT NULL,
+    uploadTimestamp INTEGER,
+    FOREIGN KEY(binID) REFERENCES bins(id)
+    )`
+
+// Ordered migrations, versions must be sequential starting from 1
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		// tables may exist in databases created before migrations were tracked
+		up: []string{`
+        CREATE TABLE IF NOT EXISTS serverConfig (
+        key TEXT UNIQUE NOT NULL,
+        value TEXT
+        )`, `
+        CREATE TABLE IF NOT EXISTS drivers(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT UNIQUE NOT NULL
+        )`, `
+        CREATE TABLE IF NOT EXISTS bins (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        driverID INTEGER,
+        name TEXT UNIQUE NOT NULL,
+        externalURL TEXT UNIQUE NOT NULL,
+        internalURL TEXT NOT NULL,
+        redirect INTEGER NOT NULL CHECK(redirect IN (0, 1)),
+        FOREIGN KEY(driverID) REFERENCES drivers(id)
+        )`, `
+        CREATE TABLE IF NOT EXISTS files (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        binID INTEGER,
+        name TEXT NOT NULL,
+        hash TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        relPath TEXT UNIQUE NOT NULL,
+        uploadTimestamp INTEGER,
+        FOREIGN KEY(binID) REFERENCES bins(id)
+        )`,
+			"CREATE INDEX IF NOT EXISTS idx_files_date ON files(uploadTimestamp)",
+			"CREATE INDEX IF NOT EXISTS idx_files_name on files(name)",
+		},
+		down: []string{
+			"DROP TABLE files",
+			"DROP TABLE bins",
+			"DROP TABLE drivers",
+			"DROP TABLE serverConfig",
+		},
+	},
+	{
+		version: 2,
+		name:    "file types and derivatives",
+		up: []string{
+			"ALTER TABLE files ADD COLUMN type TEXT", `
+        CREATE TABLE derivatives (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        fileID INTEGER NOT NULL,
+        binID INTEGER NOT NULL,
+        kind TEXT NOT NULL,
+        param INTEGER NOT NULL,
+        hash TEXT NOT NULL,
+        type TEXT,
+        size INTEGER NOT NULL,
+        relPath TEXT UNIQUE NOT NULL,
+        createdTimestamp INTEGER,
+        UNIQUE(fileID, kind, param),
+        FOREIGN KEY(fileID) REFERENCES files(id) ON DELETE CASCADE,
+        FOREIGN KEY(binID) REFERENCES bins(id)
+        )`,
+		},
+		down: []string{
+			"DROP TABLE derivatives",
+			"ALTER TABLE files DROP COLUMN type",
+		},
+	},
+	{
+		version: 3,
+		name:    "versioned paths",
+		up: []string{`
+        CREATE TABLE paths (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        binID INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        currentFileID INTEGER,
+        UNIQUE(binID, name),
+        FOREIGN KEY(binID) REFERENCES bins(id),
+        FOREIGN KEY(currentFileID) REFERENCES files(id)
+        )`,
+			"ALTER TABLE files ADD COLUMN pathID INTEGER REFERENCES paths(id)",
+			"ALTER TABLE files ADD COLUMN version INTEGER",
+			"CREATE UNIQUE INDEX idx_files_version on files(pathID, version)",
+		},
+		down: []string{
+			"DROP INDEX idx_files_version",
+			"ALTER TABLE files DROP COLUMN version",
+			"ALTER TABLE files DROP COLUMN pathID",
+			"DROP TABLE paths",
+		},
+		// sqlite cannot drop columns used by foreign keys, so files is rebuilt
+		dialectDown: map[dialect][]string{sqliteDialect: {
+			"DROP INDEX idx_files_version",
+			"ALTER TABLE files RENAME TO filesV3",
+			filesV2,
+			`INSERT INTO files (id, binID, name, hash, type, size, relPath, uploadTimestamp)
+            SELECT id, binID, name, hash, type, size, relPath, uploadTimestamp FROM filesV3`,
+			"DROP TABLE filesV3",
+			"CREATE INDEX idx_files_date ON files(uploadTimestamp)",
+			"CREATE INDEX idx_files_name on files(name)",
+			"DROP TABLE paths",
+		}},
+	},
+	{
+		version: 4,
+		name:    "trash",
+		up: []string{
+			"ALTER TABLE files ADD COLUMN deletedTimestamp INTEGER",
+			"CREATE INDEX idx_files_deleted on files(deletedTimestamp)",
+		},
+		down: []string{
+			"DROP INDEX idx_files_deleted",
+			"ALTER TABLE files DROP COLUMN deletedTimestamp",
+		},
+	},
+	{
+		version: 5,
+		name:    "tags and collections",
+		up: []string{`
+        CREATE TABLE tags (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT UNIQUE NOT NULL
+        )`, `
+        CREATE TABLE fileTags (
+        fileID INTEGER NOT NULL,
+        tagID INTEGER NOT NULL,
+        PRIMARY KEY(fileID, tagID),
+        FOREIGN KEY(fileID) REFERENCES files(id) ON DELETE CASCADE,
+        FOREIGN KEY(tagID) REFERENCES tags(id) ON DELETE CASCADE
+        )`, `
+        CREATE TABLE collections (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL,
+        shareToken TEXT UNIQUE NOT NULL,
+        createdTimestamp INTEGER
+        )`, `
+        CREATE TABLE collectionFiles (
+        collectionID INTEGER NOT NULL,
+        fileID INTEGER NOT NULL,
+        PRIMARY KEY(collectionID, fileID),
+        FOREIGN KEY(collectionID) REFERENCES collections(id) ON DELETE CASCADE,
+        FOREIGN KEY(fileID) REFERENCES files(id) ON DELETE CASCADE
+        )`,
+			"CREATE INDEX idx_fileTags_tag on fileTags(tagID)",
+		},
+		down: []string{
+			"DROP TABLE collectionFiles",
+			"DROP TABLE collections",
+			"DROP TABLE fileTags",
+			"DROP TABLE tags",
+		},
+	},
+	{
+		version: 6,
+		name:    "file descriptions",
+		up: []string{
+			"ALTER TABLE files ADD COLUMN description TEXT",
+		},
+		down: []string{
+			"ALTER TABLE files DROP COLUMN description",
+		},
+		// the search index depends on the whole schema, initSearch rebuilds it once the schema is current
+		dialectDown: map[dialect][]string{sqliteDialect: {
+			"DROP TABLE IF EXISTS filesSearch",
+			"DROP TRIGGER IF EXISTS trg_files_search_insert",
+			"DROP TRIGGER IF EXISTS trg_files_search_update",
+			"DROP TRIGGER IF EXISTS trg_files_search_delete",
+			"DROP TRIGGER IF EXISTS trg_fileTags_search_insert",
+			"DROP TRIGGER IF EXISTS trg_fileTags_search_delete",
+			"ALTER TABLE files DROP COLUMN description",
+		}},
+	},
+	{
+		version: 7,
+		name:    "usage statistics",
+		up: []string{`
+        CREATE TABLE stats (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        source TEXT NOT NULL,
+        sourceID INTEGER NOT NULL,
+        recordedTimestamp INTEGER NOT NULL,
+        uploaded INTEGER NOT NULL,
+        downloaded INTEGER NOT NULL,
+        redirected INTEGER NOT NULL,
+        deleted INTEGER NOT NULL,
+        failed INTEGER NOT NULL,
+        uploadedBytes INTEGER NOT NULL,
+        downloadedBytes INTEGER NOT NULL,
+        deletedBytes INTEGER NOT NULL
+        )`,
+			"CREATE INDEX idx_stats_source on stats(source, sourceID, recordedTimestamp)",
+		},
+		down: []string{
+			"DROP TABLE stats",
+		},
+	},
+	{
+		version: 8,
+		name:    "access log",
+		up: []string{`
+        CREATE TABLE accessLog (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        fileID INTEGER NOT NULL,
+        accessTimestamp INTEGER NOT NULL,
+        clientIP TEXT NOT NULL,
+        userAgent TEXT NOT NULL,
+        bytesSent INTEGER NOT NULL,
+        byteRange TEXT NOT NULL,
+        redirected INTEGER NOT NULL,
+        FOREIGN KEY(fileID) REFERENCES files(id) ON DELETE CASCADE
+        )`,
+			"CREATE INDEX idx_accessLog_file on accessLog(fileID, accessTimestamp)",
+			"ALTER TABLE files ADD COLUMN downloadCount INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE files ADD COLUMN lastAccessTimestamp INTEGER",
+		},
+		down: []string{
+			"DROP TABLE accessLog",
+			"ALTER TABLE files DROP COLUMN lastAccessTimestamp",
+			"ALTER TABLE files DROP COLUMN downloadCount",
+		},
+	},
+	{
+		version: 9,
+		name:    "audit log",
+		up: []string{`
+        CREATE TABLE auditLog (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        auditTimestamp INTEGER NOT NULL,
+        actor TEXT NOT NULL,
+        action TEXT NOT NULL,
+        target TEXT NOT NULL,
+        beforeState TEXT,
+        afterState TEXT
+        )`,
+			"CREATE INDEX idx_auditLog_timestamp on auditLog(auditTimestamp)",
+			"CREATE INDEX idx_auditLog_target on auditLog(target)",
+		},
+		// the audit log is append only
+		extraUp: map[dialect][]string{
+			sqliteDialect: {`
+        CREATE TRIGGER trg_auditLog_no_update BEFORE UPDATE ON auditLog BEGIN
+            SELECT RAISE(ABORT, 'the audit log is append only');
+        END`, `
+        CREATE TRIGGER trg_auditLog_no_delete BEFORE DELETE ON auditLog BEGIN
+            SELECT RAISE(ABORT, 'the audit log is append only');
+        END`,
+			},
+			postgresDialect: {`
+        CREATE FUNCTION auditLog_append_only() RETURNS trigger AS $$
+        BEGIN
+            RAISE EXCEPTION 'the audit log is append only';
+        END
+        $$ LANGUAGE plpgsql`, `
+        CREATE TRIGGER trg_auditLog_append_only BEFORE UPDATE OR DELETE ON auditLog
+        FOR EACH ROW EXECUTE FUNCTION auditLog_append_only()`,
+			},
+		},
+		down: []string{
+			"DROP TABLE auditLog",
+		},
+		dialectDown: map[dialect][]string{postgresDialect: {
+			"DROP TABLE auditLog",
+			"DROP FUNCTION auditLog_append_only",
+		}},
+	},
+	{
+		version: 10,
+		name:    "webhooks",
+		up: []string{`
+        CREATE TABLE webhooks (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        url TEXT NOT NULL,
+        secret TEXT NOT NULL,
+        events TEXT NOT NULL,
+        createdTimestamp INTEGER NOT NULL
+        )`, `
+        CREATE TABLE webhookDeliveries (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        webhookID INTEGER NOT NULL,
+        event TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        createdTimestamp INTEGER NOT NULL,
+        status TEXT NOT NULL,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        nextAttemptTimestamp INTEGER NOT NULL,
+        lastError TEXT NOT NULL DEFAULT '',
+        FOREIGN KEY(webhookID) REFERENCES webhooks(id) ON DELETE CASCADE
+        )`,
+			"CREATE INDEX idx_webhookDeliveries_due on webhookDeliveries(status, nextAttemptTimestamp)",
+			"CREATE INDEX idx_webhookDeliveries_webhook on webhookDeliveries(webhookID, createdTimestamp)",
+		},
+		down: []string{
+			"DROP TABLE webhookDeliveries",
+			"DROP TABLE webhooks",
+		},
+	},
+	{
+		version: 11,
+		name:    "event log",
+		up: []string{`
+        CREATE TABLE events (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        eventType TEXT NOT NULL,
+        binID INTEGER NOT NULL,
+        eventTimestamp INTEGER NOT NULL,
+        actor TEXT NOT NULL,
+        data TEXT NOT NULL
+        )`,
+			"CREATE INDEX idx_events_bin on events(binID, id)",
+		},
+		down: []string{
+			"DROP TABLE events",
+		},
+	},
+	{
+		version: 12,
+		name:    "usage statistic rollups",
+		up: []string{`
+        CREATE TABLE statsRollups (
+        source TEXT NOT NULL,
+        sourceID INTEGER NOT NULL,
+        resolution INTEGER NOT NULL,
+        bucketTimestamp INTEGER NOT NULL,
+        uploaded INTEGER NOT NULL,
+        downloaded INTEGER NOT NULL,
+        redirected INTEGER NOT NULL,
+        deleted INTEGER NOT NULL,
+        failed INTEGER NOT NULL,
+        uploadedBytes INTEGER NOT NULL,
+        downloadedBytes INTEGER NOT NULL,
+        deletedBytes INTEGER NOT NULL,
+        PRIMARY KEY (source, sourceID, resolution, bucketTimestamp)
+        )`, `
+        INSERT INTO statsRollups
+        SELECT source, sourceID, 3600, (recordedTimestamp / 3600) * 3600, SUM(uploaded), SUM(downloaded),
+        SUM(redirected), SUM(deleted), SUM(failed), SUM(uploadedBytes), SUM(downloadedBytes), SUM(deletedBytes)
+        FROM stats
+        GROUP BY 1, 2, 3, 4`, `
+        INSERT INTO statsRollups
+        SELECT source, sourceID, 86400, (recordedTimestamp / 86400) * 86400, SUM(uploaded), SUM(downloaded),
+        SUM(redirected), SUM(deleted), SUM(failed), SUM(uploadedBytes), SUM(downloadedBytes), SUM(deletedBytes)
+        FROM stats
+        GROUP BY 1, 2, 3, 4`,
+			"CREATE INDEX idx_stats_recorded on stats(recordedTimestamp)",
+		},
+		down: []string{
+			"DROP INDEX idx_stats_recorded",
+			"DROP TABLE statsRollups",
+		},
+	},
+}
+
+// Gets the version of the newest migration
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Gets the statements applying or reverting a migration in a dialect
+func (m migration) statements(d dialect, up bool) []string {
+	statements := slices.Concat(m.up, m.extraUp[d])
+	if !up {
+		statements = m.down
+		if override, ok := m.dialectDown[d]; ok {
+			statements = override
+		}
+	}
+
+	translated := make([]string, len(statements))
+	for i, statement := range statements {
+		translated[i] = d.ddl(statement)
+	}
+
+	return translated
+}
+
+func createMigrationsTable(ctx context.Context, db *database) error {
+	_, err := db.ExecContext(ctx, db.dialect.ddl(`
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    appliedTimestamp INTEGER NOT NULL
+    )`))
+
+	return err
+}
+
+// Gets the version of the newest migration applied to a database, 0 if none are applied
+func schemaVersion(ctx context.Context, db *database) (int, error) {
+	if err := createMigrationsTable(ctx, db); err != nil {
+		return 0, err
+	}
+
+	var version int
+	row := db.QueryRowContext(ctx, "SELECT coalesce(max(version), 0) FROM schema_migrations")
+	err := row.Scan(&version)
+
+	return version, err
+}
+
+// Applies or reverts migrations until a database is at the target version
+//
+// Foreign key enforcement is disabled while migrating sqlite so tables can be rebuilt,
+// the database is checked for foreign key violations before it is re-enabled.
+func migrate(ctx context.Context, db *database, target int) error {
+	if target < 0 || target > LatestSchemaVersion() {
+		return fmt.Errorf("unknown schema version %d", target)
+	}
+
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current == target {
+		return nil
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sqlite := db.dialect == sqliteDialect
+	if sqlite {
+		if _, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), "PRAGMA foreign_keys = ON")
+	}
+
+	for current != target {
+		var m migration
+		if current < target {
+			m = migrations[current]
+		} else {
+			m = migrations[current-1]
+		}
+		statements := m.statements(db.dialect, current < target)
+
+		sqlTx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		tx := &transaction{sqlTx, db.dialect}
+
+		for _, statement := range statements {
+			if _, err = tx.ExecContext(ctx, statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+			}
+		}
+
+		if current < target {
+			_, err = tx.ExecContext(ctx, `
+            INSERT INTO schema_migrations (version, name, appliedTimestamp)
+            VALUES (?,?,?)`, m.version, m.name, time.Now().Unix())
+		} else {
+			_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version=?", m.version)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if sqlite {
+			rows, err := tx.QueryContext(ctx, "PRAGMA foreign_key_check")
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			violation := rows.Next()
+			rows.Close()
+			if violation {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s): foreign key violation", m.version, m.name)
+			}
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+
+		if current < target {
+			logger.Printf("Applied migration %d: %s\n", m.version, m.name)
+			current++
+		} else {
+			logger.Printf("Reverted migration %d: %s\n", m.version, m.name)
+			current--
+		}
+	}
+
+	return nil
+}
+
+// Gets the version of the newest migration applied to the database
+func (m *Manager) SchemaVersion(ctx context.Context) (int, error) {
+	return schemaVersion(ctx, m.db)
+}
+
+// Applies or reverts migrations until the database is at the target version
+//
+// The search index is only created at the latest version.
+func (m *Manager) Migrate(ctx context.Context, target int) error {
+	if err := migrate(ctx, m.db, target); err != nil {
+		return err
+	}
+	// bins may have been dropped or rebuilt
+	m.InvalidateBins()
+
+	if target != LatestSchemaVersion() {
+		return nil
+	}
+	return initSearch(m.db)
+}
+
+// Gets the status of every known migration
+func (m *Manager) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	if err := createMigrationsTable(ctx, m.db); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT version, appliedTimestamp FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var epochTime int64
+		if err = rows.Scan(&version, &epochTime); err != nil {
+			return nil, err
+		}
+		applied[version] = time.Unix(epochTime, 0)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		appliedTime, ok := applied[migration.version]
+		status[i] = MigrationStatus{
+			Version:          migration.version,
+			Name:             migration.name,
+			Applied:          ok,
+			AppliedTimestamp: appliedTime,
+		}
+	}
+
+	return status, nil
+}
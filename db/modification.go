@@ -3,59 +3,196 @@ package db
 import (
 	"context"
 	"file-cellar/storage"
+	"time"
 )
 
 // registers a storage driver
 func (m *Manager) AddDriver(ctx context.Context, d storage.Driver) bool {
-	result, err := m.db.ExecContext(ctx, `
+	var id int64
+	row := m.db.QueryRowContext(ctx, `
     INSERT INTO drivers (name)
     VALUES (?)
+    RETURNING id
     `, d.Name())
 
-	if err != nil {
+	if err := row.Scan(&id); err != nil {
 		logger.Print(err)
 		return false
 	}
+	d.SetId(id)
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		logger.Print(err)
-	} else {
-		d.SetId(id)
-	}
-
-	m.Drivers[d.Name()] = d
+	m.mu.Lock()
+	m.drivers[d.Name()] = d
+	m.mu.Unlock()
 
 	return true
 }
 
 // adds a storage bin to the database and returns its assigned id
 func (m *Manager) AddBin(ctx context.Context, bin *storage.Bin, driverID int64) (int64, error) {
-	result, err := m.db.ExecContext(ctx,
+	var id int64
+	row := m.db.QueryRowContext(ctx,
 		`INSERT INTO bins (driverID, name, externalURL, internalURL, redirect)
-        VALUES (?,?,?,?,?)`,
+        VALUES (?,?,?,?,?)
+        RETURNING id`,
 		driverID, bin.Name, bin.Path.External, bin.Path.Internal, bin.Redirect)
+	if err := row.Scan(&id); err != nil {
+		logger.Print(err)
+		return 0, err
+	}
+	bin.Id = id
+	m.cacheBin(bin)
+
+	return id, nil
+}
+
+// Assigns a relative path to a file
+func (m *Manager) AddFile(ctx context.Context, f *storage.FileInfo) error {
+	row := m.db.QueryRowContext(ctx, `
+    INSERT INTO files (binID, name, hash, type, size, relPath, uploadTimestamp, description)
+    VALUES (?,?,?,?,?,?,?,?)
+    RETURNING id`,
+		f.Bin.Id, f.Name, f.Hash, f.Type, f.Size, f.RelPath, f.UploadTimestamp.Unix(), f.Description)
+
+	err := row.Scan(&f.Id)
 	if err != nil {
 		logger.Print(err)
 	}
 
-	id, err := result.LastInsertId()
+	return err
+}
+
+// Sets the description of a file
+func (m *Manager) SetDescription(ctx context.Context, uri string, description string) (bool, error) {
+	result, err := m.db.ExecContext(ctx, `
+    UPDATE files
+    SET description=?
+    WHERE relPath=? AND deletedTimestamp IS NULL`, description, uri)
 	if err != nil {
+		logger.Printf("Failed to set description of %s\n", uri)
 		logger.Print(err)
+		return false, err
 	}
-	bin.Id = id
-	m.Bins[id] = bin
 
-	return id, nil
+	count, err := result.RowsAffected()
+	return count > 0, err
 }
 
-// Assigns a relative path to a file
-func (m *Manager) AddFile(ctx context.Context, f *storage.FileInfo) error {
-	_, err := m.db.ExecContext(ctx, `
-    INSERT INTO files (binID, name, hash, size, relPath, uploadTimestamp)
-    VALUES (?,?,?,?,?,?)`,
-		f.Bin.Id, f.Name, f.Hash, f.Size, f.RelPath, f.UploadTimestamp)
+// Renames a file which is not in the trash
+func (m *Manager) SetName(ctx context.Context, uri string, name string) (bool, error) {
+	result, err := m.db.ExecContext(ctx, `
+    UPDATE files
+    SET name=?
+    WHERE relPath=? AND deletedTimestamp IS NULL`, name, uri)
+	if err != nil {
+		logger.Printf("Failed to rename %s\n", uri)
+		logger.Print(err)
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+// Adds a file as the newest version of its logical path, creating the path if needed
+//
+// Sets the file's id and version.
+func (m *Manager) AddVersion(ctx context.Context, f *storage.FileInfo) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Print(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+    INSERT INTO paths (binID, name)
+    VALUES (?,?)
+    ON CONFLICT(binID, name) DO NOTHING`, f.Bin.Id, f.LogicalPath)
+	if err != nil {
+		logger.Print(err)
+		return err
+	}
+
+	var pathId int64
+	var version int64
+	row := tx.QueryRowContext(ctx, `
+    SELECT paths.id, coalesce(max(files.version), 0) + 1
+    FROM paths
+    LEFT JOIN files ON files.pathID = paths.id
+    WHERE paths.binID=? AND paths.name=?
+    GROUP BY paths.id`, f.Bin.Id, f.LogicalPath)
+	if err = row.Scan(&pathId, &version); err != nil {
+		logger.Print(err)
+		return err
+	}
+
+	var id int64
+	row = tx.QueryRowContext(ctx, `
+    INSERT INTO files (binID, name, hash, type, size, relPath, uploadTimestamp, description, pathID, version)
+    VALUES (?,?,?,?,?,?,?,?,?,?)
+    RETURNING id`,
+		f.Bin.Id, f.Name, f.Hash, f.Type, f.Size, f.RelPath, f.UploadTimestamp.Unix(), f.Description, pathId, version)
+	if err = row.Scan(&id); err != nil {
+		logger.Print(err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    UPDATE paths
+    SET currentFileID=?
+    WHERE id=?`, id, pathId)
+	if err != nil {
+		logger.Print(err)
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Print(err)
+		return err
+	}
+	f.Id = id
+	f.Version = version
+
+	return nil
+}
+
+// Makes a previous version of a file at a logical path the current version
+func (m *Manager) SetCurrentVersion(ctx context.Context, binId int64, path string, version int64) error {
+	result, err := m.db.ExecContext(ctx, `
+    UPDATE paths
+    SET currentFileID=(
+        SELECT files.id FROM files
+        WHERE files.pathID=paths.id AND files.version=?)
+    WHERE binID=? AND name=? AND EXISTS (
+        SELECT 1 FROM files
+        WHERE files.pathID=paths.id AND files.version=? AND files.deletedTimestamp IS NULL)`,
+		version, binId, path, version)
+	if err != nil {
+		logger.Printf("Failed to set version %d of %s as current\n", version, path)
+		logger.Print(err)
+		return err
+	}
 
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if count == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Records a file generated from the content of another file
+func (m *Manager) AddDerivative(ctx context.Context, d *storage.Derivative) error {
+	row := m.db.QueryRowContext(ctx, `
+    INSERT INTO derivatives (fileID, binID, kind, param, hash, type, size, relPath, createdTimestamp)
+    VALUES (?,?,?,?,?,?,?,?,?)
+    RETURNING id`,
+		d.ParentId, d.Bin.Id, d.Kind, d.Param, d.Hash, d.Type, d.Size, d.RelPath, d.UploadTimestamp.Unix())
+
+	err := row.Scan(&d.Id)
 	if err != nil {
 		logger.Print(err)
 	}
@@ -63,10 +200,42 @@ func (m *Manager) AddFile(ctx context.Context, f *storage.FileInfo) error {
 	return err
 }
 
-// Removes a file from the database
+// Removes a file, the records of its derivatives, its tags, collection memberships and accesses from the database
 func (m *Manager) RemoveFile(ctx context.Context, uri string) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Print(err)
+		return false, err
+	}
+	defer tx.Rollback()
 
-	result, err := m.db.ExecContext(ctx, `
+	for _, table := range []string{"derivatives", "fileTags", "collectionFiles", "accessLog"} {
+		_, err = tx.ExecContext(ctx, `
+    DELETE FROM `+table+`
+    WHERE fileID IN (SELECT id FROM files WHERE relPath=?)`, uri)
+		if err != nil {
+			logger.Printf("Failed to remove %s of %s\n", table, uri)
+			logger.Print(err)
+			return false, err
+		}
+	}
+
+	// fall back to the newest remaining version when removing the current version
+	_, err = tx.ExecContext(ctx, `
+    UPDATE paths
+    SET currentFileID=(
+        SELECT files.id FROM files
+        WHERE files.pathID=paths.id AND files.relPath<>? AND files.deletedTimestamp IS NULL
+        ORDER BY files.version DESC
+        LIMIT 1)
+    WHERE currentFileID IN (SELECT id FROM files WHERE relPath=?)`, uri, uri)
+	if err != nil {
+		logger.Printf("Failed to update current version when removing %s\n", uri)
+		logger.Print(err)
+		return false, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
     DELETE FROM files
     WHERE relPath=?`, uri)
 
@@ -76,6 +245,255 @@ func (m *Manager) RemoveFile(ctx context.Context, uri string) (bool, error) {
 		return false, err
 	}
 
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, tx.Commit()
+}
+
+// Moves a file to the trash, hiding it from listings and downloads until restored or removed
+func (m *Manager) TrashFile(ctx context.Context, uri string, deleteTime time.Time) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Print(err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+    UPDATE files
+    SET deletedTimestamp=?
+    WHERE relPath=? AND deletedTimestamp IS NULL`, deleteTime.Unix(), uri)
+	if err != nil {
+		logger.Printf("Failed to trash %s\n", uri)
+		logger.Print(err)
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil || count == 0 {
+		return false, err
+	}
+
+	// fall back to the newest remaining version when trashing the current version
+	_, err = tx.ExecContext(ctx, `
+    UPDATE paths
+    SET currentFileID=(
+        SELECT files.id FROM files
+        WHERE files.pathID=paths.id AND files.deletedTimestamp IS NULL
+        ORDER BY files.version DESC
+        LIMIT 1)
+    WHERE currentFileID IN (SELECT id FROM files WHERE relPath=?)`, uri)
+	if err != nil {
+		logger.Printf("Failed to update current version when trashing %s\n", uri)
+		logger.Print(err)
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Restores a file from the trash
+//
+// A restored version becomes current when its logical path has no current version.
+func (m *Manager) RestoreFile(ctx context.Context, uri string) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Print(err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+    UPDATE files
+    SET deletedTimestamp=NULL
+    WHERE relPath=? AND deletedTimestamp IS NOT NULL`, uri)
+	if err != nil {
+		logger.Printf("Failed to restore %s\n", uri)
+		logger.Print(err)
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil || count == 0 {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    UPDATE paths
+    SET currentFileID=(SELECT id FROM files WHERE relPath=?)
+    WHERE currentFileID IS NULL AND id=(SELECT pathID FROM files WHERE relPath=?)`, uri, uri)
+	if err != nil {
+		logger.Printf("Failed to update current version when restoring %s\n", uri)
+		logger.Print(err)
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Adds a tag to a file, creating the tag if needed
+//
+// Returns ErrNotFound if there is no file with the uri.
+func (m *Manager) TagFile(ctx context.Context, uri string, tag string) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Print(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+    INSERT INTO tags (name)
+    VALUES (?)
+    ON CONFLICT(name) DO NOTHING`, tag)
+	if err != nil {
+		logger.Print(err)
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+    INSERT INTO fileTags (fileID, tagID)
+    SELECT files.id, tags.id
+    FROM files, tags
+    WHERE files.relPath=? AND files.deletedTimestamp IS NULL AND tags.name=?
+    ON CONFLICT(fileID, tagID) DO NOTHING`, uri, tag)
+	if err != nil {
+		logger.Printf("Failed to tag %s with %s\n", uri, tag)
+		logger.Print(err)
+		return err
+	}
+
+	if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		// either the file is missing or already has the tag
+		var exists bool
+		row := tx.QueryRowContext(ctx, `
+    SELECT EXISTS (SELECT 1 FROM files WHERE relPath=? AND deletedTimestamp IS NULL)`, uri)
+		if err = row.Scan(&exists); err != nil {
+			return err
+		} else if !exists {
+			return ErrNotFound
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Removes a tag from a file
+func (m *Manager) UntagFile(ctx context.Context, uri string, tag string) (bool, error) {
+	result, err := m.db.ExecContext(ctx, `
+    DELETE FROM fileTags
+    WHERE fileID=(SELECT id FROM files WHERE relPath=?)
+    AND tagID=(SELECT id FROM tags WHERE name=?)`, uri, tag)
+	if err != nil {
+		logger.Printf("Failed to untag %s from %s\n", tag, uri)
+		logger.Print(err)
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+// Adds a collection to the database, setting its id
+func (m *Manager) AddCollection(ctx context.Context, c *storage.Collection) error {
+	row := m.db.QueryRowContext(ctx, `
+    INSERT INTO collections (name, shareToken, createdTimestamp)
+    VALUES (?,?,?)
+    RETURNING id`, c.Name, c.ShareToken, c.CreatedTimestamp.Unix())
+
+	err := row.Scan(&c.Id)
+	if err != nil {
+		logger.Print(err)
+	}
+
+	return err
+}
+
+// Removes a collection, leaving its files untouched
+func (m *Manager) RemoveCollection(ctx context.Context, id int64) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Print(err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+    DELETE FROM collectionFiles
+    WHERE collectionID=?`, id)
+	if err != nil {
+		logger.Print(err)
+		return false, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+    DELETE FROM collections
+    WHERE id=?`, id)
+	if err != nil {
+		logger.Printf("Failed to remove collection %d\n", id)
+		logger.Print(err)
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, tx.Commit()
+}
+
+// Adds a file to a collection
+//
+// Returns ErrNotFound if the file or collection does not exist.
+func (m *Manager) AddToCollection(ctx context.Context, collectionId int64, uri string) error {
+	result, err := m.db.ExecContext(ctx, `
+    INSERT INTO collectionFiles (collectionID, fileID)
+    SELECT collections.id, files.id
+    FROM collections, files
+    WHERE collections.id=? AND files.relPath=? AND files.deletedTimestamp IS NULL
+    ON CONFLICT(collectionID, fileID) DO NOTHING`, collectionId, uri)
+	if err != nil {
+		logger.Printf("Failed to add %s to collection %d\n", uri, collectionId)
+		logger.Print(err)
+		return err
+	}
+
+	if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		var exists bool
+		row := m.db.QueryRowContext(ctx, `
+    SELECT EXISTS (
+        SELECT 1 FROM collectionFiles
+        INNER JOIN files ON collectionFiles.fileID = files.id
+        WHERE collectionID=? AND files.relPath=?)`, collectionId, uri)
+		if err = row.Scan(&exists); err != nil {
+			return err
+		} else if !exists {
+			return ErrNotFound
+		}
+	}
+
+	return nil
+}
+
+// Removes a file from a collection
+func (m *Manager) RemoveFromCollection(ctx context.Context, collectionId int64, uri string) (bool, error) {
+	result, err := m.db.ExecContext(ctx, `
+    DELETE FROM collectionFiles
+    WHERE collectionID=? AND fileID=(SELECT id FROM files WHERE relPath=?)`, collectionId, uri)
+	if err != nil {
+		logger.Printf("Failed to remove %s from collection %d\n", uri, collectionId)
+		logger.Print(err)
+		return false, err
+	}
+
 	count, err := result.RowsAffected()
 	return count > 0, err
 }
@@ -0,0 +1,8 @@
+//go:build postgres
+
+package db
+
+// Building the tests with -tags postgres makes the PostgreSQL backend mandatory
+func init() {
+	requirePostgres = true
+}
@@ -22,7 +22,7 @@ func (m *Manager) Resolve(ctx context.Context, path string) (string, error) {
 	err := row.Scan(&url)
 	if err == sql.ErrNoRows {
 		logger.Printf("no file with uri: %s\n", path)
-		return "", err
+		return "", notFound(err)
 	}
 	if err != nil {
 		logger.Printf("failure when querying for file %s\n%v", path, err)
@@ -32,49 +32,214 @@ func (m *Manager) Resolve(ctx context.Context, path string) (string, error) {
 	return url, err
 }
 
-func (m *Manager) GetFile(ctx context.Context, uri string) (*storage.FileInfo, error) {
-	row := m.db.QueryRowContext(ctx, `
-    SELECT binID, name, hash, size, uploadTimestamp
-    FROM files
-    WHERE files.relPath=?
-	`, uri)
+// Columns selected when querying for files, requires files to be joined with paths
+const fileColumns = `files.id, files.binID, files.name, files.hash, files.type, files.size,
+    files.relPath, files.uploadTimestamp, paths.name, files.version, files.deletedTimestamp, files.description,
+    files.downloadCount, files.lastAccessTimestamp`
 
+// Scans a row of fileColumns into a file, leaving its bin unset
+func scanFile(scan func(...any) error) (*storage.FileInfo, int64, error) {
 	f := new(storage.FileInfo)
 
-	f.RelPath = uri
-	var epochTime int64
 	var binId int64
-	err := row.Scan(&binId, &f.Name, &f.Hash, &f.Size, &epochTime)
+	var epochTime int64
+	var fileType sql.NullString
+	var logicalPath sql.NullString
+	var version sql.NullInt64
+	var deletedTime sql.NullInt64
+	var description sql.NullString
+	var accessTime sql.NullInt64
+	err := scan(&f.Id, &binId, &f.Name, &f.Hash, &fileType, &f.Size,
+		&f.RelPath, &epochTime, &logicalPath, &version, &deletedTime, &description,
+		&f.Downloads, &accessTime)
+	if err != nil {
+		return nil, 0, err
+	}
+	f.Description = description.String
+	if accessTime.Valid {
+		f.AccessTimestamp = time.Unix(accessTime.Int64, 0)
+	}
+	if deletedTime.Valid {
+		f.DeletedTimestamp = time.Unix(deletedTime.Int64, 0)
+	}
+
+	f.Type = fileType.String
+	f.UploadTimestamp = time.Unix(epochTime, 0)
+	f.LogicalPath = logicalPath.String
+	f.Version = version.Int64
+
+	return f, binId, nil
+}
+
+// Queries for files, the query must select fileColumns
+func (m *Manager) queryFiles(ctx context.Context, query string, args ...any) ([]*storage.FileInfo, error) {
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Printf("failure when querying for files\n%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]*storage.FileInfo, 0)
+	binIds := make([]int64, 0)
+	for rows.Next() {
+		f, binId, err := scanFile(rows.Scan)
+		if err != nil {
+			logger.Printf("failed to read file from database\n%v", err)
+			return nil, err
+		}
+		files = append(files, f)
+		binIds = append(binIds, binId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
 
+	for i, f := range files {
+		f.Bin, err = m.GetBin(ctx, binIds[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+func (m *Manager) GetFile(ctx context.Context, uri string) (*storage.FileInfo, error) {
+	row := m.db.QueryRowContext(ctx, `
+    SELECT `+fileColumns+`
+    FROM files
+    LEFT JOIN paths ON files.pathID = paths.id
+    WHERE files.relPath=? AND files.deletedTimestamp IS NULL
+	`, uri)
+
+	f, binId, err := scanFile(row.Scan)
 	switch {
 	case err == sql.ErrNoRows:
 		logger.Printf("no file with uri %s\n", uri)
-		return nil, err
+		return nil, notFound(err)
 	case err != nil:
 		logger.Printf("failure when querying for file %s\n%v", uri, err)
 		return nil, err
-	default:
-		f.UploadTimestamp = time.Unix(epochTime, 0)
 	}
 
-	bin, ok := m.Bins[binId]
-	if !ok {
-		bin, err = m.GetBin(ctx, binId)
-		if err != nil {
-			return nil, err
-		}
+	f.Bin, err = m.GetBin(ctx, binId)
+	if err != nil {
+		return nil, err
 	}
-	f.Bin = bin
 
 	return f, nil
 }
 
+// Gets a version of the file at a logical path, the current version is used when version is 0
+func (m *Manager) GetVersion(ctx context.Context, binId int64, path string, version int64) (*storage.FileInfo, error) {
+	var files []*storage.FileInfo
+	var err error
+	if version == 0 {
+		files, err = m.queryFiles(ctx, `
+    SELECT `+fileColumns+`
+    FROM paths
+    INNER JOIN files ON paths.currentFileID = files.id
+    WHERE paths.binID=? AND paths.name=? AND files.deletedTimestamp IS NULL`, binId, path)
+	} else {
+		files, err = m.queryFiles(ctx, `
+    SELECT `+fileColumns+`
+    FROM files
+    INNER JOIN paths ON files.pathID = paths.id
+    WHERE paths.binID=? AND paths.name=? AND files.version=? AND files.deletedTimestamp IS NULL`,
+			binId, path, version)
+	}
+
+	if err != nil {
+		return nil, err
+	} else if len(files) == 0 {
+		logger.Printf("no version %d of %s in bin %d\n", version, path, binId)
+		return nil, ErrNotFound
+	}
+
+	return files[0], nil
+}
+
+// Gets all versions of the file at a logical path, newest first
+func (m *Manager) GetVersions(ctx context.Context, binId int64, path string) ([]*storage.FileInfo, error) {
+	return m.queryFiles(ctx, `
+    SELECT `+fileColumns+`
+    FROM files
+    INNER JOIN paths ON files.pathID = paths.id
+    WHERE paths.binID=? AND paths.name=? AND files.deletedTimestamp IS NULL
+    ORDER BY files.version DESC`, binId, path)
+}
+
+// Gets the files in a bin which are not in the trash, newest first
+func (m *Manager) ListFiles(ctx context.Context, binId int64) ([]*storage.FileInfo, error) {
+	return m.queryFiles(ctx, `
+    SELECT `+fileColumns+`
+    FROM files
+    LEFT JOIN paths ON files.pathID = paths.id
+    WHERE files.binID=? AND files.deletedTimestamp IS NULL
+    ORDER BY files.uploadTimestamp DESC`, binId)
+}
+
+// Gets a version of the file at a logical path in the trash, the newest trashed version when version is 0
+func (m *Manager) GetTrashedVersion(ctx context.Context, binId int64, path string, version int64) (*storage.FileInfo, error) {
+	query := `
+    SELECT ` + fileColumns + `
+    FROM files
+    INNER JOIN paths ON files.pathID = paths.id
+    WHERE paths.binID=? AND paths.name=? AND files.deletedTimestamp IS NOT NULL`
+	args := []any{binId, path}
+	if version != 0 {
+		query += ` AND files.version=?`
+		args = append(args, version)
+	}
+
+	files, err := m.queryFiles(ctx, query+`
+    ORDER BY files.version DESC
+    LIMIT 1`, args...)
+	if err != nil {
+		return nil, err
+	} else if len(files) == 0 {
+		logger.Printf("no trashed version %d of %s in bin %d\n", version, path, binId)
+		return nil, ErrNotFound
+	}
+
+	return files[0], nil
+}
+
+// Gets a file in the trash
+func (m *Manager) GetTrashedFile(ctx context.Context, uri string) (*storage.FileInfo, error) {
+	files, err := m.queryFiles(ctx, `
+    SELECT `+fileColumns+`
+    FROM files
+    LEFT JOIN paths ON files.pathID = paths.id
+    WHERE files.relPath=? AND files.deletedTimestamp IS NOT NULL`, uri)
+	if err != nil {
+		return nil, err
+	} else if len(files) == 0 {
+		logger.Printf("no trashed file with uri %s\n", uri)
+		return nil, ErrNotFound
+	}
+
+	return files[0], nil
+}
+
+// Gets the files moved to the trash at or before a time, oldest first
+func (m *Manager) GetTrash(ctx context.Context, before time.Time) ([]*storage.FileInfo, error) {
+	return m.queryFiles(ctx, `
+    SELECT `+fileColumns+`
+    FROM files
+    LEFT JOIN paths ON files.pathID = paths.id
+    WHERE files.deletedTimestamp IS NOT NULL AND files.deletedTimestamp<=?
+    ORDER BY files.deletedTimestamp`, before.Unix())
+}
+
+// Gets a bin, loading it into the manager's cache if needed
 func (m *Manager) GetBin(ctx context.Context, id int64) (*storage.Bin, error) {
-	bin, ok := m.Bins[id]
-	if ok {
+	if bin, ok := m.cachedBin(id); ok {
 		return bin, nil
 	}
-	bin = new(storage.Bin)
+	bin := new(storage.Bin)
 	bin.Id = id
 
 	row := m.db.QueryRowContext(ctx, `
@@ -87,21 +252,29 @@ func (m *Manager) GetBin(ctx context.Context, id int64) (*storage.Bin, error) {
 	err := row.Scan(&bin.Name, &bin.Path.External, &bin.Path.Internal, &bin.Redirect, &driverName)
 	if err != nil {
 		fmt.Println("error after scan: ", err)
+		return nil, notFound(err)
+	}
+
+	bin.Driver, err = m.getCachedDriver(ctx, driverName)
+	if err != nil {
 		return nil, err
 	}
 
-	driver, ok := m.Drivers[driverName]
-	if !ok {
-		driver, err = m.GetDriver(ctx, driverName)
-		if err != nil {
-			return nil, err
-		}
+	return m.cacheBin(bin), nil
+}
+
+// Gets a driver from the manager's cache, loading it if needed
+func (m *Manager) getCachedDriver(ctx context.Context, driverName string) (storage.Driver, error) {
+	if driver, ok := m.cachedDriver(driverName); ok {
+		return driver, nil
 	}
 
-	bin.Driver = driver
-	m.Bins[id] = bin
+	driver, err := m.GetDriver(ctx, driverName)
+	if err != nil {
+		return nil, err
+	}
 
-	return bin, nil
+	return m.cacheDriver(driver), nil
 }
 
 func (m *Manager) GetDriver(ctx context.Context, driverName string) (storage.Driver, error) {
@@ -114,7 +287,7 @@ func (m *Manager) GetDriver(ctx context.Context, driverName string) (storage.Dri
 	var id int64
 	err := row.Scan(&id)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
 	}
 
 	var driver storage.Driver
@@ -132,37 +305,299 @@ func (m *Manager) GetDriver(ctx context.Context, driverName string) (storage.Dri
 
 // Clear a managers bins and recreates them according to the database
 func (m *Manager) GetBins(ctx context.Context) error {
-	m.Bins = make(map[int64]*storage.Bin)
 	rows, err := m.db.QueryContext(ctx, `
     SELECT bins.id, bins.name, bins.internalURL, bins.externalURL, bins.redirect, drivers.name
     FROM bins
     INNER JOIN drivers ON bins.driverID = drivers.id`)
-	if err == sql.ErrNoRows {
-		logger.Printf("no bins found\n")
+	if err != nil {
+		logger.Printf("failure when querying for bins\n%v", err)
 		return err
 	}
 	defer rows.Close()
 
+	loaded := make([]*storage.Bin, 0)
+	driverNames := make([]string, 0)
 	for rows.Next() {
 		bin := new(storage.Bin)
-		var id int64
 		var driverName string
-		err = rows.Scan(&id, &bin.Name, &bin.Path.Internal, &bin.Path.External, &bin.Redirect, &driverName)
+		err = rows.Scan(&bin.Id, &bin.Name, &bin.Path.Internal, &bin.Path.External, &bin.Redirect, &driverName)
 
 		if err != nil {
 			logger.Printf("failed to read from database\n")
 			continue
 		}
+		loaded = append(loaded, bin)
+		driverNames = append(driverNames, driverName)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
 
-		driver, ok := m.Drivers[driverName]
-		if !ok {
-			logger.Printf("failed to find driver `%s` while querying bins\n", driverName)
+	bins := make(map[int64]*storage.Bin)
+	for i, bin := range loaded {
+		bin.Driver, err = m.getCachedDriver(ctx, driverNames[i])
+		if err != nil {
+			logger.Printf("failed to find driver `%s` while querying bins\n", driverNames[i])
 			// TODO: create custom error and set it for return
 			continue
 		}
-		bin.Driver = driver
-		m.Bins[id] = bin
+		bin.RegisterRoot()
+		bins[bin.Id] = bin
 	}
 
+	m.mu.Lock()
+	m.bins = bins
+	m.mu.Unlock()
+
 	return nil
 }
+
+// Gets every bin ordered by id, sharing the cached bins handed out by GetBin
+func (m *Manager) ListBins(ctx context.Context) ([]*storage.Bin, error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT id FROM bins ORDER BY id")
+	if err != nil {
+		logger.Printf("failure when querying for bins\n%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	bins := make([]*storage.Bin, 0, len(ids))
+	for _, id := range ids {
+		bin, err := m.GetBin(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		bins = append(bins, bin)
+	}
+
+	return bins, nil
+}
+
+// Gets a derivative of a file by its kind and parameter
+func (m *Manager) GetDerivative(ctx context.Context, fileId int64, kind string, param int64) (*storage.Derivative, error) {
+	row := m.db.QueryRowContext(ctx, `
+    SELECT id, binID, hash, type, size, relPath, createdTimestamp
+    FROM derivatives
+    WHERE fileID=? AND kind=? AND param=?`, fileId, kind, param)
+
+	d := &storage.Derivative{ParentId: fileId, Kind: kind, Param: param}
+	var binId int64
+	var epochTime int64
+	var fileType sql.NullString
+	err := row.Scan(&d.Id, &binId, &d.Hash, &fileType, &d.Size, &d.RelPath, &epochTime)
+	if err == sql.ErrNoRows {
+		return nil, notFound(err)
+	} else if err != nil {
+		logger.Printf("failure when querying for %s %d of file %d\n%v", kind, param, fileId, err)
+		return nil, err
+	}
+	d.Type = fileType.String
+	d.UploadTimestamp = time.Unix(epochTime, 0)
+
+	d.Bin, err = m.GetBin(ctx, binId)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Gets all derivatives of a file
+func (m *Manager) GetDerivatives(ctx context.Context, fileId int64) ([]*storage.Derivative, error) {
+	rows, err := m.db.QueryContext(ctx, `
+    SELECT id, binID, kind, param, hash, type, size, relPath, createdTimestamp
+    FROM derivatives
+    WHERE fileID=?`, fileId)
+	if err != nil {
+		logger.Printf("failure when querying for derivatives of file %d\n%v", fileId, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	derivatives := make([]*storage.Derivative, 0)
+	binIds := make([]int64, 0)
+	for rows.Next() {
+		d := &storage.Derivative{ParentId: fileId}
+		var binId int64
+		var epochTime int64
+		var fileType sql.NullString
+		err = rows.Scan(&d.Id, &binId, &d.Kind, &d.Param, &d.Hash, &fileType, &d.Size, &d.RelPath, &epochTime)
+		if err != nil {
+			return nil, err
+		}
+		d.Type = fileType.String
+		d.UploadTimestamp = time.Unix(epochTime, 0)
+
+		derivatives = append(derivatives, d)
+		binIds = append(binIds, binId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i, d := range derivatives {
+		d.Bin, err = m.GetBin(ctx, binIds[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return derivatives, nil
+}
+
+// Gets the tags of a file, sorted by name
+func (m *Manager) GetTags(ctx context.Context, uri string) ([]string, error) {
+	rows, err := m.db.QueryContext(ctx, `
+    SELECT tags.name
+    FROM fileTags
+    INNER JOIN tags ON fileTags.tagID = tags.id
+    INNER JOIN files ON fileTags.fileID = files.id
+    WHERE files.relPath=?
+    ORDER BY tags.name`, uri)
+	if err != nil {
+		logger.Printf("failure when querying for tags of %s\n%v", uri, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// Gets every tag and the number of files not in the trash with it
+func (m *Manager) ListTags(ctx context.Context) (map[string]int64, error) {
+	rows, err := m.db.QueryContext(ctx, `
+    SELECT tags.name, count(files.id)
+    FROM tags
+    LEFT JOIN fileTags ON fileTags.tagID = tags.id
+    LEFT JOIN files ON fileTags.fileID = files.id AND files.deletedTimestamp IS NULL
+    GROUP BY tags.id`)
+	if err != nil {
+		logger.Printf("failure when querying for tags\n%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string]int64)
+	for rows.Next() {
+		var tag string
+		var count int64
+		if err = rows.Scan(&tag, &count); err != nil {
+			return nil, err
+		}
+		tags[tag] = count
+	}
+
+	return tags, rows.Err()
+}
+
+// Gets the files with a tag which are not in the trash, newest first
+func (m *Manager) GetTaggedFiles(ctx context.Context, tag string) ([]*storage.FileInfo, error) {
+	return m.queryFiles(ctx, `
+    SELECT `+fileColumns+`
+    FROM files
+    LEFT JOIN paths ON files.pathID = paths.id
+    INNER JOIN fileTags ON fileTags.fileID = files.id
+    INNER JOIN tags ON fileTags.tagID = tags.id
+    WHERE tags.name=? AND files.deletedTimestamp IS NULL
+    ORDER BY files.uploadTimestamp DESC`, tag)
+}
+
+func scanCollection(scan func(...any) error) (*storage.Collection, error) {
+	c := new(storage.Collection)
+	var epochTime int64
+	if err := scan(&c.Id, &c.Name, &c.ShareToken, &epochTime); err != nil {
+		return nil, err
+	}
+	c.CreatedTimestamp = time.Unix(epochTime, 0)
+
+	return c, nil
+}
+
+// Gets a collection by its id
+func (m *Manager) GetCollection(ctx context.Context, id int64) (*storage.Collection, error) {
+	row := m.db.QueryRowContext(ctx, `
+    SELECT id, name, shareToken, createdTimestamp
+    FROM collections
+    WHERE id=?`, id)
+
+	c, err := scanCollection(row.Scan)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Printf("failure when querying for collection %d\n%v", id, err)
+	}
+
+	return c, notFound(err)
+}
+
+// Gets a collection by its share token
+func (m *Manager) GetSharedCollection(ctx context.Context, token string) (*storage.Collection, error) {
+	row := m.db.QueryRowContext(ctx, `
+    SELECT id, name, shareToken, createdTimestamp
+    FROM collections
+    WHERE shareToken=?`, token)
+
+	c, err := scanCollection(row.Scan)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Printf("failure when querying for shared collection\n%v", err)
+	}
+
+	return c, notFound(err)
+}
+
+// Gets every collection, sorted by name
+func (m *Manager) ListCollections(ctx context.Context) ([]*storage.Collection, error) {
+	rows, err := m.db.QueryContext(ctx, `
+    SELECT id, name, shareToken, createdTimestamp
+    FROM collections
+    ORDER BY name`)
+	if err != nil {
+		logger.Printf("failure when querying for collections\n%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	collections := make([]*storage.Collection, 0)
+	for rows.Next() {
+		c, err := scanCollection(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, c)
+	}
+
+	return collections, rows.Err()
+}
+
+// Gets the files in a collection which are not in the trash, sorted by name
+func (m *Manager) GetCollectionFiles(ctx context.Context, collectionId int64) ([]*storage.FileInfo, error) {
+	return m.queryFiles(ctx, `
+    SELECT `+fileColumns+`
+    FROM files
+    LEFT JOIN paths ON files.pathID = paths.id
+    INNER JOIN collectionFiles ON collectionFiles.fileID = files.id
+    WHERE collectionFiles.collectionID=? AND files.deletedTimestamp IS NULL
+    ORDER BY files.name`, collectionId)
+}
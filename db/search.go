@@ -0,0 +1,265 @@
+package db
+
+import (
+	"context"
+	"file-cellar/storage"
+	"html"
+	"strings"
+)
+
+// Markers placed around matching terms in search highlights, the rest of which is html escaped
+const (
+	HighlightStart = "<mark>"
+	HighlightEnd   = "</mark>"
+)
+
+// Placeholders fts5 puts around matching terms, swapped for the highlight markers once the text is escaped
+const (
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+var matchMarkers = strings.NewReplacer(matchStart, HighlightStart, matchEnd, HighlightEnd)
+
+// Escapes highlighted text as html and marks its matching terms
+func escapeHighlight(text string) string {
+	return matchMarkers.Replace(html.EscapeString(text))
+}
+
+// A file matching a search
+type SearchResult struct {
+	File                 *storage.FileInfo
+	Rank                 float64 // relevance of the match, lower is more relevant
+	NameHighlight        string  // html escaped file name with matching terms highlighted
+	DescriptionHighlight string  // html escaped file description with matching terms highlighted
+	Snippet              string  // html escaped fragment of the file's content around matching terms
+}
+
+// Creates the full text search index over files and the triggers keeping it in sync
+//
+// The index requires sqlite to be built with FTS5 (the sqlite_fts5 build tag),
+// when it is unavailable or the database is not sqlite searches fall back to substring matching.
+func initSearch(db *database) error {
+	if db.dialect != sqliteDialect {
+		return nil
+	}
+
+	var exists bool
+	row := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type='table' AND name='filesSearch')`)
+	if err := row.Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err := db.Exec(`
+    CREATE VIRTUAL TABLE filesSearch USING fts5(
+    name,
+    description,
+    tags,
+    content,
+    tokenize='unicode61 remove_diacritics 2'
+    )`)
+	if err != nil && strings.Contains(err.Error(), "no such module") {
+		logger.Println("FTS5 unavailable, searches will use substring matching")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	triggers := []string{`
+    CREATE TRIGGER IF NOT EXISTS trg_files_search_insert AFTER INSERT ON files BEGIN
+        INSERT INTO filesSearch (rowid, name, description, tags, content)
+        VALUES (new.id, new.name, coalesce(new.description, ''), '', '');
+    END`, `
+    CREATE TRIGGER IF NOT EXISTS trg_files_search_update AFTER UPDATE OF name, description ON files BEGIN
+        UPDATE filesSearch
+        SET name=new.name, description=coalesce(new.description, '')
+        WHERE rowid=new.id;
+    END`, `
+    CREATE TRIGGER IF NOT EXISTS trg_files_search_delete AFTER DELETE ON files BEGIN
+        DELETE FROM filesSearch WHERE rowid=old.id;
+    END`, `
+    CREATE TRIGGER IF NOT EXISTS trg_fileTags_search_insert AFTER INSERT ON fileTags BEGIN
+        UPDATE filesSearch
+        SET tags=(
+            SELECT coalesce(group_concat(tags.name, ' '), '')
+            FROM fileTags INNER JOIN tags ON fileTags.tagID = tags.id
+            WHERE fileTags.fileID=new.fileID)
+        WHERE rowid=new.fileID;
+    END`, `
+    CREATE TRIGGER IF NOT EXISTS trg_fileTags_search_delete AFTER DELETE ON fileTags BEGIN
+        UPDATE filesSearch
+        SET tags=(
+            SELECT coalesce(group_concat(tags.name, ' '), '')
+            FROM fileTags INNER JOIN tags ON fileTags.tagID = tags.id
+            WHERE fileTags.fileID=old.fileID)
+        WHERE rowid=old.fileID;
+    END`,
+	}
+	for _, trigger := range triggers {
+		if _, err = db.Exec(trigger); err != nil {
+			return err
+		}
+	}
+
+	// index files added before the index existed
+	_, err = db.Exec(`
+    INSERT INTO filesSearch (rowid, name, description, tags, content)
+    SELECT files.id, files.name, coalesce(files.description, ''), coalesce((
+        SELECT group_concat(tags.name, ' ')
+        FROM fileTags INNER JOIN tags ON fileTags.tagID = tags.id
+        WHERE fileTags.fileID = files.id), ''), ''
+    FROM files`)
+	if err != nil {
+		return err
+	}
+
+	logger.Println("Initialized search index")
+	return nil
+}
+
+// Reports if the full text search index exists
+func (m *Manager) hasSearchIndex(ctx context.Context) (bool, error) {
+	if m.db.dialect != sqliteDialect {
+		return false, nil
+	}
+
+	var exists bool
+	row := m.db.QueryRowContext(ctx, `
+    SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type='table' AND name='filesSearch')`)
+	err := row.Scan(&exists)
+
+	return exists, err
+}
+
+// Converts a user query into an FTS5 query matching every term as a prefix
+func ftsQuery(query string) string {
+	terms := strings.Fields(query)
+	for i, term := range terms {
+		terms[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// Sets the extracted text content of a file in the search index
+func (m *Manager) IndexContent(ctx context.Context, fileId int64, content string) error {
+	if ok, err := m.hasSearchIndex(ctx); err != nil || !ok {
+		return err
+	}
+
+	_, err := m.db.ExecContext(ctx, `
+    UPDATE filesSearch
+    SET content=?
+    WHERE rowid=?`, content, fileId)
+	if err != nil {
+		logger.Printf("Failed to index content of file %d\n", fileId)
+		logger.Print(err)
+	}
+
+	return err
+}
+
+// Searches the names, descriptions, tags and content of files not in the trash
+//
+// Results are limited to a bin unless binId is negative, and sorted by relevance.
+func (m *Manager) Search(ctx context.Context, query string, binId int64, limit int) ([]SearchResult, error) {
+	if strings.TrimSpace(query) == "" {
+		return []SearchResult{}, nil
+	}
+
+	ok, err := m.hasSearchIndex(ctx)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return m.searchSubstring(ctx, query, binId, limit)
+	}
+
+	rows, err := m.db.QueryContext(ctx, `
+    SELECT `+fileColumns+`,
+        bm25(filesSearch, 10.0, 5.0, 5.0, 1.0),
+        highlight(filesSearch, 0, ?, ?),
+        highlight(filesSearch, 1, ?, ?),
+        snippet(filesSearch, 3, ?, ?, '...', 16)
+    FROM filesSearch
+    INNER JOIN files ON files.id = filesSearch.rowid
+    LEFT JOIN paths ON files.pathID = paths.id
+    WHERE filesSearch MATCH ? AND files.deletedTimestamp IS NULL AND (? < 0 OR files.binID=?)
+    ORDER BY bm25(filesSearch, 10.0, 5.0, 5.0, 1.0)
+    LIMIT ?`,
+		matchStart, matchEnd, matchStart, matchEnd, matchStart, matchEnd,
+		ftsQuery(query), binId, binId, limit)
+	if err != nil {
+		logger.Printf("failure when searching for %s\n%v", query, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0)
+	binIds := make([]int64, 0)
+	for rows.Next() {
+		var result SearchResult
+		var binId int64
+		result.File, binId, err = scanFile(func(dest ...any) error {
+			return rows.Scan(append(dest, &result.Rank, &result.NameHighlight,
+				&result.DescriptionHighlight, &result.Snippet)...)
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.NameHighlight = escapeHighlight(result.NameHighlight)
+		result.DescriptionHighlight = escapeHighlight(result.DescriptionHighlight)
+		result.Snippet = escapeHighlight(result.Snippet)
+		results = append(results, result)
+		binIds = append(binIds, binId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i, result := range results {
+		result.File.Bin, err = m.GetBin(ctx, binIds[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// Searches for files whose name, description or tags contain every term of a query
+func (m *Manager) searchSubstring(ctx context.Context, query string, binId int64, limit int) ([]SearchResult, error) {
+	like := m.db.dialect.ilike()
+	conditions := ""
+	args := []any{binId, binId}
+	for _, term := range strings.Fields(query) {
+		conditions += `
+    AND (files.name ` + like + ` ? ESCAPE '\' OR files.description ` + like + ` ? ESCAPE '\' OR EXISTS (
+        SELECT 1 FROM fileTags INNER JOIN tags ON fileTags.tagID = tags.id
+        WHERE fileTags.fileID = files.id AND tags.name ` + like + ` ? ESCAPE '\'))`
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term) + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+	args = append(args, limit)
+
+	files, err := m.queryFiles(ctx, `
+    SELECT `+fileColumns+`
+    FROM files
+    LEFT JOIN paths ON files.pathID = paths.id
+    WHERE files.deletedTimestamp IS NULL AND (? < 0 OR files.binID=?)`+conditions+`
+    ORDER BY files.uploadTimestamp DESC
+    LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]SearchResult, len(files))
+	for i, f := range files {
+		results[i] = SearchResult{File: f, NameHighlight: html.EscapeString(f.Name), DescriptionHighlight: html.EscapeString(f.Description)}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"file-cellar/storage"
+	"slices"
+	"time"
+)
+
+// The kind of object stats were recorded from
+type StatsSource string
+
+const (
+	BinStats    StatsSource = "bin"
+	DriverStats StatsSource = "driver"
+)
+
+// Resolutions stats can be rolled up to, buckets start at multiples of the resolution since the unix epoch
+const (
+	RawResolution  time.Duration = 0
+	HourResolution               = time.Hour
+	DayResolution                = 24 * time.Hour
+)
+
+// Resolutions stats are rolled up to as they are added, so they outlive the raw records they sum
+var rollupResolutions = []time.Duration{HourResolution, DayResolution}
+
+// Columns of the counters of stats, in the order of storage.Stats
+const statsColumns = "uploaded, downloaded, redirected, deleted, failed, uploadedBytes, downloadedBytes, deletedBytes"
+
+// The operations of a bin or driver over an interval
+//
+// Records hold the change in stats since the previous record of their source, so they can be summed.
+type StatsRecord struct {
+	Source    StatsSource
+	SourceId  int64 // negative when summed over every source
+	Timestamp time.Time
+	storage.Stats
+}
+
+// The files stored in a bin, including files in the trash
+type BinUsage struct {
+	BinId int64
+	Files int64
+	Bytes int64
+}
+
+// Gets the length in seconds of the buckets of a resolution
+func bucketSeconds(resolution time.Duration) int64 {
+	return max(int64(resolution/time.Second), 1)
+}
+
+// Gets the counters of stats as they are stored
+//
+// sqlite can't store unsigned integers with the high bit set, counters never get near it.
+func statsValues(s storage.Stats) []any {
+	return []any{int64(s.Uploaded), int64(s.Downloaded), int64(s.Redirected), int64(s.Deleted), int64(s.Failed),
+		int64(s.UploadedBytes), int64(s.DownloadedBytes), int64(s.DeletedBytes)}
+}
+
+// Stores stats records, adding them to the hourly and daily rollups
+func (m *Manager) AddStats(ctx context.Context, records []StatsRecord) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Print(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, r := range records {
+		_, err = tx.ExecContext(ctx, `
+    INSERT INTO stats (source, sourceID, recordedTimestamp, `+statsColumns+`)
+    VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+			append([]any{string(r.Source), r.SourceId, r.Timestamp.Unix()}, statsValues(r.Stats)...)...)
+		if err != nil {
+			logger.Printf("Failed to add stats of %s %d\n%v", r.Source, r.SourceId, err)
+			return err
+		}
+
+		for _, resolution := range rollupResolutions {
+			bucket := bucketSeconds(resolution)
+			_, err = tx.ExecContext(ctx, `
+    INSERT INTO statsRollups (source, sourceID, resolution, bucketTimestamp, `+statsColumns+`)
+    VALUES (?,?,?,?,?,?,?,?,?,?,?,?)
+    ON CONFLICT(source, sourceID, resolution, bucketTimestamp) DO UPDATE SET
+    uploaded = statsRollups.uploaded + excluded.uploaded,
+    downloaded = statsRollups.downloaded + excluded.downloaded,
+    redirected = statsRollups.redirected + excluded.redirected,
+    deleted = statsRollups.deleted + excluded.deleted,
+    failed = statsRollups.failed + excluded.failed,
+    uploadedBytes = statsRollups.uploadedBytes + excluded.uploadedBytes,
+    downloadedBytes = statsRollups.downloadedBytes + excluded.downloadedBytes,
+    deletedBytes = statsRollups.deletedBytes + excluded.deletedBytes`,
+				append([]any{string(r.Source), r.SourceId, bucket, r.Timestamp.Unix() / bucket * bucket}, statsValues(r.Stats)...)...)
+			if err != nil {
+				logger.Printf("Failed to roll up stats of %s %d\n%v", r.Source, r.SourceId, err)
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Gets the stats of a source recorded between two times inclusive, summed into buckets of a resolution
+//
+// A negative sourceId sums the stats of every source of the kind. Buckets are ordered oldest first and
+// timestamped with their start, buckets without records are omitted. Hourly and daily stats are read from
+// their rollups, which hold whole buckets, so every bucket overlapping the time range is included.
+// Other resolutions are summed from the raw records still kept.
+func (m *Manager) GetStats(ctx context.Context, source StatsSource, sourceId int64, from time.Time, to time.Time, resolution time.Duration) ([]StatsRecord, error) {
+	bucket := bucketSeconds(resolution)
+	query := `
+    SELECT (recordedTimestamp / ?) * ?, SUM(uploaded), SUM(downloaded), SUM(redirected), SUM(deleted), SUM(failed),
+    SUM(uploadedBytes), SUM(downloadedBytes), SUM(deletedBytes)
+    FROM stats
+    WHERE source=? AND (? < 0 OR sourceID=?) AND recordedTimestamp BETWEEN ? AND ?
+    GROUP BY 1
+    ORDER BY 1`
+	args := []any{bucket, bucket, string(source), sourceId, sourceId, from.Unix(), to.Unix()}
+	if slices.Contains(rollupResolutions, resolution) {
+		query = `
+    SELECT bucketTimestamp, SUM(uploaded), SUM(downloaded), SUM(redirected), SUM(deleted), SUM(failed),
+    SUM(uploadedBytes), SUM(downloadedBytes), SUM(deletedBytes)
+    FROM statsRollups
+    WHERE source=? AND (? < 0 OR sourceID=?) AND resolution=? AND bucketTimestamp BETWEEN ? AND ?
+    GROUP BY 1
+    ORDER BY 1`
+		args = []any{string(source), sourceId, sourceId, bucket, from.Unix() / bucket * bucket, to.Unix()}
+	}
+
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Printf("failure when querying for stats of %s %d\n%v", source, sourceId, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]StatsRecord, 0)
+	for rows.Next() {
+		r := StatsRecord{Source: source, SourceId: sourceId}
+		var epochTime int64
+		err = rows.Scan(&epochTime, &r.Uploaded, &r.Downloaded, &r.Redirected, &r.Deleted, &r.Failed,
+			&r.UploadedBytes, &r.DownloadedBytes, &r.DeletedBytes)
+		if err != nil {
+			return nil, err
+		}
+		r.Timestamp = time.Unix(epochTime, 0)
+		records = append(records, r)
+	}
+
+	return records, rows.Err()
+}
+
+// Removes the stats of a resolution from before a time, raw records or the rollups of the resolution
+//
+// Returns the number of removed records or rollups.
+func (m *Manager) PruneStats(ctx context.Context, resolution time.Duration, before time.Time) (int64, error) {
+	var result sql.Result
+	var err error
+	if resolution == RawResolution {
+		result, err = m.db.ExecContext(ctx, "DELETE FROM stats WHERE recordedTimestamp < ?", before.Unix())
+	} else {
+		result, err = m.db.ExecContext(ctx, "DELETE FROM statsRollups WHERE resolution=? AND bucketTimestamp < ?",
+			bucketSeconds(resolution), before.Unix())
+	}
+	if err != nil {
+		logger.Printf("Failed to prune %v stats\n%v", resolution, err)
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Gets the number and total size of the files stored in every bin, ordered by bin id
+func (m *Manager) GetBinUsage(ctx context.Context) ([]BinUsage, error) {
+	rows, err := m.db.QueryContext(ctx, `
+    SELECT bins.id, COUNT(files.id), COALESCE(SUM(files.size), 0)
+    FROM bins
+    LEFT JOIN files ON files.binID = bins.id
+    GROUP BY bins.id
+    ORDER BY bins.id`)
+	if err != nil {
+		logger.Printf("failure when querying for bin usage\n%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make([]BinUsage, 0)
+	for rows.Next() {
+		var u BinUsage
+		if err = rows.Scan(&u.BinId, &u.Files, &u.Bytes); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+
+	return usage, rows.Err()
+}
@@ -0,0 +1,266 @@
+package db
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+)
+
+// States of a webhook delivery
+const (
+	DeliveryPending   = "pending"   // waiting for its next attempt
+	DeliveryDelivered = "delivered" // accepted by the webhook
+	DeliveryFailed    = "failed"    // abandoned after too many attempts
+)
+
+// A url events are posted to
+type Webhook struct {
+	Id               int64
+	URL              string
+	Secret           string   // key signing the deliveries, so receivers can check they came from the server
+	Events           []string // types of the events delivered, every type when empty
+	CreatedTimestamp time.Time
+}
+
+// A post of an event to a webhook
+type WebhookDelivery struct {
+	Id                   int64
+	WebhookId            int64
+	URL                  string // url of the webhook
+	Secret               string // secret of the webhook
+	Event                string // type of the event
+	Payload              []byte // json body of the post
+	CreatedTimestamp     time.Time
+	Status               string // one of the Delivery states
+	Attempts             int
+	NextAttemptTimestamp time.Time
+	LastError            string // why the last attempt failed, empty if it succeeded
+}
+
+// Checks if a webhook receives events of a type
+func (h *Webhook) Accepts(eventType string) bool {
+	return len(h.Events) == 0 || slices.Contains(h.Events, eventType)
+}
+
+func joinEvents(events []string) string {
+	return strings.Join(events, ",")
+}
+
+func splitEvents(events string) []string {
+	if events == "" {
+		return nil
+	}
+	return strings.Split(events, ",")
+}
+
+// Adds a webhook to the database, setting its id
+func (m *Manager) AddWebhook(ctx context.Context, h *Webhook) error {
+	row := m.db.QueryRowContext(ctx, `
+    INSERT INTO webhooks (url, secret, events, createdTimestamp)
+    VALUES (?,?,?,?)
+    RETURNING id`, h.URL, h.Secret, joinEvents(h.Events), h.CreatedTimestamp.Unix())
+
+	err := row.Scan(&h.Id)
+	if err != nil {
+		logger.Printf("Failed to add webhook %s\n%v", h.URL, err)
+	}
+
+	return err
+}
+
+// Removes a webhook and its deliveries
+func (m *Manager) RemoveWebhook(ctx context.Context, id int64) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Print(err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+    DELETE FROM webhookDeliveries
+    WHERE webhookID=?`, id)
+	if err != nil {
+		logger.Print(err)
+		return false, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+    DELETE FROM webhooks
+    WHERE id=?`, id)
+	if err != nil {
+		logger.Printf("Failed to remove webhook %d\n%v", id, err)
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, tx.Commit()
+}
+
+func (m *Manager) queryWebhooks(ctx context.Context, query string, args ...any) ([]*Webhook, error) {
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Printf("failure when querying for webhooks\n%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := make([]*Webhook, 0)
+	for rows.Next() {
+		h := new(Webhook)
+		var events string
+		var epochTime int64
+		if err = rows.Scan(&h.Id, &h.URL, &h.Secret, &events, &epochTime); err != nil {
+			return nil, err
+		}
+		h.Events = splitEvents(events)
+		h.CreatedTimestamp = time.Unix(epochTime, 0)
+		webhooks = append(webhooks, h)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// Gets a webhook by id
+func (m *Manager) GetWebhook(ctx context.Context, id int64) (*Webhook, error) {
+	webhooks, err := m.queryWebhooks(ctx, `
+    SELECT id, url, secret, events, createdTimestamp
+    FROM webhooks
+    WHERE id=?`, id)
+	if err != nil {
+		return nil, err
+	} else if len(webhooks) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return webhooks[0], nil
+}
+
+// Gets every webhook, ordered by id
+func (m *Manager) ListWebhooks(ctx context.Context) ([]*Webhook, error) {
+	return m.queryWebhooks(ctx, `
+    SELECT id, url, secret, events, createdTimestamp
+    FROM webhooks
+    ORDER BY id`)
+}
+
+// Queues the delivery of an event to every webhook receiving its type
+//
+// Returns the number of queued deliveries.
+func (m *Manager) QueueEvent(ctx context.Context, eventType string, payload []byte, at time.Time) (int, error) {
+	webhooks, err := m.ListWebhooks(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Print(err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	queued := 0
+	for _, h := range webhooks {
+		if !h.Accepts(eventType) {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, `
+    INSERT INTO webhookDeliveries (webhookID, event, payload, createdTimestamp, status, nextAttemptTimestamp)
+    VALUES (?,?,?,?,?,?)`, h.Id, eventType, string(payload), at.Unix(), DeliveryPending, at.Unix())
+		if err != nil {
+			logger.Printf("Failed to queue %s for webhook %d\n%v", eventType, h.Id, err)
+			return 0, err
+		}
+		queued++
+	}
+
+	return queued, tx.Commit()
+}
+
+func (m *Manager) queryDeliveries(ctx context.Context, query string, args ...any) ([]*WebhookDelivery, error) {
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Printf("failure when querying for webhook deliveries\n%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]*WebhookDelivery, 0)
+	for rows.Next() {
+		d := new(WebhookDelivery)
+		var payload string
+		var created, next int64
+		err = rows.Scan(&d.Id, &d.WebhookId, &d.URL, &d.Secret, &d.Event, &payload, &created, &d.Status,
+			&d.Attempts, &next, &d.LastError)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = []byte(payload)
+		d.CreatedTimestamp = time.Unix(created, 0)
+		d.NextAttemptTimestamp = time.Unix(next, 0)
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+const deliveryColumns = `webhookDeliveries.id, webhookDeliveries.webhookID, webhooks.url, webhooks.secret,
+    webhookDeliveries.event, webhookDeliveries.payload, webhookDeliveries.createdTimestamp, webhookDeliveries.status,
+    webhookDeliveries.attempts, webhookDeliveries.nextAttemptTimestamp, webhookDeliveries.lastError`
+
+// Gets pending deliveries due to be attempted at a time, oldest first
+func (m *Manager) GetDueDeliveries(ctx context.Context, now time.Time, limit int) ([]*WebhookDelivery, error) {
+	return m.queryDeliveries(ctx, `
+    SELECT `+deliveryColumns+`
+    FROM webhookDeliveries
+    INNER JOIN webhooks ON webhookDeliveries.webhookID = webhooks.id
+    WHERE webhookDeliveries.status=? AND webhookDeliveries.nextAttemptTimestamp<=?
+    ORDER BY webhookDeliveries.nextAttemptTimestamp, webhookDeliveries.id
+    LIMIT ?`, DeliveryPending, now.Unix(), limit)
+}
+
+// Gets the most recent deliveries to a webhook, newest first
+func (m *Manager) GetDeliveries(ctx context.Context, webhookId int64, limit int) ([]*WebhookDelivery, error) {
+	return m.queryDeliveries(ctx, `
+    SELECT `+deliveryColumns+`
+    FROM webhookDeliveries
+    INNER JOIN webhooks ON webhookDeliveries.webhookID = webhooks.id
+    WHERE webhookDeliveries.webhookID=?
+    ORDER BY webhookDeliveries.createdTimestamp DESC, webhookDeliveries.id DESC
+    LIMIT ?`, webhookId, limit)
+}
+
+// Saves the outcome of an attempt to deliver an event
+func (m *Manager) UpdateDelivery(ctx context.Context, d *WebhookDelivery) error {
+	_, err := m.db.ExecContext(ctx, `
+    UPDATE webhookDeliveries
+    SET status=?, attempts=?, nextAttemptTimestamp=?, lastError=?
+    WHERE id=?`, d.Status, d.Attempts, d.NextAttemptTimestamp.Unix(), d.LastError, d.Id)
+	if err != nil {
+		logger.Printf("Failed to update webhook delivery %d\n%v", d.Id, err)
+	}
+
+	return err
+}
+
+// Removes delivered and failed deliveries created before a time
+//
+// Returns the number of removed deliveries.
+func (m *Manager) RemoveFinishedDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	result, err := m.db.ExecContext(ctx, `
+    DELETE FROM webhookDeliveries
+    WHERE status<>? AND createdTimestamp<?`, DeliveryPending, before.Unix())
+	if err != nil {
+		logger.Printf("Failed to remove finished webhook deliveries\n%v", err)
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,43 @@
+package derive
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+var ErrUnsupported = errors.New("unsupported file type")
+
+var logger *log.Logger
+
+var generators map[string]Generator
+
+// Creates files from the content of another file
+type Generator interface {
+	// The kind of file the generator creates, ie "thumb"
+	Kind() string
+	// If the generator can create a derivative from a file of a mimetype
+	Accepts(mimeType string) bool
+	// Writes a derivative of src to w, returning the mimetype of the derivative
+	//
+	// The meaning of param is specific to each generator
+	Generate(w io.Writer, src io.Reader, param int64) (string, error)
+}
+
+// Makes a generator available through Get
+func Register(g Generator) {
+	generators[g.Kind()] = g
+}
+
+// Gets the generator for a kind of derivative
+func Get(kind string) (Generator, bool) {
+	g, ok := generators[kind]
+	return g, ok
+}
+
+func init() {
+	logger = log.New(os.Stdout, "[DERIVE]: ", log.LUTC|log.Ldate|log.Ltime)
+	generators = make(map[string]Generator)
+	Register(Thumbnailer{})
+}
@@ -0,0 +1,139 @@
+package derive
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+const ThumbnailKind = "thumb"
+
+const jpegQuality = 85
+
+// Pixels an image may have before it is refused rather than decoded
+const DefaultMaxPixels = 40_000_000
+
+// Returned when an image is too large to decode
+var ErrTooLarge = errors.New("image too large")
+
+// Generates downscaled copies of images
+type Thumbnailer struct {
+	MaxPixels int64 // pixels an image may have, checked from its header before it is decoded, 0 for DefaultMaxPixels
+}
+
+func (Thumbnailer) Kind() string {
+	return ThumbnailKind
+}
+
+func (Thumbnailer) Accepts(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	default:
+		return false
+	}
+}
+
+// Writes a thumbnail of src that is at most maxDim pixels wide and tall.
+//
+// Images with transparency are encoded as png, all others as jpeg.
+func (t Thumbnailer) Generate(w io.Writer, src io.Reader, maxDim int64) (string, error) {
+	if maxDim <= 0 {
+		return "", errors.New("thumbnail dimension must be positive")
+	}
+
+	// the header is read twice, so the dimensions it declares are checked before anything is allocated for them
+	header := new(bytes.Buffer)
+	cfg, format, err := image.DecodeConfig(io.TeeReader(src, header))
+	if err == image.ErrFormat {
+		return "", ErrUnsupported
+	} else if err != nil {
+		logger.Printf("Failed to decode %s image header: %v\n", format, err)
+		return "", err
+	}
+	maxPixels := t.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = DefaultMaxPixels
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		logger.Printf("Refusing to decode %dx%d %s image\n", cfg.Width, cfg.Height, format)
+		return "", ErrTooLarge
+	}
+
+	img, format, err := image.Decode(io.MultiReader(header, src))
+	if err == image.ErrFormat {
+		return "", ErrUnsupported
+	} else if err != nil {
+		logger.Printf("Failed to decode %s image: %v\n", format, err)
+		return "", err
+	}
+
+	thumb := Resize(img, int(maxDim))
+
+	if thumb.Opaque() {
+		return "image/jpeg", jpeg.Encode(w, thumb, &jpeg.Options{Quality: jpegQuality})
+	}
+	return "image/png", png.Encode(w, thumb)
+}
+
+// Scales an image to fit within a maxDim by maxDim square, preserving its aspect ratio.
+//
+// Images which already fit are copied without scaling.
+// Each destination pixel is the average of the source pixels it covers.
+func Resize(img image.Image, maxDim int) *image.NRGBA {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	dstW, dstH := srcW, srcH
+	if srcW > maxDim || srcH > maxDim {
+		if srcW >= srcH {
+			dstW = maxDim
+			dstH = max(1, srcH*maxDim/srcW)
+		} else {
+			dstH = maxDim
+			dstW = max(1, srcW*maxDim/srcH)
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	if dstW == srcW && dstH == srcH {
+		draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+		return dst
+	}
+
+	for y := range dstH {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcH/dstH)
+		for x := range dstW {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcW/dstW)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(img.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,67 @@
+package derive
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	testCase := func(srcW, srcH, maxDim, expectedW, expectedH int) {
+		src := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+		dst := Resize(src, maxDim)
+		if dst.Bounds().Dx() != expectedW || dst.Bounds().Dy() != expectedH {
+			t.Errorf("Incorrect size resizing %dx%d to fit %d, expected %dx%d != %dx%d\n",
+				srcW, srcH, maxDim, expectedW, expectedH, dst.Bounds().Dx(), dst.Bounds().Dy())
+		}
+	}
+
+	testCase(1024, 768, 256, 256, 192)
+	testCase(768, 1024, 256, 192, 256)
+	testCase(100, 50, 256, 100, 50)
+	testCase(4000, 1, 256, 256, 1)
+}
+
+func TestThumbnailGenerate(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	for y := range 32 {
+		for x := range 64 {
+			src.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	thumb := new(bytes.Buffer)
+	mimeType, err := Thumbnailer{}.Generate(thumb, buf, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "image/jpeg" {
+		t.Errorf("Incorrect mimetype for opaque image, expected image/jpeg != %s\n", mimeType)
+	}
+
+	img, _, err := image.Decode(thumb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 16 || img.Bounds().Dy() != 8 {
+		t.Errorf("Incorrect thumbnail size, expected 16x8 != %v\n", img.Bounds().Size())
+	}
+
+	buf = new(bytes.Buffer)
+	png.Encode(buf, src)
+	_, err = Thumbnailer{MaxPixels: 64*32 - 1}.Generate(new(bytes.Buffer), buf, 16)
+	if err != ErrTooLarge {
+		t.Errorf("Incorrect error for oversized image, expected %v != %v\n", ErrTooLarge, err)
+	}
+
+	_, err = Thumbnailer{}.Generate(new(bytes.Buffer), bytes.NewBufferString("not an image"), 16)
+	if err != ErrUnsupported {
+		t.Errorf("Incorrect error for non image, expected %v != %v\n", ErrUnsupported, err)
+	}
+}
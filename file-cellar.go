@@ -4,20 +4,69 @@ import (
 	"context"
 	"file-cellar/config"
 	"file-cellar/db"
+	"file-cellar/derive"
 	"file-cellar/server"
 	"file-cellar/storage"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [command]
+
+Commands:
+  serve                 run the file server (default)
+  trash list            list files in the trash
+  trash restore PATH    restore a file from the trash
+  trash purge [-all]    permanently delete files past the trash grace period
+  migrate status        show applied and pending schema migrations
+  migrate up [VERSION]  apply migrations up to VERSION, the latest by default
+  migrate down VERSION  revert migrations down to VERSION
+  audit [FLAGS]         show the audit log, newest first, see audit -h for filters
+  client COMMAND        upload, download and list files of a running server, see client -h
+`, os.Args[0])
+}
+
 func main() {
+	if len(os.Args) < 2 {
+		serve()
+		return
+	}
+
+	switch os.Args[1] {
+	case "serve":
+		serve()
+	case "trash":
+		trashCommand(os.Args[2:])
+	case "migrate":
+		migrateCommand(os.Args[2:])
+	case "audit":
+		auditCommand(os.Args[2:])
+	case "client":
+		clientCommand(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func serve() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	ctx := context.Background()
 	manager, err := db.GetManager(config.Server["DBURL"], config.DB_PRAGMAS)
 	if err != nil {
 		log.Panicf("Unable to get manager: %v\n", err)
 	}
+	// handlers share the manager, so it is only closed once the server has shut down
 	defer manager.Close()
 
 	err = manager.Init()
@@ -25,8 +74,11 @@ func main() {
 		log.Panicf("Failed to initialize tables: %v\n", err)
 	}
 
+	// the events of the server and its background jobs, signalling the webhook deliverer
+	events := server.NewEventBus()
+
 	localDriver := storage.NewLocalDriver()
-	if !manager.AddDriver(ctx, localDriver) {
+	if !server.RegisterDriver(ctx, manager, localDriver) {
 		log.Panicf("Failed to register local driver: %v\n", err)
 	}
 
@@ -38,13 +90,76 @@ func main() {
 	bin.Path.External = "foobar"
 	bin.Path.Internal = "./testing/files"
 
-	_, err = manager.AddBin(ctx, bin, bin.Driver.Id())
+	_, err = server.CreateBin(ctx, manager, events, bin, bin.Driver.Id())
 	if err != nil {
 		log.Panicf("Error adding bin: %v\n", err)
 	}
 
+	maxPixels, err := strconv.ParseInt(config.Server["ThumbnailMaxPixels"], 10, 64)
+	if err != nil || maxPixels <= 0 {
+		log.Panicf("Bad thumbnail max pixels `%s`\n", config.Server["ThumbnailMaxPixels"])
+	}
+	derive.Register(derive.Thumbnailer{MaxPixels: maxPixels})
+
+	purgeInterval, err := time.ParseDuration(config.Server["TrashPurgeInterval"])
+	if err != nil || purgeInterval <= 0 {
+		log.Panicf("Bad trash purge interval `%s`\n", config.Server["TrashPurgeInterval"])
+	}
+	go server.PurgeTrashPeriodically(ctx, manager, events, purgeInterval)
+
+	cleanupInterval, err := time.ParseDuration(config.Server["UnusedCleanupInterval"])
+	if err != nil || cleanupInterval <= 0 {
+		log.Panicf("Bad unused cleanup interval `%s`\n", config.Server["UnusedCleanupInterval"])
+	}
+	go server.TrashUnusedPeriodically(ctx, manager, events, cleanupInterval)
+
+	pollInterval, err := time.ParseDuration(config.Server["WebhookPollInterval"])
+	if err != nil || pollInterval <= 0 {
+		log.Panicf("Bad webhook poll interval `%s`\n", config.Server["WebhookPollInterval"])
+	}
+	go server.DeliverWebhooksPeriodically(ctx, manager, events, pollInterval)
+
+	recorder := server.NewStatsRecorder(manager)
+	recorded := make(chan struct{})
+	go func() {
+		defer close(recorded)
+		recorder.RecordPeriodically(ctx, server.StatsInterval())
+	}()
+
+	redirectLifetime, err := time.ParseDuration(config.Server["RedirectLifetime"])
+	if err != nil || redirectLifetime <= 0 {
+		log.Panicf("Bad redirect lifetime `%s`\n", config.Server["RedirectLifetime"])
+	}
+
 	const PORT uint = 8080
-	mux := server.GetMux()
+	cellar := server.NewServer(manager, events, redirectLifetime)
+	srv := &http.Server{
+		Addr:    ":" + fmt.Sprint(PORT),
+		Handler: cellar.Handler(),
+	}
+	// event streams only end when their client disconnects, so they are closed rather than waited for
+	srv.RegisterOnShutdown(cellar.CloseStreams)
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		log.Println("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down cleanly: %v\n", err)
+		}
+	}()
+
 	log.Printf("Listening on %d\n", PORT)
-	http.ListenAndServe(":"+fmt.Sprint(PORT), mux)
+	if err = srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Printf("Server stopped: %v\n", err)
+		return
+	}
+	// wait for in flight requests before closing the manager
+	<-shutdown
+	<-recorded
+	if err = recorder.Record(context.Background()); err != nil {
+		log.Printf("Failed to record stats: %v\n", err)
+	}
 }
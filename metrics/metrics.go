@@ -0,0 +1,231 @@
+// Metrics in the Prometheus text exposition format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default upper bounds of histogram buckets, in seconds
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A label of a sample
+type Label struct {
+	Name  string
+	Value string
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Writes the HELP and TYPE lines starting a metric family, kind is counter, gauge or histogram
+func WriteHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, kind)
+}
+
+// Writes a single sample of a metric
+func WriteSample(w io.Writer, name string, labels []Label, value float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, `%s="%s"`, l.Name, labelEscaper.Replace(l.Value))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatValue(value))
+	b.WriteByte('\n')
+
+	io.WriteString(w, b.String())
+}
+
+// A monotonically increasing count, safe for concurrent use
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Counts observations in cumulative buckets, safe for concurrent use
+type Histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if i, _ := slices.BinarySearch(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// Writes the bucket, sum and count samples of the histogram
+func (h *Histogram) write(w io.Writer, name string, labels []Label) {
+	h.mu.Lock()
+	counts := slices.Clone(h.counts)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	bucketLabels := append(slices.Clone(labels), Label{Name: "le"})
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		bucketLabels[len(labels)].Value = formatValue(bound)
+		WriteSample(w, name+"_bucket", bucketLabels, float64(cumulative))
+	}
+	bucketLabels[len(labels)].Value = "+Inf"
+	WriteSample(w, name+"_bucket", bucketLabels, float64(count))
+	WriteSample(w, name+"_sum", labels, sum)
+	WriteSample(w, name+"_count", labels, float64(count))
+}
+
+// A family of metrics of the same name, distinguished by the values of their labels
+type vec[T any] struct {
+	name   string
+	help   string
+	labels []string
+	create func() *T
+
+	mu       sync.RWMutex
+	children map[string]*T
+	values   map[string][]string
+}
+
+func newVec[T any](name string, help string, labels []string, create func() *T) vec[T] {
+	return vec[T]{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		create:   create,
+		children: make(map[string]*T),
+		values:   make(map[string][]string),
+	}
+}
+
+// Gets the metric with label values in the order the labels were declared, creating it if needed
+func (v *vec[T]) With(values ...string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	child, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if child, ok = v.children[key]; !ok {
+		child = v.create()
+		v.children[key] = child
+		v.values[key] = slices.Clone(values)
+	}
+
+	return child
+}
+
+// Calls fn with every metric and its labels, ordered by label values
+func (v *vec[T]) each(fn func(*T, []Label)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		v.mu.RLock()
+		child, values := v.children[key], v.values[key]
+		v.mu.RUnlock()
+
+		labels := make([]Label, len(values))
+		for i, value := range values {
+			labels[i] = Label{Name: v.labels[i], Value: value}
+		}
+		fn(child, labels)
+	}
+}
+
+// Counters distinguished by label values
+type CounterVec struct {
+	vec[Counter]
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, labels, func() *Counter { return new(Counter) })}
+}
+
+// Writes every counter of the family
+func (v *CounterVec) Expose(w io.Writer) {
+	WriteHeader(w, v.name, v.help, "counter")
+	v.each(func(c *Counter, labels []Label) {
+		WriteSample(w, v.name, labels, float64(c.Value()))
+	})
+}
+
+// Histograms distinguished by label values
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+// Creates histograms with buckets of ascending upper bounds
+func NewHistogramVec(name string, help string, bounds []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{newVec(name, help, labels, func() *Histogram { return newHistogram(bounds) })}
+}
+
+// Writes every histogram of the family
+func (v *HistogramVec) Expose(w io.Writer) {
+	WriteHeader(w, v.name, v.help, "histogram")
+	v.each(func(h *Histogram, labels []Label) {
+		h.write(w, v.name, labels)
+	})
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	requests := NewCounterVec("requests_total", "Requests\nhandled.", "route", "code")
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				requests.With("GET /f/{filePath...}", "200").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	requests.With(`say "hi"`, "404").Add(2)
+
+	out := new(strings.Builder)
+	requests.Expose(out)
+	expected := `# HELP requests_total Requests\nhandled.
+# TYPE requests_total counter
+requests_total{route="GET /f/{filePath...}",code="200"} 800
+requests_total{route="say \"hi\"",code="404"} 2
+`
+	if out.String() != expected {
+		t.Errorf("Incorrect exposition\n%s\nexpected\n%s", out.String(), expected)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	durations := NewHistogramVec("duration_seconds", "Durations.", []float64{0.1, 1}, "route")
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		durations.With("upload").Observe(v)
+	}
+
+	out := new(strings.Builder)
+	durations.Expose(out)
+	expected := `# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="upload",le="0.1"} 2
+duration_seconds_bucket{route="upload",le="1"} 3
+duration_seconds_bucket{route="upload",le="+Inf"} 4
+duration_seconds_sum{route="upload"} 3.65
+duration_seconds_count{route="upload"} 4
+`
+	if out.String() != expected {
+		t.Errorf("Incorrect exposition\n%s\nexpected\n%s", out.String(), expected)
+	}
+}
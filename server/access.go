@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"file-cellar/config"
+	"file-cellar/db"
+	"file-cellar/storage"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultAccessLogLimit = 100
+
+// Files trashed at once by a cleanup of unused files
+const unusedBatchSize = 100
+
+type accessJSON struct {
+	Timestamp  time.Time `json:"timestamp"`
+	ClientIP   string    `json:"clientIP"`
+	UserAgent  string    `json:"userAgent"`
+	BytesSent  int64     `json:"bytesSent"`
+	Range      string    `json:"range,omitempty"`
+	Redirected bool      `json:"redirected"`
+}
+
+// Gets how long files can go without being downloaded before they are moved to the trash, 0 when disabled
+func UnusedFileAge() time.Duration {
+	if config.Server["UnusedFileAge"] == "" {
+		return 0
+	}
+
+	age, err := time.ParseDuration(config.Server["UnusedFileAge"])
+	if err != nil || age < 0 {
+		log.Printf("Bad unused file age `%s`, unused files are kept\n", config.Server["UnusedFileAge"])
+		return 0
+	}
+
+	return age
+}
+
+// Responds with a file, recording the download in the access log when it succeeds
+//
+// Files which no longer match their recorded size or hash are published as integrity failures.
+func (s *Server) serveTrackedFile(w http.ResponseWriter, r *http.Request, fInfo *storage.FileInfo) {
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	if err := s.serveFile(recorder, r, fInfo); err != nil {
+		log.Printf("Integrity check of %s failed: %v\n", fInfo.RelPath, err)
+		publish(r.Context(), s.catalog, s.events, EventIntegrityFailed, fInfo.Bin.Id, integrityEvent{newFileJSON(fInfo), err.Error()})
+	}
+	if !isDownload(recorder, fInfo) {
+		return
+	}
+
+	access := &db.FileAccess{
+		FileId:     fInfo.Id,
+		Timestamp:  time.Now(),
+		ClientIP:   clientIP(r),
+		UserAgent:  r.UserAgent(),
+		BytesSent:  int64(recorder.written),
+		Range:      r.Header.Get("Range"),
+		Redirected: fInfo.Bin.Redirect,
+	}
+	// the response is complete, so the access is recorded even if the client has gone
+	if err := s.catalog.RecordAccess(context.WithoutCancel(r.Context()), access); err != nil {
+		log.Printf("Failed to record access of %s: %v\n", fInfo.RelPath, err)
+	}
+}
+
+// Checks if a response downloaded a whole file, or was a redirect to it
+//
+// Revalidating a cached copy isn't a download, and neither is a range unless it reaches the end of the file,
+// so resuming or seeking clients count once rather than once per range.
+func isDownload(recorder *statusRecorder, fInfo *storage.FileInfo) bool {
+	switch recorder.status {
+	case http.StatusOK:
+		return true
+	case http.StatusTemporaryRedirect:
+		return fInfo.Bin.Redirect
+	case http.StatusPartialContent:
+		// ranges of several parts are sent without a Content-Range header
+		var first, last, size int64
+		_, err := fmt.Sscanf(recorder.Header().Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &size)
+		return err == nil && last == size-1
+	}
+
+	return false
+}
+
+// Moves files which were last downloaded, or uploaded if never downloaded, before a time to the trash
+//
+// Returns the number of trashed files.
+func TrashUnusedFiles(ctx context.Context, catalog db.Catalog, events *EventBus, before time.Time) (int, error) {
+	trashed := 0
+	for {
+		files, err := catalog.GetLeastRecentlyUsed(ctx, -1, before, unusedBatchSize)
+		if err != nil {
+			return trashed, err
+		}
+
+		now := time.Now()
+		for _, fInfo := range files {
+			ok, err := catalog.TrashFile(ctx, fInfo.RelPath, now)
+			if err != nil {
+				return trashed, err
+			} else if ok {
+				trashed++
+				after := *fInfo
+				after.DeletedTimestamp = now
+				publish(ctx, catalog, events, EventFileExpired, fInfo.Bin.Id, fileRemovalEvent{newFileJSON(&after), false})
+				auditSaved(ctx, catalog, db.AuditFileTrash, fileTarget(fInfo.RelPath), newFileJSON(fInfo), newFileJSON(&after))
+			}
+		}
+
+		if len(files) < unusedBatchSize {
+			return trashed, nil
+		}
+	}
+}
+
+// Trashes files unused for longer than the unused file age every interval, until ctx is done
+func TrashUnusedPeriodically(ctx context.Context, catalog db.Catalog, events *EventBus, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if age := UnusedFileAge(); age > 0 {
+			trashed, err := TrashUnusedFiles(ctx, catalog, events, time.Now().Add(-age))
+			if err != nil {
+				log.Printf("Failed to trash unused files: %v\n", err)
+			} else if trashed > 0 {
+				log.Printf("Moved %d unused files to the trash\n", trashed)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Lists the most recent downloads of a file, limited by the limit parameter
+func (s *Server) listAccesses(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("filePath")
+	limit, ok := parseLimit(w, r, defaultAccessLogLimit)
+	if !ok {
+		return
+	}
+
+	if _, err := s.catalog.GetFile(r.Context(), path); errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting file info: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	accesses, err := s.catalog.GetAccessLog(r.Context(), path, limit)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting accesses of %s: %v : %s\n", path, err, r.RemoteAddr)
+		return
+	}
+
+	response := make([]accessJSON, len(accesses))
+	for i, a := range accesses {
+		response[i] = accessJSON{
+			Timestamp:  a.Timestamp,
+			ClientIP:   a.ClientIP,
+			UserAgent:  a.UserAgent,
+			BytesSent:  a.BytesSent,
+			Range:      a.Range,
+			Redirected: a.Redirected,
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Lists the least recently used files of a bin, last used before the before parameter if given
+func (s *Server) listUnused(w http.ResponseWriter, r *http.Request) {
+	binId, ok := parseBinId(w, r)
+	if !ok {
+		return
+	}
+	before, ok := parseTimeParam(w, r, "before", time.Now())
+	if !ok {
+		return
+	}
+	limit, ok := parseLimit(w, r, defaultAccessLogLimit)
+	if !ok {
+		return
+	}
+
+	files, err := s.catalog.GetLeastRecentlyUsed(r.Context(), binId, before, limit)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting unused files of bin %d: %v : %s\n", binId, err, r.RemoteAddr)
+		return
+	}
+
+	response := make([]fileJSON, len(files))
+	for i, fInfo := range files {
+		response[i] = newFileJSON(fInfo)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"file-cellar/storage"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The representation of a file in api responses
+type fileJSON struct {
+	Id               int64      `json:"id"`
+	BinId            int64      `json:"binId"`
+	Name             string     `json:"name"`
+	Hash             string     `json:"hash"`
+	Type             string     `json:"type"`
+	Size             int64      `json:"size"`
+	RelPath          string     `json:"relPath"`
+	UploadTimestamp  time.Time  `json:"uploadTimestamp"`
+	LogicalPath      string     `json:"logicalPath,omitempty"`
+	Version          int64      `json:"version,omitempty"`
+	DeletedTimestamp *time.Time `json:"deletedTimestamp,omitempty"`
+	Description      string     `json:"description,omitempty"`
+	Downloads        int64      `json:"downloads"`
+	AccessTimestamp  *time.Time `json:"accessTimestamp,omitempty"`
+}
+
+func newFileJSON(fInfo *storage.FileInfo) fileJSON {
+	f := fileJSON{
+		Id:              fInfo.Id,
+		BinId:           fInfo.Bin.Id,
+		Name:            fInfo.Name,
+		Hash:            fInfo.Hash,
+		Type:            fInfo.Type,
+		Size:            fInfo.Size,
+		RelPath:         fInfo.RelPath,
+		UploadTimestamp: fInfo.UploadTimestamp,
+		LogicalPath:     fInfo.LogicalPath,
+		Version:         fInfo.Version,
+		Description:     fInfo.Description,
+		Downloads:       fInfo.Downloads,
+	}
+	if !fInfo.DeletedTimestamp.IsZero() {
+		f.DeletedTimestamp = &fInfo.DeletedTimestamp
+	}
+	if !fInfo.AccessTimestamp.IsZero() {
+		f.AccessTimestamp = &fInfo.AccessTimestamp
+	}
+
+	return f
+}
+
+// Writes v as the json body of a response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing json response: %v\n", err)
+	}
+}
+
+// Parses the optional limit query parameter, responding with an error if it is invalid
+func parseLimit(w http.ResponseWriter, r *http.Request, fallback int) (int, bool) {
+	if !r.URL.Query().Has("limit") {
+		return fallback, true
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		http.Error(w, "Bad limit, it should be a positive integer", http.StatusBadRequest)
+		return 0, false
+	}
+
+	return limit, true
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"file-cellar/db"
+	"file-cellar/storage"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats archives are downloaded in
+const (
+	archiveZip   = "zip"
+	archiveTarGz = "tar.gz"
+)
+
+// Name of the manifest ending every archive, listing the hashes of its files in the format of md5sum
+const manifestName = "MD5SUMS"
+
+// Gets a unique name for each file in an archive, numbering names which collide
+//
+// Files are named by their logical path when they have one, keeping its directories.
+// Name collisions are resolved by inserting " (n)" before the extension, ie "a.txt" and "a (1).txt".
+func archiveNames(files []*storage.FileInfo) []string {
+	used := map[string]bool{manifestName: true}
+	names := make([]string, len(files))
+
+	for i, f := range files {
+		name := f.Name
+		if f.LogicalPath != "" {
+			name = f.LogicalPath
+		}
+		name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))[1:]
+		if name == "" {
+			name = f.RelPath
+		}
+
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		candidate := name
+		for n := 1; used[candidate]; n++ {
+			candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+
+		used[candidate] = true
+		names[i] = candidate
+	}
+
+	return names
+}
+
+// Writes the entries of an archive in one of the archive formats
+type archiveWriter interface {
+	create(name string, size int64, modified time.Time) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a zipArchive) create(name string, size int64, modified time.Time) (io.Writer, error) {
+	return a.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (a tarArchive) create(name string, size int64, modified time.Time) (io.Writer, error) {
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     size,
+		ModTime:  modified,
+	})
+	return a.tw, err
+}
+
+func (a tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+func newArchiveWriter(w io.Writer, format string) archiveWriter {
+	if format == archiveTarGz {
+		gz := gzip.NewWriter(w)
+		return tarArchive{tar.NewWriter(gz), gz}
+	}
+	return zipArchive{zip.NewWriter(w)}
+}
+
+// Streams files into an archive written to w, followed by a manifest of their hashes
+//
+// Fails if a file cannot be read from its bin, leaving the archive incomplete.
+func writeArchive(ctx context.Context, w io.Writer, format string, files []*storage.FileInfo) error {
+	aw := newArchiveWriter(w, format)
+	names := archiveNames(files)
+	manifest := new(strings.Builder)
+
+	for i, fInfo := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		f, err := fInfo.Bin.Get(ctx, storage.FileIdentifier(fInfo.RelPath))
+		if err != nil {
+			return fmt.Errorf("getting %s: %w", fInfo.RelPath, err)
+		}
+
+		entry, err := aw.create(names[i], fInfo.Size, fInfo.UploadTimestamp)
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		_, err = io.Copy(entry, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(manifest, "%s  %s\n", fInfo.Hash, names[i])
+	}
+
+	entry, err := aw.create(manifestName, int64(manifest.Len()), time.Now())
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(entry, manifest.String()); err != nil {
+		return err
+	}
+
+	return aw.Close()
+}
+
+// Checks every file can be read from its bin, so an archive isn't started which can't be finished
+//
+// Files are checked by their status rather than opened, so the check isn't counted as a download.
+func checkReadable(ctx context.Context, files []*storage.FileInfo) error {
+	for _, fInfo := range files {
+		status, err := fInfo.Bin.FileStatus(ctx, storage.FileIdentifier(fInfo.RelPath))
+		if err != nil {
+			return fmt.Errorf("checking %s: %w", fInfo.RelPath, err)
+		} else if status != storage.FileOk {
+			return fmt.Errorf("checking %s: %s", fInfo.RelPath, status)
+		}
+	}
+
+	return nil
+}
+
+// Responds with an archive of files, named name with the extension of the format
+//
+// Responds with an error if a file cannot be read from its bin, and aborts the response
+// if one fails once the archive has started, so clients never get an archive missing files.
+func serveArchive(w http.ResponseWriter, r *http.Request, name string, format string, files []*storage.FileInfo) error {
+	if err := checkReadable(r.Context(), files); err != nil {
+		storageError(w, err)
+		return err
+	}
+
+	contentType := "application/zip"
+	if format == archiveTarGz {
+		contentType = "application/gzip"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name+"."+format))
+	if err := writeArchive(r.Context(), w, format, files); err != nil {
+		log.Printf("Aborting archive %s: %v : %s\n", name, err, r.RemoteAddr)
+		// the status has been sent, so breaking the connection is the only way to signal the failure
+		panic(http.ErrAbortHandler)
+	}
+
+	return nil
+}
+
+// Keeps only the current version of each logical path of files
+func currentFiles(files []*storage.FileInfo) []*storage.FileInfo {
+	latest := make(map[string]int64)
+	for _, f := range files {
+		if f.LogicalPath != "" {
+			latest[f.LogicalPath] = max(latest[f.LogicalPath], f.Version)
+		}
+	}
+
+	current := make([]*storage.FileInfo, 0, len(files))
+	for _, f := range files {
+		if f.LogicalPath == "" || f.Version == latest[f.LogicalPath] {
+			current = append(current, f)
+		}
+	}
+
+	return current
+}
+
+// Parses the ids in the values of a parameter, responding with an error if one is invalid
+func parseIdParams(w http.ResponseWriter, form url.Values, name string) ([]int64, bool) {
+	ids := make([]int64, len(form[name]))
+	for i, value := range form[name] {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, fmt.Sprintf("Bad %s `%s`, it should be a positive integer", name, value), http.StatusBadRequest)
+			return nil, false
+		}
+		ids[i] = id
+	}
+
+	return ids, true
+}
+
+// Gets the files selected by the relPath, tag, collection and bin parameters, responding with an error if it fails
+//
+// Every parameter can be repeated, and files selected more than once are only included once.
+func (s *Server) archiveFiles(w http.ResponseWriter, r *http.Request) ([]*storage.FileInfo, bool) {
+	ctx := r.Context()
+
+	collections, ok := parseIdParams(w, r.Form, "collection")
+	if !ok {
+		return nil, false
+	}
+	bins, ok := parseIdParams(w, r.Form, "bin")
+	if !ok {
+		return nil, false
+	}
+	if len(r.Form["relPath"])+len(r.Form["tag"])+len(collections)+len(bins) == 0 {
+		http.Error(w, "Missing files, select them with the relPath, tag, collection or bin parameters", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var files []*storage.FileInfo
+	for _, relPath := range r.Form["relPath"] {
+		fInfo, err := s.catalog.GetFile(ctx, relPath)
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, fmt.Sprintf("File `%s` not found", relPath), http.StatusNotFound)
+			return nil, false
+		} else if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error getting file %s: %v : %s\n", relPath, err, r.RemoteAddr)
+			return nil, false
+		}
+		files = append(files, fInfo)
+	}
+
+	for _, tag := range r.Form["tag"] {
+		tagged, err := s.catalog.GetTaggedFiles(ctx, tag)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error getting files tagged %s: %v : %s\n", tag, err, r.RemoteAddr)
+			return nil, false
+		}
+		files = append(files, tagged...)
+	}
+
+	for _, id := range collections {
+		if _, err := s.catalog.GetCollection(ctx, id); errors.Is(err, db.ErrNotFound) {
+			http.Error(w, fmt.Sprintf("Collection %d not found", id), http.StatusNotFound)
+			return nil, false
+		} else if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error getting collection %d: %v : %s\n", id, err, r.RemoteAddr)
+			return nil, false
+		}
+		collected, err := s.catalog.GetCollectionFiles(ctx, id)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error getting files of collection %d: %v : %s\n", id, err, r.RemoteAddr)
+			return nil, false
+		}
+		files = append(files, collected...)
+	}
+
+	for _, id := range bins {
+		if _, err := s.catalog.GetBin(ctx, id); errors.Is(err, db.ErrNotFound) {
+			http.Error(w, fmt.Sprintf("Bin %d not found", id), http.StatusNotFound)
+			return nil, false
+		} else if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error getting bin %d: %v : %s\n", id, err, r.RemoteAddr)
+			return nil, false
+		}
+		stored, err := s.catalog.ListFiles(ctx, id)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error listing files in bin %d: %v : %s\n", id, err, r.RemoteAddr)
+			return nil, false
+		}
+		// old versions would only be numbered duplicates of the current ones
+		files = append(files, currentFiles(stored)...)
+	}
+
+	seen := make(map[int64]bool, len(files))
+	unique := files[:0]
+	for _, f := range files {
+		if !seen[f.Id] {
+			seen[f.Id] = true
+			unique = append(unique, f)
+		}
+	}
+
+	return unique, true
+}
+
+// Downloads an archive of the files selected by the relPath, tag, collection and bin parameters
+//
+// The format parameter is zip or tar.gz, defaulting to zip, and the name parameter names the archive.
+// Parameters can be sent in a form for selections too long for a url.
+func (s *Server) downloadArchive(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	format := r.Form.Get("format")
+	if format == "" {
+		format = archiveZip
+	} else if format != archiveZip && format != archiveTarGz {
+		http.Error(w, fmt.Sprintf("Bad format `%s`, it should be %s or %s", format, archiveZip, archiveTarGz), http.StatusBadRequest)
+		return
+	}
+	name := path.Base("/" + r.Form.Get("name"))
+	if name == "/" {
+		name = "archive"
+	}
+
+	files, ok := s.archiveFiles(w, r)
+	if !ok {
+		return
+	}
+
+	if err := serveArchive(w, r, name, format, files); err != nil {
+		log.Printf("Error writing archive: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	log.Printf("Archive of %d files downloaded from %s", len(files), r.RemoteAddr)
+}
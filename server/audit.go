@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"file-cellar/db"
+	"file-cellar/storage"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const defaultAuditLimit = 100
+
+// The audited state of a bin
+type auditBin struct {
+	Id          int64  `json:"id"`
+	Name        string `json:"name"`
+	Driver      string `json:"driver"`
+	ExternalURL string `json:"externalURL"`
+	InternalURL string `json:"internalURL"`
+	Redirect    bool   `json:"redirect"`
+}
+
+// The audited state of a collection, leaving out its share token as knowing it grants access
+type auditCollection struct {
+	Id               int64     `json:"id"`
+	Name             string    `json:"name"`
+	CreatedTimestamp time.Time `json:"createdTimestamp"`
+}
+
+func auditBinState(bin *storage.Bin) any {
+	return auditBin{bin.Id, bin.Name, bin.Driver.Name(), bin.Path.External, bin.Path.Internal, bin.Redirect}
+}
+
+func auditCollectionState(c *storage.Collection) any {
+	return auditCollection{c.Id, c.Name, c.CreatedTimestamp}
+}
+
+func fileTarget(relPath string) string {
+	return "file:" + relPath
+}
+
+// Gets the audit log target of a logical path
+func pathTarget(binId int64, path string) string {
+	return fmt.Sprintf("path:%d/%s", binId, path)
+}
+
+func collectionTarget(id int64) string {
+	return fmt.Sprintf("collection:%d", id)
+}
+
+// Gets the address of the client making a request
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
+// Gets the context of a request, attributing audited operations to the client
+//
+// Requests aren't authenticated, so clients are identified by their address.
+func actorContext(r *http.Request) context.Context {
+	return db.WithActor(r.Context(), "http:"+clientIP(r))
+}
+
+// Records an action in the audit log, attributed to the actor of ctx
+//
+// before and after are encoded as json, nil when the target didn't exist before or doesn't exist after.
+// Callers which can still undo the action fail it when the audit fails, rather than let it go unrecorded,
+// actions which have already been saved are audited with auditSaved instead.
+func Audit(ctx context.Context, catalog db.Catalog, action string, target string, before any, after any) error {
+	entry := &db.AuditEntry{
+		Timestamp: time.Now(),
+		Actor:     db.ActorOf(ctx),
+		Action:    action,
+		Target:    target,
+	}
+
+	var err error
+	if before != nil {
+		if entry.Before, err = json.Marshal(before); err != nil {
+			return fmt.Errorf("encoding state of %s before %s: %w", target, action, err)
+		}
+	}
+	if after != nil {
+		if entry.After, err = json.Marshal(after); err != nil {
+			return fmt.Errorf("encoding state of %s after %s: %w", target, action, err)
+		}
+	}
+
+	// record the action even if the request was cancelled after it happened
+	if err = catalog.AddAuditEntry(context.WithoutCancel(ctx), entry); err != nil {
+		return fmt.Errorf("auditing %s of %s by %s: %w", action, target, entry.Actor, err)
+	}
+
+	return nil
+}
+
+// Audits an action which has already been saved, logging a failure to audit it
+//
+// Failing the action would report a change which happened as failed, and retrying it would then fail too.
+func auditSaved(ctx context.Context, catalog db.Catalog, action string, target string, before any, after any) {
+	if err := Audit(ctx, catalog, action, target, before, after); err != nil {
+		log.Printf("Error auditing: %v\n", err)
+	}
+}
+
+// Lists audit log entries newest first, filtered by the actor, action, target, from and to parameters
+func (s *Server) listAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, ok := parseLimit(w, r, defaultAuditLimit)
+	if !ok {
+		return
+	}
+	from, ok := parseTimeParam(w, r, "from", time.Time{})
+	if !ok {
+		return
+	}
+	to, ok := parseTimeParam(w, r, "to", time.Time{})
+	if !ok {
+		return
+	}
+
+	entries, err := s.catalog.GetAuditLog(r.Context(), db.AuditQuery{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Target: query.Get("target"),
+		From:   from,
+		To:     to,
+		Limit:  limit,
+	})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting audit log: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// Registers a driver in a catalog, auditing the registration
+func RegisterDriver(ctx context.Context, catalog db.Catalog, d storage.Driver) bool {
+	if !catalog.AddDriver(ctx, d) {
+		return false
+	}
+
+	if err := Audit(ctx, catalog, db.AuditDriverRegister, "driver:"+d.Name(), nil, map[string]any{"id": d.Id(), "name": d.Name()}); err != nil {
+		log.Printf("Failed to register driver %s: %v\n", d.Name(), err)
+		return false
+	}
+	return true
+}
+
+// Adds a bin to a catalog, auditing its creation and publishing it on events
+func CreateBin(ctx context.Context, catalog db.Catalog, events *EventBus, bin *storage.Bin, driverId int64) (int64, error) {
+	id, err := catalog.AddBin(ctx, bin, driverId)
+	if err != nil {
+		return 0, err
+	}
+
+	publish(ctx, catalog, events, EventBinChanged, id, binEvent{auditBinState(bin), "created"})
+	if err = Audit(ctx, catalog, db.AuditBinCreate, fmt.Sprintf("bin:%d", id), nil, auditBinState(bin)); err != nil {
+		return id, err
+	}
+	return id, nil
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"errors"
+	"file-cellar/db"
+	"file-cellar/storage"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type collectionJSON struct {
+	Id               int64      `json:"id"`
+	Name             string     `json:"name"`
+	ShareURL         string     `json:"shareUrl"`
+	CreatedTimestamp time.Time  `json:"createdTimestamp"`
+	Files            []fileJSON `json:"files,omitempty"`
+}
+
+func newCollectionJSON(c *storage.Collection, files []*storage.FileInfo) collectionJSON {
+	response := collectionJSON{
+		Id:               c.Id,
+		Name:             c.Name,
+		ShareURL:         "/c/" + c.ShareToken,
+		CreatedTimestamp: c.CreatedTimestamp,
+	}
+	if files != nil {
+		response.Files = make([]fileJSON, len(files))
+		for i, fInfo := range files {
+			response.Files[i] = newFileJSON(fInfo)
+		}
+	}
+
+	return response
+}
+
+// Parses the collectionId path value of a request, responding with an error if it is invalid
+func parseCollectionId(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("collectionId"), 10, 64)
+	if err != nil || id < 0 {
+		http.Error(w, fmt.Sprintf("Bad collectionId `%s`, it should be a positive integer", r.PathValue("collectionId")), http.StatusBadRequest)
+		return 0, false
+	}
+
+	return id, true
+}
+
+func (s *Server) listCollections(w http.ResponseWriter, r *http.Request) {
+	collections, err := s.catalog.ListCollections(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error listing collections: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	response := make([]collectionJSON, len(collections))
+	for i, c := range collections {
+		response[i] = newCollectionJSON(c, nil)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Creates a collection named by the form value name
+func (s *Server) createCollection(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Missing collection name", http.StatusBadRequest)
+		return
+	}
+
+	token, err := storage.NewShareToken()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating share token: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	c := &storage.Collection{
+		Name:             name,
+		ShareToken:       token,
+		CreatedTimestamp: time.Now(),
+	}
+	ctx := actorContext(r)
+	if err = s.catalog.AddCollection(ctx, c); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error adding collection: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+	auditSaved(ctx, s.catalog, db.AuditCollectionCreate, collectionTarget(c.Id), nil, auditCollectionState(c))
+
+	writeJSON(w, http.StatusCreated, newCollectionJSON(c, nil))
+	log.Printf("Collection created %s from %s", name, r.RemoteAddr)
+}
+
+func (s *Server) getCollection(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseCollectionId(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	c, err := s.catalog.GetCollection(ctx, id)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting collection %d: %v : %s\n", id, err, r.RemoteAddr)
+		return
+	}
+
+	files, err := s.catalog.GetCollectionFiles(ctx, id)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting files of collection %d: %v : %s\n", id, err, r.RemoteAddr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newCollectionJSON(c, files))
+}
+
+func (s *Server) deleteCollection(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseCollectionId(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := actorContext(r)
+
+	c, err := s.catalog.GetCollection(ctx, id)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting collection %d: %v : %s\n", id, err, r.RemoteAddr)
+		return
+	}
+
+	ok, err = s.catalog.RemoveCollection(ctx, id)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error removing collection %d: %v : %s\n", id, err, r.RemoteAddr)
+		return
+	} else if !ok {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+	auditSaved(ctx, s.catalog, db.AuditCollectionDelete, collectionTarget(id), auditCollectionState(c), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("Collection deleted %d from %s", id, r.RemoteAddr)
+}
+
+func (s *Server) addToCollection(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseCollectionId(w, r)
+	if !ok {
+		return
+	}
+	path := r.PathValue("filePath")
+
+	err := s.catalog.AddToCollection(r.Context(), id, path)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Collection or file not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error adding %s to collection %d: %v : %s\n", path, id, err, r.RemoteAddr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) removeFromCollection(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseCollectionId(w, r)
+	if !ok {
+		return
+	}
+	path := r.PathValue("filePath")
+
+	ok, err := s.catalog.RemoveFromCollection(r.Context(), id, path)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error removing %s from collection %d: %v : %s\n", path, id, err, r.RemoteAddr)
+		return
+	} else if !ok {
+		http.Error(w, "File not in collection", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) downloadCollection(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseCollectionId(w, r)
+	if !ok {
+		return
+	}
+
+	c, err := s.catalog.GetCollection(r.Context(), id)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting collection %d: %v : %s\n", id, err, r.RemoteAddr)
+		return
+	}
+
+	serveCollection(w, r, s.catalog, c)
+}
+
+// Downloads a collection through its share link
+//
+// Like individual files, knowing the unguessable share token is what grants access,
+// and files in the trash are never included.
+func (s *Server) downloadSharedCollection(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+
+	c, err := s.catalog.GetSharedCollection(r.Context(), token)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting shared collection: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	serveCollection(w, r, s.catalog, c)
+}
+
+// Responds with a zip archive of the files in a collection
+func serveCollection(w http.ResponseWriter, r *http.Request, catalog db.Catalog, c *storage.Collection) {
+	ctx := r.Context()
+
+	files, err := catalog.GetCollectionFiles(ctx, c.Id)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting files of collection %d: %v : %s\n", c.Id, err, r.RemoteAddr)
+		return
+	}
+
+	if err = serveArchive(w, r, c.Name, archiveZip, files); err != nil {
+		log.Printf("Error writing archive of collection %d: %v : %s\n", c.Id, err, r.RemoteAddr)
+		return
+	}
+
+	log.Printf("Collection downloaded %d from %s", c.Id, r.RemoteAddr)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"file-cellar/db"
+	"file-cellar/storage"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Moves a file to the trash
+func (s *Server) remove(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("filePath")
+	if path == "" {
+		http.Error(w, "Missing path", http.StatusBadRequest)
+		log.Println("Missing file path: ", r.RemoteAddr)
+		return
+	}
+
+	ctx := actorContext(r)
+
+	fInfo, err := s.catalog.GetFile(ctx, path)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting file info: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	now := time.Now()
+	ok, err := s.catalog.TrashFile(ctx, path, now)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error moving file to trash: %v : %s\n", err, r.RemoteAddr)
+		return
+	} else if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	after := *fInfo
+	after.DeletedTimestamp = now
+	publish(ctx, s.catalog, s.events, EventFileDeleted, fInfo.Bin.Id, fileRemovalEvent{newFileJSON(&after), false})
+	auditSaved(ctx, s.catalog, db.AuditFileTrash, fileTarget(path), newFileJSON(fInfo), newFileJSON(&after))
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("File trashed %s from %s", path, r.RemoteAddr)
+}
+
+// Removes a file from the database then deletes it and its derivatives from storage
+//
+// The removal is audited and published on events as an event of eventType. Failures to delete from storage are
+// logged but not returned.
+func deleteFile(ctx context.Context, catalog db.Catalog, events *EventBus, fInfo *storage.FileInfo, eventType string) error {
+	derivatives, err := catalog.GetDerivatives(ctx, fInfo.Id)
+	if err != nil {
+		return err
+	}
+
+	if _, err = catalog.RemoveFile(ctx, fInfo.RelPath); err != nil {
+		return err
+	}
+	auditSaved(ctx, catalog, db.AuditFileDelete, fileTarget(fInfo.RelPath), newFileJSON(fInfo), nil)
+	publish(ctx, catalog, events, eventType, fInfo.Bin.Id, fileRemovalEvent{newFileJSON(fInfo), true})
+
+	deleteDerivatives(ctx, derivatives)
+	if err = fInfo.Bin.Delete(ctx, fInfo); err != nil {
+		log.Printf("Failed to delete %s from storage: %v\n", fInfo.RelPath, err)
+	}
+
+	return nil
+}
+
+// Renames a file to the form value name
+func (s *Server) renameFile(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("filePath")
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		http.Error(w, fmt.Sprintf("Bad name `%s`, it should be a non empty file name without slashes", name), http.StatusBadRequest)
+		return
+	}
+
+	ctx := actorContext(r)
+
+	fInfo, err := s.catalog.GetFile(ctx, path)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting file info: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	ok, err := s.catalog.SetName(ctx, path, name)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error renaming %s: %v : %s\n", path, err, r.RemoteAddr)
+		return
+	} else if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	after := *fInfo
+	after.Name = name
+	auditSaved(ctx, s.catalog, db.AuditFileRename, fileTarget(path), newFileJSON(fInfo), newFileJSON(&after))
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("File renamed %s to %s from %s", path, name, r.RemoteAddr)
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"file-cellar/config"
+	"file-cellar/db"
+	"file-cellar/derive"
+	"file-cellar/storage"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// Gets the sizes thumbnails can be requested at
+func thumbnailSizes() []int64 {
+	sizes := make([]int64, 0)
+	for _, field := range strings.Split(config.Server["ThumbnailSizes"], ",") {
+		size, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil || size <= 0 {
+			continue
+		}
+		sizes = append(sizes, size)
+	}
+
+	return sizes
+}
+
+// Gets the bin derivatives of a file should be stored in
+func derivativeBin(ctx context.Context, catalog db.Catalog, source *storage.Bin) (*storage.Bin, error) {
+	binId, err := strconv.ParseInt(config.Server["DerivativeBin"], 10, 64)
+	if err != nil {
+		return source, nil
+	}
+
+	return catalog.GetBin(ctx, binId)
+}
+
+// Gets a derivative of a file, creating it if it does not exist
+func getDerivative(ctx context.Context, catalog db.Catalog, fInfo *storage.FileInfo, kind string, param int64) (*storage.Derivative, error) {
+	d, err := catalog.GetDerivative(ctx, fInfo.Id, kind, param)
+	if !errors.Is(err, db.ErrNotFound) {
+		return d, err
+	}
+
+	gen, ok := derive.Get(kind)
+	if !ok {
+		return nil, fmt.Errorf("unknown derivative kind %s", kind)
+	}
+
+	return createDerivative(ctx, catalog, fInfo, gen, param)
+}
+
+// Generates a derivative of a file, storing and recording it
+func createDerivative(ctx context.Context, catalog db.Catalog, fInfo *storage.FileInfo, gen derive.Generator, param int64) (*storage.Derivative, error) {
+	if !gen.Accepts(fInfo.Type) {
+		return nil, derive.ErrUnsupported
+	}
+
+	src, err := fInfo.Bin.Get(ctx, storage.FileIdentifier(fInfo.RelPath))
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	buf := new(bytes.Buffer)
+	mimeType, err := gen.Generate(buf, src, param)
+	if err != nil {
+		return nil, err
+	}
+	data := bytes.NewReader(buf.Bytes())
+
+	hash, err := computeHash(newFileHash(), data)
+	if err != nil {
+		return nil, err
+	}
+	data.Seek(0, io.SeekStart)
+
+	bin, err := derivativeBin(ctx, catalog, fInfo.Bin)
+	if err != nil {
+		return nil, err
+	}
+
+	createTime := time.Now()
+	name := fmt.Sprintf("%s.%s%d", fInfo.Name, gen.Kind(), param)
+	relPath, err := storage.GetRelPath(name, hash, createTime)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &storage.Derivative{
+		ParentId: fInfo.Id,
+		Kind:     gen.Kind(),
+		Param:    param,
+		FileInfo: storage.FileInfo{
+			Name:            name,
+			Hash:            hash,
+			Type:            mimeType,
+			Size:            data.Size(),
+			RelPath:         relPath,
+			UploadTimestamp: createTime,
+			Bin:             bin,
+		},
+	}
+
+	f := &storage.File{
+		Data:     nopSeekCloser{data},
+		FileInfo: d.FileInfo,
+	}
+	if err = bin.Upload(ctx, f); err != nil {
+		return nil, err
+	}
+
+	if err = catalog.AddDerivative(ctx, d); err != nil {
+		// the derivative may have been created concurrently
+		if err := bin.Delete(ctx, &d.FileInfo); err != nil {
+			log.Printf("Failed to remove unrecorded derivative %s: %v\n", relPath, err)
+		}
+		return catalog.GetDerivative(ctx, fInfo.Id, gen.Kind(), param)
+	}
+	log.Printf("Created %s %d of %s\n", d.Kind, d.Param, fInfo.RelPath)
+
+	return d, nil
+}
+
+// Creates thumbnails of a newly uploaded file at every configured size
+func createThumbnails(catalog db.Catalog, fInfo *storage.FileInfo) {
+	gen, ok := derive.Get(derive.ThumbnailKind)
+	if !ok || !gen.Accepts(fInfo.Type) {
+		return
+	}
+
+	ctx := context.Background()
+	for _, size := range thumbnailSizes() {
+		if _, err := getDerivative(ctx, catalog, fInfo, gen.Kind(), size); err != nil {
+			log.Printf("Failed to create thumbnail %d of %s: %v\n", size, fInfo.RelPath, err)
+		}
+	}
+}
+
+// Removes all derivatives of a file from storage
+func deleteDerivatives(ctx context.Context, derivatives []*storage.Derivative) {
+	for _, d := range derivatives {
+		if err := d.Bin.Delete(ctx, &d.FileInfo); err != nil {
+			log.Printf("Failed to delete %s %d of file %d: %v\n", d.Kind, d.Param, d.ParentId, err)
+		}
+	}
+}
+
+func (s *Server) serveThumbnail(w http.ResponseWriter, r *http.Request, fInfo *storage.FileInfo) {
+	size, err := strconv.ParseInt(r.URL.Query().Get("thumb"), 10, 64)
+	allowed := false
+	for _, s := range thumbnailSizes() {
+		allowed = allowed || s == size
+	}
+	if err != nil || !allowed {
+		http.Error(w, fmt.Sprintf("Bad thumbnail size, expected one of %v", thumbnailSizes()), http.StatusBadRequest)
+		log.Printf("Bad thumbnail size `%s`: %s\n", r.URL.Query().Get("thumb"), r.RemoteAddr)
+		return
+	}
+
+	d, err := getDerivative(r.Context(), s.catalog, fInfo, derive.ThumbnailKind, size)
+	if err == derive.ErrUnsupported || err == derive.ErrTooLarge {
+		http.Error(w, "No thumbnail available for file", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting thumbnail of %s: %v : %s\n", fInfo.RelPath, err, r.RemoteAddr)
+		return
+	}
+
+	s.serveFile(w, r, &d.FileInfo)
+}
@@ -1,49 +1,291 @@
 package server
 
 import (
-	"file-cellar/config"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"file-cellar/db"
 	"file-cellar/storage"
+	"fmt"
+	"hash"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"path"
+	"strings"
 )
 
-func download(w http.ResponseWriter, r *http.Request) {
-	// TODO: get relpath
+// Cache-Control of content which never changes, such as files downloaded by their content addressed relative path
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// Responds with the error of finding a file or version for a download, returning if there was one
+//
+// Files in the trash, including expired files, are gone rather than not found.
+func findError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, db.ErrNotFound):
+		http.Error(w, "File not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrTrashed):
+		http.Error(w, "File has been deleted", http.StatusGone)
+	default:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting file info: %v : %s\n", err, r.RemoteAddr)
+	}
+
+	return true
+}
+
+// Downloads a file by its relative path, or gets its headers with HEAD
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
 	path := r.PathValue("filePath")
 	if path == "" {
 		http.Error(w, "Missing path", http.StatusBadRequest)
 		log.Println("Missing file path: ", r.RemoteAddr)
-        return
+		return
 	}
 
-	manager, err := db.GetManager(config.Server["DBURL"], config.DB_PRAGMAS)
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error getting manager for: %s\n", r.RemoteAddr)
+	fInfo, err := db.FindFile(r.Context(), s.catalog, path)
+	if findError(w, r, err) {
+		return
+	}
+
+	if r.URL.Query().Has("thumb") {
+		s.serveThumbnail(w, r, fInfo)
+		return
+	}
+
+	// relative paths are derived from the hash of the content, so it never changes
+	s.serveDownload(w, r, fInfo, immutableCacheControl)
+}
+
+// Responds to a GET of a file with its content, or to a HEAD with the same headers and status
+//
+// HEAD is answered from the catalog, without getting the file from its bin, or redirected like GET for redirecting bins.
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request, fInfo *storage.FileInfo, cacheControl string) {
+	w.Header().Set("Cache-Control", cacheControl)
+	if r.Method != http.MethodHead {
+		s.serveTrackedFile(w, r, fInfo)
+		return
+	}
+	if fInfo.Bin.Redirect {
+		s.serveRedirect(w, r, fInfo)
 		return
 	}
-	defer manager.Close()
 
-	ctx := r.Context()
+	setFileHeaders(w.Header(), fInfo)
+	http.ServeContent(w, r, fInfo.Name, fInfo.UploadTimestamp, &unreadContent{size: fInfo.Size})
+}
+
+// Content of a known size which is never read, letting ServeContent answer HEAD requests without the file
+type unreadContent struct {
+	size   int64
+	offset int64
+}
+
+func (c *unreadContent) Read(p []byte) (int, error) {
+	return 0, errors.New("content of a HEAD request read")
+}
+
+func (c *unreadContent) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		c.offset = offset
+	case io.SeekCurrent:
+		c.offset += offset
+	case io.SeekEnd:
+		c.offset = c.size + offset
+	}
+
+	return c.offset, nil
+}
+
+// Responds with the status of an error getting a file from its bin
+func storageError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, storage.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, storage.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusServiceUnavailable
+	}
+
+	// errors are only temporary, unlike the content the caching headers were set for
+	w.Header().Del("Cache-Control")
+	http.Error(w, http.StatusText(status), status)
+}
+
+// A reader hashing the content read in order from the start of a file
+type hashingReader struct {
+	io.ReadSeeker
+	hash    hash.Hash
+	size    int64 // size of the content, -1 until the end has been seeked to
+	offset  int64
+	hashing bool // every byte before offset has been hashed in order
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.ReadSeeker.Read(p)
+	if h.hashing {
+		h.hash.Write(p[:n])
+	}
+	h.offset += int64(n)
+
+	return n, err
+}
 
-	fInfo, err := manager.GetFile(ctx, path)
+func (h *hashingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := h.ReadSeeker.Seek(offset, whence)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error getting file info: %v : %s\n", err, r.RemoteAddr)
+		return pos, err
+	}
+
+	if whence == io.SeekEnd && offset == 0 {
+		h.size = pos
+	}
+	h.offset = pos
+	h.hashing = pos == 0
+	if h.hashing {
+		h.hash.Reset()
+	}
+
+	return pos, nil
+}
+
+// Checks the content read matches the recorded size and hash of a file
+//
+// The hash is only checked when the whole content was read.
+func (h *hashingReader) verify(fInfo *storage.FileInfo) error {
+	if h.size < 0 {
+		return nil
+	} else if h.size != fInfo.Size {
+		return fmt.Errorf("stored size %d does not match recorded size %d", h.size, fInfo.Size)
+	}
+
+	if h.hashing && h.offset == h.size {
+		if hash := hex.EncodeToString(h.hash.Sum(nil)); hash != fInfo.Hash {
+			return fmt.Errorf("stored hash %s does not match recorded hash %s", hash, fInfo.Hash)
+		}
+	}
+
+	return nil
+}
+
+// Sets the headers describing a downloaded file
+//
+// The ETag lets ServeContent answer If-None-Match, If-Match and If-Range.
+// The recorded type is sent rather than sniffed, so the headers are known without the content.
+func setFileHeaders(header http.Header, fInfo *storage.FileInfo) {
+	contentType := fInfo.Type
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(fInfo.Name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("ETag", `"`+fInfo.Hash+`"`)
+	header.Set("Content-Disposition", contentDisposition("inline", fInfo.Name))
+	setDigest(header, fInfo.Hash)
+}
+
+// Redirects to a url of a file from the driver of its bin
+//
+// The redirect is temporary and cached no longer than the redirect lifetime, so clients come back for a new url
+// and stop being redirected once the file is trashed and cached redirects expire.
+// The url itself is only revoked if the driver expires it: the urls of local bins are never revoked,
+// staying valid until the file is purged from the public url of its bin.
+func (s *Server) serveRedirect(w http.ResponseWriter, r *http.Request, fInfo *storage.FileInfo) {
+	lifetime := s.redirectLifetime
+	redirectUrl, err := fInfo.Bin.URL(r.Context(), storage.FileIdentifier(fInfo.RelPath), lifetime)
+	if err != nil {
+		storageError(w, err)
+		log.Printf("Error getting url of %s from its bin: %v : %s\n", fInfo.RelPath, err, r.RemoteAddr)
 		return
 	}
 
-	f, redirectUrl, err := fInfo.Bin.Get(ctx, storage.FileIdentifier(fInfo.RelPath))
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(lifetime.Seconds())))
+	http.Redirect(w, r, redirectUrl, http.StatusTemporaryRedirect)
+}
+
+// Responds with the contents of a file or a redirect to it
+//
+// Returns an error if the content served doesn't match the recorded size or hash of the file,
+// including when it is missing from its bin.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, fInfo *storage.FileInfo) error {
+	if fInfo.Bin.Redirect {
+		s.serveRedirect(w, r, fInfo)
+		return nil
+	}
+
+	f, err := fInfo.Bin.Get(r.Context(), storage.FileIdentifier(fInfo.RelPath))
 	if err != nil {
-		// TODO: handle errors from Bin Get
+		storageError(w, err)
+		if errors.Is(err, storage.ErrNotExist) {
+			return fmt.Errorf("stored file is missing: %w", err)
+		}
+		log.Printf("Error getting %s from its bin: %v : %s\n", fInfo.RelPath, err, r.RemoteAddr)
+		return nil
 	}
 	defer f.Close()
 
-	if fInfo.Bin.Redirect {
-		http.Redirect(w, r, redirectUrl, http.StatusPermanentRedirect)
+	setFileHeaders(w.Header(), fInfo)
+
+	content := &hashingReader{ReadSeeker: f, hash: newFileHash(), size: -1}
+	http.ServeContent(w, r, fInfo.Name, fInfo.UploadTimestamp, content)
+
+	return content.verify(fInfo)
+}
+
+// Formats a Content-Disposition header naming a file, as described in RFC 6266
+//
+// The filename parameter is an ascii approximation of the name for old clients,
+// and filename* is the exact name encoded as in RFC 8187.
+func contentDisposition(disposition string, name string) string {
+	fallback := new(strings.Builder)
+	encoded := new(strings.Builder)
+	for _, c := range name {
+		if c < 0x20 || c > 0x7e || c == '"' || c == '\\' || c == '%' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(c)
+		}
+	}
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(encoded, "%%%02X", b)
+		}
+	}
+
+	if fallback.String() == name {
+		return fmt.Sprintf(`%s; filename="%s"`, disposition, name)
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback, encoded)
+}
+
+// Checks if a byte can appear unencoded in an RFC 8187 extended value
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// Sets the Repr-Digest header of RFC 9530, and the Digest header of RFC 3230 it replaces, from the hex md5 of a file
+func setDigest(header http.Header, hexHash string) {
+	sum, err := hex.DecodeString(hexHash)
+	if err != nil || len(sum) != md5.Size {
 		return
 	}
 
-	http.ServeContent(w, r, fInfo.Name, fInfo.UploadTimestamp, f)
+	encoded := base64.StdEncoding.EncodeToString(sum)
+	header.Set("Repr-Digest", "md5=:"+encoded+":")
+	header.Set("Digest", "md5="+encoded)
 }
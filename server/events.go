@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"file-cellar/config"
+	"file-cellar/db"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Types of the events published by the server
+const (
+	EventFileUploaded    = "file.uploaded"
+	EventFileDeleted     = "file.deleted"     // trashed or permanently deleted by a client
+	EventFileExpired     = "file.expired"     // removed by the unused file cleanup, trash grace period or version retention
+	EventIntegrityFailed = "integrity.failed" // a stored file no longer matches its recorded size or hash
+	EventBinChanged      = "bin.changed"
+)
+
+// Every type of event, in the order they are documented
+var EventTypes = []string{EventFileUploaded, EventFileDeleted, EventFileExpired, EventIntegrityFailed, EventBinChanged}
+
+// Something that happened to a file or bin
+type Event struct {
+	Id        int64     `json:"id"` // position of the event in the event log
+	Type      string    `json:"type"`
+	BinId     int64     `json:"binId"` // bin the event happened in
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"` // who caused the event, see db.ActorOf
+	Data      any       `json:"data"`
+}
+
+// The data of file.uploaded events
+type fileEvent struct {
+	File fileJSON `json:"file"`
+}
+
+// The data of file.deleted and file.expired events
+type fileRemovalEvent struct {
+	File      fileJSON `json:"file"`
+	Permanent bool     `json:"permanent"` // the file was deleted from storage rather than moved to the trash
+}
+
+// The data of integrity.failed events
+type integrityEvent struct {
+	File  fileJSON `json:"file"`
+	Error string   `json:"error"`
+}
+
+// The data of bin.changed events
+type binEvent struct {
+	Bin    any    `json:"bin"`    // the state of the bin, as recorded in the audit log
+	Change string `json:"change"` // what happened to the bin, ie created
+}
+
+// Distributes events to the subscribers in the server process, and signals the webhook deliverer of queued deliveries
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers map[int]func(Event)
+	lastId      int
+	queued      chan struct{} // signalled when deliveries to webhooks were queued
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[int]func(Event)), queued: make(chan struct{}, 1)}
+}
+
+// Calls fn with every event published until the returned function is called
+//
+// fn is called by the publisher, so it must not block.
+func (b *EventBus) Subscribe(fn func(Event)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastId++
+	id := b.lastId
+	b.subscribers[id] = fn
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+func (b *EventBus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, fn := range b.subscribers {
+		fn(e)
+	}
+}
+
+// Signals the webhook deliverer that deliveries were queued, without waiting for it
+func (b *EventBus) signalQueued() {
+	select {
+	case b.queued <- struct{}{}:
+	default:
+	}
+}
+
+// Gets a channel receiving a signal when deliveries to webhooks were queued
+func (b *EventBus) Queued() <-chan struct{} {
+	return b.queued
+}
+
+// Gets how many events are kept in the event log for clients resuming event streams
+func EventLogSize() int {
+	size, err := strconv.Atoi(config.Server["EventLogSize"])
+	if err != nil || size <= 0 {
+		log.Printf("Bad event log size `%s`, using 10000\n", config.Server["EventLogSize"])
+		return 10000
+	}
+
+	return size
+}
+
+// Gets an event from its record in the event log
+func loggedEvent(record *db.EventRecord) Event {
+	return Event{
+		Id:        record.Id,
+		Type:      record.Type,
+		BinId:     record.BinId,
+		Timestamp: record.Timestamp,
+		Actor:     record.Actor,
+		Data:      json.RawMessage(record.Data),
+	}
+}
+
+// Publishes an event in a bin caused by the actor of ctx on a bus, logging it and queueing its delivery to webhooks
+//
+// Failures are logged as the event has already happened.
+func publish(ctx context.Context, catalog db.Catalog, events *EventBus, eventType string, binId int64, data any) {
+	// the event is recorded even if the request was cancelled after it happened
+	ctx = context.WithoutCancel(ctx)
+	e := Event{
+		Type:      eventType,
+		BinId:     binId,
+		Timestamp: time.Now().Truncate(time.Second),
+		Actor:     db.ActorOf(ctx),
+		Data:      data,
+	}
+
+	encoded, err := json.Marshal(e.Data)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", eventType, err)
+		return
+	}
+
+	record := &db.EventRecord{
+		Type:      e.Type,
+		BinId:     e.BinId,
+		Timestamp: e.Timestamp,
+		Actor:     e.Actor,
+		Data:      encoded,
+	}
+	if err = catalog.AddEvent(ctx, record, EventLogSize()); err != nil {
+		log.Printf("Failed to log %s event: %v\n", eventType, err)
+	}
+	e.Id = record.Id
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", eventType, err)
+		return
+	}
+	queued, err := catalog.QueueEvent(ctx, eventType, payload, e.Timestamp)
+	if err != nil {
+		log.Printf("Failed to queue %s event for webhooks: %v\n", eventType, err)
+	} else if queued > 0 {
+		events.signalQueued()
+	}
+
+	events.Publish(e)
+}
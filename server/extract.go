@@ -0,0 +1,299 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"file-cellar/config"
+	"file-cellar/db"
+	"file-cellar/storage"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of archives extracted on upload, in addition to the formats archives are downloaded in
+const archiveTar = "tar"
+
+// Limits of the archives extracted on upload, guarding against archives expanding far beyond their size
+type extractLimits struct {
+	maxBytes int64   // total size of the extracted files
+	maxFiles int     // number of extracted files
+	maxRatio float64 // total size of the extracted files over the size of the archive
+}
+
+// Gets the configured limits of extracted archives
+func extractionLimits() extractLimits {
+	limits := extractLimits{maxBytes: 1 << 30, maxFiles: 10000, maxRatio: 100}
+
+	if maxBytes, err := strconv.ParseInt(config.Server["ExtractMaxBytes"], 10, 64); err != nil || maxBytes <= 0 {
+		log.Printf("Bad extraction size limit `%s`, using %d\n", config.Server["ExtractMaxBytes"], limits.maxBytes)
+	} else {
+		limits.maxBytes = maxBytes
+	}
+	if maxFiles, err := strconv.Atoi(config.Server["ExtractMaxFiles"]); err != nil || maxFiles <= 0 {
+		log.Printf("Bad extraction file limit `%s`, using %d\n", config.Server["ExtractMaxFiles"], limits.maxFiles)
+	} else {
+		limits.maxFiles = maxFiles
+	}
+	if maxRatio, err := strconv.ParseFloat(config.Server["ExtractMaxRatio"], 64); err != nil || maxRatio <= 0 {
+		log.Printf("Bad extraction ratio limit `%s`, using %g\n", config.Server["ExtractMaxRatio"], limits.maxRatio)
+	} else {
+		limits.maxRatio = maxRatio
+	}
+
+	return limits
+}
+
+// Checks if archives uploaded to a bin are extracted
+func extractsArchives(binId int64) bool {
+	if config.Server["ExtractArchiveBins"] == "" {
+		return false
+	}
+
+	return slices.Contains(strings.Split(config.Server["ExtractArchiveBins"], ","), strconv.FormatInt(binId, 10))
+}
+
+// Gets the format of an archive by its file name, empty if it isn't an archive
+func uploadedArchiveFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return archiveZip
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return archiveTarGz
+	case strings.HasSuffix(name, ".tar"):
+		return archiveTar
+	}
+
+	return ""
+}
+
+// Gets the name of an archive without its extension
+func archiveBaseName(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(lower, ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+
+	return name
+}
+
+// Gets the most bytes an archive may expand to under the limits of extracted archives
+func (limits extractLimits) expandedLimit(size int64) int64 {
+	return min(limits.maxBytes, int64(limits.maxRatio*float64(max(size, 1))))
+}
+
+// A reader failing once more than limit bytes have been read through it
+type expansionReader struct {
+	r     io.Reader
+	read  int64
+	limit int64
+}
+
+func (e *expansionReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.read += int64(n)
+	if e.read > e.limit {
+		return n, fmt.Errorf("it expands to more than %d bytes", e.limit)
+	}
+
+	return n, err
+}
+
+// Calls fn with every regular file of an archive, its path and its size
+//
+// Directories, links and other special members are skipped. The reader is only valid until fn returns.
+// Reading more than limit bytes of a decompressed tar stream fails, counting the headers and data of every member,
+// since the data of skipped members is decompressed too.
+func walkArchive(archive *os.File, size int64, format string, limit int64, fn func(name string, size int64, r io.Reader) error) error {
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if format == archiveZip {
+		zr, err := zip.NewReader(archive, size)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			if err = walkZipFile(f, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var r io.Reader = archive
+	if format == archiveTarGz {
+		gz, err := gzip.NewReader(archive)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(&expansionReader{r: r, limit: limit})
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err = fn(header.Name, header.Size, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZipFile(f *zip.File, fn func(name string, size int64, r io.Reader) error) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return fn(f.Name, int64(f.UncompressedSize64), r)
+}
+
+// Gets the path of an archive member, failing if it would be extracted outside of the archive
+func memberPath(name string) (string, error) {
+	cleaned := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if !fs.ValidPath(cleaned) || cleaned == "." {
+		return "", fmt.Errorf("member `%s` is outside of the archive", name)
+	}
+
+	return cleaned, nil
+}
+
+// Checks an archive is within the limits of extracted archives before anything is extracted
+//
+// The sizes recorded in the archive are checked, and extraction fails if a member is larger than recorded.
+func checkArchive(archive *os.File, size int64, format string, limits extractLimits) error {
+	files, total := 0, int64(0)
+	err := walkArchive(archive, size, format, limits.expandedLimit(size), func(name string, memberSize int64, r io.Reader) error {
+		if _, err := memberPath(name); err != nil {
+			return err
+		}
+
+		files++
+		total += memberSize
+		switch {
+		case files > limits.maxFiles:
+			return fmt.Errorf("it has more than %d files", limits.maxFiles)
+		case memberSize < 0 || total > limits.maxBytes:
+			return fmt.Errorf("it expands to more than %d bytes", limits.maxBytes)
+		case float64(total) > limits.maxRatio*float64(max(size, 1)):
+			return fmt.Errorf("it expands to more than %g times its size", limits.maxRatio)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if files == 0 {
+		return errors.New("it has no files")
+	}
+
+	return nil
+}
+
+// Extracts the files of an uploaded archive into its bin, collecting them in a collection named after the archive
+//
+// Files are stored at their path in the archive, under the logical path of the archive without its extension.
+// Returns the collection and the extracted files, which are removed along with the collection if extraction fails part way.
+// The collection is audited once every file is extracted, and the files are left for the caller to complete.
+func (s *Server) extractArchive(ctx context.Context, archive *storage.FileInfo, spool *os.File, format string) (*storage.Collection, []*storage.FileInfo, error) {
+	token, err := storage.NewShareToken()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &storage.Collection{
+		Name:             archiveBaseName(archive.Name),
+		ShareToken:       token,
+		CreatedTimestamp: time.Now(),
+	}
+	if err = s.catalog.AddCollection(ctx, c); err != nil {
+		return nil, nil, err
+	}
+
+	dir := archiveBaseName(archive.Name)
+	if archive.LogicalPath != "" {
+		dir = archiveBaseName(archive.LogicalPath)
+	}
+
+	var extracted []*storage.FileInfo
+	err = walkArchive(spool, archive.Size, format, extractionLimits().expandedLimit(archive.Size), func(name string, size int64, r io.Reader) error {
+		name, err := memberPath(name)
+		if err != nil {
+			return err
+		}
+
+		// members larger than recorded fail, as the limits were checked against the recorded sizes
+		member, hash, memberSize, err := spoolUpload(io.LimitReader(r, size+1))
+		if err != nil {
+			return err
+		}
+		defer os.Remove(member.Name())
+		defer member.Close()
+		if memberSize != size {
+			return fmt.Errorf("member `%s` is %d bytes rather than %d", name, memberSize, size)
+		}
+
+		fInfo := &storage.FileInfo{
+			Name:        path.Base(name),
+			Bin:         archive.Bin,
+			LogicalPath: path.Join(dir, name),
+			Description: archive.Description,
+		}
+		if err = s.storeUpload(ctx, fInfo, member, hash, memberSize); err != nil {
+			return err
+		}
+		extracted = append(extracted, fInfo)
+
+		return s.catalog.AddToCollection(ctx, c.Id, fInfo.RelPath)
+	})
+	if err == nil {
+		err = Audit(ctx, s.catalog, db.AuditCollectionCreate, collectionTarget(c.Id), nil, auditCollectionState(c))
+	}
+	if err != nil {
+		s.discardExtraction(ctx, c, extracted)
+		return nil, nil, err
+	}
+
+	return c, extracted, nil
+}
+
+// Removes the collection and files of a failed extraction, so nothing is kept of an upload reported as failed
+//
+// Neither was announced, so their removal isn't published or audited.
+func (s *Server) discardExtraction(ctx context.Context, c *storage.Collection, extracted []*storage.FileInfo) {
+	for _, fInfo := range extracted {
+		s.discardUpload(ctx, fInfo)
+	}
+
+	if _, err := s.catalog.RemoveCollection(ctx, c.Id); err != nil {
+		log.Printf("Failed to remove collection %d of a failed extraction: %v\n", c.Id, err)
+	}
+}
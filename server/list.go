@@ -0,0 +1,65 @@
+package server
+
+import (
+	"log"
+	"net/http"
+)
+
+type binJSON struct {
+	Id       int64  `json:"id"`
+	Name     string `json:"name"`
+	Driver   string `json:"driver"`
+	Redirect bool   `json:"redirect"`
+	Files    int64  `json:"files"` // number of stored files, including trashed files and old versions
+	Bytes    int64  `json:"bytes"`
+}
+
+// Lists the bins and the files stored in them
+func (s *Server) listBins(w http.ResponseWriter, r *http.Request) {
+	bins, err := s.catalog.ListBins(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error listing bins: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+	usage, err := s.catalog.GetBinUsage(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting bin usage: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	response := make([]binJSON, len(bins))
+	for i, bin := range bins {
+		response[i] = binJSON{Id: bin.Id, Name: bin.Name, Driver: bin.Driver.Name(), Redirect: bin.Redirect}
+		for _, u := range usage {
+			if u.BinId == bin.Id {
+				response[i].Files = u.Files
+				response[i].Bytes = u.Bytes
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request) {
+	binId, ok := parseBinId(w, r)
+	if !ok {
+		return
+	}
+
+	files, err := s.catalog.ListFiles(r.Context(), binId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error listing files in bin %d: %v : %s\n", binId, err, r.RemoteAddr)
+		return
+	}
+
+	response := make([]fileJSON, len(files))
+	for i, fInfo := range files {
+		response[i] = newFileJSON(fInfo)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"file-cellar/db"
+	"file-cellar/metrics"
+	"file-cellar/storage"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Counters of storage.Stats exported for every bin and driver
+var statsMetrics = []struct {
+	name  string
+	help  string
+	value func(storage.Stats) uint64
+}{
+	{"uploads_total", "Files uploaded.", func(s storage.Stats) uint64 { return s.Uploaded }},
+	{"downloads_total", "Files downloaded.", func(s storage.Stats) uint64 { return s.Downloaded }},
+	{"redirects_total", "Downloads redirected to the storage backend.", func(s storage.Stats) uint64 { return s.Redirected }},
+	{"deletes_total", "Files deleted.", func(s storage.Stats) uint64 { return s.Deleted }},
+	{"failures_total", "Failed file operations.", func(s storage.Stats) uint64 { return s.Failed }},
+	{"uploaded_bytes_total", "Bytes uploaded.", func(s storage.Stats) uint64 { return s.UploadedBytes }},
+	{"downloaded_bytes_total", "Bytes read from downloaded files.", func(s storage.Stats) uint64 { return s.DownloadedBytes }},
+	{"deleted_bytes_total", "Bytes freed by deleting files.", func(s storage.Stats) uint64 { return s.DeletedBytes }},
+}
+
+// Metrics of the requests handled by a server
+type httpMetrics struct {
+	requests      *metrics.CounterVec
+	durations     *metrics.HistogramVec
+	responseBytes *metrics.CounterVec
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		requests: metrics.NewCounterVec("file_cellar_http_requests_total",
+			"HTTP requests handled, by route and status code.", "route", "code"),
+		durations: metrics.NewHistogramVec("file_cellar_http_request_duration_seconds",
+			"Time taken to handle HTTP requests, by route.", metrics.DefaultBuckets, "route"),
+		responseBytes: metrics.NewCounterVec("file_cellar_http_response_bytes_total",
+			"Bytes written in HTTP response bodies, by route.", "route"),
+	}
+}
+
+// A response writer remembering the status and size of its response
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written uint64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += uint64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Allows http.ResponseController to reach the underlying writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Gets a handler serving the server's routes and recording metrics of every request
+func (s *Server) Handler() http.Handler {
+	mux := s.GetMux()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(recorder, r)
+
+		// the mux sets the pattern it matched, requests it couldn't route are grouped together
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		s.metrics.requests.With(route, strconv.Itoa(recorder.status)).Inc()
+		s.metrics.durations.With(route).Observe(time.Since(start).Seconds())
+		s.metrics.responseBytes.With(route).Add(recorder.written)
+	})
+}
+
+// Serves metrics in the Prometheus text exposition format
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	bins, err := s.catalog.ListBins(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting bins for metrics: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+	usage, err := s.catalog.GetBinUsage(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting bin usage for metrics: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	binStats := make([]storage.Stats, len(bins))
+	binLabels := make(map[int64][]metrics.Label, len(bins))
+	drivers := make([]storage.Driver, 0)
+	seenDrivers := make(map[int64]bool)
+	for i, bin := range bins {
+		binStats[i] = bin.Stats()
+		binLabels[bin.Id] = []metrics.Label{{Name: "bin", Value: strconv.FormatInt(bin.Id, 10)}, {Name: "name", Value: bin.Name}}
+		if !seenDrivers[bin.Driver.Id()] {
+			seenDrivers[bin.Driver.Id()] = true
+			drivers = append(drivers, bin.Driver)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	for _, metric := range statsMetrics {
+		name := "file_cellar_bin_" + metric.name
+		metrics.WriteHeader(out, name, metric.help, "counter")
+		for i, bin := range bins {
+			metrics.WriteSample(out, name, binLabels[bin.Id], float64(metric.value(binStats[i])))
+		}
+	}
+	for _, metric := range statsMetrics {
+		name := "file_cellar_driver_" + metric.name
+		metrics.WriteHeader(out, name, metric.help, "counter")
+		for _, d := range drivers {
+			labels := []metrics.Label{{Name: "driver", Value: strconv.FormatInt(d.Id(), 10)}, {Name: "name", Value: d.Name()}}
+			metrics.WriteSample(out, name, labels, float64(metric.value(d.Stats())))
+		}
+	}
+
+	metrics.WriteHeader(out, "file_cellar_bin_files", "Files stored in the bin, including the trash.", "gauge")
+	for _, u := range usage {
+		metrics.WriteSample(out, "file_cellar_bin_files", binLabels[u.BinId], float64(u.Files))
+	}
+	metrics.WriteHeader(out, "file_cellar_bin_stored_bytes", "Bytes stored in the bin, including the trash.", "gauge")
+	for _, u := range usage {
+		metrics.WriteSample(out, "file_cellar_bin_stored_bytes", binLabels[u.BinId], float64(u.Bytes))
+	}
+
+	s.metrics.requests.Expose(out)
+	s.metrics.durations.Expose(out)
+	s.metrics.responseBytes.Expose(out)
+	db.QueryDurations.Expose(out)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err = out.WriteTo(w); err != nil {
+		log.Printf("Error writing metrics: %v\n", err)
+	}
+}
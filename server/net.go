@@ -1,15 +1,39 @@
 package server
 
 import (
+	"file-cellar/db"
 	"fmt"
 	"log"
 	"mime"
 	"net/http"
+	"sync"
+	"time"
 )
 
-func GetMux() *http.ServeMux {
+// A file server, serving the files recorded in its catalog
+type Server struct {
+	catalog          db.Catalog
+	metrics          *httpMetrics
+	events           *EventBus     // bus the events of the server are published on
+	redirectLifetime time.Duration // time redirects of redirecting bins are cached for, and their urls valid for at least
+	closing          chan struct{} // closed when the server shuts down, ending event streams
+	closeOnce        sync.Once
+}
+
+func NewServer(catalog db.Catalog, events *EventBus, redirectLifetime time.Duration) *Server {
+	return &Server{catalog: catalog, metrics: newHTTPMetrics(), events: events, redirectLifetime: redirectLifetime, closing: make(chan struct{})}
+}
+
+// Ends the event streams of the server so it can shut down, see http.Server.RegisterOnShutdown
+func (s *Server) CloseStreams() {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+}
+
+func (s *Server) GetMux() *http.ServeMux {
 	mux := http.NewServeMux()
-	initMux(mux)
+	s.initMux(mux)
 	return mux
 }
 
@@ -53,9 +77,70 @@ func determineFT(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "Detected filetype: %s\n", http.DetectContentType(buf[:n]))
 }
 
-func initMux(mux *http.ServeMux) {
-	mux.HandleFunc("GET /ping", ping)
-	mux.HandleFunc("POST /ft", determineFT)
-	mux.HandleFunc("POST /upload", upload)
-	mux.HandleFunc("GET /f/{filePath...}", download)
+// A pattern of the mux and the handler of the requests it matches
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// Gets every route of the server, each documented in openapi.json
+func (s *Server) routes() []route {
+	return []route{
+		{"GET /{$}", redirectToPortal},
+		{"GET /ping", ping},
+		{"GET /metrics", s.serveMetrics},
+		{"GET /api/openapi.json", serveOpenAPI},
+		{"POST /ft", determineFT},
+		{"POST /upload", s.upload},
+		{"GET /f/{filePath...}", s.download},
+		{"HEAD /f/{filePath...}", s.download},
+		{"DELETE /f/{filePath...}", s.remove},
+		{"GET /p/{binId}/{path...}", s.downloadVersion},
+		{"HEAD /p/{binId}/{path...}", s.downloadVersion},
+		{"GET /api/v1/bins", s.listBins},
+		{"GET /api/v1/bins/{binId}/versions/{path...}", s.listVersions},
+		{"POST /api/v1/bins/{binId}/rollback/{path...}", s.rollback},
+		{"GET /api/v1/bins/{binId}/files", s.listFiles},
+		{"GET /api/v1/bins/{binId}/unused", s.listUnused},
+		{"GET /api/v1/trash", s.listTrash},
+		{"POST /api/v1/trash/restore/{filePath...}", s.restore},
+		{"DELETE /api/v1/trash/{filePath...}", s.purge},
+		{"GET /api/v1/tags", s.listTags},
+		{"GET /api/v1/tags/{tag}", s.listTaggedFiles},
+		{"PUT /api/v1/tags/{tag}/{filePath...}", s.tagFile},
+		{"DELETE /api/v1/tags/{tag}/{filePath...}", s.untagFile},
+		{"GET /api/v1/files/tags/{filePath...}", s.getFileTags},
+		{"GET /api/v1/files/accesses/{filePath...}", s.listAccesses},
+		{"PUT /api/v1/files/description/{filePath...}", s.setDescription},
+		{"PUT /api/v1/files/name/{filePath...}", s.renameFile},
+		{"GET /api/v1/search", s.search},
+		{"GET /api/v1/collections", s.listCollections},
+		{"POST /api/v1/collections", s.createCollection},
+		{"GET /api/v1/collections/{collectionId}", s.getCollection},
+		{"DELETE /api/v1/collections/{collectionId}", s.deleteCollection},
+		{"GET /api/v1/collections/{collectionId}/download", s.downloadCollection},
+		{"PUT /api/v1/collections/{collectionId}/files/{filePath...}", s.addToCollection},
+		{"DELETE /api/v1/collections/{collectionId}/files/{filePath...}", s.removeFromCollection},
+		{"GET /c/{token}", s.downloadSharedCollection},
+		{"GET /api/v1/archive", s.downloadArchive},
+		{"POST /api/v1/archive", s.downloadArchive},
+		{"GET /api/v1/stats/{source}", s.getStats},
+		{"GET /api/v1/stats/{source}/{sourceId}", s.getStats},
+		{"GET /api/v1/audit", s.listAudit},
+		{"GET /api/v1/events", s.streamEvents},
+		{"GET /api/v1/webhooks", s.listWebhooks},
+		{"POST /api/v1/webhooks", s.createWebhook},
+		{"DELETE /api/v1/webhooks/{webhookId}", s.deleteWebhook},
+		{"GET /api/v1/webhooks/{webhookId}/deliveries", s.listDeliveries},
+		{"GET /ui/{$}", s.portalBins},
+		{"GET /ui/bins/{binId}", s.portalFiles},
+		{"GET /ui/files/{filePath...}", s.portalFile},
+		{"GET /ui/static/{asset...}", portalStatic().ServeHTTP},
+	}
+}
+
+func (s *Server) initMux(mux *http.ServeMux) {
+	for _, route := range s.routes() {
+		mux.HandleFunc(route.pattern, route.handler)
+	}
 }
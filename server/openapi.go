@@ -0,0 +1,19 @@
+package server
+
+import (
+	_ "embed"
+	"log"
+	"net/http"
+)
+
+// The OpenAPI 3 document describing the routes of the server
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(openAPISpec); err != nil {
+		log.Printf("Error writing api document: %v\n", err)
+	}
+}
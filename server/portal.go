@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"embed"
+	"errors"
+	"file-cellar/db"
+	"file-cellar/storage"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+//go:embed portal/templates portal/static
+var portalFS embed.FS
+
+var portalFuncs = template.FuncMap{
+	"size": formatSize,
+	"time": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04")
+	},
+	"isImage": func(fileType string) bool {
+		return strings.HasPrefix(fileType, "image/")
+	},
+}
+
+// Pages of the portal, each rendered inside the layout
+var (
+	binsPage  = parsePage("bins.html")
+	filesPage = parsePage("files.html")
+	filePage  = parsePage("file.html")
+)
+
+func parsePage(name string) *template.Template {
+	return template.Must(template.New("layout.html").Funcs(portalFuncs).ParseFS(portalFS,
+		"portal/templates/layout.html", "portal/templates/"+name))
+}
+
+// Formats a number of bytes with a binary unit
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// Renders a portal page, responding with an error if it fails
+func renderPage(w http.ResponseWriter, r *http.Request, page *template.Template, data any) {
+	// render to a buffer so a failure doesn't leave a partial page
+	out := new(bytes.Buffer)
+	if err := page.Execute(out, data); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error rendering %s: %v : %s\n", r.URL.Path, err, r.RemoteAddr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := out.WriteTo(w); err != nil {
+		log.Printf("Error writing page: %v\n", err)
+	}
+}
+
+// A bin as listed in the portal
+type binRow struct {
+	*storage.Bin
+	Files int64
+	Bytes int64
+}
+
+// Columns files can be sorted by, and how they compare
+var fileSorts = map[string]func(a, b *storage.FileInfo) int{
+	"name": func(a, b *storage.FileInfo) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	},
+	"type": func(a, b *storage.FileInfo) int {
+		return strings.Compare(a.Type, b.Type)
+	},
+	"size": func(a, b *storage.FileInfo) int {
+		return cmp.Compare(a.Size, b.Size)
+	},
+	"uploaded": func(a, b *storage.FileInfo) int {
+		return a.UploadTimestamp.Compare(b.UploadTimestamp)
+	},
+	"downloads": func(a, b *storage.FileInfo) int {
+		return cmp.Compare(a.Downloads, b.Downloads)
+	},
+}
+
+// The listing of a bin's files, filtered and sorted by the query parameters
+type fileListing struct {
+	Bin   *storage.Bin
+	Files []*storage.FileInfo
+	Total int    // files in the bin before filtering
+	Query string // text the names of listed files contain
+	Type  string // prefix of the types of listed files
+	Sort  string
+	Desc  bool
+}
+
+// Gets the url of the listing sorted by a column, reversing the order if it is already sorted by it
+func (l *fileListing) SortURL(column string) string {
+	values := url.Values{}
+	if l.Query != "" {
+		values.Set("q", l.Query)
+	}
+	if l.Type != "" {
+		values.Set("type", l.Type)
+	}
+	values.Set("sort", column)
+	if column != l.Sort || !l.Desc {
+		values.Set("order", "desc")
+	} else {
+		values.Set("order", "asc")
+	}
+
+	return "?" + values.Encode()
+}
+
+// Gets the indicator of the order of a column, empty if the listing isn't sorted by it
+func (l *fileListing) SortIndicator(column string) string {
+	if column != l.Sort {
+		return ""
+	} else if l.Desc {
+		return "▼"
+	}
+	return "▲"
+}
+
+// The details of a file
+type fileDetails struct {
+	*storage.FileInfo
+	Tags        []string
+	PreviewSize int64 // size of the thumbnail previewing the file, 0 when no thumbnail sizes are configured
+}
+
+// Redirects to the portal
+func redirectToPortal(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/ui/", http.StatusFound)
+}
+
+// Lists the bins and the files stored in them
+func (s *Server) portalBins(w http.ResponseWriter, r *http.Request) {
+	bins, err := s.catalog.ListBins(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error listing bins: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+	usage, err := s.catalog.GetBinUsage(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting bin usage: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	rows := make([]binRow, len(bins))
+	for i, bin := range bins {
+		rows[i].Bin = bin
+		for _, u := range usage {
+			if u.BinId == bin.Id {
+				rows[i].Files = u.Files
+				rows[i].Bytes = u.Bytes
+			}
+		}
+	}
+
+	renderPage(w, r, binsPage, rows)
+}
+
+// Lists the files of a bin, filtered by the q and type parameters and sorted by the sort and order parameters
+func (s *Server) portalFiles(w http.ResponseWriter, r *http.Request) {
+	binId, ok := parseBinId(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	bin, err := s.catalog.GetBin(ctx, binId)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Bin not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting bin %d: %v : %s\n", binId, err, r.RemoteAddr)
+		return
+	}
+
+	files, err := s.catalog.ListFiles(ctx, binId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error listing files of bin %d: %v : %s\n", binId, err, r.RemoteAddr)
+		return
+	}
+
+	query := r.URL.Query()
+	listing := &fileListing{
+		Bin:   bin,
+		Total: len(files),
+		Query: strings.TrimSpace(query.Get("q")),
+		Type:  strings.TrimSpace(query.Get("type")),
+		Sort:  query.Get("sort"),
+		Desc:  query.Get("order") == "desc",
+	}
+	compare, ok := fileSorts[listing.Sort]
+	if !ok {
+		// newest first unless asked otherwise
+		listing.Sort = "uploaded"
+		listing.Desc = query.Get("order") != "asc"
+		compare = fileSorts[listing.Sort]
+	}
+
+	needle := strings.ToLower(listing.Query)
+	listing.Files = slices.DeleteFunc(files, func(f *storage.FileInfo) bool {
+		return !strings.Contains(strings.ToLower(f.Name), needle) || !strings.HasPrefix(f.Type, listing.Type)
+	})
+	slices.SortStableFunc(listing.Files, func(a, b *storage.FileInfo) int {
+		if listing.Desc {
+			return compare(b, a)
+		}
+		return compare(a, b)
+	})
+
+	renderPage(w, r, filesPage, listing)
+}
+
+// Shows the details of a file
+func (s *Server) portalFile(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("filePath")
+
+	ctx := r.Context()
+
+	fInfo, err := s.catalog.GetFile(ctx, path)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting file info: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	tags, err := s.catalog.GetTags(ctx, path)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting tags of %s: %v : %s\n", path, err, r.RemoteAddr)
+		return
+	}
+
+	var previewSize int64
+	for _, size := range thumbnailSizes() {
+		previewSize = max(previewSize, size)
+	}
+
+	renderPage(w, r, filePage, fileDetails{fInfo, tags, previewSize})
+}
+
+// Serves the stylesheets and scripts of the portal
+func portalStatic() http.Handler {
+	static, err := fs.Sub(portalFS, "portal/static")
+	if err != nil {
+		log.Panicf("Missing portal assets: %v\n", err)
+	}
+
+	return http.StripPrefix("/ui/static/", http.FileServerFS(static))
+}
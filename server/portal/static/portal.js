@@ -0,0 +1,116 @@
+// Uploads, deletions and renames of the portal, made through the same endpoints as the api
+
+// Uploads files in a single request, keeping the relative paths of files of chosen folders
+function uploadFiles(form, files) {
+  if (files.length === 0) {
+    return;
+  }
+
+  const item = document.createElement("li");
+  const bar = document.createElement("progress");
+  bar.max = 1;
+  bar.value = 0;
+  item.append(bar, files.length === 1 ? files[0].name : files.length + " files");
+  form.querySelector(".progress").append(item);
+
+  const data = new FormData();
+  data.append("binId", form.elements.binId.value);
+  for (const file of files) {
+    data.append("file", file, file.webkitRelativePath || file.name);
+  }
+
+  const request = new XMLHttpRequest();
+  request.upload.addEventListener("progress", (e) => {
+    if (e.lengthComputable) {
+      bar.value = e.loaded / e.total;
+    }
+  });
+  request.addEventListener("loadend", () => {
+    let results = [];
+    try {
+      results = JSON.parse(request.responseText);
+    } catch {
+      results = [{ name: "upload", error: request.responseText.trim() || "upload failed" }];
+    }
+
+    const failed = results.filter((result) => result.error);
+    bar.value = failed.length === 0 ? 1 : bar.value;
+    if (failed.length === 0) {
+      location.reload();
+      return;
+    }
+    item.classList.add("failed");
+    const list = document.createElement("ul");
+    for (const result of failed) {
+      const failure = document.createElement("li");
+      failure.textContent = result.name + ": " + result.error;
+      list.append(failure);
+    }
+    item.append(list);
+  });
+  request.open("POST", form.action);
+  request.send(data);
+}
+
+function initUpload(form) {
+  const inputs = form.querySelectorAll("input[type=file]");
+  inputs.forEach((input) => input.addEventListener("change", () => uploadFiles(form, input.files)));
+  form.addEventListener("submit", (e) => {
+    e.preventDefault();
+    inputs.forEach((input) => uploadFiles(form, input.files));
+  });
+
+  form.addEventListener("dragover", (e) => {
+    e.preventDefault();
+    form.classList.add("dragging");
+  });
+  form.addEventListener("dragleave", () => form.classList.remove("dragging"));
+  form.addEventListener("drop", (e) => {
+    e.preventDefault();
+    form.classList.remove("dragging");
+    uploadFiles(form, e.dataTransfer.files);
+  });
+}
+
+function initDelete(button) {
+  button.hidden = false;
+  button.addEventListener("click", async () => {
+    if (!confirm("Move this file to the trash?")) {
+      return;
+    }
+    const response = await fetch("/f/" + button.dataset.delete, { method: "DELETE" });
+    if (response.ok) {
+      location = button.dataset.return;
+    } else {
+      alert(await response.text());
+    }
+  });
+}
+
+function initRename(form) {
+  form.hidden = false;
+  form.addEventListener("submit", async (e) => {
+    e.preventDefault();
+    const response = await fetch("/api/v1/files/name/" + form.dataset.path, {
+      method: "PUT",
+      body: new URLSearchParams(new FormData(form)),
+    });
+    if (response.ok) {
+      location.reload();
+    } else {
+      alert(await response.text());
+    }
+  });
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  const upload = document.getElementById("upload");
+  if (upload) {
+    initUpload(upload);
+  }
+  document.querySelectorAll("[data-delete]").forEach(initDelete);
+  const rename = document.getElementById("rename");
+  if (rename) {
+    initRename(rename);
+  }
+});
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"file-cellar/config"
+	"file-cellar/db"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultSearchLimit = 50
+
+type searchResultJSON struct {
+	File       fileJSON          `json:"file"`
+	Rank       float64           `json:"rank"`
+	Highlights map[string]string `json:"highlights,omitempty"`
+	Snippet    string            `json:"snippet,omitempty"`
+}
+
+// Indexes the text content of a file for searches when enabled
+//
+// Only text mimetypes are indexed, and only up to the configured number of bytes.
+func indexContent(ctx context.Context, catalog db.Catalog, fileId int64, mimeType string, data io.Reader) {
+	if config.Server["IndexTextContent"] != "true" || !strings.HasPrefix(mimeType, "text/") {
+		return
+	}
+
+	limit, err := strconv.ParseInt(config.Server["IndexTextLimit"], 10, 64)
+	if err != nil || limit <= 0 {
+		return
+	}
+
+	content, err := io.ReadAll(io.LimitReader(data, limit))
+	if err != nil {
+		log.Printf("Failed to read content of file %d for indexing: %v\n", fileId, err)
+		return
+	}
+
+	if err = catalog.IndexContent(ctx, fileId, strings.ToValidUTF8(string(content), "")); err != nil {
+		log.Printf("Failed to index content of file %d: %v\n", fileId, err)
+	}
+}
+
+// Searches files with the query parameter q, optionally limited to the bin in the bin parameter
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	binId := int64(-1)
+	if query.Has("bin") {
+		id, err := strconv.ParseInt(query.Get("bin"), 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, "Bad bin, it should be a positive integer", http.StatusBadRequest)
+			return
+		}
+		binId = id
+	}
+
+	limit, ok := parseLimit(w, r, defaultSearchLimit)
+	if !ok {
+		return
+	}
+
+	results, err := s.catalog.Search(r.Context(), query.Get("q"), binId, limit)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error searching for `%s`: %v : %s\n", query.Get("q"), err, r.RemoteAddr)
+		return
+	}
+
+	response := make([]searchResultJSON, len(results))
+	for i, result := range results {
+		response[i] = searchResultJSON{
+			File: newFileJSON(result.File),
+			Rank: result.Rank,
+			Highlights: map[string]string{
+				"name":        result.NameHighlight,
+				"description": result.DescriptionHighlight,
+			},
+			Snippet: result.Snippet,
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Sets the description of a file to the form value description
+func (s *Server) setDescription(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("filePath")
+	description := r.FormValue("description")
+
+	ctx := actorContext(r)
+
+	fInfo, err := s.catalog.GetFile(ctx, path)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting file info: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	ok, err := s.catalog.SetDescription(ctx, path, description)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error setting description of %s: %v : %s\n", path, err, r.RemoteAddr)
+		return
+	} else if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	after := *fInfo
+	after.Description = description
+	auditSaved(ctx, s.catalog, db.AuditFileDescribe, fileTarget(path), newFileJSON(fInfo), newFileJSON(&after))
+
+	w.WriteHeader(http.StatusNoContent)
+}
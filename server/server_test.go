@@ -0,0 +1,1456 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"file-cellar/config"
+	"file-cellar/db"
+	"file-cellar/storage"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func printMismatch[T any](p func(string, ...any), name string, expected T, recieved T) {
+	p("Incorrect %s, expected %v != %v\n", name, expected, recieved)
+}
+
+// Sets server config values for the duration of a test
+func setConfig(t *testing.T, values map[string]string) {
+	for key, value := range values {
+		previous := config.Server[key]
+		config.Server[key] = value
+		t.Cleanup(func() { config.Server[key] = previous })
+	}
+}
+
+// Creates a server backed by an in memory catalog with a single local bin
+func newTestServer(t *testing.T) (*Server, http.Handler) {
+	ctx := context.Background()
+	catalog := db.NewMemoryCatalog()
+
+	driver := storage.NewLocalDriver()
+	if !catalog.AddDriver(ctx, driver) {
+		t.Log("Failed to add driver")
+		t.FailNow()
+	}
+
+	bin := &storage.Bin{Name: "testing bin", Driver: driver}
+	bin.Path.External = "testing"
+	bin.Path.Internal = t.TempDir()
+	if _, err := catalog.AddBin(ctx, bin, driver.Id()); err != nil {
+		t.Logf("Failed to add bin: %v\n", err)
+		t.FailNow()
+	}
+
+	s := NewServer(catalog, NewEventBus(), 15*time.Minute)
+	return s, s.GetMux()
+}
+
+func request(handler http.Handler, method string, target string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+// Uploads a file to the testing bin, returning its relative path
+func uploadFile(t *testing.T, handler http.Handler, name string, content string) string {
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("binId", "1")
+	part, _ := form.CreateFormFile("file", name)
+	part.Write([]byte(content))
+	form.Close()
+
+	w := request(handler, http.MethodPost, "/upload", body, form.FormDataContentType())
+	if w.Code != http.StatusOK {
+		t.Logf("Failed to upload %s: %d %s\n", name, w.Code, w.Body.String())
+		t.FailNow()
+	}
+
+	var results []uploadResultJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) != 1 || results[0].File == nil {
+		t.Logf("Incorrect upload results %s: %v\n", w.Body.String(), err)
+		t.FailNow()
+	}
+
+	return results[0].File.RelPath
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	relPath := uploadFile(t, handler, "notes.txt", "remember the milk")
+
+	w := request(handler, http.MethodGet, "/f/"+relPath, nil, "")
+	if w.Code != http.StatusOK {
+		printMismatch(t.Errorf, "download status", http.StatusOK, w.Code)
+	} else if w.Body.String() != "remember the milk" {
+		printMismatch(t.Errorf, "downloaded content", "remember the milk", w.Body.String())
+	}
+
+	w = request(handler, http.MethodGet, "/api/v1/bins/1/files", nil, "")
+	var files []fileJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &files); err != nil {
+		t.Errorf("Failed to decode file listing %s: %v\n", w.Body.String(), err)
+	} else if len(files) != 1 || files[0].RelPath != relPath || files[0].Type != "text/plain; charset=utf-8" {
+		t.Errorf("Incorrect file listing %v\n", files)
+	}
+
+	w = request(handler, http.MethodGet, "/api/v1/search?q=milk", nil, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), relPath) {
+		t.Errorf("Incorrect search response %d %s\n", w.Code, w.Body.String())
+	}
+}
+
+func TestConditionalDownload(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	relPath := uploadFile(t, handler, "résumé 1.txt", "remember the milk")
+
+	w := request(handler, http.MethodGet, "/f/"+relPath, nil, "")
+	etag := w.Header().Get("ETag")
+	if etag != `"1c6e76593ebd1c93bc2934c3e57f810c"` {
+		printMismatch(t.Errorf, "ETag", `"1c6e76593ebd1c93bc2934c3e57f810c"`, etag)
+	}
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != immutableCacheControl {
+		printMismatch(t.Errorf, "Cache-Control", immutableCacheControl, cacheControl)
+	}
+	expectedDisposition := `inline; filename="r_sum_ 1.txt"; filename*=UTF-8''r%C3%A9sum%C3%A9%201.txt`
+	if disposition := w.Header().Get("Content-Disposition"); disposition != expectedDisposition {
+		printMismatch(t.Errorf, "Content-Disposition", expectedDisposition, disposition)
+	}
+	if digest := w.Header().Get("Repr-Digest"); digest != "md5=:HG52WT69HJO8KTTD5X+BDA==:" {
+		printMismatch(t.Errorf, "Repr-Digest", "md5=:HG52WT69HJO8KTTD5X+BDA==:", digest)
+	}
+
+	conditional := func(header string, value string) int {
+		r := httptest.NewRequest(http.MethodGet, "/f/"+relPath, nil)
+		r.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	if status := conditional("If-None-Match", etag); status != http.StatusNotModified {
+		printMismatch(t.Errorf, "status of a matching If-None-Match", http.StatusNotModified, status)
+	}
+	if status := conditional("If-None-Match", `"stale"`); status != http.StatusOK {
+		printMismatch(t.Errorf, "status of a stale If-None-Match", http.StatusOK, status)
+	}
+	if status := conditional("If-Match", `"stale"`); status != http.StatusPreconditionFailed {
+		printMismatch(t.Errorf, "status of a stale If-Match", http.StatusPreconditionFailed, status)
+	}
+	for _, byteRange := range []string{"bytes=0-3", "bytes=4-8", "bytes=9-"} {
+		if status := conditional("Range", byteRange); status != http.StatusPartialContent {
+			printMismatch(t.Errorf, "status of range "+byteRange, http.StatusPartialContent, status)
+		}
+	}
+
+	// only the full downloads and the range reaching the end are recorded, not the revalidation
+	w = request(handler, http.MethodGet, "/api/v1/files/accesses/"+relPath, nil, "")
+	var accesses []json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &accesses); err != nil || len(accesses) != 3 {
+		t.Errorf("Incorrect accesses after conditional downloads %s: %v\n", w.Body.String(), err)
+	}
+}
+
+func TestMultiFileUpload(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("binId", "1")
+	for name, content := range map[string]string{"photos/a.txt": "same", "photos/trip/a.txt": "same", "../escape.txt": "out"} {
+		part, _ := form.CreateFormFile("file", name)
+		part.Write([]byte(content))
+	}
+	form.WriteField("dir", "shared")
+	form.WriteField("path", "notes/today.txt")
+	part, _ := form.CreateFormFile("file", "draft.txt")
+	part.Write([]byte("remember the milk"))
+	form.Close()
+
+	w := request(handler, http.MethodPost, "/upload", body, form.FormDataContentType())
+	if w.Code != http.StatusMultiStatus {
+		printMismatch(t.Errorf, "upload status", http.StatusMultiStatus, w.Code)
+	}
+	var results []uploadResultJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) != 4 {
+		t.Logf("Incorrect upload results %s: %v\n", w.Body.String(), err)
+		t.FailNow()
+	}
+
+	logicalPaths := make(map[string]string)
+	for _, result := range results {
+		if result.Name == "../escape.txt" {
+			if result.Status != http.StatusBadRequest || result.File != nil {
+				t.Errorf("Uploaded a file outside of its directory %+v\n", result)
+			}
+		} else if result.Status != http.StatusOK || result.File == nil {
+			t.Errorf("Failed to upload %s: %+v\n", result.Name, result)
+		} else {
+			logicalPaths[result.Name] = result.File.LogicalPath
+		}
+	}
+	expected := map[string]string{"photos/a.txt": "photos/a.txt", "photos/trip/a.txt": "photos/trip/a.txt", "draft.txt": "shared/notes/today.txt"}
+	for name, logicalPath := range expected {
+		if logicalPaths[name] != logicalPath {
+			printMismatch(t.Errorf, "logical path of "+name, logicalPath, logicalPaths[name])
+		}
+	}
+
+	body.Reset()
+	form = multipart.NewWriter(body)
+	form.WriteField("binId", "7")
+	part, _ = form.CreateFormFile("file", "lost.txt")
+	part.Write([]byte("nowhere"))
+	form.Close()
+	if w = request(handler, http.MethodPost, "/upload", body, form.FormDataContentType()); w.Code != http.StatusBadRequest {
+		printMismatch(t.Errorf, "status of upload to a missing bin", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestUploadFieldErrors(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	upload := func(body []byte, contentType string) []uploadResultJSON {
+		w := request(handler, http.MethodPost, "/upload", bytes.NewReader(body), contentType)
+		var results []uploadResultJSON
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Logf("Incorrect upload results %d %s: %v\n", w.Code, w.Body.String(), err)
+			t.FailNow()
+		}
+		return results
+	}
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("binId", "1")
+	part, _ := form.CreateFormFile("file", "first.txt")
+	part.Write([]byte("stored before the field"))
+	form.WriteField("description", strings.Repeat("a", maxUploadFieldSize+1))
+	part, _ = form.CreateFormFile("file", "second.txt")
+	part.Write([]byte("never reached"))
+	form.Close()
+
+	// a field over the limit is rejected rather than truncated, after the file before it was stored
+	results := upload(body.Bytes(), form.FormDataContentType())
+	if len(results) != 2 || results[0].File == nil || results[1].Status != http.StatusBadRequest || !strings.Contains(results[1].Error, "description") {
+		t.Errorf("Incorrect results of an upload with a large field %+v\n", results)
+	}
+
+	body.Reset()
+	form = multipart.NewWriter(body)
+	form.WriteField("binId", "1")
+	part, _ = form.CreateFormFile("file", "third.txt")
+	part.Write([]byte("stored before the stream ended"))
+	form.WriteField("description", "cut short")
+	form.Close()
+	truncated := body.Bytes()[:bytes.LastIndex(body.Bytes(), []byte("cut short"))+3]
+
+	// so is a field the stream ends in the middle of
+	results = upload(truncated, form.FormDataContentType())
+	if len(results) != 2 || results[0].File == nil || results[1].Status != http.StatusBadRequest {
+		t.Errorf("Incorrect results of a truncated upload %+v\n", results)
+	}
+}
+
+func TestTrashAndRestore(t *testing.T) {
+	s, handler := newTestServer(t)
+	ctx := context.Background()
+
+	relPath := uploadFile(t, handler, "draft.txt", "first draft")
+
+	if w := request(handler, http.MethodPost, "/api/v1/trash/restore/"+relPath, nil, ""); w.Code != http.StatusNotFound {
+		printMismatch(t.Errorf, "status of restoring a file not in the trash", http.StatusNotFound, w.Code)
+	}
+	if w := request(handler, http.MethodDelete, "/f/"+relPath, nil, ""); w.Code != http.StatusNoContent {
+		printMismatch(t.Errorf, "trash status", http.StatusNoContent, w.Code)
+	}
+	if w := request(handler, http.MethodGet, "/f/"+relPath, nil, ""); w.Code != http.StatusGone {
+		printMismatch(t.Errorf, "status of downloading a file in the trash", http.StatusGone, w.Code)
+	}
+	if w := request(handler, http.MethodDelete, "/f/"+relPath, nil, ""); w.Code != http.StatusNotFound {
+		printMismatch(t.Errorf, "repeated trash status", http.StatusNotFound, w.Code)
+	}
+
+	w := request(handler, http.MethodGet, "/api/v1/trash", nil, "")
+	if !strings.Contains(w.Body.String(), relPath) {
+		t.Errorf("File missing from trash %s\n", w.Body.String())
+	}
+
+	if w = request(handler, http.MethodPost, "/api/v1/trash/restore/"+relPath, nil, ""); w.Code != http.StatusOK {
+		printMismatch(t.Errorf, "restore status", http.StatusOK, w.Code)
+	}
+	if w = request(handler, http.MethodGet, "/f/"+relPath, nil, ""); w.Code != http.StatusOK || w.Body.String() != "first draft" {
+		t.Errorf("Incorrect download of a restored file %d %q\n", w.Code, w.Body.String())
+	}
+
+	// a trashed file is only purged once its grace period has passed
+	request(handler, http.MethodDelete, "/f/"+relPath, nil, "")
+	if purged, err := PurgeTrash(ctx, s.catalog, s.events, time.Now().Add(-TrashGracePeriod())); err != nil || purged != 0 {
+		t.Errorf("Incorrect purge within the grace period %d: %v\n", purged, err)
+	}
+	if w = request(handler, http.MethodGet, "/f/"+relPath, nil, ""); w.Code != http.StatusGone {
+		printMismatch(t.Errorf, "status of a file in the trash within its grace period", http.StatusGone, w.Code)
+	}
+	later := time.Now().Add(TrashGracePeriod() + time.Minute)
+	if purged, err := PurgeTrash(ctx, s.catalog, s.events, later.Add(-TrashGracePeriod())); err != nil || purged != 1 {
+		t.Errorf("Incorrect purge after the grace period %d: %v\n", purged, err)
+	}
+	if w = request(handler, http.MethodGet, "/f/"+relPath, nil, ""); w.Code != http.StatusNotFound {
+		printMismatch(t.Errorf, "status of a purged file", http.StatusNotFound, w.Code)
+	}
+	if w = request(handler, http.MethodPost, "/api/v1/trash/restore/"+relPath, nil, ""); w.Code != http.StatusNotFound {
+		printMismatch(t.Errorf, "status of restoring a purged file", http.StatusNotFound, w.Code)
+	}
+
+	// or straight away through the api
+	relPath = uploadFile(t, handler, "scrap.txt", "scribbles")
+	request(handler, http.MethodDelete, "/f/"+relPath, nil, "")
+	if w = request(handler, http.MethodDelete, "/api/v1/trash/"+relPath, nil, ""); w.Code != http.StatusNoContent {
+		printMismatch(t.Errorf, "purge status", http.StatusNoContent, w.Code)
+	}
+	if w = request(handler, http.MethodGet, "/api/v1/trash", nil, ""); w.Body.String() != "[]\n" {
+		t.Errorf("Purged files left in the trash %s\n", w.Body.String())
+	}
+}
+
+func TestTags(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	relPath := uploadFile(t, handler, "receipt.txt", "one coffee")
+
+	if w := request(handler, http.MethodPut, "/api/v1/tags/expenses/"+relPath, nil, ""); w.Code != http.StatusNoContent {
+		printMismatch(t.Errorf, "tag status", http.StatusNoContent, w.Code)
+	}
+	if w := request(handler, http.MethodPut, "/api/v1/tags/expenses/missing.txt", nil, ""); w.Code != http.StatusNotFound {
+		printMismatch(t.Errorf, "missing file tag status", http.StatusNotFound, w.Code)
+	}
+
+	w := request(handler, http.MethodGet, "/api/v1/tags", nil, "")
+	var tags map[string]int64
+	if err := json.Unmarshal(w.Body.Bytes(), &tags); err != nil {
+		t.Errorf("Failed to decode tags %s: %v\n", w.Body.String(), err)
+	} else if tags["expenses"] != 1 {
+		printMismatch(t.Errorf, "tag count", 1, tags["expenses"])
+	}
+}
+
+func TestStatsRecorder(t *testing.T) {
+	s, handler := newTestServer(t)
+	ctx := context.Background()
+	recorder := NewStatsRecorder(s.catalog)
+
+	relPath := uploadFile(t, handler, "usage.txt", "0123456789")
+	if err := recorder.Record(ctx); err != nil {
+		t.Logf("Failed to record stats: %v\n", err)
+		t.FailNow()
+	}
+	request(handler, http.MethodGet, "/f/"+relPath, nil, "")
+	if err := recorder.Record(ctx); err != nil {
+		t.Logf("Failed to record stats: %v\n", err)
+		t.FailNow()
+	}
+	// nothing changed, so nothing is recorded
+	if err := recorder.Record(ctx); err != nil {
+		t.Logf("Failed to record stats: %v\n", err)
+		t.FailNow()
+	}
+
+	w := request(handler, http.MethodGet, "/api/v1/stats/bins/1?resolution=raw", nil, "")
+	var stats statsJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Logf("Failed to decode stats %s: %v\n", w.Body.String(), err)
+		t.FailNow()
+	}
+	expected := storage.Stats{Uploaded: 1, Downloaded: 1, UploadedBytes: 10, DownloadedBytes: 10}
+	if stats.Summary.Total != expected {
+		printMismatch(t.Errorf, "total bin stats", expected, stats.Summary.Total)
+	}
+	if len(stats.Points) == 0 || len(stats.Points) > 2 {
+		t.Errorf("Incorrect bin stats points %v\n", stats.Points)
+	}
+
+	w = request(handler, http.MethodGet, "/api/v1/stats/drivers?resolution=day", nil, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Errorf("Failed to decode stats %s: %v\n", w.Body.String(), err)
+	} else if stats.Summary.Total != expected {
+		printMismatch(t.Errorf, "total driver stats", expected, stats.Summary.Total)
+	}
+
+	if w = request(handler, http.MethodGet, "/api/v1/stats/bins?resolution=week", nil, ""); w.Code != http.StatusBadRequest {
+		printMismatch(t.Errorf, "bad resolution status", http.StatusBadRequest, w.Code)
+	}
+	if w = request(handler, http.MethodGet, "/api/v1/stats/files", nil, ""); w.Code != http.StatusNotFound {
+		printMismatch(t.Errorf, "bad source status", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestStatsDelta(t *testing.T) {
+	last := storage.Stats{Uploaded: 2, UploadedBytes: 20}
+	current := storage.Stats{Uploaded: 3, UploadedBytes: 50, Failed: 1}
+	if expected, delta := (storage.Stats{Uploaded: 1, UploadedBytes: 30, Failed: 1}), statsDelta(current, last); delta != expected {
+		printMismatch(t.Errorf, "delta", expected, delta)
+	}
+
+	// a bin reloaded with fresh counters
+	reset := storage.Stats{Uploaded: 1, UploadedBytes: 5}
+	if delta := statsDelta(reset, last); delta != reset {
+		printMismatch(t.Errorf, "delta after reset", reset, delta)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s, _ := newTestServer(t)
+	handler := s.Handler()
+
+	uploadFile(t, handler, "metrics.txt", "0123456789")
+	request(handler, http.MethodDelete, "/f/missing.txt", nil, "")
+	request(handler, http.MethodGet, "/nowhere", nil, "")
+
+	w := request(handler, http.MethodGet, "/metrics", nil, "")
+	if w.Code != http.StatusOK {
+		printMismatch(t.Errorf, "metrics status", http.StatusOK, w.Code)
+	}
+	for _, sample := range []string{
+		`file_cellar_bin_uploads_total{bin="1",name="testing bin"} 1`,
+		`file_cellar_bin_uploaded_bytes_total{bin="1",name="testing bin"} 10`,
+		`file_cellar_driver_uploads_total{driver="1",name="LocalDriver"} 1`,
+		`file_cellar_bin_files{bin="1",name="testing bin"} 1`,
+		`file_cellar_bin_stored_bytes{bin="1",name="testing bin"} 10`,
+		`file_cellar_http_requests_total{route="POST /upload",code="200"} 1`,
+		`file_cellar_http_requests_total{route="DELETE /f/{filePath...}",code="404"} 1`,
+		`file_cellar_http_requests_total{route="unmatched",code="404"} 1`,
+		`file_cellar_http_request_duration_seconds_count{route="POST /upload"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), sample+"\n") {
+			t.Errorf("Missing sample %s in\n%s", sample, w.Body.String())
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	s, handler := newTestServer(t)
+	ctx := context.Background()
+
+	relPath := uploadFile(t, handler, "popular.txt", "0123456789")
+	unused := uploadFile(t, handler, "unpopular.txt", "nobody wants this")
+
+	r := httptest.NewRequest(http.MethodGet, "/f/"+relPath, nil)
+	// a range reaching the end of the file is a download
+	r.Header.Set("Range", "bytes=6-")
+	r.Header.Set("User-Agent", "tester")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent {
+		printMismatch(t.Errorf, "range status", http.StatusPartialContent, w.Code)
+	}
+	request(handler, http.MethodGet, "/f/"+relPath, nil, "")
+
+	w = request(handler, http.MethodGet, "/api/v1/files/accesses/"+relPath, nil, "")
+	var accesses []accessJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &accesses); err != nil {
+		t.Logf("Failed to decode accesses %s: %v\n", w.Body.String(), err)
+		t.FailNow()
+	}
+	if len(accesses) != 2 {
+		t.Logf("Incorrect accesses %v\n", accesses)
+		t.FailNow()
+	}
+	ranged := accesses[0]
+	if ranged.Range == "" {
+		ranged = accesses[1]
+	}
+	if ranged.Range != "bytes=6-" || ranged.BytesSent != 4 || ranged.UserAgent != "tester" || ranged.ClientIP != "192.0.2.1" {
+		t.Errorf("Incorrect ranged access %v\n", ranged)
+	}
+
+	w = request(handler, http.MethodGet, "/api/v1/bins/1/files", nil, "")
+	var files []fileJSON
+	json.Unmarshal(w.Body.Bytes(), &files)
+	var popularId int64
+	for _, f := range files {
+		if f.RelPath == relPath {
+			popularId = f.Id
+			if f.Downloads != 2 || f.AccessTimestamp == nil {
+				t.Errorf("Incorrect download count of accessed file %v\n", f)
+			}
+		}
+	}
+
+	// downloads and uploads in the same second can't be told apart, so the popular file is used again later
+	later := time.Now().Add(time.Hour)
+	if err := s.catalog.RecordAccess(ctx, &db.FileAccess{FileId: popularId, Timestamp: later}); err != nil {
+		t.Logf("Failed to record access: %v\n", err)
+		t.FailNow()
+	}
+
+	w = request(handler, http.MethodGet, "/api/v1/bins/1/unused?limit=1&before="+later.Add(time.Second).Format(time.RFC3339), nil, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &files); err != nil || len(files) != 1 || files[0].RelPath != unused {
+		t.Errorf("Incorrect least recently used files %s\n", w.Body.String())
+	}
+
+	trashed, err := TrashUnusedFiles(ctx, s.catalog, s.events, later)
+	if err != nil || trashed != 1 {
+		t.Errorf("Incorrect number of unused files trashed %d: %v\n", trashed, err)
+	}
+	if _, err = s.catalog.GetTrashedFile(ctx, unused); err != nil {
+		t.Errorf("Unused file not in the trash: %v\n", err)
+	}
+}
+
+// A catalog which fails to record audit entries
+type unauditedCatalog struct {
+	db.Catalog
+}
+
+func (c unauditedCatalog) AddAuditEntry(ctx context.Context, entry *db.AuditEntry) error {
+	return errors.New("audit log unavailable")
+}
+
+func TestAudit(t *testing.T) {
+	s, handler := newTestServer(t)
+
+	relPath := uploadFile(t, handler, "secret.txt", "classified")
+	request(handler, http.MethodDelete, "/f/"+relPath, nil, "")
+	request(handler, http.MethodPost, "/api/v1/trash/restore/"+relPath, nil, "")
+	request(handler, http.MethodDelete, "/f/"+relPath, nil, "")
+	request(handler, http.MethodDelete, "/api/v1/trash/"+relPath, nil, "")
+
+	form := strings.NewReader("name=shared")
+	w := request(handler, http.MethodPost, "/api/v1/collections", form, "application/x-www-form-urlencoded")
+	var collection collectionJSON
+	json.Unmarshal(w.Body.Bytes(), &collection)
+
+	w = request(handler, http.MethodGet, "/api/v1/audit?target=file:"+relPath, nil, "")
+	var entries []db.AuditEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Logf("Failed to decode audit log %s: %v\n", w.Body.String(), err)
+		t.FailNow()
+	}
+	expected := []string{db.AuditFileDelete, db.AuditFileTrash, db.AuditFileRestore, db.AuditFileTrash}
+	if len(entries) != len(expected) {
+		t.Logf("Incorrect audit log %s\n", w.Body.String())
+		t.FailNow()
+	}
+	for i, e := range entries {
+		if e.Action != expected[i] || e.Actor != "http:192.0.2.1" {
+			t.Errorf("Incorrect audit entry %d %v\n", i, e)
+		}
+	}
+	if entries[0].Before == nil || entries[0].After != nil {
+		t.Errorf("Incorrect states of delete %s %s\n", entries[0].Before, entries[0].After)
+	}
+
+	w = request(handler, http.MethodGet, "/api/v1/audit?action="+db.AuditCollectionCreate, nil, "")
+	if !strings.Contains(w.Body.String(), `"name":"shared"`) {
+		t.Errorf("Missing collection creation %s\n", w.Body.String())
+	}
+	if token := strings.TrimPrefix(collection.ShareURL, "/c/"); token == "" || strings.Contains(w.Body.String(), token) {
+		t.Errorf("Share token missing or audited %s\n", w.Body.String())
+	}
+
+	kept := uploadFile(t, handler, "kept.txt", "on the record")
+	form = strings.NewReader("name=renamed.txt")
+	request(handler, http.MethodPut, "/api/v1/files/name/"+kept, form, "application/x-www-form-urlencoded")
+	w = request(handler, http.MethodGet, "/api/v1/audit?action="+db.AuditFileRename, nil, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != 1 || entries[0].Target != "file:"+kept ||
+		!strings.Contains(string(entries[0].Before), `"name":"kept.txt"`) || !strings.Contains(string(entries[0].After), `"name":"renamed.txt"`) {
+		t.Errorf("Incorrect audit of rename %s: %v\n", w.Body.String(), err)
+	}
+
+	form = strings.NewReader("description=on file")
+	request(handler, http.MethodPut, "/api/v1/files/description/"+kept, form, "application/x-www-form-urlencoded")
+	w = request(handler, http.MethodGet, "/api/v1/audit?action="+db.AuditFileDescribe, nil, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != 1 || entries[0].Actor != "http:192.0.2.1" ||
+		!strings.Contains(string(entries[0].After), `"description":"on file"`) {
+		t.Errorf("Incorrect audit of description %s: %v\n", w.Body.String(), err)
+	}
+
+	// changes already saved when their audit fails are reported as they happened
+	s.catalog = unauditedCatalog{s.catalog}
+	if w = request(handler, http.MethodDelete, "/f/"+kept, nil, ""); w.Code != http.StatusNoContent {
+		printMismatch(t.Errorf, "status of an unaudited trashing", http.StatusNoContent, w.Code)
+	}
+	if w = request(handler, http.MethodPost, "/api/v1/trash/restore/"+kept, nil, ""); w.Code != http.StatusOK {
+		printMismatch(t.Errorf, "status of an unaudited restore", http.StatusOK, w.Code)
+	}
+	form = strings.NewReader("name=unrecorded")
+	if w = request(handler, http.MethodPost, "/api/v1/collections", form, "application/x-www-form-urlencoded"); w.Code != http.StatusCreated {
+		printMismatch(t.Errorf, "status of an unaudited collection creation", http.StatusCreated, w.Code)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	setConfig(t, map[string]string{"WebhookAllowedHosts": "127.0.0.1"})
+	s, handler := newTestServer(t)
+	ctx := context.Background()
+
+	type post struct {
+		event string
+		body  []byte
+		valid bool
+	}
+	var secret string
+	status := http.StatusServiceUnavailable
+	posts := make([]post, 0)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		valid := VerifyWebhookSignature(secret, r.Header.Get("X-Cellar-Timestamp"), body, r.Header.Get("X-Cellar-Signature"))
+		posts = append(posts, post{r.Header.Get("X-Cellar-Event"), body, valid})
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	form := strings.NewReader("url=" + receiver.URL + "&events=file.uploaded,file.deleted")
+	w := request(handler, http.MethodPost, "/api/v1/webhooks", form, "application/x-www-form-urlencoded")
+	var webhook webhookJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &webhook); err != nil || w.Code != http.StatusCreated || webhook.Secret == "" {
+		t.Logf("Failed to create webhook %d %s: %v\n", w.Code, w.Body.String(), err)
+		t.FailNow()
+	}
+	secret = webhook.Secret
+
+	for _, bad := range []string{"ftp://example.com", "http://localhost:8080/", "http://169.254.169.254/latest", "http://[::1]/", "http://10.0.0.1/"} {
+		form = strings.NewReader("url=" + bad)
+		if w = request(handler, http.MethodPost, "/api/v1/webhooks", form, "application/x-www-form-urlencoded"); w.Code != http.StatusBadRequest {
+			printMismatch(t.Errorf, "status of webhook with the bad url "+bad, http.StatusBadRequest, w.Code)
+		}
+	}
+	if w = request(handler, http.MethodGet, "/api/v1/webhooks", nil, ""); strings.Contains(w.Body.String(), secret) {
+		t.Errorf("Webhook secret listed %s\n", w.Body.String())
+	}
+
+	published := make([]string, 0)
+	defer s.events.Subscribe(func(e Event) {
+		published = append(published, e.Type)
+	})()
+
+	relPath := uploadFile(t, handler, "notes.txt", "remember the milk")
+	request(handler, http.MethodDelete, "/f/"+relPath, nil, "")
+	if len(published) != 2 || published[0] != EventFileUploaded || published[1] != EventFileDeleted {
+		t.Errorf("Incorrect published events %v\n", published)
+	}
+
+	delivered, err := DeliverWebhooks(ctx, s.catalog, receiver.Client())
+	if err != nil || delivered != 0 || len(posts) != 2 {
+		t.Logf("Incorrect failing delivery %d %v: %v\n", delivered, posts, err)
+		t.FailNow()
+	}
+	deliveries, _ := s.catalog.GetDeliveries(ctx, webhook.Id, 10)
+	for _, d := range deliveries {
+		if d.Status != db.DeliveryPending || d.Attempts != 1 || d.LastError == "" {
+			t.Errorf("Incorrect failed delivery %v\n", d)
+		}
+		if d.NextAttemptTimestamp.Before(time.Now().Add(WebhookRetryDelay() - time.Second)) {
+			t.Errorf("Failed delivery retried without backoff at %v\n", d.NextAttemptTimestamp)
+		}
+
+		d.NextAttemptTimestamp = time.Now()
+		s.catalog.UpdateDelivery(ctx, d)
+	}
+
+	status = http.StatusNoContent
+	delivered, err = DeliverWebhooks(ctx, s.catalog, receiver.Client())
+	if err != nil || delivered != 2 || len(posts) != 4 {
+		t.Logf("Incorrect retried delivery %d %v: %v\n", delivered, posts, err)
+		t.FailNow()
+	}
+	for i, p := range posts[2:] {
+		var e Event
+		if err = json.Unmarshal(p.body, &e); err != nil || e.Type != p.event || e.Type != published[i] || !p.valid {
+			t.Errorf("Incorrect delivery of %s %s valid %v: %v\n", p.event, p.body, p.valid, err)
+		}
+	}
+
+	w = request(handler, http.MethodGet, "/api/v1/webhooks/1/deliveries", nil, "")
+	if !strings.Contains(w.Body.String(), `"status":"delivered"`) || strings.Contains(w.Body.String(), `"status":"pending"`) {
+		t.Errorf("Incorrect deliveries %s\n", w.Body.String())
+	}
+	if delivered, _ = DeliverWebhooks(ctx, s.catalog, receiver.Client()); delivered != 0 || len(posts) != 4 {
+		t.Errorf("Delivered events again %v\n", posts)
+	}
+
+	// the delivery client refuses internal addresses once the host is no longer allowed
+	config.Server["WebhookAllowedHosts"] = ""
+	uploadFile(t, handler, "more notes.txt", "and the eggs")
+	if delivered, _ = DeliverWebhooks(ctx, s.catalog, webhookClient()); delivered != 0 || len(posts) != 4 {
+		t.Errorf("Delivered to an internal address %v\n", posts)
+	}
+	deliveries, _ = s.catalog.GetDeliveries(ctx, webhook.Id, 1)
+	if len(deliveries) != 1 || !strings.Contains(deliveries[0].LastError, "internal address") {
+		t.Errorf("Incorrect refused delivery %v\n", deliveries)
+	}
+}
+
+func TestSlowWebhook(t *testing.T) {
+	setConfig(t, map[string]string{"WebhookAllowedHosts": "127.0.0.1"})
+	s, handler := newTestServer(t)
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer slow.Close()
+	received := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer fast.Close()
+
+	for _, receiver := range []*httptest.Server{slow, fast} {
+		form := strings.NewReader("url=" + receiver.URL + "&events=file.uploaded")
+		if w := request(handler, http.MethodPost, "/api/v1/webhooks", form, "application/x-www-form-urlencoded"); w.Code != http.StatusCreated {
+			t.Logf("Failed to create webhook %d %s\n", w.Code, w.Body.String())
+			t.FailNow()
+		}
+	}
+	uploadFile(t, handler, "notes.txt", "remember the milk")
+
+	done := make(chan int)
+	go func() {
+		delivered, _ := DeliverWebhooks(ctx, s.catalog, http.DefaultClient)
+		done <- delivered
+	}()
+
+	// the slow webhook was created first, yet doesn't hold up the delivery to the fast one
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Delivery to a fast webhook waited for a slow one\n")
+	}
+	close(release)
+	if delivered := <-done; delivered != 2 {
+		printMismatch(t.Errorf, "delivered events", 2, delivered)
+	}
+}
+
+func TestIntegrityFailure(t *testing.T) {
+	s, handler := newTestServer(t)
+
+	relPath := uploadFile(t, handler, "notes.txt", "remember the milk")
+	failures := make([]Event, 0)
+	defer s.events.Subscribe(func(e Event) {
+		if e.Type == EventIntegrityFailed {
+			failures = append(failures, e)
+		}
+	})()
+
+	request(handler, http.MethodGet, "/f/"+relPath, nil, "")
+	if len(failures) != 0 {
+		t.Errorf("Intact file failed integrity check %v\n", failures)
+	}
+
+	bin, _ := s.catalog.GetBin(context.Background(), 1)
+	if err := os.WriteFile(filepath.Join(bin.Path.Internal, relPath), []byte("remember the MILK"), 0644); err != nil {
+		t.Logf("Failed to corrupt file: %v\n", err)
+		t.FailNow()
+	}
+
+	// every server has its own bus, so other servers don't see the failure
+	other, _ := newTestServer(t)
+	defer other.events.Subscribe(func(e Event) {
+		t.Errorf("Event published on another server %v\n", e)
+	})()
+
+	request(handler, http.MethodGet, "/f/"+relPath, nil, "")
+	if len(failures) != 1 || !strings.Contains(failures[0].Data.(integrityEvent).Error, "hash") {
+		t.Errorf("Incorrect integrity failures %v\n", failures)
+	}
+}
+
+func TestDownloadErrors(t *testing.T) {
+	s, handler := newTestServer(t)
+
+	kept := uploadFile(t, handler, "kept.txt", "still here")
+	lost := uploadFile(t, handler, "lost.txt", "gone missing")
+	trashed := uploadFile(t, handler, "trashed.txt", "thrown away")
+	request(handler, http.MethodDelete, "/f/"+trashed, nil, "")
+
+	w := request(handler, http.MethodHead, "/f/"+kept, nil, "")
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "10" || w.Header().Get("ETag") == "" {
+		t.Errorf("Incorrect HEAD response %d %v %q\n", w.Code, w.Header(), w.Body.String())
+	}
+
+	bin, _ := s.catalog.GetBin(context.Background(), 1)
+	os.Remove(filepath.Join(bin.Path.Internal, lost))
+
+	// HEAD is answered from the catalog, so it succeeds for files missing from their bin
+	if w = request(handler, http.MethodHead, "/f/"+lost, nil, ""); w.Code != http.StatusOK {
+		printMismatch(t.Errorf, "HEAD status of a file missing from its bin", http.StatusOK, w.Code)
+	}
+
+	statuses := []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodGet, "/f/missing", http.StatusNotFound},
+		{http.MethodHead, "/f/missing", http.StatusNotFound},
+		{http.MethodGet, "/f/" + trashed, http.StatusGone},
+		{http.MethodHead, "/f/" + trashed, http.StatusGone},
+		{http.MethodGet, "/f/" + lost, http.StatusNotFound},
+	}
+	for _, test := range statuses {
+		if w = request(handler, test.method, test.target, nil, ""); w.Code != test.status {
+			printMismatch(t.Errorf, "status of "+test.method+" "+test.target, test.status, w.Code)
+		}
+	}
+
+	// storage which is no longer mounted is unavailable rather than missing the file
+	os.RemoveAll(bin.Path.Internal)
+	if w = request(handler, http.MethodGet, "/f/"+kept, nil, ""); w.Code != http.StatusServiceUnavailable {
+		printMismatch(t.Errorf, "status of an unavailable bin", http.StatusServiceUnavailable, w.Code)
+	} else if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "" {
+		printMismatch(t.Errorf, "Cache-Control of an unavailable bin", "", cacheControl)
+	}
+}
+
+// Encodes an opaque red image as png
+func redPNG(t *testing.T, width int, height int) string {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestThumbnails(t *testing.T) {
+	setConfig(t, map[string]string{"ThumbnailSizes": "16,32", "ThumbnailsOnUpload": "false"})
+	_, handler := newTestServer(t)
+
+	imagePath := uploadFile(t, handler, "red.png", redPNG(t, 64, 32))
+	textPath := uploadFile(t, handler, "notes.txt", "remember the milk")
+
+	w := request(handler, http.MethodGet, "/f/"+imagePath+"?thumb=16", nil, "")
+	if w.Code != http.StatusOK {
+		printMismatch(t.Errorf, "thumbnail status", http.StatusOK, w.Code)
+	} else if contentType := w.Header().Get("Content-Type"); contentType != "image/jpeg" {
+		printMismatch(t.Errorf, "thumbnail Content-Type", "image/jpeg", contentType)
+	} else if thumb, _, err := image.Decode(w.Body); err != nil {
+		t.Errorf("Failed to decode thumbnail: %v\n", err)
+	} else if size := thumb.Bounds().Size(); size != image.Pt(16, 8) {
+		printMismatch(t.Errorf, "thumbnail size", image.Pt(16, 8), size)
+	}
+
+	statuses := []struct {
+		target string
+		status int
+	}{
+		{"/f/" + imagePath + "?thumb=32", http.StatusOK},
+		{"/f/" + imagePath + "?thumb=64", http.StatusBadRequest},
+		{"/f/" + imagePath + "?thumb=big", http.StatusBadRequest},
+		{"/f/" + textPath + "?thumb=16", http.StatusNotFound},
+	}
+	for _, test := range statuses {
+		if w = request(handler, http.MethodGet, test.target, nil, ""); w.Code != test.status {
+			printMismatch(t.Errorf, "status of "+test.target, test.status, w.Code)
+		}
+	}
+}
+
+// Uploads a file as a new version of a logical path in the testing bin, returning its relative path
+func uploadVersion(t *testing.T, handler http.Handler, path string, content string) string {
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("binId", "1")
+	form.WriteField("path", path)
+	part, _ := form.CreateFormFile("file", "version.txt")
+	part.Write([]byte(content))
+	form.Close()
+
+	w := request(handler, http.MethodPost, "/upload", body, form.FormDataContentType())
+	var results []uploadResultJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) != 1 || results[0].File == nil {
+		t.Logf("Incorrect upload results %d %s: %v\n", w.Code, w.Body.String(), err)
+		t.FailNow()
+	}
+
+	return results[0].File.RelPath
+}
+
+func TestVersions(t *testing.T) {
+	setConfig(t, map[string]string{"VersionRetention": "3"})
+	_, handler := newTestServer(t)
+
+	listVersions := func() []versionJSON {
+		w := request(handler, http.MethodGet, "/api/v1/bins/1/versions/notes/plan.txt", nil, "")
+		var versions []versionJSON
+		if err := json.Unmarshal(w.Body.Bytes(), &versions); err != nil {
+			t.Logf("Failed to decode versions %d %s: %v\n", w.Code, w.Body.String(), err)
+			t.FailNow()
+		}
+		return versions
+	}
+	rollback := func(version string) *httptest.ResponseRecorder {
+		body := strings.NewReader(url.Values{"version": {version}}.Encode())
+		return request(handler, http.MethodPost, "/api/v1/bins/1/rollback/notes/plan.txt", body, "application/x-www-form-urlencoded")
+	}
+
+	uploadVersion(t, handler, "notes/plan.txt", "first plan")
+	uploadVersion(t, handler, "notes/plan.txt", "second plan")
+
+	if w := rollback("7"); w.Code != http.StatusNotFound {
+		printMismatch(t.Errorf, "status of a rollback to a missing version", http.StatusNotFound, w.Code)
+	}
+	if w := rollback("1"); w.Code != http.StatusOK {
+		printMismatch(t.Errorf, "rollback status", http.StatusOK, w.Code)
+	}
+	for _, v := range listVersions() {
+		if v.Current != (v.Version == 1) {
+			t.Errorf("Incorrect current flag of version %d after a rollback %t\n", v.Version, v.Current)
+		}
+	}
+
+	// an earlier version can be downloaded by its number, the rolled back one without it
+	downloads := []struct {
+		target  string
+		content string
+	}{
+		{"/p/1/notes/plan.txt", "first plan"},
+		{"/p/1/notes/plan.txt?version=2", "second plan"},
+	}
+	for _, test := range downloads {
+		w := request(handler, http.MethodGet, test.target, nil, "")
+		if w.Code != http.StatusOK || w.Body.String() != test.content {
+			t.Errorf("Incorrect download of %s %d %q\n", test.target, w.Code, w.Body.String())
+		}
+	}
+
+	// the oldest versions beyond the retention are pruned, but never the current one
+	uploadVersion(t, handler, "notes/plan.txt", "third plan")
+	uploadVersion(t, handler, "notes/plan.txt", "fourth plan")
+	uploadVersion(t, handler, "notes/plan.txt", "fifth plan")
+	var kept []int64
+	for _, v := range listVersions() {
+		kept = append(kept, v.Version)
+	}
+	slices.Sort(kept)
+	if !slices.Equal(kept, []int64{3, 4, 5}) {
+		printMismatch(t.Errorf, "versions kept", []int64{3, 4, 5}, kept)
+	}
+	if w := request(handler, http.MethodGet, "/p/1/notes/plan.txt?version=1", nil, ""); w.Code == http.StatusOK {
+		t.Error("Downloaded a pruned version")
+	}
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+	_, handler := newTestServer(t)
+
+	first := uploadVersion(t, handler, "notes/todo.txt", "first draft")
+	uploadVersion(t, handler, "notes/todo.txt", "second draft")
+
+	for _, target := range []string{"/f/" + first, "/p/1/notes/todo.txt"} {
+		get := request(handler, http.MethodGet, target, nil, "")
+		head := request(handler, http.MethodHead, target, nil, "")
+		if head.Code != get.Code || head.Body.Len() != 0 {
+			t.Errorf("Incorrect HEAD response of %s %d %q, GET gave %d\n", target, head.Code, head.Body.String(), get.Code)
+		}
+		for _, name := range []string{"Content-Type", "Content-Length", "ETag", "Cache-Control", "Content-Disposition", "Repr-Digest", "Last-Modified"} {
+			if head.Header().Get(name) != get.Header().Get(name) {
+				printMismatch(t.Errorf, name+" of HEAD "+target, get.Header().Get(name), head.Header().Get(name))
+			}
+		}
+		if contentType := head.Header().Get("Content-Type"); contentType == "" {
+			t.Errorf("Missing Content-Type of HEAD %s\n", target)
+		}
+
+		since := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			r := httptest.NewRequest(method, target, nil)
+			r.Header.Set("If-Modified-Since", since)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusNotModified {
+				printMismatch(t.Errorf, "status of "+method+" "+target+" with If-Modified-Since", http.StatusNotModified, w.Code)
+			}
+		}
+	}
+
+	// a trashed version is gone, like its file
+	request(handler, http.MethodDelete, "/f/"+first, nil, "")
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if w := request(handler, method, "/p/1/notes/todo.txt?version=1", nil, ""); w.Code != http.StatusGone {
+			printMismatch(t.Errorf, "status of "+method+" of a trashed version", http.StatusGone, w.Code)
+		}
+		if w := request(handler, method, "/p/1/notes/missing.txt", nil, ""); w.Code != http.StatusNotFound {
+			printMismatch(t.Errorf, "status of "+method+" of a missing path", http.StatusNotFound, w.Code)
+		}
+	}
+}
+
+func TestRedirectBin(t *testing.T) {
+	s, handler := newTestServer(t)
+
+	relPath := uploadFile(t, handler, "notes.txt", "remember the milk")
+	bin, _ := s.catalog.GetBin(context.Background(), 1)
+	bin.Redirect = true
+
+	// the external url of the testing bin isn't an http url, so there's nowhere to redirect to
+	if w := request(handler, http.MethodGet, "/f/"+relPath, nil, ""); w.Code != http.StatusInternalServerError {
+		printMismatch(t.Errorf, "status of a bin without a public url", http.StatusInternalServerError, w.Code)
+	}
+
+	bin.Path.External = "https://cdn.example.com/notes"
+	w := request(handler, http.MethodGet, "/f/"+relPath, nil, "")
+	if w.Code != http.StatusTemporaryRedirect {
+		printMismatch(t.Errorf, "redirect status", http.StatusTemporaryRedirect, w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "https://cdn.example.com/notes/"+relPath {
+		printMismatch(t.Errorf, "redirect location", "https://cdn.example.com/notes/"+relPath, location)
+	}
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "private, max-age=900" {
+		printMismatch(t.Errorf, "redirect Cache-Control", "private, max-age=900", cacheControl)
+	}
+
+	// HEAD is redirected like GET, rather than describing a file the bin doesn't serve
+	w = request(handler, http.MethodHead, "/f/"+relPath, nil, "")
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "https://cdn.example.com/notes/"+relPath {
+		t.Errorf("Incorrect HEAD response of a redirecting bin %d %v\n", w.Code, w.Header())
+	}
+}
+
+// Reads the next event of a server-sent event stream, skipping comments
+func readStreamEvent(t *testing.T, lines *bufio.Scanner) (id string, eventType string) {
+	for lines.Scan() {
+		line := lines.Text()
+		if value, ok := strings.CutPrefix(line, "id: "); ok {
+			id = value
+		} else if value, ok := strings.CutPrefix(line, "event: "); ok {
+			eventType = value
+		} else if line == "" && id != "" {
+			return id, eventType
+		}
+	}
+
+	t.Logf("Event stream ended: %v\n", lines.Err())
+	t.FailNow()
+	return "", ""
+}
+
+func TestEventStream(t *testing.T) {
+	s, handler := newTestServer(t)
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	relPath := uploadFile(t, handler, "notes.txt", "remember the milk")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/v1/events?bin=1", nil)
+	r.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Logf("Failed to open event stream: %v\n", err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+
+	if id, eventType := readStreamEvent(t, lines); id != "1" || eventType != EventFileUploaded {
+		t.Errorf("Incorrect resumed event %s %s\n", id, eventType)
+	}
+
+	request(handler, http.MethodDelete, "/f/"+relPath, nil, "")
+	if id, eventType := readStreamEvent(t, lines); id != "2" || eventType != EventFileDeleted {
+		t.Errorf("Incorrect live event %s %s\n", id, eventType)
+	}
+
+	r, _ = http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/v1/events", nil)
+	latest, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Logf("Failed to open event stream: %v\n", err)
+		t.FailNow()
+	}
+	defer latest.Body.Close()
+	uploadFile(t, handler, "list.txt", "eggs")
+	if id, _ := readStreamEvent(t, bufio.NewScanner(latest.Body)); id != "3" {
+		printMismatch(t.Errorf, "first event of new stream", "3", id)
+	}
+	readStreamEvent(t, lines)
+
+	s.CloseStreams()
+	for lines.Scan() {
+		if strings.HasPrefix(lines.Text(), "id: ") {
+			t.Errorf("Unexpected event after closing streams %s\n", lines.Text())
+		}
+	}
+	if ctx.Err() != nil {
+		t.Error("Event stream wasn't closed")
+	}
+
+	if w := request(handler, http.MethodGet, "/api/v1/events?lastEventId=x", nil, ""); w.Code != http.StatusBadRequest {
+		printMismatch(t.Errorf, "status of bad last event id", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestPortal(t *testing.T) {
+	setConfig(t, map[string]string{"ThumbnailSizes": "64,200", "ThumbnailsOnUpload": "false"})
+	_, handler := newTestServer(t)
+
+	notes := uploadFile(t, handler, "notes.txt", "remember the milk")
+	uploadFile(t, handler, "Agenda.txt", "standup")
+
+	w := request(handler, http.MethodGet, "/ui/", nil, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<a href="/ui/bins/1">testing bin</a>`) {
+		t.Errorf("Incorrect bin list %d %s\n", w.Code, w.Body.String())
+	}
+
+	w = request(handler, http.MethodGet, "/ui/bins/1?sort=name", nil, "")
+	agenda, notesRow := strings.Index(w.Body.String(), "Agenda.txt"), strings.Index(w.Body.String(), "notes.txt")
+	if w.Code != http.StatusOK || agenda < 0 || notesRow < agenda {
+		t.Errorf("Incorrect file listing sorted by name %d %s\n", w.Code, w.Body.String())
+	}
+	w = request(handler, http.MethodGet, "/ui/bins/1?q=NOTES", nil, "")
+	if strings.Contains(w.Body.String(), "Agenda.txt") || !strings.Contains(w.Body.String(), "Showing 1 of 2 files") {
+		t.Errorf("Incorrect filtered file listing %s\n", w.Body.String())
+	}
+	if w = request(handler, http.MethodGet, "/ui/bins/7", nil, ""); w.Code != http.StatusNotFound {
+		printMismatch(t.Errorf, "status of missing bin", http.StatusNotFound, w.Code)
+	}
+
+	form := strings.NewReader("name=shopping.txt")
+	if w = request(handler, http.MethodPut, "/api/v1/files/name/"+notes, form, "application/x-www-form-urlencoded"); w.Code != http.StatusNoContent {
+		printMismatch(t.Errorf, "status of rename", http.StatusNoContent, w.Code)
+	}
+	w = request(handler, http.MethodGet, "/ui/files/"+notes, nil, "")
+	if !strings.Contains(w.Body.String(), "<h1>shopping.txt</h1>") || !strings.Contains(w.Body.String(), "1c6e76593ebd1c93bc2934c3e57f810c") {
+		t.Errorf("Incorrect file details %s\n", w.Body.String())
+	}
+
+	if !strings.Contains(w.Body.String(), `<form id="rename" data-path="`+notes+`" hidden>`) {
+		t.Errorf("Rename form shown without the portal script %s\n", w.Body.String())
+	}
+
+	// images are previewed at a configured thumbnail size
+	picture := uploadFile(t, handler, "red.png", redPNG(t, 8, 8))
+	w = request(handler, http.MethodGet, "/ui/files/"+picture, nil, "")
+	if !strings.Contains(w.Body.String(), `src="/f/`+picture+`?thumb=200"`) {
+		t.Errorf("Incorrect preview %s\n", w.Body.String())
+	}
+
+	if w = request(handler, http.MethodGet, "/ui/static/portal.js", nil, ""); w.Code != http.StatusOK {
+		printMismatch(t.Errorf, "status of portal script", http.StatusOK, w.Code)
+	}
+
+	for bytes, expected := range map[int64]string{12: "12 B", 1536: "1.5 KiB", 5 << 30: "5.0 GiB"} {
+		if size := formatSize(bytes); size != expected {
+			printMismatch(t.Errorf, "formatted size", expected, size)
+		}
+	}
+}
+
+// Gets the method and OpenAPI path of a mux pattern
+func patternOperation(pattern string) (string, string) {
+	method, path, _ := strings.Cut(pattern, " ")
+	path = strings.TrimSuffix(path, "{$}")
+	path = strings.ReplaceAll(path, "...}", "}")
+
+	return strings.ToLower(method), path
+}
+
+func TestOpenAPI(t *testing.T) {
+	s, handler := newTestServer(t)
+
+	w := request(handler, http.MethodGet, "/api/openapi.json", nil, "")
+	if w.Code != http.StatusOK {
+		printMismatch(t.Errorf, "document status", http.StatusOK, w.Code)
+	}
+	var doc struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Logf("Failed to decode document: %v\n", err)
+		t.FailNow()
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		printMismatch(t.Errorf, "openapi version", "3.x", doc.OpenAPI)
+	}
+
+	routed := make(map[string]bool)
+	for _, route := range s.routes() {
+		method, path := patternOperation(route.pattern)
+		routed[method+" "+path] = true
+		if _, ok := doc.Paths[path][method]; !ok {
+			t.Errorf("Route %s is not documented\n", route.pattern)
+		}
+	}
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			if method != "parameters" && !routed[method+" "+path] {
+				t.Errorf("Documented operation %s %s has no route\n", method, path)
+			}
+		}
+	}
+}
+
+// A catalog which fails to look up collections
+type brokenCollectionsCatalog struct {
+	db.Catalog
+}
+
+func (c brokenCollectionsCatalog) GetCollection(ctx context.Context, id int64) (*storage.Collection, error) {
+	return nil, errors.New("collections unavailable")
+}
+
+func TestArchive(t *testing.T) {
+	s, handler := newTestServer(t)
+
+	first := uploadFile(t, handler, "report.txt", "first draft")
+	second := uploadFile(t, handler, "report.txt", "final draft")
+
+	w := request(handler, http.MethodGet, "/api/v1/archive?format=tar.gz&name=deliverables&relPath="+first+"&relPath="+second, nil, "")
+	if w.Code != http.StatusOK {
+		t.Logf("Failed to download archive: %d %s\n", w.Code, w.Body.String())
+		t.FailNow()
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != `attachment; filename="deliverables.tar.gz"` {
+		printMismatch(t.Errorf, "content disposition", `attachment; filename="deliverables.tar.gz"`, disposition)
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Logf("Failed to decompress archive: %v\n", err)
+		t.FailNow()
+	}
+	entries := make(map[string]string)
+	var names []string
+	tr := tar.NewReader(gz)
+	for header, err := tr.Next(); err != io.EOF; header, err = tr.Next() {
+		if err != nil {
+			t.Logf("Failed to read archive: %v\n", err)
+			t.FailNow()
+		}
+		content, _ := io.ReadAll(tr)
+		entries[header.Name] = string(content)
+		names = append(names, header.Name)
+	}
+	expectedNames := []string{"report.txt", "report (1).txt", manifestName}
+	if !slices.Equal(names, expectedNames) {
+		printMismatch(t.Errorf, "archive entries", expectedNames, names)
+	} else if entries["report.txt"] != "first draft" || entries["report (1).txt"] != "final draft" {
+		t.Errorf("Incorrect archived files %v\n", entries)
+	}
+	if !strings.HasPrefix(entries[manifestName], "3bf0896f1d78514e862c04374e4ebe96  report.txt\n") || strings.Count(entries[manifestName], "\n") != 2 {
+		t.Errorf("Incorrect manifest %q\n", entries[manifestName])
+	}
+	bin, _ := s.catalog.GetBin(context.Background(), 1)
+	if downloaded := bin.Stats().Downloaded; downloaded != 2 {
+		printMismatch(t.Errorf, "downloads counted for an archive of 2 files", 2, downloaded)
+	}
+
+	// a file selected twice is only archived once
+	w = request(handler, http.MethodPost, "/api/v1/archive", strings.NewReader("bin=1&relPath="+first), "application/x-www-form-urlencoded")
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Logf("Failed to read zip archive %d: %v\n", w.Code, err)
+		t.FailNow()
+	}
+	if len(archive.File) != 3 {
+		printMismatch(t.Errorf, "number of zip entries", 3, len(archive.File))
+	}
+
+	if w = request(handler, http.MethodGet, "/api/v1/archive", nil, ""); w.Code != http.StatusBadRequest {
+		printMismatch(t.Errorf, "status without files", http.StatusBadRequest, w.Code)
+	}
+	if w = request(handler, http.MethodGet, "/api/v1/archive?relPath=missing", nil, ""); w.Code != http.StatusNotFound {
+		printMismatch(t.Errorf, "status of missing file", http.StatusNotFound, w.Code)
+	}
+	if w = request(handler, http.MethodGet, "/api/v1/archive?bin=1&format=rar", nil, ""); w.Code != http.StatusBadRequest {
+		printMismatch(t.Errorf, "status of bad format", http.StatusBadRequest, w.Code)
+	}
+
+	if w = request(handler, http.MethodGet, "/api/v1/archive?collection=9", nil, ""); w.Code != http.StatusNotFound {
+		printMismatch(t.Errorf, "status of missing collection", http.StatusNotFound, w.Code)
+	}
+	catalog := s.catalog
+	s.catalog = brokenCollectionsCatalog{catalog}
+	if w = request(handler, http.MethodGet, "/api/v1/archive?collection=1", nil, ""); w.Code != http.StatusInternalServerError {
+		printMismatch(t.Errorf, "status of a failed collection lookup", http.StatusInternalServerError, w.Code)
+	}
+	s.catalog = catalog
+
+	// an archive missing a file isn't sent as if it were complete
+	os.Remove(filepath.Join(bin.Path.Internal, second))
+	if w = request(handler, http.MethodGet, "/api/v1/archive?bin=1", nil, ""); w.Code != http.StatusNotFound {
+		printMismatch(t.Errorf, "status of an archive of a file missing from its bin", http.StatusNotFound, w.Code)
+	}
+}
+
+// Uploads a file to bin 1, returning the result of the upload
+func uploadResult(t *testing.T, handler http.Handler, name string, content []byte) uploadResultJSON {
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("binId", "1")
+	part, _ := form.CreateFormFile("file", name)
+	part.Write(content)
+	form.Close()
+
+	w := request(handler, http.MethodPost, "/upload", body, form.FormDataContentType())
+	var results []uploadResultJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) != 1 {
+		t.Logf("Incorrect upload results %d %s: %v\n", w.Code, w.Body.String(), err)
+		t.FailNow()
+	}
+
+	return results[0]
+}
+
+func zipOf(files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		entry, _ := zw.Create(name)
+		io.WriteString(entry, content)
+	}
+	zw.Close()
+
+	return buf.Bytes()
+}
+
+func TestExtractArchive(t *testing.T) {
+	setConfig(t, map[string]string{"ExtractArchiveBins": "1", "ExtractMaxRatio": "100"})
+	s, handler := newTestServer(t)
+
+	result := uploadResult(t, handler, "site.zip", zipOf(map[string]string{"index.html": "<p>home</p>", "css/style.css": "p {}"}))
+	if result.Status != http.StatusOK || result.File == nil || result.Collection == nil {
+		t.Logf("Incorrect result extracting a zip %+v\n", result)
+		t.FailNow()
+	}
+	paths := make([]string, len(result.Collection.Files))
+	for i, f := range result.Collection.Files {
+		paths[i] = f.LogicalPath
+	}
+	slices.Sort(paths)
+	if expected := []string{"site/css/style.css", "site/index.html"}; !slices.Equal(paths, expected) {
+		printMismatch(t.Errorf, "extracted paths", expected, paths)
+	}
+	if result.Collection.Name != "site" {
+		printMismatch(t.Errorf, "collection name", "site", result.Collection.Name)
+	}
+
+	tarball := new(bytes.Buffer)
+	gz := gzip.NewWriter(tarball)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "docs/", Mode: 0o755})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "docs/readme.md", Mode: 0o644, Size: 7})
+	io.WriteString(tw, "# docs\n")
+	tw.Close()
+	gz.Close()
+	result = uploadResult(t, handler, "docs.tar.gz", tarball.Bytes())
+	if result.Collection == nil || len(result.Collection.Files) != 1 || result.Collection.Files[0].LogicalPath != "docs/docs/readme.md" {
+		t.Errorf("Incorrect result extracting a tarball %+v\n", result)
+	}
+
+	result = uploadResult(t, handler, "escape.zip", zipOf(map[string]string{"../outside.txt": "gotcha"}))
+	if result.Status != http.StatusBadRequest || result.File != nil {
+		t.Errorf("Incorrect result of an archive escaping its directory %+v\n", result)
+	}
+
+	config.Server["ExtractMaxRatio"] = "10"
+	result = uploadResult(t, handler, "zeros.zip", zipOf(map[string]string{"zeros": strings.Repeat("\x00", 1<<20)}))
+	if result.Status != http.StatusBadRequest || !strings.Contains(result.Error, "times its size") {
+		t.Errorf("Incorrect result of an archive over the ratio limit %+v\n", result)
+	}
+
+	// data hidden in members which aren't extracted, such as contiguous files, still counts towards the limits
+	hidden := new(bytes.Buffer)
+	tw = tar.NewWriter(hidden)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "hidden", Mode: 0o644, Size: 1 << 20})
+	tw.Write(make([]byte, 1<<20))
+	tw.Close()
+	header := hidden.Bytes()[:512]
+	header[156] = tar.TypeCont
+	copy(header[148:156], "        ")
+	checksum := 0
+	for _, b := range header {
+		checksum += int(b)
+	}
+	copy(header[148:156], fmt.Sprintf("%06o\x00 ", checksum))
+	tarball.Reset()
+	gz = gzip.NewWriter(tarball)
+	gz.Write(hidden.Bytes())
+	gz.Close()
+	result = uploadResult(t, handler, "hidden.tar.gz", tarball.Bytes())
+	if result.Status != http.StatusBadRequest || !strings.Contains(result.Error, "expands") {
+		t.Errorf("Incorrect result of an archive hiding data in a skipped member %+v\n", result)
+	}
+
+	// only the archive is stored in bins which don't extract archives
+	config.Server["ExtractArchiveBins"] = "2"
+	result = uploadResult(t, handler, "kept.zip", zipOf(map[string]string{"a.txt": "a"}))
+	if result.Status != http.StatusOK || result.Collection != nil {
+		t.Errorf("Incorrect result of an archive in a bin without extraction %+v\n", result)
+	}
+
+	// a member larger than recorded only fails once extracted, after the files before it were stored
+	config.Server["ExtractArchiveBins"] = "1"
+	lying := new(bytes.Buffer)
+	zw := zip.NewWriter(lying)
+	entry, _ := zw.Create("fine.txt")
+	io.WriteString(entry, "fine")
+	entry, _ = zw.CreateRaw(&zip.FileHeader{Name: "liar.txt", Method: zip.Store, CompressedSize64: 11, UncompressedSize64: 5})
+	io.WriteString(entry, "hello world")
+	zw.Close()
+	var events []string
+	unsubscribe := s.events.Subscribe(func(e Event) { events = append(events, e.Type) })
+	result = uploadResult(t, handler, "lying.zip", lying.Bytes())
+	unsubscribe()
+	if result.Status != http.StatusBadRequest || result.File != nil || result.Collection != nil {
+		t.Errorf("Incorrect result of an archive failing extraction %+v\n", result)
+	}
+	// nothing is announced of an upload which failed
+	if len(events) != 0 {
+		t.Errorf("Events published for an archive failing extraction %v\n", events)
+	}
+	w := request(handler, http.MethodGet, "/api/v1/audit?action="+db.AuditFileDelete, nil, "")
+	if w.Body.String() != "[]\n" {
+		t.Errorf("Audited removal of an archive failing extraction %s\n", w.Body.String())
+	}
+
+	w = request(handler, http.MethodGet, "/api/v1/bins/1/files", nil, "")
+	var files []fileJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &files); err != nil || len(files) != 6 {
+		t.Errorf("Incorrect files after extraction %d: %v\n", len(files), err)
+	}
+	w = request(handler, http.MethodGet, "/api/v1/collections", nil, "")
+	var collections []collectionJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &collections); err != nil || len(collections) != 2 {
+		t.Errorf("Incorrect collections after a failed extraction %s: %v\n", w.Body.String(), err)
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"file-cellar/config"
+	"file-cellar/db"
+	"file-cellar/storage"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sources of stats by their name in api paths
+var statsSources = map[string]db.StatsSource{
+	"bins":    db.BinStats,
+	"drivers": db.DriverStats,
+}
+
+// Resolutions of stats by their name in api queries
+var statsResolutions = map[string]time.Duration{
+	"raw":  db.RawResolution,
+	"hour": db.HourResolution,
+	"day":  db.DayResolution,
+}
+
+type statsPointJSON struct {
+	Timestamp time.Time `json:"timestamp"`
+	storage.Stats
+}
+
+type statsJSON struct {
+	Points  []statsPointJSON     `json:"points"`
+	Summary storage.StatsSummary `json:"summary"`
+}
+
+type statsKey struct {
+	source db.StatsSource
+	id     int64
+}
+
+// Records the stats of every bin and driver of a catalog as they change
+type StatsRecorder struct {
+	catalog db.Catalog
+
+	mu   sync.Mutex // serializes recordings
+	last map[statsKey]storage.Stats
+}
+
+func NewStatsRecorder(catalog db.Catalog) *StatsRecorder {
+	return &StatsRecorder{catalog: catalog, last: make(map[statsKey]storage.Stats)}
+}
+
+// Gets the time between recordings of stats
+func StatsInterval() time.Duration {
+	interval, err := time.ParseDuration(config.Server["StatsInterval"])
+	if err != nil || interval <= 0 {
+		log.Printf("Bad stats interval `%s`, using 1 minute\n", config.Server["StatsInterval"])
+		return time.Minute
+	}
+
+	return interval
+}
+
+// Gets how long raw stats records are kept for, once summed into the hourly and daily rollups
+func StatsRawRetention() time.Duration {
+	retention, err := time.ParseDuration(config.Server["StatsRawRetention"])
+	if err != nil || retention <= 0 {
+		log.Printf("Bad raw stats retention `%s`, using 7 days\n", config.Server["StatsRawRetention"])
+		return 7 * 24 * time.Hour
+	}
+
+	return retention
+}
+
+// Gets how long hourly stats rollups are kept for, daily rollups are kept indefinitely
+func StatsHourlyRetention() time.Duration {
+	retention, err := time.ParseDuration(config.Server["StatsHourlyRetention"])
+	if err != nil || retention <= 0 {
+		log.Printf("Bad hourly stats retention `%s`, using 90 days\n", config.Server["StatsHourlyRetention"])
+		return 90 * 24 * time.Hour
+	}
+
+	return retention
+}
+
+// Gets the change from one stats snapshot to the next
+//
+// Counters only go down when a bin is reloaded with fresh counters, so every operation in current is new.
+func statsDelta(current storage.Stats, last storage.Stats) storage.Stats {
+	lower := current
+	lower.Min(last)
+	if lower != last {
+		return current
+	}
+
+	current.Sub(last)
+	return current
+}
+
+// Stores the change in stats of every bin and driver since the previous recording
+//
+// Sources without new operations are skipped.
+func (r *StatsRecorder) Record(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bins, err := r.catalog.ListBins(ctx)
+	if err != nil {
+		return err
+	}
+
+	snapshots := make(map[statsKey]storage.Stats)
+	for _, bin := range bins {
+		snapshots[statsKey{db.BinStats, bin.Id}] = bin.Stats()
+		snapshots[statsKey{db.DriverStats, bin.Driver.Id()}] = bin.Driver.Stats()
+	}
+
+	now := time.Now()
+	records := make([]db.StatsRecord, 0)
+	for key, snapshot := range snapshots {
+		delta := statsDelta(snapshot, r.last[key])
+		if delta == (storage.Stats{}) {
+			continue
+		}
+		records = append(records, db.StatsRecord{Source: key.source, SourceId: key.id, Timestamp: now, Stats: delta})
+	}
+
+	if len(records) > 0 {
+		// on failure the changes are kept for the next recording
+		if err = r.catalog.AddStats(ctx, records); err != nil {
+			return err
+		}
+	}
+	for key, snapshot := range snapshots {
+		r.last[key] = snapshot
+	}
+
+	return nil
+}
+
+// Removes raw stats and hourly rollups older than their retention
+func (r *StatsRecorder) Prune(ctx context.Context) error {
+	now := time.Now()
+	if _, err := r.catalog.PruneStats(ctx, db.RawResolution, now.Add(-StatsRawRetention())); err != nil {
+		return err
+	}
+	_, err := r.catalog.PruneStats(ctx, db.HourResolution, now.Add(-StatsHourlyRetention()))
+	return err
+}
+
+// Records stats every interval, pruning those past their retention, until ctx is done
+func (r *StatsRecorder) RecordPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := r.Record(ctx); err != nil {
+			log.Printf("Failed to record stats: %v\n", err)
+		}
+		if err := r.Prune(ctx); err != nil {
+			log.Printf("Failed to prune stats: %v\n", err)
+		}
+	}
+}
+
+// Parses an optional RFC 3339 time query parameter, responding with an error if it is invalid
+func parseTimeParam(w http.ResponseWriter, r *http.Request, name string, fallback time.Time) (time.Time, bool) {
+	if !r.URL.Query().Has(name) {
+		return fallback, true
+	}
+
+	t, err := time.Parse(time.RFC3339, r.URL.Query().Get(name))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad %s `%s`, it should be an RFC 3339 time", name, r.URL.Query().Get(name)), http.StatusBadRequest)
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// Gets the recorded stats of a bin or driver, or of every bin or driver when no id is given
+//
+// The from and to parameters bound the time range, defaulting to the last day,
+// and resolution rolls the stats up by raw recording, hour or day, defaulting to hour.
+func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
+	source, ok := statsSources[r.PathValue("source")]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Bad source `%s`, it should be bins or drivers", r.PathValue("source")), http.StatusNotFound)
+		return
+	}
+
+	sourceId := int64(-1)
+	if r.PathValue("sourceId") != "" {
+		id, err := strconv.ParseInt(r.PathValue("sourceId"), 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, fmt.Sprintf("Bad id `%s`, it should be a positive integer", r.PathValue("sourceId")), http.StatusBadRequest)
+			return
+		}
+		sourceId = id
+	}
+
+	to, ok := parseTimeParam(w, r, "to", time.Now())
+	if !ok {
+		return
+	}
+	from, ok := parseTimeParam(w, r, "from", to.Add(-24*time.Hour))
+	if !ok {
+		return
+	}
+
+	resolution := db.HourResolution
+	if r.URL.Query().Has("resolution") {
+		resolution, ok = statsResolutions[r.URL.Query().Get("resolution")]
+		if !ok {
+			http.Error(w, "Bad resolution, it should be raw, hour or day", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := s.catalog.GetStats(r.Context(), source, sourceId, from, to, resolution)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting stats of %s %d: %v : %s\n", source, sourceId, err, r.RemoteAddr)
+		return
+	}
+
+	response := statsJSON{Points: make([]statsPointJSON, len(records))}
+	stats := make([]storage.Stats, len(records))
+	for i, record := range records {
+		response.Points[i] = statsPointJSON{Timestamp: record.Timestamp, Stats: record.Stats}
+		stats[i] = record.Stats
+	}
+	response.Summary = storage.Summary(stats)
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Events read from the event log at once by an event stream
+const eventBatchSize = 100
+
+// Time between comments sent on idle event streams, keeping proxies from closing them
+const streamKeepAlive = 15 * time.Second
+
+// Parses an optional non negative id, responding with an error if it is invalid
+func parseEventParam(w http.ResponseWriter, name string, value string) (int64, bool) {
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		http.Error(w, fmt.Sprintf("Bad %s `%s`, it should be a positive integer", name, value), http.StatusBadRequest)
+		return 0, false
+	}
+
+	return id, true
+}
+
+// Streams events as server-sent events, filtered to a bin by the bin parameter
+//
+// Streams resume after the id in the Last-Event-ID header, or the lastEventId parameter for clients which
+// can't set headers, as long as the event is still in the event log. Without an id only new events are sent.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	binId := int64(-1)
+	if query.Has("bin") {
+		id, ok := parseEventParam(w, "bin", query.Get("bin"))
+		if !ok {
+			return
+		}
+		binId = id
+	}
+
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = query.Get("lastEventId")
+	}
+	var lastId int64
+	if resume != "" {
+		id, ok := parseEventParam(w, "last event id", resume)
+		if !ok {
+			return
+		}
+		lastId = id
+	}
+
+	// subscribe before reading the log, so events logged while it is read aren't missed
+	wake := make(chan struct{}, 1)
+	defer s.events.Subscribe(func(e Event) {
+		if binId < 0 || e.BinId == binId {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	})()
+
+	if resume == "" {
+		id, err := s.catalog.LastEventId(ctx)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error getting last event id: %v : %s\n", err, r.RemoteAddr)
+			return
+		}
+		lastId = id
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		events, err := s.catalog.GetEvents(ctx, lastId, binId, eventBatchSize)
+		if err != nil {
+			log.Printf("Error getting events after %d: %v : %s\n", lastId, err, r.RemoteAddr)
+			return
+		}
+		for _, record := range events {
+			data, err := json.Marshal(loggedEvent(record))
+			if err != nil {
+				log.Printf("Failed to encode event %d: %v\n", record.Id, err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", record.Id, record.Type, data)
+			lastId = record.Id
+		}
+		if err = rc.Flush(); err != nil {
+			log.Printf("Error flushing event stream: %v : %s\n", err, r.RemoteAddr)
+			return
+		}
+		if len(events) == eventBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.closing:
+			return
+		case <-wake:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"file-cellar/db"
+	"log"
+	"net/http"
+)
+
+func (s *Server) listTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := s.catalog.ListTags(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error listing tags: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tags)
+}
+
+func (s *Server) listTaggedFiles(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+
+	files, err := s.catalog.GetTaggedFiles(r.Context(), tag)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error listing files tagged %s: %v : %s\n", tag, err, r.RemoteAddr)
+		return
+	}
+
+	response := make([]fileJSON, len(files))
+	for i, fInfo := range files {
+		response[i] = newFileJSON(fInfo)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) getFileTags(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("filePath")
+
+	ctx := r.Context()
+
+	if _, err := s.catalog.GetFile(ctx, path); errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting file info: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	tags, err := s.catalog.GetTags(ctx, path)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting tags of %s: %v : %s\n", path, err, r.RemoteAddr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tags)
+}
+
+func (s *Server) tagFile(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	path := r.PathValue("filePath")
+
+	err := s.catalog.TagFile(r.Context(), path, tag)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error tagging %s with %s: %v : %s\n", path, tag, err, r.RemoteAddr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) untagFile(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	path := r.PathValue("filePath")
+
+	ok, err := s.catalog.UntagFile(r.Context(), path, tag)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error untagging %s from %s: %v : %s\n", tag, path, err, r.RemoteAddr)
+		return
+	} else if !ok {
+		http.Error(w, "File does not have tag", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"file-cellar/config"
+	"file-cellar/db"
+	"file-cellar/storage"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Gets how long files stay in the trash before they are purged
+func TrashGracePeriod() time.Duration {
+	grace, err := time.ParseDuration(config.Server["TrashGracePeriod"])
+	if err != nil || grace < 0 {
+		log.Printf("Bad trash grace period `%s`, using 30 days\n", config.Server["TrashGracePeriod"])
+		return 30 * 24 * time.Hour
+	}
+
+	return grace
+}
+
+// Permanently deletes files moved to the trash at or before a time
+//
+// Returns the number of purged files.
+func PurgeTrash(ctx context.Context, catalog db.Catalog, events *EventBus, before time.Time) (int, error) {
+	trash, err := catalog.GetTrash(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, fInfo := range trash {
+		if err = deleteFile(ctx, catalog, events, fInfo, EventFileExpired); err != nil {
+			log.Printf("Failed to purge %s: %v\n", fInfo.RelPath, err)
+			continue
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// Purges files older than the trash grace period every interval, until ctx is done
+func PurgeTrashPeriodically(ctx context.Context, catalog db.Catalog, events *EventBus, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := PurgeTrash(ctx, catalog, events, time.Now().Add(-TrashGracePeriod()))
+		if err != nil {
+			log.Printf("Failed to purge trash: %v\n", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d files from the trash\n", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) listTrash(w http.ResponseWriter, r *http.Request) {
+	trash, err := s.catalog.GetTrash(r.Context(), time.Now())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting trash: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	response := make([]fileJSON, len(trash))
+	for i, fInfo := range trash {
+		response[i] = newFileJSON(fInfo)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Restores a file from the trash, auditing the restore
+//
+// Returns db.ErrNotFound if the file isn't in the trash.
+func RestoreFile(ctx context.Context, catalog db.Catalog, path string) (*storage.FileInfo, error) {
+	before, err := catalog.GetTrashedFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := catalog.RestoreFile(ctx, path)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, db.ErrNotFound
+	}
+
+	fInfo, err := catalog.GetFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	auditSaved(ctx, catalog, db.AuditFileRestore, fileTarget(path), newFileJSON(before), newFileJSON(fInfo))
+
+	return fInfo, nil
+}
+
+func (s *Server) restore(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("filePath")
+
+	fInfo, err := RestoreFile(actorContext(r), s.catalog, path)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "File not found in trash", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error restoring file: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newFileJSON(fInfo))
+	log.Printf("File restored %s from %s", path, r.RemoteAddr)
+}
+
+// Permanently deletes a single file from the trash
+func (s *Server) purge(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("filePath")
+
+	ctx := actorContext(r)
+
+	fInfo, err := s.catalog.GetTrashedFile(ctx, path)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "File not found in trash", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting trashed file info: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	if err = deleteFile(ctx, s.catalog, s.events, fInfo, EventFileDeleted); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error purging file: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("File purged %s from %s", path, r.RemoteAddr)
+}
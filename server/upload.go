@@ -5,17 +5,29 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"file-cellar/config"
-	"file-cellar/db"
 	"file-cellar/storage"
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// Creates the hash the content of files is recorded by
+//
+// Every file is recorded by its md5, which ETags, digests, integrity checks and the client rely on.
+func newFileHash() hash.Hash {
+	return md5.New()
+}
+
 func computeHash(hasher hash.Hash, data io.Reader) (string, error) {
 	if _, err := io.Copy(hasher, data); err != nil {
 		return "", err
@@ -28,106 +40,321 @@ func computeHash(hasher hash.Hash, data io.Reader) (string, error) {
 
 func detectFileType(f io.ReadSeeker) string {
 	buf := make([]byte, 512)
-	t := http.DetectContentType(buf)
+	n, _ := io.ReadFull(f, buf)
+	t := http.DetectContentType(buf[:n])
 	f.Seek(0, io.SeekStart)
 
 	return t
 }
 
-func upload(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(10e6)
+// Bytes of the value of a form field read from an upload
+const maxUploadFieldSize = 64 << 10
+
+// The outcome of uploading one of the files of an upload
+type uploadResultJSON struct {
+	Name   string    `json:"name"` // file name of the part, including the relative path of directory uploads
+	Status int       `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	File   *fileJSON `json:"file,omitempty"`
+
+	Collection *collectionJSON `json:"collection,omitempty"` // files extracted from an archive
+}
+
+// The form fields of an upload, applying to the files after them
+type uploadFields struct {
+	binId       string
+	path        string // logical path of the next file
+	dir         string // directory the logical paths of files are in
+	description string
+}
+
+// Gets the file name of a part as sent, keeping the relative path of directory uploads
+//
+// multipart.Part.FileName only keeps the base name.
+func partFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+
+	return params["filename"]
+}
+
+// Gets the logical path of an uploaded file, empty for files without one
+func uploadLogicalPath(fields *uploadFields, name string) string {
+	if fields.path != "" {
+		return path.Join(fields.dir, fields.path)
+	}
+	if fields.dir != "" || strings.Contains(name, "/") {
+		return path.Join(fields.dir, name)
+	}
+
+	return ""
+}
+
+// Uploads the file parts of a multipart form, each succeeding or failing on its own
+//
+// The binId, path, dir and description fields apply to the files after them, path only to the next file.
+// Files are named by their part's file name, and files of directory uploads are stored at their relative path.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	reader, err := r.MultipartReader()
 	if err != nil {
-		// TODO: use correct http status code
-		http.Error(w, "Error Parsing MultiPartForm data", 400)
+		http.Error(w, "Error Parsing MultiPartForm data", http.StatusBadRequest)
 		log.Printf("Parsing Multipart form failed: %s\n", r.RemoteAddr)
 		return
 	}
 
-	formFile, fileFormHeader, err := r.FormFile("file")
-	if err != nil {
+	ctx := actorContext(r)
+
+	fields := new(uploadFields)
+	results := make([]uploadResultJSON, 0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// the files before the malformed part were uploaded, so their results are still sent
+			results = append(results, uploadResultJSON{Status: http.StatusBadRequest, Error: "Error Parsing MultiPartForm data"})
+			log.Printf("Parsing Multipart form failed: %v : %s\n", err, r.RemoteAddr)
+			break
+		}
+
+		if part.FormName() == "file" {
+			results = append(results, s.uploadPart(ctx, r, part, fields))
+			fields.path = ""
+		} else {
+			// like a malformed part, a field which can't be read ends the upload with the results of the files before it
+			value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldSize+1))
+			if err != nil {
+				results = append(results, uploadResultJSON{Status: http.StatusBadRequest, Error: "Error Parsing MultiPartForm data"})
+				log.Printf("Reading form field %s failed: %v : %s\n", part.FormName(), err, r.RemoteAddr)
+				break
+			} else if len(value) > maxUploadFieldSize {
+				message := fmt.Sprintf("Form field `%s` is over %d bytes", part.FormName(), maxUploadFieldSize)
+				results = append(results, uploadResultJSON{Status: http.StatusBadRequest, Error: message})
+				log.Printf("Form field %s too large: %s\n", part.FormName(), r.RemoteAddr)
+				break
+			}
+			switch part.FormName() {
+			case "binId":
+				fields.binId = string(value)
+			case "path":
+				fields.path = string(value)
+			case "dir":
+				fields.dir = string(value)
+			case "description":
+				fields.description = string(value)
+			}
+		}
+		part.Close()
+	}
+
+	if len(results) == 0 {
 		http.Error(w, "Error finding file in upload, did you include it under the name `file`?", http.StatusBadRequest)
 		log.Printf("Missing file in upload: %s\n", r.RemoteAddr)
 		return
 	}
 
-	manager, err := db.GetManager(config.Server["DBURL"], config.DB_PRAGMAS)
+	// the status of the upload is the status of its files when they agree
+	status := results[0].Status
+	for _, result := range results[1:] {
+		if result.Status != status {
+			status = http.StatusMultiStatus
+		}
+	}
+
+	writeJSON(w, status, results)
+}
+
+// Copies uploaded content to a temporary file, as its hash is needed before it is stored
+//
+// The caller must close and remove the returned file.
+func spoolUpload(data io.Reader) (*os.File, string, int64, error) {
+	spool, err := os.CreateTemp("", "file-cellar-upload-*")
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error getting manager for: %s\n", r.RemoteAddr)
-		return
+		return nil, "", 0, err
 	}
-	defer manager.Close()
 
-	binId, err := strconv.ParseInt(r.FormValue("binId"), 10, 64)
-	if err != nil || binId < 0 {
-		http.Error(w, fmt.Sprintf("Bad binId `%s`, it should be a positive integer", r.FormValue("binId")), http.StatusBadRequest)
-		log.Printf("Bad bin id `%s`: %s", r.FormValue("binId"), r.RemoteAddr)
-		return
+	hasher := newFileHash()
+	size, err := io.Copy(io.MultiWriter(spool, hasher), data)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
 	}
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, "", 0, err
+	}
+
+	return spool, hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// Stores a spooled file in the bin of fInfo and records it in the catalog
+//
+// The name, logical path and description of fInfo are kept, and the rest is set from the spooled content.
+// The file is announced by completeUpload once its upload has succeeded, or removed by discardUpload.
+func (s *Server) storeUpload(ctx context.Context, fInfo *storage.FileInfo, spool *os.File, hash string, size int64) error {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	fInfo.UploadTimestamp = time.Now()
+	fInfo.Hash = hash
+	fInfo.Size = size
+	fInfo.Type = detectFileType(spool)
 
-	ctx := r.Context()
-	bin, err := manager.GetBin(ctx, binId)
+	// files of a directory upload with the same name and content differ by their logical paths
+	seed := fInfo.Name
+	if fInfo.LogicalPath != "" {
+		seed = fInfo.LogicalPath
+	}
+	relPath, err := storage.GetRelPath(seed, hash, fInfo.UploadTimestamp)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Could not find bin with id `%d`", binId), http.StatusBadRequest)
-		log.Printf("No bin with id `%d`: %s\n", binId, r.RemoteAddr)
-		return
+		return err
 	}
+	fInfo.RelPath = relPath
 
-	uploadTime := time.Now()
+	if fInfo.LogicalPath != "" {
+		err = s.catalog.AddVersion(ctx, fInfo)
+	} else {
+		err = s.catalog.AddFile(ctx, fInfo)
+	}
+	if err != nil {
+		return fmt.Errorf("adding file info to database: %w", err)
+	}
+
+	f := &storage.File{
+		Data:     spool,
+		FileInfo: *fInfo,
+	}
+	if err = f.Bin.Upload(ctx, f); err != nil {
+		log.Println("Saving uploaded file failed: ", err)
+		log.Println("Attempting cleanup of ", f.RelPath)
+		if _, cleanupErr := s.catalog.RemoveFile(context.TODO(), f.RelPath); cleanupErr != nil {
+			log.Panicf("Failed removing file info from database :%v\n%v\n", cleanupErr, fInfo)
+		}
+		return err
+	}
+
+	if _, err = spool.Seek(0, io.SeekStart); err == nil {
+		indexContent(ctx, s.catalog, fInfo.Id, fInfo.Type, spool)
+	}
+
+	return nil
+}
+
+// Finishes the upload of a stored file, pruning old versions of its logical path, publishing it and creating its thumbnails
+func (s *Server) completeUpload(ctx context.Context, fInfo *storage.FileInfo) {
+	if fInfo.LogicalPath != "" {
+		pruneVersions(ctx, s.catalog, s.events, fInfo.Bin.Id, fInfo.LogicalPath)
+	}
+
+	publish(ctx, s.catalog, s.events, EventFileUploaded, fInfo.Bin.Id, fileEvent{newFileJSON(fInfo)})
 
-	// TODO: use hash strategy set in server config
-	hash, err := computeHash(md5.New(), formFile)
-	if err != nil || hash == "" {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Failed to compute file hash: %v :%s", err, r.RemoteAddr)
+	if config.Server["ThumbnailsOnUpload"] == "true" {
+		go createThumbnails(s.catalog, fInfo)
+	}
+}
+
+// Removes a stored file of a failed upload from the catalog and its bin
+//
+// The upload was never completed, so the removal isn't published or audited.
+func (s *Server) discardUpload(ctx context.Context, fInfo *storage.FileInfo) {
+	if _, err := s.catalog.RemoveFile(ctx, fInfo.RelPath); err != nil {
+		log.Printf("Failed to remove %s of a failed upload: %v\n", fInfo.RelPath, err)
 		return
 	}
-	if _, err = formFile.Seek(0, io.SeekStart); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Failed to reset file after computing its hash: %v : %s", err, r.RemoteAddr)
+	if err := fInfo.Bin.Delete(ctx, fInfo); err != nil {
+		log.Printf("Failed to delete %s of a failed upload from storage: %v\n", fInfo.RelPath, err)
 	}
+}
 
-	fileType := detectFileType(formFile)
+// Uploads the file of a part to the bin in the fields
+func (s *Server) uploadPart(ctx context.Context, r *http.Request, part *multipart.Part, fields *uploadFields) uploadResultJSON {
+	name := partFileName(part)
+	result := uploadResultJSON{Name: name, Status: http.StatusOK}
+	fail := func(status int, message string) uploadResultJSON {
+		result.Status = status
+		result.Error = message
+		return result
+	}
 
-	relPath, err := storage.GetRelPath(fileFormHeader.Filename, hash, uploadTime)
+	binId, err := strconv.ParseInt(fields.binId, 10, 64)
+	if err != nil || binId < 0 {
+		log.Printf("Bad bin id `%s`: %s", fields.binId, r.RemoteAddr)
+		return fail(http.StatusBadRequest, fmt.Sprintf("Bad binId `%s`, it should be a positive integer", fields.binId))
+	}
+
+	bin, err := s.catalog.GetBin(ctx, binId)
 	if err != nil {
-		http.Error(w, "Missing Filename in upload", http.StatusBadRequest)
+		log.Printf("No bin with id `%d`: %s\n", binId, r.RemoteAddr)
+		return fail(http.StatusBadRequest, fmt.Sprintf("Could not find bin with id `%d`", binId))
+	}
+
+	if name == "" {
 		log.Println("Missing filename for upload: ", r.RemoteAddr)
-		return
+		return fail(http.StatusBadRequest, "Missing Filename in upload")
+	}
+	name = path.Clean(name)
+	if !fs.ValidPath(name) {
+		log.Printf("Bad filename `%s` for upload: %s\n", result.Name, r.RemoteAddr)
+		return fail(http.StatusBadRequest, fmt.Sprintf("Bad filename `%s`, it should be a relative path", result.Name))
 	}
 
-	fInfo := storage.FileInfo{
-		Name:            fileFormHeader.Filename,
-		Hash:            hash,
-		Type:            fileType,
-		Size:            fileFormHeader.Size,
-		RelPath:         relPath,
-		UploadTimestamp: uploadTime,
-		Bin:             bin,
+	spool, hash, size, err := spoolUpload(part)
+	if err != nil {
+		log.Printf("Failed to spool uploaded file %s: %v : %s", name, err, r.RemoteAddr)
+		return fail(http.StatusBadRequest, "Error reading file from upload")
 	}
-	f := &storage.File{
-		Data:     formFile,
-		FileInfo: fInfo,
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	fInfo := &storage.FileInfo{
+		Name:        path.Base(name),
+		Bin:         bin,
+		LogicalPath: uploadLogicalPath(fields, name),
+		Description: fields.description,
 	}
 
-	if err = manager.AddFile(ctx, &fInfo); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error adding file info to database: %s\n", r.RemoteAddr)
-		return
+	// archives are checked before anything is stored, so rejected archives aren't kept
+	format := ""
+	if extractsArchives(bin.Id) {
+		format = uploadedArchiveFormat(fInfo.Name)
+	}
+	if format != "" {
+		if err = checkArchive(spool, size, format, extractionLimits()); err != nil {
+			log.Printf("Rejected archive %s: %v : %s\n", name, err, r.RemoteAddr)
+			return fail(http.StatusBadRequest, fmt.Sprintf("Archive rejected, %v", err))
+		}
 	}
 
-	if err = f.Bin.Upload(ctx, f); err != nil {
-		http.Error(w, "Error while saving file", http.StatusInternalServerError)
-		log.Println("Saving uploaded file failed: ", err)
-		log.Println("Attempting cleanup: ", r.RemoteAddr)
-		err = f.Bin.Delete(context.TODO(), storage.FileIdentifier(f.RelPath))
+	if err = s.storeUpload(ctx, fInfo, spool, hash, size); err != nil {
+		log.Printf("Error storing uploaded file %s: %v : %s\n", name, err, r.RemoteAddr)
+		return fail(http.StatusInternalServerError, "Error while saving file")
+	}
+
+	// archives are only completed once extracted, so nothing is announced of an upload which fails
+	var extracted []*storage.FileInfo
+	if format != "" {
+		var c *storage.Collection
+		c, extracted, err = s.extractArchive(ctx, fInfo, spool, format)
 		if err != nil {
-			log.Panicf("Failed removing file info from database :%v\n%v\n", err, fInfo)
+			log.Printf("Error extracting archive %s: %v : %s\n", fInfo.RelPath, err, r.RemoteAddr)
+			s.discardUpload(ctx, fInfo)
+			return fail(http.StatusBadRequest, fmt.Sprintf("Failed to extract archive, %v", err))
 		}
-		return
+		collection := newCollectionJSON(c, extracted)
+		result.Collection = &collection
+		log.Printf("Extracted %d files from %s", len(extracted), fInfo.RelPath)
+	}
+
+	s.completeUpload(ctx, fInfo)
+	for _, member := range extracted {
+		s.completeUpload(ctx, member)
 	}
 
-	// FIXME: use correct accesible url
-	fmt.Fprintf(w, "%s\n", relPath)
-	log.Printf("File uploaded %s from %s", relPath, r.RemoteAddr)
+	log.Printf("File uploaded %s from %s", fInfo.RelPath, r.RemoteAddr)
+	uploaded := newFileJSON(fInfo)
+	result.File = &uploaded
+	return result
 }
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"file-cellar/config"
+	"file-cellar/db"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type versionJSON struct {
+	fileJSON
+	Current bool `json:"current"`
+}
+
+// Gets the number of versions to keep for each logical path, 0 keeps every version
+func versionRetention() int {
+	retention, err := strconv.Atoi(config.Server["VersionRetention"])
+	if err != nil || retention < 0 {
+		return 0
+	}
+
+	return retention
+}
+
+// Parses the binId path value of a request, responding with an error if it is invalid
+func parseBinId(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	binId, err := strconv.ParseInt(r.PathValue("binId"), 10, 64)
+	if err != nil || binId < 0 {
+		http.Error(w, fmt.Sprintf("Bad binId `%s`, it should be a positive integer", r.PathValue("binId")), http.StatusBadRequest)
+		log.Printf("Bad bin id `%s`: %s", r.PathValue("binId"), r.RemoteAddr)
+		return 0, false
+	}
+
+	return binId, true
+}
+
+// Deletes the oldest versions of a logical path beyond the configured retention
+//
+// The current version is always kept.
+func pruneVersions(ctx context.Context, catalog db.Catalog, events *EventBus, binId int64, path string) {
+	retention := versionRetention()
+	if retention == 0 {
+		return
+	}
+
+	current, err := catalog.GetVersion(ctx, binId, path, 0)
+	if err != nil {
+		log.Printf("Failed to get current version of %s while pruning: %v\n", path, err)
+		return
+	}
+
+	versions, err := catalog.GetVersions(ctx, binId, path)
+	if err != nil {
+		log.Printf("Failed to get versions of %s while pruning: %v\n", path, err)
+		return
+	}
+
+	kept := 0
+	for _, v := range versions {
+		if v.Id == current.Id || kept < retention-1 {
+			if v.Id != current.Id {
+				kept++
+			}
+			continue
+		}
+
+		if err = deleteFile(ctx, catalog, events, v, EventFileExpired); err != nil {
+			log.Printf("Failed to prune version %d of %s: %v\n", v.Version, path, err)
+		} else {
+			log.Printf("Pruned version %d of %s\n", v.Version, path)
+		}
+	}
+}
+
+func (s *Server) listVersions(w http.ResponseWriter, r *http.Request) {
+	binId, ok := parseBinId(w, r)
+	if !ok {
+		return
+	}
+	path := r.PathValue("path")
+
+	ctx := r.Context()
+
+	current, err := s.catalog.GetVersion(ctx, binId, path, 0)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Path not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting current version of %s: %v : %s\n", path, err, r.RemoteAddr)
+		return
+	}
+
+	versions, err := s.catalog.GetVersions(ctx, binId, path)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting versions of %s: %v : %s\n", path, err, r.RemoteAddr)
+		return
+	}
+
+	response := make([]versionJSON, len(versions))
+	for i, v := range versions {
+		response[i] = versionJSON{newFileJSON(v), v.Id == current.Id}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Downloads the current version of a logical path, or the version in the version query parameter, or gets its headers with HEAD
+func (s *Server) downloadVersion(w http.ResponseWriter, r *http.Request) {
+	binId, ok := parseBinId(w, r)
+	if !ok {
+		return
+	}
+	path := r.PathValue("path")
+
+	var version int64
+	var err error
+	if r.URL.Query().Has("version") {
+		version, err = strconv.ParseInt(r.URL.Query().Get("version"), 10, 64)
+		if err != nil || version <= 0 {
+			http.Error(w, "Bad version, it should be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	fInfo, err := db.FindVersion(r.Context(), s.catalog, binId, path, version)
+	if findError(w, r, err) {
+		return
+	}
+
+	if r.URL.Query().Has("thumb") {
+		s.serveThumbnail(w, r, fInfo)
+		return
+	}
+
+	// a logical path gets new versions, so caches revalidate it by its ETag
+	s.serveDownload(w, r, fInfo, "no-cache")
+}
+
+// Makes the version in the form value version the current version of a logical path
+func (s *Server) rollback(w http.ResponseWriter, r *http.Request) {
+	binId, ok := parseBinId(w, r)
+	if !ok {
+		return
+	}
+	path := r.PathValue("path")
+
+	version, err := strconv.ParseInt(r.FormValue("version"), 10, 64)
+	if err != nil || version <= 0 {
+		http.Error(w, "Bad version, it should be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	ctx := actorContext(r)
+
+	before, err := s.catalog.GetVersion(ctx, binId, path, 0)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting current version of %s: %v : %s\n", path, err, r.RemoteAddr)
+		return
+	}
+
+	err = s.catalog.SetCurrentVersion(ctx, binId, path, version)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error rolling back %s to version %d: %v : %s\n", path, version, err, r.RemoteAddr)
+		return
+	}
+
+	current, err := s.catalog.GetVersion(ctx, binId, path, 0)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting current version of %s: %v : %s\n", path, err, r.RemoteAddr)
+		return
+	}
+
+	var beforeState any
+	if before != nil {
+		beforeState = newFileJSON(before)
+	}
+	auditSaved(ctx, s.catalog, db.AuditVersionRollback, pathTarget(binId, path), beforeState, newFileJSON(current))
+
+	writeJSON(w, http.StatusOK, versionJSON{newFileJSON(current), true})
+	log.Printf("Rolled back %s in bin %d to version %d from %s", path, binId, version, r.RemoteAddr)
+}
@@ -0,0 +1,564 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file-cellar/config"
+	"file-cellar/db"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultDeliveryLimit = 100
+
+// Deliveries attempted at once by the webhook deliverer
+const deliveryBatchSize = 100
+
+// The longest delay between attempts to deliver an event, however often it failed
+const maxWebhookBackoff = 24 * time.Hour
+
+// Bytes of webhook responses read so connections can be reused, the rest is ignored
+const webhookResponseLimit = 64 << 10
+
+type webhookJSON struct {
+	Id               int64     `json:"id"`
+	URL              string    `json:"url"`
+	Events           []string  `json:"events"`           // every event when empty
+	Secret           string    `json:"secret,omitempty"` // only sent when the webhook is created
+	CreatedTimestamp time.Time `json:"createdTimestamp"`
+}
+
+type deliveryJSON struct {
+	Id                   int64           `json:"id"`
+	Event                string          `json:"event"`
+	Payload              json.RawMessage `json:"payload"`
+	CreatedTimestamp     time.Time       `json:"createdTimestamp"`
+	Status               string          `json:"status"`
+	Attempts             int             `json:"attempts"`
+	NextAttemptTimestamp *time.Time      `json:"nextAttemptTimestamp,omitempty"`
+	LastError            string          `json:"lastError,omitempty"`
+}
+
+// The audited state of a webhook, leaving out its secret
+type auditWebhook struct {
+	Id     int64    `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+func newWebhookJSON(h *db.Webhook) webhookJSON {
+	events := h.Events
+	if events == nil {
+		events = []string{}
+	}
+
+	return webhookJSON{
+		Id:               h.Id,
+		URL:              h.URL,
+		Events:           events,
+		CreatedTimestamp: h.CreatedTimestamp,
+	}
+}
+
+func auditWebhookState(h *db.Webhook) any {
+	return auditWebhook{h.Id, h.URL, h.Events}
+}
+
+func webhookTarget(id int64) string {
+	return fmt.Sprintf("webhook:%d", id)
+}
+
+// Gets the delay before the first retry of a failed delivery, doubled after every further failure
+func WebhookRetryDelay() time.Duration {
+	delay, err := time.ParseDuration(config.Server["WebhookRetryDelay"])
+	if err != nil || delay <= 0 {
+		log.Printf("Bad webhook retry delay `%s`, using 30 seconds\n", config.Server["WebhookRetryDelay"])
+		return 30 * time.Second
+	}
+
+	return delay
+}
+
+// Gets how many times an event is posted to a webhook before its delivery is abandoned
+func WebhookMaxAttempts() int {
+	attempts, err := strconv.Atoi(config.Server["WebhookMaxAttempts"])
+	if err != nil || attempts <= 0 {
+		log.Printf("Bad webhook max attempts `%s`, using 8\n", config.Server["WebhookMaxAttempts"])
+		return 8
+	}
+
+	return attempts
+}
+
+// Gets how many webhooks are delivered to at once
+func WebhookWorkers() int {
+	workers, err := strconv.Atoi(config.Server["WebhookWorkers"])
+	if err != nil || workers <= 0 {
+		log.Printf("Bad webhook workers `%s`, using 4\n", config.Server["WebhookWorkers"])
+		return 4
+	}
+
+	return workers
+}
+
+// Gets how long a webhook has to respond to a delivery
+func WebhookTimeout() time.Duration {
+	timeout, err := time.ParseDuration(config.Server["WebhookTimeout"])
+	if err != nil || timeout <= 0 {
+		log.Printf("Bad webhook timeout `%s`, using 10 seconds\n", config.Server["WebhookTimeout"])
+		return 10 * time.Second
+	}
+
+	return timeout
+}
+
+// Gets how long finished deliveries are kept for
+func WebhookDeliveryRetention() time.Duration {
+	retention, err := time.ParseDuration(config.Server["WebhookDeliveryRetention"])
+	if err != nil || retention < 0 {
+		log.Printf("Bad webhook delivery retention `%s`, using 7 days\n", config.Server["WebhookDeliveryRetention"])
+		return 7 * 24 * time.Hour
+	}
+
+	return retention
+}
+
+// Gets the delay before the next attempt of a delivery which has failed a number of times
+func retryBackoff(delay time.Duration, attempts int) time.Duration {
+	for i := 1; i < attempts && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxWebhookBackoff)
+}
+
+// Gets the signature of a delivery sent at a unix timestamp, as sent in its X-Cellar-Signature header
+//
+// The signature is the hex encoded HMAC-SHA256 of the timestamp, a dot and the body, keyed with the secret of
+// the webhook. Receivers should compare it with VerifyWebhookSignature and reject stale timestamps.
+func WebhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the signature of a delivery in constant time
+func VerifyWebhookSignature(secret string, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(WebhookSignature(secret, timestamp, body)))
+}
+
+// Creates a random secret for signing deliveries
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// Checks if a host is in the configured hosts webhooks may target at any address
+func webhookHostAllowed(host string) bool {
+	for _, allowed := range strings.Split(config.Server["WebhookAllowedHosts"], ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if an address is internal to the server's network, which webhooks can't target unless their host is allowed
+//
+// This covers loopback, private, link-local (including cloud metadata services) and unspecified addresses.
+func internalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// Checks the host of a webhook url resolves only to addresses webhooks may target
+func checkWebhookHost(ctx context.Context, target *url.URL) error {
+	host := target.Hostname()
+	if webhookHostAllowed(host) {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("resolving %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if internalAddress(addr.IP) {
+			return fmt.Errorf("%s resolves to the internal address %s", host, addr.IP)
+		}
+	}
+
+	return nil
+}
+
+// Gets a client for posting deliveries
+//
+// Connections to internal addresses are refused unless the host of the webhook is allowed, so a host
+// resolving to another address after the webhook was created can't reach the server's network.
+func webhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || internalAddress(ip) {
+				return fmt.Errorf("webhook connection to the internal address %s refused", host)
+			}
+			return nil
+		},
+	}
+	allowedDialer := &net.Dialer{}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would connect to the webhook itself, around the check of its address
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(address); err == nil && webhookHostAllowed(host) {
+			return allowedDialer.DialContext(ctx, network, address)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	return &http.Client{
+		Timeout:   WebhookTimeout(),
+		Transport: transport,
+		// redirects are failures, the payload isn't sent anywhere but the configured url
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Posts the payload of a delivery to its webhook, failing unless the webhook responds with a 2xx status
+func postDelivery(ctx context.Context, client *http.Client, d *db.WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "file-cellar-webhooks")
+	req.Header.Set("X-Cellar-Event", d.Event)
+	req.Header.Set("X-Cellar-Delivery", strconv.FormatInt(d.Id, 10))
+	req.Header.Set("X-Cellar-Timestamp", timestamp)
+	req.Header.Set("X-Cellar-Signature", WebhookSignature(d.Secret, timestamp, d.Payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, webhookResponseLimit))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Attempts the pending deliveries which are due, rescheduling failed ones with exponential backoff
+//
+// Webhooks are delivered to concurrently by up to the configured number of workers, so a slow webhook
+// only delays its own deliveries, which are attempted in order. Deliveries are abandoned once they fail
+// the max attempts. Returns the number of delivered events.
+func DeliverWebhooks(ctx context.Context, catalog db.Catalog, client *http.Client) (int, error) {
+	maxAttempts := WebhookMaxAttempts()
+	retryDelay := WebhookRetryDelay()
+	workers := WebhookWorkers()
+
+	delivered := 0
+	for {
+		due, err := catalog.GetDueDeliveries(ctx, time.Now(), deliveryBatchSize)
+		if err != nil {
+			return delivered, err
+		}
+
+		webhooks := make([]int64, 0)
+		byWebhook := make(map[int64][]*db.WebhookDelivery)
+		for _, d := range due {
+			if _, ok := byWebhook[d.WebhookId]; !ok {
+				webhooks = append(webhooks, d.WebhookId)
+			}
+			byWebhook[d.WebhookId] = append(byWebhook[d.WebhookId], d)
+		}
+
+		queue := make(chan []*db.WebhookDelivery)
+		var mu sync.Mutex
+		var firstErr error
+		var wg sync.WaitGroup
+		for range min(workers, len(webhooks)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for deliveries := range queue {
+					n, err := attemptDeliveries(ctx, catalog, client, deliveries, maxAttempts, retryDelay)
+					mu.Lock()
+					delivered += n
+					if err != nil && firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		for _, id := range webhooks {
+			queue <- byWebhook[id]
+		}
+		close(queue)
+		wg.Wait()
+
+		if firstErr != nil {
+			return delivered, firstErr
+		}
+		if len(due) < deliveryBatchSize {
+			return delivered, nil
+		}
+	}
+}
+
+// Attempts deliveries to a webhook in order, returning the number of delivered events
+func attemptDeliveries(ctx context.Context, catalog db.Catalog, client *http.Client, deliveries []*db.WebhookDelivery, maxAttempts int, retryDelay time.Duration) (int, error) {
+	delivered := 0
+	for _, d := range deliveries {
+		err := postDelivery(ctx, client, d)
+		if ctx.Err() != nil {
+			// interrupted attempts don't count, the delivery is retried when the server restarts
+			return delivered, ctx.Err()
+		}
+
+		d.Attempts++
+		if err == nil {
+			d.Status = db.DeliveryDelivered
+			d.LastError = ""
+			delivered++
+		} else {
+			d.LastError = err.Error()
+			d.NextAttemptTimestamp = time.Now().Add(retryBackoff(retryDelay, d.Attempts))
+			if d.Attempts >= maxAttempts {
+				d.Status = db.DeliveryFailed
+				log.Printf("Abandoned delivery %d of %s to %s after %d attempts: %v\n", d.Id, d.Event, d.URL, d.Attempts, err)
+			}
+		}
+
+		if err = catalog.UpdateDelivery(ctx, d); err != nil {
+			return delivered, err
+		}
+	}
+
+	return delivered, nil
+}
+
+// Delivers queued events every interval, or as soon as they are queued on events, until ctx is done
+//
+// Finished deliveries older than the delivery retention are removed.
+func DeliverWebhooksPeriodically(ctx context.Context, catalog db.Catalog, events *EventBus, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	client := webhookClient()
+
+	for {
+		if _, err := DeliverWebhooks(ctx, catalog, client); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to deliver webhooks: %v\n", err)
+		}
+		if _, err := catalog.RemoveFinishedDeliveries(ctx, time.Now().Add(-WebhookDeliveryRetention())); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to remove finished webhook deliveries: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-events.Queued():
+		}
+	}
+}
+
+// Parses the webhookId path value of a request, responding with an error if it is invalid
+func parseWebhookId(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("webhookId"), 10, 64)
+	if err != nil || id < 0 {
+		http.Error(w, fmt.Sprintf("Bad webhookId `%s`, it should be a positive integer", r.PathValue("webhookId")), http.StatusBadRequest)
+		return 0, false
+	}
+
+	return id, true
+}
+
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := s.catalog.ListWebhooks(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error listing webhooks: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	response := make([]webhookJSON, len(webhooks))
+	for i, h := range webhooks {
+		response[i] = newWebhookJSON(h)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Creates a webhook posting to the form value url, receiving the comma separated events or every event
+//
+// The response includes the secret signing the deliveries, it isn't shown again.
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	target, err := url.Parse(r.FormValue("url"))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, fmt.Sprintf("Bad url `%s`, it should be an absolute http or https url", r.FormValue("url")), http.StatusBadRequest)
+		return
+	}
+	if err = checkWebhookHost(r.Context(), target); err != nil {
+		http.Error(w, fmt.Sprintf("Bad url `%s`, %v", r.FormValue("url"), err), http.StatusBadRequest)
+		log.Printf("Rejected webhook url `%s`: %v : %s\n", r.FormValue("url"), err, r.RemoteAddr)
+		return
+	}
+
+	var events []string
+	if r.FormValue("events") != "" {
+		for _, event := range strings.Split(r.FormValue("events"), ",") {
+			event = strings.TrimSpace(event)
+			if !slices.Contains(EventTypes, event) {
+				http.Error(w, fmt.Sprintf("Unknown event `%s`, it should be one of %s", event, strings.Join(EventTypes, ", ")), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(events, event) {
+				events = append(events, event)
+			}
+		}
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating webhook secret: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+
+	h := &db.Webhook{
+		URL:              target.String(),
+		Secret:           secret,
+		Events:           events,
+		CreatedTimestamp: time.Now(),
+	}
+	ctx := actorContext(r)
+	if err = s.catalog.AddWebhook(ctx, h); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error adding webhook: %v : %s\n", err, r.RemoteAddr)
+		return
+	}
+	auditSaved(ctx, s.catalog, db.AuditWebhookCreate, webhookTarget(h.Id), nil, auditWebhookState(h))
+
+	response := newWebhookJSON(h)
+	response.Secret = h.Secret
+	writeJSON(w, http.StatusCreated, response)
+	log.Printf("Webhook created for %s from %s", h.URL, r.RemoteAddr)
+}
+
+// Deletes a webhook, abandoning its pending deliveries
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseWebhookId(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := actorContext(r)
+
+	h, err := s.catalog.GetWebhook(ctx, id)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting webhook %d: %v : %s\n", id, err, r.RemoteAddr)
+		return
+	}
+
+	ok, err = s.catalog.RemoveWebhook(ctx, id)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error removing webhook %d: %v : %s\n", id, err, r.RemoteAddr)
+		return
+	} else if !ok {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	auditSaved(ctx, s.catalog, db.AuditWebhookDelete, webhookTarget(id), auditWebhookState(h), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("Webhook deleted %d from %s", id, r.RemoteAddr)
+}
+
+// Lists the most recent deliveries to a webhook, limited by the limit parameter
+func (s *Server) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseWebhookId(w, r)
+	if !ok {
+		return
+	}
+	limit, ok := parseLimit(w, r, defaultDeliveryLimit)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	if _, err := s.catalog.GetWebhook(ctx, id); errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting webhook %d: %v : %s\n", id, err, r.RemoteAddr)
+		return
+	}
+
+	deliveries, err := s.catalog.GetDeliveries(ctx, id, limit)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting deliveries of webhook %d: %v : %s\n", id, err, r.RemoteAddr)
+		return
+	}
+
+	response := make([]deliveryJSON, len(deliveries))
+	for i, d := range deliveries {
+		response[i] = deliveryJSON{
+			Id:               d.Id,
+			Event:            d.Event,
+			Payload:          d.Payload,
+			CreatedTimestamp: d.CreatedTimestamp,
+			Status:           d.Status,
+			Attempts:         d.Attempts,
+			LastError:        d.LastError,
+		}
+		if d.Status == db.DeliveryPending {
+			response[i].NextAttemptTimestamp = &d.NextAttemptTimestamp
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"net/url"
+	"time"
 )
 
 type pathPair struct {
@@ -21,63 +21,79 @@ type Bin struct {
 	Path         pathPair
 	OpenFiles    map[FileIdentifier]io.ReadCloser // files currently opened by this bin TODO: remove or add use
 	Driver       Driver
-	Redirect     bool              // if bin should Redirect or Download when getting a file
+	Redirect     bool              // if downloads are redirected to a url from the driver rather than served
 	DriverParams map[string]string // Params to be passed to the storage driver
-	stats        Stats
+	stats        Counters
 }
 
 // Get a file from a bin
+func (b *Bin) Get(ctx context.Context, id FileIdentifier) (io.ReadSeekCloser, error) {
+	f, err := b.Driver.Get(ctx, b.Path.Internal, id)
+	if err != nil {
+		b.stats.Fail()
+		return f, err
+	}
+	b.stats.Download()
+
+	return b.stats.CountReads(f), nil
+}
+
+// Gets a url to redirect a download of a file to, valid for at least lifetime
 //
-// If Bin.Redirect is false returns an io.ReaderCloser, else returns a url for redirection
-func (b *Bin) Get(ctx context.Context, id FileIdentifier) (io.ReadSeekCloser, string, error) {
-	if b.Redirect {
-		redirectURL, err := url.JoinPath(b.Path.Internal, string(id))
-		if err != nil {
-			b.stats.Failed++
-			return nil, "", nil
-		} else {
-			b.stats.Redirected++
-		}
-		return nil, redirectURL, nil
+// Fails with ErrNoURL if the driver of the bin can't generate urls.
+func (b *Bin) URL(ctx context.Context, id FileIdentifier, lifetime time.Duration) (string, error) {
+	d, ok := b.Driver.(URLDriver)
+	if !ok {
+		b.stats.Fail()
+		return "", fmt.Errorf("%w: %s", ErrNoURL, b.Driver.Name())
 	}
 
-	f, err := b.Driver.Get(ctx, b.Path.Internal, id)
+	redirectURL, err := d.URL(ctx, b.Path.Internal, b.Path.External, id, lifetime)
 	if err != nil {
-		b.stats.Failed++
-	} else {
-		b.stats.Downloaded++
+		b.stats.Fail()
+		return "", err
 	}
-	return f, "", err
+	b.stats.Redirect()
+
+	return redirectURL, nil
 }
 
-func (b Bin) Upload(ctx context.Context, f *File) error {
+func (b *Bin) Upload(ctx context.Context, f *File) error {
 	err := b.Driver.Upload(ctx, b.Path.Internal, f)
 	if err != nil {
-		b.stats.Failed++
+		b.stats.Fail()
 	} else {
-		b.stats.Uploaded++
+		b.stats.Upload(f.Size)
 	}
 	return err
 }
 
-func (b Bin) Delete(ctx context.Context, id FileIdentifier) error {
-	err := b.Driver.Delete(ctx, b.Path.Internal, id)
+// Deletes a file from a bin
+func (b *Bin) Delete(ctx context.Context, f *FileInfo) error {
+	err := b.Driver.Delete(ctx, b.Path.Internal, FileIdentifier(f.RelPath))
 	if err != nil {
-		b.stats.Failed++
+		b.stats.Fail()
 	} else {
-		b.stats.Deleted++
+		b.stats.Delete(f.Size)
 	}
 	return err
 }
 
-func (b Bin) FileStatus(ctx context.Context, id FileIdentifier) (FileStatus, error) {
+func (b *Bin) FileStatus(ctx context.Context, id FileIdentifier) (FileStatus, error) {
 	return b.Driver.Status(ctx, b.Path.Internal, id)
 }
 
-func (b Bin) Stats() Stats {
-	return b.stats
+// Registers a bin's base url with its driver when the driver requires it
+func (b *Bin) RegisterRoot() {
+	if d, ok := b.Driver.(RootedDriver); ok {
+		d.AddRoot(b.Path.Internal)
+	}
+}
+
+func (b *Bin) Stats() Stats {
+	return b.stats.Snapshot()
 }
 
-func (b Bin) String() string {
+func (b *Bin) String() string {
 	return fmt.Sprintf("Bin %s [%v]:%s", b.Name, b.Driver, b.Path.Internal)
 }
@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// A named group of files that can be shared with a single link
+type Collection struct {
+	Id               int64
+	Name             string
+	ShareToken       string // unguessable token identifying the collection in share links
+	CreatedTimestamp time.Time
+}
+
+// Creates a random token for sharing a collection
+func NewShareToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (c Collection) String() string {
+	return fmt.Sprintf("Collection %s [%d] created at %v", c.Name, c.Id, c.CreatedTimestamp)
+}
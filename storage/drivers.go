@@ -2,11 +2,20 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
 )
 
 var registeredDrivers []Driver
 
+// Errors of drivers getting files, wrapping the error of the backend, for callers to match with errors.Is
+var (
+	ErrNotExist    = errors.New("file does not exist in storage")
+	ErrUnavailable = errors.New("storage is unavailable")
+	ErrNoURL       = errors.New("storage can't generate urls")
+)
+
 type Driver interface {
 	Get(ctx context.Context, baseUrl string, id FileIdentifier) (io.ReadSeekCloser, error)
 	Upload(ctx context.Context, baseUrl string, f *File) error
@@ -20,6 +29,22 @@ type Driver interface {
 	String() string
 }
 
+// A driver which only operates on files within known base urls
+type RootedDriver interface {
+	Driver
+	AddRoot(baseUrl string)
+}
+
+// A driver which can generate urls clients download files from directly, used by redirecting bins
+//
+// Urls are either public, such as those of a CDN or static file server in front of the storage,
+// or presigned and expiring, such as those of object stores.
+type URLDriver interface {
+	Driver
+	// Gets a url of a file valid for at least lifetime, publicUrl is the external url of its bin
+	URL(ctx context.Context, baseUrl string, publicUrl string, id FileIdentifier, lifetime time.Duration) (string, error)
+}
+
 func ListDrivers() []Driver {
 	return registeredDrivers
 }
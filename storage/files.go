@@ -20,13 +20,28 @@ type FileRequest struct {
 
 // TODO: use Type field
 type FileInfo struct {
-	Name            string    // name of the source
-	Hash            string    // hash of the file content
-	Type            string    // mimetype of the file content
-	Size            int64     // size of the file in bytes
-	RelPath         string    // the path of a file relative to its bin's base url
-	UploadTimestamp time.Time // date-time of file upload
-	Bin             *Bin      // bin storing this file
+	Id               int64     // catalog id of the file
+	Name             string    // name of the source
+	Hash             string    // hash of the file content
+	Type             string    // mimetype of the file content
+	Size             int64     // size of the file in bytes
+	RelPath          string    // the path of a file relative to its bin's base url
+	UploadTimestamp  time.Time // date-time of file upload
+	Bin              *Bin      // bin storing this file
+	LogicalPath      string    // overwritable path of the file within its bin, empty for unversioned files
+	Version          int64     // version of the file at its logical path
+	DeletedTimestamp time.Time // date-time the file was moved to the trash, zero if it is not in the trash
+	Description      string    // user provided description of the file
+	Downloads        int64     // number of times the file was downloaded or redirected to
+	AccessTimestamp  time.Time // date-time of the last download, zero if it was never downloaded
+}
+
+// A file generated from the content of another file, ie a thumbnail
+type Derivative struct {
+	ParentId int64  // catalog id of the file this was generated from
+	Kind     string // kind of generated file
+	Param    int64  // kind specific parameter, ie the maximum dimension of a thumbnail
+	FileInfo
 }
 
 type File struct {
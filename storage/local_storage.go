@@ -5,14 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
 type LocalDriver struct {
+	rootsMu    sync.RWMutex
 	knownRoots map[string]bool
-	stats      Stats
+	stats      Counters
 	id         int64
 	name       string
 }
@@ -40,8 +45,9 @@ func createLocal(path string) string {
 }
 
 func (d *LocalDriver) rootKnown(baseUrl string) (bool, error) {
-	// FIXME: add known roots to driver
+	d.rootsMu.RLock()
 	_, ok := d.knownRoots[baseUrl]
+	d.rootsMu.RUnlock()
 	var err error = nil
 	if !ok {
 		err = errors.New("unknown base directory")
@@ -50,7 +56,13 @@ func (d *LocalDriver) rootKnown(baseUrl string) (bool, error) {
 	return ok, err
 }
 
-func (d *LocalDriver) addRoot(root string) {
+// Allow operations on files within root
+func (d *LocalDriver) AddRoot(root string) {
+	d.rootsMu.Lock()
+	defer d.rootsMu.Unlock()
+	if d.knownRoots == nil {
+		d.knownRoots = make(map[string]bool)
+	}
 	d.knownRoots[root] = true
 }
 
@@ -58,19 +70,37 @@ func (d *LocalDriver) Get(ctx context.Context, baseUrl string, id FileIdentifier
 	path := filepath.Join(baseUrl, string(id))
 	f, err := os.Open(path)
 	if err != nil {
-		d.stats.Failed++
+		d.stats.Fail()
 		log.Printf("Driver: failed to open %s: %v\n", id, err)
-	} else {
-		d.stats.Downloaded++
+		// a missing or unreachable base directory is storage which isn't mounted rather than a missing file
+		if _, statErr := os.Stat(baseUrl); statErr != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUnavailable, statErr)
+		} else if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %w", ErrNotExist, err)
+		}
+		return nil, err
+	}
+	d.stats.Download()
+
+	return d.stats.CountReads(f), nil
+}
+
+// Gets the url of a file served from the public url of its bin, by a static file server or CDN
+//
+// The url doesn't expire, so lifetime is ignored.
+func (d *LocalDriver) URL(ctx context.Context, baseUrl string, publicUrl string, id FileIdentifier, lifetime time.Duration) (string, error) {
+	u, err := url.Parse(publicUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%w: public url `%s` of %s isn't an http url", ErrNoURL, publicUrl, baseUrl)
 	}
 
-	return f, err
+	return u.JoinPath(string(id)).String(), nil
 }
 
 func (d *LocalDriver) Upload(ctx context.Context, baseUrl string, f *File) error {
 	// ok, err := d.rootKnown(baseUrl)
 	// if !ok {
-	// 	d.stats.Failed++
+	// 	d.stats.Fail()
 	// 	return err
 	// }
 
@@ -78,19 +108,19 @@ func (d *LocalDriver) Upload(ctx context.Context, baseUrl string, f *File) error
 
 	w, err := os.Create(path)
 	if err != nil {
-		d.stats.Failed++
+		d.stats.Fail()
 		log.Printf("Driver: Failed to create %s: %v\n", f.RelPath, err)
 		return err
 	}
 
 	n, err := io.Copy(w, f.Data)
 	if err != nil {
-		d.stats.Failed++
+		d.stats.Fail()
 		log.Printf("Driver: Failed to write file %s: %v\n", f.RelPath, err)
 		return err
 	}
 	if n != f.Size {
-		d.stats.Failed++
+		d.stats.Fail()
 		log.Printf("Driver: %s: Incorrect number of bytes written: %d != %d\n", f.RelPath, n, f.Size)
 
 		err := os.Remove(path)
@@ -102,7 +132,7 @@ func (d *LocalDriver) Upload(ctx context.Context, baseUrl string, f *File) error
 		return errors.New("incorrect number of bytes written")
 	}
 
-	d.stats.Uploaded++
+	d.stats.Upload(n)
 
 	return nil
 }
@@ -110,16 +140,21 @@ func (d *LocalDriver) Upload(ctx context.Context, baseUrl string, f *File) error
 func (d *LocalDriver) Delete(ctx context.Context, baseUrl string, id FileIdentifier) error {
 	ok, err := d.rootKnown(baseUrl)
 	if !ok {
-		d.stats.Failed++
+		d.stats.Fail()
 		return err
 	}
 
 	path := filepath.Join(baseUrl, string(id))
 
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+
 	if err = os.Remove(path); err != nil {
-		d.stats.Failed++
+		d.stats.Fail()
 	} else {
-		d.stats.Deleted++
+		d.stats.Delete(size)
 	}
 	return err
 }
@@ -133,6 +168,12 @@ func (d *LocalDriver) Status(ctx context.Context, baseUrl string, id FileIdentif
 	info, err := os.Stat(filepath.Join(baseUrl, string(id)))
 	if err != nil {
 		log.Printf("Driver: %s: failed to get status: %v\n", id, err)
+		// as in Get, a missing base directory is storage which isn't mounted rather than a missing file
+		if _, statErr := os.Stat(baseUrl); statErr != nil {
+			return FileUnknownError, fmt.Errorf("%w: %w", ErrUnavailable, statErr)
+		} else if errors.Is(err, fs.ErrNotExist) {
+			return FileMissing, fmt.Errorf("%w: %w", ErrNotExist, err)
+		}
 		return FileMissing, err
 	}
 
@@ -149,7 +190,7 @@ func (d *LocalDriver) Status(ctx context.Context, baseUrl string, id FileIdentif
 }
 
 func (d *LocalDriver) Stats() Stats {
-	return d.stats
+	return d.stats.Snapshot()
 }
 
 func (d *LocalDriver) Name() string {
@@ -169,6 +210,8 @@ func (d *LocalDriver) SetId(id int64) {
 }
 
 func (d *LocalDriver) String() string {
+	d.rootsMu.RLock()
+	defer d.rootsMu.RUnlock()
 	return fmt.Sprintf("%s:%v", d.name, d.knownRoots)
 }
 
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Gets files which can't be opened, checking only missing storage is unavailable
+func TestLocalDriverErrors(t *testing.T) {
+	ctx := context.Background()
+	driver := NewLocalDriver()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file"), []byte("content"), 0o644); err != nil {
+		t.Logf("Failed to write file: %v\n", err)
+		t.FailNow()
+	}
+
+	if _, err := driver.Get(ctx, root, "missing"); !errors.Is(err, ErrNotExist) {
+		printMismatch(t.Errorf, "error getting a missing file", ErrNotExist, err)
+	}
+
+	// a file used as a directory is neither missing nor unavailable storage
+	_, err := driver.Get(ctx, root, "file/child")
+	if err == nil || errors.Is(err, ErrNotExist) || errors.Is(err, ErrUnavailable) {
+		t.Errorf("Incorrect error getting a file beneath a file: %v\n", err)
+	}
+
+	if _, err = driver.Get(ctx, filepath.Join(root, "unmounted"), "file"); !errors.Is(err, ErrUnavailable) {
+		printMismatch(t.Errorf, "error getting a file from missing storage", ErrUnavailable, err)
+	}
+}
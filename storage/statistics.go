@@ -1,41 +1,65 @@
 package storage
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+)
 
 // Track stats of file operations
 type Stats struct {
-	Uploaded   uint32 // number of uploaded files
-	Downloaded uint32 // number of downloaded files
-	Redirected uint32 // number of redirects, should be mutually exclusive from downloads
-	Deleted    uint32 // number of deleted files
-	Failed     uint32 // number of failures
+	Uploaded        uint64 `json:"uploaded"`        // number of uploaded files
+	Downloaded      uint64 `json:"downloaded"`      // number of downloaded files
+	Redirected      uint64 `json:"redirected"`      // number of redirects, should be mutually exclusive from downloads
+	Deleted         uint64 `json:"deleted"`         // number of deleted files
+	Failed          uint64 `json:"failed"`          // number of failures
+	UploadedBytes   uint64 `json:"uploadedBytes"`   // number of bytes uploaded
+	DownloadedBytes uint64 `json:"downloadedBytes"` // number of bytes read from downloaded files
+	DeletedBytes    uint64 `json:"deletedBytes"`    // number of bytes freed by deleting files
 }
 
 // A summary of multiple Stats
 type StatsSummary struct {
-	Count   uint
-	Minimum Stats
-	Maximum Stats
-	Average statsFloat
-	Total   Stats
-	StdDev  statsFloat
+	Count   uint       `json:"count"`
+	Minimum Stats      `json:"minimum"`
+	Maximum Stats      `json:"maximum"`
+	Average statsFloat `json:"average"`
+	Total   Stats      `json:"total"`
+	StdDev  statsFloat `json:"stdDev"` // population standard deviation
 }
 
 type statsFloat struct {
-	Uploaded   float32
-	Downloaded float32
-	Redirected float32
-	Deleted    float32
-	Failed     float32
+	Uploaded        float64 `json:"uploaded"`
+	Downloaded      float64 `json:"downloaded"`
+	Redirected      float64 `json:"redirected"`
+	Deleted         float64 `json:"deleted"`
+	Failed          float64 `json:"failed"`
+	UploadedBytes   float64 `json:"uploadedBytes"`
+	DownloadedBytes float64 `json:"downloadedBytes"`
+	DeletedBytes    float64 `json:"deletedBytes"`
 }
 
-// Prints the usage statistics in the form "uploaded downloaded redirected deleted Failed"
+// Gets pointers to every counter, in declaration order
+func (s *Stats) fields() []*uint64 {
+	return []*uint64{&s.Uploaded, &s.Downloaded, &s.Redirected, &s.Deleted, &s.Failed,
+		&s.UploadedBytes, &s.DownloadedBytes, &s.DeletedBytes}
+}
+
+func (s *statsFloat) fields() []*float64 {
+	return []*float64{&s.Uploaded, &s.Downloaded, &s.Redirected, &s.Deleted, &s.Failed,
+		&s.UploadedBytes, &s.DownloadedBytes, &s.DeletedBytes}
+}
+
+// Prints the usage statistics in the form "uploaded downloaded redirected deleted failed uploadedBytes downloadedBytes deletedBytes"
 func (s Stats) String() string {
-	return fmt.Sprint(s.Uploaded, s.Downloaded, s.Redirected, s.Deleted, s.Failed)
+	return fmt.Sprint(s.Uploaded, s.Downloaded, s.Redirected, s.Deleted, s.Failed,
+		s.UploadedBytes, s.DownloadedBytes, s.DeletedBytes)
 }
 
 func (s statsFloat) String() string {
-	return fmt.Sprint(s.Uploaded, s.Downloaded, s.Redirected, s.Deleted, s.Failed)
+	return fmt.Sprint(s.Uploaded, s.Downloaded, s.Redirected, s.Deleted, s.Failed,
+		s.UploadedBytes, s.DownloadedBytes, s.DeletedBytes)
 }
 
 func (s StatsSummary) String() string {
@@ -43,28 +67,35 @@ func (s StatsSummary) String() string {
 }
 
 // Add one stats object to another
-func (this Stats) Add(that Stats) {
-	this.Uploaded += that.Uploaded
-	this.Downloaded += that.Downloaded
-	this.Redirected += that.Redirected
-	this.Deleted += that.Deleted
-	this.Failed += that.Failed
+func (this *Stats) Add(that Stats) {
+	other := that.fields()
+	for i, field := range this.fields() {
+		*field += *other[i]
+	}
 }
 
-func (this Stats) Min(that Stats) {
-	this.Uploaded = min(this.Uploaded, that.Uploaded)
-	this.Downloaded = min(this.Downloaded, that.Downloaded)
-	this.Redirected = min(this.Redirected, that.Redirected)
-	this.Deleted = min(this.Deleted, that.Deleted)
-	this.Failed = min(this.Failed, that.Failed)
+// Subtract one stats object from another, every counter of that must be at most the counter of this
+func (this *Stats) Sub(that Stats) {
+	other := that.fields()
+	for i, field := range this.fields() {
+		*field -= *other[i]
+	}
+}
+
+// Sets each counter to the smaller of the two
+func (this *Stats) Min(that Stats) {
+	other := that.fields()
+	for i, field := range this.fields() {
+		*field = min(*field, *other[i])
+	}
 }
 
-func (this Stats) Max(that Stats) {
-	this.Uploaded = max(this.Uploaded, that.Uploaded)
-	this.Downloaded = max(this.Downloaded, that.Downloaded)
-	this.Redirected = max(this.Redirected, that.Redirected)
-	this.Deleted = max(this.Deleted, that.Deleted)
-	this.Failed = max(this.Failed, that.Failed)
+// Sets each counter to the larger of the two
+func (this *Stats) Max(that Stats) {
+	other := that.fields()
+	for i, field := range this.fields() {
+		*field = max(*field, *other[i])
+	}
 }
 
 // Sum multiple Stats into a single Stats
@@ -81,34 +112,105 @@ func SumStats(s []Stats) Stats {
 // Compute a summary from multiple Stats
 func Summary(stats []Stats) StatsSummary {
 	s := StatsSummary{Count: uint(len(stats))}
+	if len(stats) == 0 {
+		return s
+	}
 
-	// JP: couldn't tell if there was a single pass way to compute everything so
-	//     two passes are made.
+	// the mean is needed before deviations from it can be summed, so two passes are made
+	s.Minimum = stats[0]
 	for _, v := range stats {
 		s.Minimum.Min(v)
 		s.Maximum.Max(v)
 		s.Total.Add(v)
 	}
 
-	s.Average.Uploaded = float32(s.Total.Uploaded) / float32(s.Count)
-	s.Average.Downloaded = float32(s.Total.Downloaded) / float32(s.Count)
-	s.Average.Redirected = float32(s.Total.Redirected) / float32(s.Count)
-	s.Average.Deleted = float32(s.Total.Deleted) / float32(s.Count)
-	s.Average.Failed = float32(s.Total.Failed) / float32(s.Count)
+	count := float64(s.Count)
+	average := s.Average.fields()
+	for i, total := range s.Total.fields() {
+		*average[i] = float64(*total) / count
+	}
 
+	stdDev := s.StdDev.fields()
 	for _, v := range stats {
-		s.StdDev.Uploaded += float32(v.Uploaded) - s.Average.Uploaded
-		s.StdDev.Downloaded += float32(v.Downloaded) - s.Average.Downloaded
-		s.StdDev.Redirected += float32(v.Redirected) - s.Average.Redirected
-		s.StdDev.Deleted += float32(v.Deleted) - s.Average.Deleted
-		s.StdDev.Failed += float32(v.Failed) - s.Average.Failed
+		for i, field := range v.fields() {
+			deviation := float64(*field) - *average[i]
+			*stdDev[i] += deviation * deviation
+		}
+	}
+	for _, field := range stdDev {
+		*field = math.Sqrt(*field / count)
 	}
-
-	s.StdDev.Uploaded /= float32(s.Count)
-	s.StdDev.Downloaded /= float32(s.Count)
-	s.StdDev.Redirected /= float32(s.Count)
-	s.StdDev.Deleted /= float32(s.Count)
-	s.StdDev.Failed /= float32(s.Count)
 
 	return s
 }
+
+// Counters of file operations which are safe for concurrent use
+//
+// The zero value is ready to use, Counters must not be copied after first use.
+type Counters struct {
+	uploaded        atomic.Uint64
+	downloaded      atomic.Uint64
+	redirected      atomic.Uint64
+	deleted         atomic.Uint64
+	failed          atomic.Uint64
+	uploadedBytes   atomic.Uint64
+	downloadedBytes atomic.Uint64
+	deletedBytes    atomic.Uint64
+}
+
+// Records an upload of a number of bytes
+func (c *Counters) Upload(bytes int64) {
+	c.uploaded.Add(1)
+	c.uploadedBytes.Add(uint64(max(bytes, 0)))
+}
+
+// Records a download, the bytes read from it are recorded by a reader from CountReads
+func (c *Counters) Download() {
+	c.downloaded.Add(1)
+}
+
+// Records a redirect
+func (c *Counters) Redirect() {
+	c.redirected.Add(1)
+}
+
+// Records a deletion freeing a number of bytes
+func (c *Counters) Delete(bytes int64) {
+	c.deleted.Add(1)
+	c.deletedBytes.Add(uint64(max(bytes, 0)))
+}
+
+// Records a failed operation
+func (c *Counters) Fail() {
+	c.failed.Add(1)
+}
+
+// Gets the current value of every counter
+func (c *Counters) Snapshot() Stats {
+	return Stats{
+		Uploaded:        c.uploaded.Load(),
+		Downloaded:      c.downloaded.Load(),
+		Redirected:      c.redirected.Load(),
+		Deleted:         c.deleted.Load(),
+		Failed:          c.failed.Load(),
+		UploadedBytes:   c.uploadedBytes.Load(),
+		DownloadedBytes: c.downloadedBytes.Load(),
+		DeletedBytes:    c.deletedBytes.Load(),
+	}
+}
+
+type countingReader struct {
+	io.ReadSeekCloser
+	counters *Counters
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(p)
+	r.counters.downloadedBytes.Add(uint64(n))
+	return n, err
+}
+
+// Wraps a downloaded file so the bytes read from it are counted
+func (c *Counters) CountReads(f io.ReadSeekCloser) io.ReadSeekCloser {
+	return countingReader{f, c}
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func printMismatch[T any](p func(string, ...any), name string, expected T, recieved T) {
+	p("Incorrect %s, expected %v != %v\n", name, expected, recieved)
+}
+
+func TestSummary(t *testing.T) {
+	stats := []Stats{
+		{Uploaded: 2, Downloaded: 10, UploadedBytes: 100},
+		{Uploaded: 4, Downloaded: 0, UploadedBytes: 300},
+		{Uploaded: 6, Downloaded: 5, UploadedBytes: 200, Failed: 3},
+	}
+
+	s := Summary(stats)
+
+	if s.Count != 3 {
+		printMismatch(t.Errorf, "count", 3, s.Count)
+	}
+	if expected := (Stats{Uploaded: 12, Downloaded: 15, UploadedBytes: 600, Failed: 3}); s.Total != expected {
+		printMismatch(t.Errorf, "total", expected, s.Total)
+	}
+	if expected := (Stats{Uploaded: 2, UploadedBytes: 100}); s.Minimum != expected {
+		printMismatch(t.Errorf, "minimum", expected, s.Minimum)
+	}
+	if expected := (Stats{Uploaded: 6, Downloaded: 10, UploadedBytes: 300, Failed: 3}); s.Maximum != expected {
+		printMismatch(t.Errorf, "maximum", expected, s.Maximum)
+	}
+	if s.Average.Uploaded != 4 || s.Average.UploadedBytes != 200 || s.Average.Failed != 1 {
+		t.Errorf("Incorrect average %v\n", s.Average)
+	}
+
+	closeTo := func(name string, expected float64, recieved float64) {
+		if math.Abs(expected-recieved) > 1e-9 {
+			printMismatch(t.Errorf, name, expected, recieved)
+		}
+	}
+	closeTo("uploaded standard deviation", math.Sqrt(8.0/3), s.StdDev.Uploaded)
+	closeTo("downloaded standard deviation", math.Sqrt(50.0/3), s.StdDev.Downloaded)
+	closeTo("uploaded bytes standard deviation", math.Sqrt(20000.0/3), s.StdDev.UploadedBytes)
+	closeTo("redirected standard deviation", 0, s.StdDev.Redirected)
+
+	if empty := Summary(nil); empty.Count != 0 || empty.Average.Uploaded != 0 {
+		t.Errorf("Incorrect summary of no stats %v\n", empty)
+	}
+
+	total := SumStats(stats)
+	if total != s.Total {
+		printMismatch(t.Errorf, "sum", s.Total, total)
+	}
+}
+
+func TestCountersConcurrent(t *testing.T) {
+	var c Counters
+	const workers = 32
+	const operations = 100
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range operations {
+				c.Upload(10)
+				c.Download()
+				c.Redirect()
+				c.Delete(3)
+				c.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+
+	const n = workers * operations
+	expected := Stats{
+		Uploaded:      n,
+		Downloaded:    n,
+		Redirected:    n,
+		Deleted:       n,
+		Failed:        n,
+		UploadedBytes: 10 * n,
+		DeletedBytes:  3 * n,
+	}
+	if s := c.Snapshot(); s != expected {
+		printMismatch(t.Errorf, "stats", expected, s)
+	}
+}
+
+// Uploads, downloads and deletes through a bin, checking both the bin and driver accumulate
+func TestBinStats(t *testing.T) {
+	ctx := context.Background()
+	driver := NewLocalDriver()
+	bin := &Bin{Name: "stats", Driver: driver}
+	bin.Path.Internal = t.TempDir()
+	bin.RegisterRoot()
+
+	content := []byte("twelve bytes")
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f := &File{
+				Data:     nopCloser{bytes.NewReader(content)},
+				FileInfo: FileInfo{RelPath: name, Size: int64(len(content))},
+			}
+			if err := bin.Upload(ctx, f); err != nil {
+				t.Errorf("Failed to upload %s: %v\n", name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	r, err := bin.Get(ctx, "a")
+	if err != nil {
+		t.Logf("Failed to get file: %v\n", err)
+		t.FailNow()
+	}
+	io.Copy(io.Discard, r)
+	r.Close()
+
+	if _, err = bin.Get(ctx, "missing"); !errors.Is(err, ErrNotExist) {
+		printMismatch(t.Errorf, "error getting a missing file", ErrNotExist, err)
+	}
+
+	if err = bin.Delete(ctx, &FileInfo{RelPath: "b", Size: int64(len(content))}); err != nil {
+		t.Errorf("Failed to delete file: %v\n", err)
+	}
+
+	expected := Stats{
+		Uploaded:        3,
+		Downloaded:      1,
+		Deleted:         1,
+		Failed:          1,
+		UploadedBytes:   36,
+		DownloadedBytes: 12,
+		DeletedBytes:    12,
+	}
+	if s := bin.Stats(); s != expected {
+		printMismatch(t.Errorf, "bin stats", expected, s)
+	}
+	if s := driver.Stats(); s != expected {
+		printMismatch(t.Errorf, "driver stats", expected, s)
+	}
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Generates redirect urls through a bin, which only the driver's url capability can make
+func TestBinURL(t *testing.T) {
+	ctx := context.Background()
+	bin := &Bin{Name: "public", Driver: NewLocalDriver(), Redirect: true}
+	bin.Path.Internal = t.TempDir()
+	bin.Path.External = "https://cdn.example.com/files/"
+
+	u, err := bin.URL(ctx, "a b", time.Minute)
+	if err != nil || u != "https://cdn.example.com/files/a%20b" {
+		t.Errorf("Incorrect url %s: %v\n", u, err)
+	}
+
+	bin.Path.External = "/srv/files"
+	if _, err = bin.URL(ctx, "a", time.Minute); !errors.Is(err, ErrNoURL) {
+		printMismatch(t.Errorf, "error of a bin without a public url", ErrNoURL, err)
+	}
+
+	if s := bin.Stats(); s.Redirected != 1 || s.Failed != 1 {
+		t.Errorf("Incorrect redirect stats %+v\n", s)
+	}
+}